@@ -0,0 +1,72 @@
+// Command server runs the HTTP server of package httpserver on port 4221,
+// or one of its subcommands. SIGINT and SIGTERM stop it once the requests
+// in flight have finished; SIGUSR2 restarts it without dropping
+// connections, for instance after the binary has been replaced.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/http-server-starter-go/httpserver"
+)
+
+const (
+	port = ":4221"
+	// shutdownTimeout is how long requests in flight are given to finish
+	// once the server has been asked to stop.
+	shutdownTimeout = 30 * time.Second
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := httpserver.Commands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+	}
+
+	cfg, err := httpserver.ParseFlags(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	srv, err := httpserver.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	if cfg.SelfTest {
+		os.Exit(srv.RunSelfTest())
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, restartSignals...)...)
+		for sig := range signals {
+			if slices.Contains(restartSignals, sig) {
+				log.Println("Restarting")
+				if err := srv.Restart(); err != nil {
+					log.Printf("Error restarting: %v", err)
+					continue
+				}
+			}
+			log.Println("Shutting down")
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+		close(stopped)
+	}()
+	if err := srv.ListenAndServe(port); err != httpserver.ErrServerClosed {
+		log.Fatalf("Failed to bind to port %s: %v", port, err)
+	}
+	<-stopped
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// restartSignals ask the server to restart without dropping connections,
+// which needs signals this system lacks.
+var restartSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals ask the server to restart without dropping connections.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,171 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// requireAdmin checks the request's bearer token against -admin-token,
+// also letting in a logged-in user with the "admin" role. It sends the
+// appropriate error response and returns false if the caller may not use
+// admin endpoints.
+func requireAdmin(conn net.Conn, req *http.Request) bool {
+	if p := currentPrincipal(req); p != nil && slices.Contains(p.Roles, adminRole) {
+		return true
+	}
+	if config.AdminToken == "" {
+		handleNotFound(conn)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		sendResponse(conn, http.StatusUnauthorized, nil, map[string]string{"WWW-Authenticate": `Bearer realm="admin"`})
+		return false
+	}
+	return true
+}
+
+func handleAdmin(conn net.Conn, req *http.Request) {
+	if !requireAdmin(conn, req) {
+		return
+	}
+
+	switch req.URL.Path {
+	case "/admin/upstreams":
+		handleAdminUpstreams(conn, req)
+	case "/admin/cache":
+		handleAdminCache(conn, req)
+	case "/admin/cache/purge":
+		handleAdminCachePurge(conn, req)
+	case "/admin/usage":
+		handleAdminUsage(conn, req)
+	case "/admin/files/sign":
+		handleSignFileURL(conn, req)
+	case "/admin/storage/rotate-keys":
+		handleAdminRotateKeys(conn, req)
+	case "/admin/replication":
+		handleAdminReplication(conn, req)
+	case "/admin/replication/sync":
+		handleAdminReplicationSync(conn, req)
+	case "/admin/users":
+		handleAdminUsers(conn, req)
+	case "/admin/bans":
+		handleAdminBans(conn, req)
+	default:
+		if req.URL.Path == "/admin/replica" || strings.HasPrefix(req.URL.Path, "/admin/replica/") {
+			handleAdminReplica(conn, req)
+			return
+		}
+		if name, ok := strings.CutPrefix(req.URL.Path, "/admin/users/"); ok {
+			handleAdminUser(conn, req, name)
+			return
+		}
+		if ip, ok := strings.CutPrefix(req.URL.Path, "/admin/bans/"); ok {
+			handleAdminBan(conn, req, ip)
+			return
+		}
+		handleNotFound(conn)
+	}
+}
+
+type upstreamStatus struct {
+	URL               string `json:"url"`
+	Healthy           bool   `json:"healthy"`
+	ActiveConnections int64  `json:"active_connections"`
+	LastCheck         string `json:"last_check,omitempty"`
+	LastError         string `json:"last_error,omitempty"`
+}
+
+type routeStatus struct {
+	Prefix    string           `json:"prefix"`
+	Balance   string           `json:"balance"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+// handleAdminUpstreams reports the health of every proxy upstream.
+func handleAdminUpstreams(conn net.Conn, req *http.Request) {
+	var routes []routeStatus
+	for _, route := range allProxyRoutes() {
+		status := routeStatus{Prefix: route.Prefix, Balance: route.balancer.strategy}
+
+		for _, u := range route.balancer.upstreams {
+			u.healthMu.Lock()
+			s := upstreamStatus{
+				URL:               u.target.String(),
+				Healthy:           u.healthy.Load(),
+				ActiveConnections: u.active.Load(),
+				LastError:         u.lastError,
+			}
+			if !u.lastCheck.IsZero() {
+				s.LastCheck = u.lastCheck.UTC().Format(time.RFC3339)
+			}
+			u.healthMu.Unlock()
+			status.Upstreams = append(status.Upstreams, s)
+		}
+		routes = append(routes, status)
+	}
+
+	sendJSON(conn, http.StatusOK, map[string]any{"routes": routes}, true)
+}
+
+type cacheStatus struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// handleAdminCache reports hit and miss counters for the response caches.
+func handleAdminCache(conn net.Conn, req *http.Request) {
+	sendJSON(conn, http.StatusOK, map[string]cacheStatus{
+		"files": {Hits: fileCache.hits.Load(), Misses: fileCache.misses.Load()},
+		"proxy": {Hits: proxyCache.hits.Load(), Misses: proxyCache.misses.Load()},
+	}, true)
+}
+
+// methodPurge is the non-standard method used by caching proxies such as
+// Varnish and Squid to evict a URL from the cache.
+const methodPurge = "PURGE"
+
+// handlePurge evicts the cached responses for the request path. It takes
+// the same token as the admin endpoints.
+func handlePurge(conn net.Conn, req *http.Request) {
+	if !requireAdmin(conn, req) {
+		return
+	}
+	sendPurged(conn, purgeCaches(func(path string) bool { return path == req.URL.Path }))
+}
+
+// handleAdminCachePurge evicts cached responses by exact path (?path=) or by
+// path prefix (?prefix=).
+func handleAdminCachePurge(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+
+	query := req.URL.Query()
+	path, prefix := query.Get("path"), query.Get("prefix")
+	switch {
+	case path != "" && prefix == "":
+		sendPurged(conn, purgeCaches(func(p string) bool { return p == path }))
+	case prefix != "" && path == "":
+		sendPurged(conn, purgeCaches(func(p string) bool { return strings.HasPrefix(p, prefix) }))
+	default:
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "exactly one of path or prefix is required"}, false)
+	}
+}
+
+// purgeCaches removes the entries of every response cache whose request
+// path satisfies match.
+func purgeCaches(match func(path string) bool) int {
+	matchEntry := func(entry *cacheEntry) bool { return match(entry.path) }
+	return proxyCache.purge(matchEntry) + fileCache.purge(matchEntry)
+}
+
+func sendPurged(conn net.Conn, n int) {
+	sendJSON(conn, http.StatusOK, map[string]int{"purged": n}, false)
+}
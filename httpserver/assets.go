@@ -0,0 +1,148 @@
+package httpserver
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// builtinAssets are the static files served under /assets/, such as the
+// stylesheet of the HTML pages, unless -assets names a directory to serve
+// instead.
+//
+//go:embed assets
+var builtinAssets embed.FS
+
+// errReadOnly is returned by the writing methods of a read-only Storage.
+var errReadOnly = errors.New("storage is read-only")
+
+// assetStorage is a read-only Storage over a file tree, so that assets
+// are served, cached and compressed the same way as files in the data
+// directory. Its names are slash-separated paths within the tree.
+type assetStorage struct {
+	fsys fs.FS
+}
+
+// assets holds the files served under /assets/.
+var assets Storage
+
+// openAssets sets up the assets, from -assets or those built in.
+func openAssets() {
+	if config.AssetsDir != "" {
+		assets = &assetStorage{fsys: os.DirFS(config.AssetsDir)}
+		return
+	}
+	sub, _ := fs.Sub(builtinAssets, "assets")
+	assets = &assetStorage{fsys: sub}
+}
+
+// validAssetName reports whether name may be served: a path within the
+// tree with no hidden elements.
+func validAssetName(name string) bool {
+	if !fs.ValidPath(name) || name == "." {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *assetStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	if rs, ok := f.(io.ReadSeekCloser); ok {
+		return rs, info, nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, info, nil
+}
+
+func (s *assetStorage) Stat(name string) (FileInfo, error) {
+	if !validAssetName(name) {
+		return FileInfo{}, fs.ErrInvalid
+	}
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return FileInfo{}, fs.ErrNotExist
+	}
+	modTime := info.ModTime()
+	if modTime.IsZero() {
+		// Embedded files have no time of their own; they are as new as
+		// the running program.
+		modTime = startTime
+	}
+	return FileInfo{Name: name, Size: info.Size(), ModTime: modTime}, nil
+}
+
+func (s *assetStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	return FileInfo{}, errReadOnly
+}
+
+func (s *assetStorage) Delete(name string) error {
+	return errReadOnly
+}
+
+func (s *assetStorage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	err := fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if info, err := s.Stat(name); err == nil {
+			files = append(files, info)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// handleAsset serves a file from the assets, with /favicon.ico standing
+// for the favicon among them.
+func handleAsset(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": "GET, HEAD"})
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/assets/")
+	if req.URL.Path == "/favicon.ico" {
+		name = "favicon.ico"
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if path.Ext(name) == ".ico" {
+		// Not every system's MIME table knows icons.
+		contentType = "image/x-icon"
+	} else if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	serveStoredFile(conn, req, assets, name, contentType)
+}
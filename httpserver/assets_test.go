@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssets(t *testing.T) {
+	addr := startTestServer(t)
+	client := testClient()
+	style, err := builtinAssets.ReadFile("assets/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path string
+		status       int
+		contentType  string
+		body         string
+	}{
+		{"GET", "/assets/style.css", 200, "text/css; charset=utf-8", string(style)},
+		{"HEAD", "/assets/style.css", 200, "text/css; charset=utf-8", ""},
+		{"GET", "/favicon.ico", 200, "image/x-icon", ""},
+		{"GET", "/assets/favicon.ico", 200, "image/x-icon", ""},
+		{"GET", "/assets/missing.css", 404, "", ""},
+		{"GET", "/assets/", 404, "", ""},
+		{"POST", "/assets/style.css", 405, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://"+addr+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", resp.Header.Get("Content-Type"), tt.contentType)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+
+	t.Run("conditional", func(t *testing.T) {
+		resp, err := client.Get("http://" + addr + "/assets/style.css")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/assets/style.css", nil)
+		req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("status = %d, want 304", resp.StatusCode)
+		}
+	})
+}
+
+func TestAssetsDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "js"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"js/app.js": "run()", ".secret": "hidden"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startTestServer(t, "-assets", dir)
+
+	for path, want := range map[string]int{"/assets/js/app.js": 200, "/assets/.secret": 404, "/assets/style.css": 404} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	addr := startTestServer(t, "-users", writeTestUsers(t), "-audit-log", path)
+	client := &http.Client{Timeout: 5 * time.Second}
+	status, tokens := postAuth(t, client, "http://"+addr+"/auth/login", `{"username":"ann","password":"hunter2"}`)
+	if status != http.StatusOK {
+		t.Fatalf("login = %d", status)
+	}
+	for _, r := range []struct{ method, path, token string }{
+		{"POST", "/files/a.txt", tokens.AccessToken},
+		{"GET", "/files/a.txt", tokens.AccessToken},
+		{"POST", "/files/b.txt", ""},
+		{"DELETE", "/files/a.txt", tokens.AccessToken},
+	} {
+		req, _ := http.NewRequest(r.method, "http://"+addr+r.path, strings.NewReader("hi"))
+		req.Header.Set("X-Request-Id", "req-"+r.method)
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Entries are written once the response has gone.
+	var lines [][]byte
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := os.ReadFile(path)
+		if lines = bytes.SplitAfter(bytes.TrimSpace(data), []byte("\n")); len(lines) >= 2 {
+			break
+		}
+	}
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d entries, want the upload and the delete by ann", len(lines))
+	}
+	var first auditEntry
+	json.Unmarshal(lines[0], &first)
+	if first.User != "ann" || first.Via != "token" || first.Method != "POST" || first.Path != "/files/a.txt" || first.Status != 201 || first.RequestID != "req-POST" || first.PrevHash != "" {
+		t.Errorf("first entry = %+v", first)
+	}
+	if n, err := verifyAuditLog(bytes.NewReader(bytes.Join(lines, nil))); n != 2 || err != nil {
+		t.Errorf("verifying the log = %d, %v", n, err)
+	}
+
+	// Editing, dropping or reordering entries breaks the chain.
+	edited := bytes.Replace(lines[0], []byte(`"user":"ann"`), []byte(`"user":"bob"`), 1)
+	for name, log := range map[string][][]byte{
+		"edited":    {edited, lines[1]},
+		"dropped":   {lines[1]},
+		"reordered": {lines[1], lines[0]},
+	} {
+		if _, err := verifyAuditLog(bytes.NewReader(bytes.Join(log, nil))); err == nil || !strings.Contains(err.Error(), "entry 1") {
+			t.Errorf("%s log: verify = %v, want entry 1 to fail", name, err)
+		}
+	}
+
+	// Reopening the log continues the chain.
+	reopened, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.append(auditEntry{User: "ann", Method: "PUT"}); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	if n, err := verifyAuditLog(f); n != 3 || err != nil {
+		t.Errorf("verifying the reopened log = %d, %v", n, err)
+	}
+}
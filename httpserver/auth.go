@@ -0,0 +1,293 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	User  string
+	Roles []string
+	// Via says how the caller authenticated: "token", "session", or
+	// "oidc:" and the name of an OpenID Connect provider.
+	Via string
+}
+
+type principalContextKey struct{}
+
+// authenticate identifies the caller from an access token in the
+// Authorization header or, failing that, from the user recorded in their
+// session, which the request keeps from going idle, and attaches the
+// result to the request for currentPrincipal.
+// Requests with neither are passed through anonymously. A bearer token
+// that looks like one of ours but doesn't verify is refused with a 401,
+// unless the request goes to a proxy route, whose upstream may issue
+// tokens of its own; other bearer tokens, such as -admin-token, are left
+// for their endpoints.
+func authenticate(conn net.Conn, req *http.Request) (*http.Request, bool) {
+	var p *principal
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && looksLikeJWT(token) {
+		claims, err := verifyAccessToken(token, time.Now())
+		if err != nil && matchProxyRoute(req) != nil {
+			// The token is for the upstream, which checks it itself.
+			return req, true
+		}
+		if err != nil {
+			sendResponse(conn, http.StatusUnauthorized, nil, map[string]string{"WWW-Authenticate": `Bearer error="invalid_token"`})
+			return req, false
+		}
+		p = &principal{User: claims.Subject, Roles: claims.Roles, Via: "token"}
+		if users != nil {
+			// The user may have been disabled, removed or given other
+			// roles since the token was issued.
+			u, ok := users.lookup(claims.Subject)
+			if !ok {
+				sendResponse(conn, http.StatusUnauthorized, nil, map[string]string{"WWW-Authenticate": `Bearer error="invalid_token"`})
+				return req, false
+			}
+			p.Roles = u.Roles
+		}
+	} else if _, ok := requestCookie(req, sessionCookieName); ok {
+		sess := loadSession(req)
+		if p = sessionPrincipal(sess); p != nil {
+			sess.touch(time.Now())
+		}
+	}
+
+	if p == nil {
+		return req, true
+	}
+	return req.WithContext(context.WithValue(req.Context(), principalContextKey{}, p)), true
+}
+
+// authorize runs the authentication and authorization layers for a
+// built-in endpoint, a proxy route or a FastCGI route: signed download
+// URLs, access tokens and sessions, per-route Basic, Digest or signature
+// authentication, role policies, per-user rate limits and the CSRF check.
+// A valid signed URL takes the place of the per-route checks. It returns
+// false when one of them has responded.
+func authorize(conn net.Conn, req *http.Request) (*http.Request, bool) {
+	signed, ok := checkSignedURL(conn, req)
+	if !ok {
+		return req, false
+	}
+	if req, ok = authenticate(conn, req); !ok {
+		return req, false
+	}
+	if !signed {
+		if req, ok = requireRouteAuth(conn, req); !ok || !checkPolicy(conn, req) {
+			return req, false
+		}
+	}
+	if p := currentPrincipal(req); p != nil && !allowCredential(conn, p) {
+		return req, false
+	}
+	return req, checkCSRF(conn, req)
+}
+
+// sessionPrincipal returns the user logged in to sess, either with a
+// password from the users file or through an OpenID Connect provider.
+func sessionPrincipal(sess *session) *principal {
+	name := sess.data.User
+	if name == "" {
+		return nil
+	}
+	if provider := sess.data.AuthProvider; provider != "" {
+		return &principal{User: name, Via: "oidc:" + provider}
+	}
+	if users == nil {
+		return nil
+	}
+	if u, ok := users.lookup(name); ok {
+		return &principal{User: u.Name, Roles: u.Roles, Via: "session"}
+	}
+	return nil
+}
+
+// currentPrincipal returns the authenticated caller of req, or nil.
+func currentPrincipal(req *http.Request) *principal {
+	p, _ := req.Context().Value(principalContextKey{}).(*principal)
+	return p
+}
+
+// tokenResponse is the body returned by /auth/login and /auth/refresh,
+// following the field names of RFC 6749 5.1.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func handleAuth(conn net.Conn, req *http.Request) {
+	if users == nil {
+		handleNotFound(conn)
+		return
+	}
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+
+	switch req.URL.Path {
+	case "/auth/login":
+		handleLogin(conn, req)
+	case "/auth/refresh":
+		handleRefresh(conn, req)
+	case "/auth/logout":
+		handleLogout(conn, req)
+	default:
+		handleNotFound(conn)
+	}
+}
+
+// handleLogin checks a username and password, sent as a form or as JSON,
+// and returns an access token and a refresh token. It also records the
+// user in the caller's session, so a browser is logged in by its cookie.
+func handleLogin(conn net.Conn, req *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readAuthRequest(conn, req, &creds) {
+		return
+	}
+
+	u, ok := users.authenticate(creds.Username, creds.Password)
+	if !ok {
+		log.Printf("Failed login for %q from %s", creds.Username, req.RemoteAddr)
+		sendJSON(conn, http.StatusUnauthorized, map[string]string{"error": "invalid username or password"}, false)
+		return
+	}
+
+	sess := loadSession(req)
+	if err := sess.Renew(); err != nil {
+		sendError(conn, fmt.Errorf("renewing session: %w", err))
+		return
+	}
+	sess.logIn(u.Name, "")
+	cookie, err := sess.save(conn, req)
+	if err != nil {
+		sendError(conn, fmt.Errorf("saving session: %w", err))
+		return
+	}
+	sendTokens(conn, u, sessionCookies(cookie)...)
+}
+
+// handleRefresh exchanges a refresh token for a new access token and a
+// new refresh token. The old refresh token stops working.
+func handleRefresh(conn net.Conn, req *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !readAuthRequest(conn, req, &body) {
+		return
+	}
+
+	name, err := refreshTokens.redeem(body.RefreshToken, time.Now())
+	if err != nil {
+		sendJSON(conn, http.StatusUnauthorized, map[string]string{"error": err.Error()}, false)
+		return
+	}
+	u, ok := users.lookup(name)
+	if !ok {
+		sendJSON(conn, http.StatusUnauthorized, map[string]string{"error": errBadToken.Error()}, false)
+		return
+	}
+	sendTokens(conn, u)
+}
+
+// handleLogout revokes the refresh token in the body, if any, and ends the
+// caller's session.
+func handleLogout(conn net.Conn, req *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !readAuthRequest(conn, req, &body) {
+		return
+	}
+	if body.RefreshToken != "" {
+		refreshTokens.revoke(body.RefreshToken)
+	}
+
+	sess := loadSession(req)
+	sess.Destroy()
+	cookie, err := sess.save(conn, req)
+	if err != nil {
+		sendError(conn, fmt.Errorf("ending session: %w", err))
+		return
+	}
+	sendResponse(conn, http.StatusNoContent, nil, nil, sessionCookies(cookie)...)
+}
+
+// readAuthRequest decodes the body of an /auth/ request into v, from JSON
+// or from a form whose fields carry the JSON names. An empty body leaves v
+// unchanged.
+func readAuthRequest(conn net.Conn, req *http.Request, v any) bool {
+	body, err := readBody(req)
+	if err != nil {
+		sendResponse(conn, bodyErrorStatus(err), nil, nil)
+		return false
+	}
+	if len(body) == 0 {
+		return true
+	}
+
+	if isForm(req) {
+		form, err := decodeForm(req.Header.Get("Content-Type"), body)
+		if err != nil {
+			sendJSON(conn, formErrorStatus(err), map[string]string{"error": err.Error()}, false)
+			return false
+		}
+		fields := make(map[string]string, len(form))
+		for name := range form {
+			fields[name] = form.String(name, "")
+		}
+		if body, err = json.Marshal(fields); err != nil {
+			sendError(conn, fmt.Errorf("encoding form: %w", err))
+			return false
+		}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()}, false)
+		return false
+	}
+	return true
+}
+
+func sendTokens(conn net.Conn, u *user, cookies ...*http.Cookie) {
+	now := time.Now()
+	access, expires, err := issueAccessToken(u, now)
+	if err != nil {
+		sendError(conn, fmt.Errorf("issuing access token: %w", err))
+		return
+	}
+	refresh, err := refreshTokens.issue(u.Name, now)
+	if err != nil {
+		sendError(conn, fmt.Errorf("issuing refresh token: %w", err))
+		return
+	}
+
+	body, err := json.Marshal(tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(expires.Sub(now) / time.Second),
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		sendError(conn, fmt.Errorf("encoding JSON: %w", err))
+		return
+	}
+	// Tokens must not be kept by caches along the way (RFC 6749 5.1).
+	sendResponse(conn, http.StatusOK, append(body, '\n'), map[string]string{
+		"Content-Type":  "application/json; charset=utf-8",
+		"Cache-Control": "no-store",
+	}, cookies...)
+}
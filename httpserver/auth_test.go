@@ -0,0 +1,100 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestUsers writes a -users file holding ann, whose password is
+// hunter2, with the given roles.
+func writeTestUsers(t *testing.T, roles ...string) string {
+	t.Helper()
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal([]map[string]any{{"name": "ann", "password": hash, "roles": roles}})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// postAuth posts body to an /auth/ endpoint, decoding any tokens sent
+// back.
+func postAuth(t *testing.T, client *http.Client, url, body string) (int, tokenResponse) {
+	t.Helper()
+	resp, err := client.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tokens tokenResponse
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	return resp.StatusCode, tokens
+}
+
+func TestAccessToken(t *testing.T) {
+	now := time.Now()
+	token, expires, err := issueAccessToken(&user{Name: "ann", Roles: []string{"reader"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := verifyAccessToken(token, now)
+	if err != nil || claims.Subject != "ann" || len(claims.Roles) != 1 {
+		t.Fatalf("verifying a fresh token = %+v, %v", claims, err)
+	}
+	if _, err := verifyAccessToken(token, expires); err == nil {
+		t.Error("token accepted once expired")
+	}
+
+	header, rest, _ := strings.Cut(token, ".")
+	_, signature, _ := strings.Cut(rest, ".")
+	raise := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ann","roles":["admin"],"exp":` + "9999999999}"))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	for name, forged := range map[string]string{
+		"changed claims": header + "." + raise + "." + signature,
+		"alg none":       none + "." + raise + ".",
+		"no signature":   header + "." + raise,
+	} {
+		if _, err := verifyAccessToken(forged, now); err == nil {
+			t.Errorf("%s: forged token accepted", name)
+		}
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	addr := startTestServer(t, "-users", writeTestUsers(t))
+	// An API client, keeping no session cookie to be held to CSRF checks.
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	status, tokens := postAuth(t, client, "http://"+addr+"/auth/login", `{"username":"ann","password":"hunter2"}`)
+	if status != http.StatusOK || tokens.RefreshToken == "" || tokens.TokenType != "Bearer" {
+		t.Fatalf("login = %d %+v", status, tokens)
+	}
+	refresh := `{"refresh_token":"` + tokens.RefreshToken + `"}`
+	status, renewed := postAuth(t, client, "http://"+addr+"/auth/refresh", refresh)
+	if status != http.StatusOK || renewed.AccessToken == "" || renewed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh = %d %+v", status, renewed)
+	}
+	// Refresh tokens are single-use.
+	if status, _ := postAuth(t, client, "http://"+addr+"/auth/refresh", refresh); status != http.StatusUnauthorized {
+		t.Errorf("redeeming a refresh token twice = %d, want 401", status)
+	}
+
+	// Logging out revokes the refresh token passed in.
+	refresh = `{"refresh_token":"` + renewed.RefreshToken + `"}`
+	if status, _ := postAuth(t, client, "http://"+addr+"/auth/logout", refresh); status != http.StatusNoContent {
+		t.Fatalf("logout = %d, want 204", status)
+	}
+	if status, _ := postAuth(t, client, "http://"+addr+"/auth/refresh", refresh); status != http.StatusUnauthorized {
+		t.Errorf("refresh after logout = %d, want 401", status)
+	}
+}
@@ -0,0 +1,101 @@
+package httpserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load-balancing strategies for proxy routes with several upstreams.
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceLeastConnections = "least_connections"
+	balanceIPHash           = "ip_hash"
+)
+
+// upstream is one backend server of a proxy route. Each upstream keeps its
+// own connection pool so that a slow backend cannot exhaust idle
+// connections meant for the others.
+type upstream struct {
+	target    *url.URL
+	transport *http.Transport
+	active    atomic.Int64
+
+	// healthy is cleared by active health checks; upstreams without
+	// health checks are always considered healthy.
+	healthy atomic.Bool
+
+	healthMu  sync.Mutex
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// balancer chooses an upstream for each proxied request.
+type balancer struct {
+	strategy  string
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+func newBalancer(strategy string, targets []string) (*balancer, error) {
+	switch strategy {
+	case "":
+		strategy = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastConnections, balanceIPHash:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+
+	b := &balancer{strategy: strategy}
+	for _, raw := range targets {
+		target, err := url.Parse(raw)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("upstream %q must be an absolute http(s) URL", raw)
+		}
+		u := &upstream{target: target, transport: newUpstreamTransport()}
+		u.healthy.Store(true)
+		b.upstreams = append(b.upstreams, u)
+	}
+	return b, nil
+}
+
+// pick returns the upstream that should serve a request from clientIP,
+// skipping any in exclude. It returns nil if no healthy upstream remains.
+func (b *balancer) pick(clientIP string, exclude map[*upstream]bool) *upstream {
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		if u.healthy.Load() && !exclude[u] {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch b.strategy {
+	case balanceLeastConnections:
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+	case balanceIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+	default:
+		n := b.next.Add(1) - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
@@ -0,0 +1,243 @@
+package httpserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanConfig bans client addresses for a while once they have made too
+// many bad requests: ParseErrors unparseable ones, Unauthorized ones
+// answered with 401 or RateLimited ones answered with 429, all within
+// Window. A count of 0 doesn't ban for that kind of request.
+type BanConfig struct {
+	ParseErrors  int
+	Unauthorized int
+	RateLimited  int
+	Window       time.Duration
+	Duration     time.Duration
+}
+
+// parseBan parses a -ban spec such as
+// "parse-errors=5,unauthorized=10,rate-limited=20,window=1m,time=10m".
+func parseBan(spec string) (*BanConfig, error) {
+	c := &BanConfig{Window: time.Minute, Duration: 10 * time.Minute}
+	for _, item := range splitList(spec) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not name=value", item)
+		}
+		if name == "window" || name == "time" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration, not %q", name, value)
+			}
+			if name == "window" {
+				c.Window = d
+			} else {
+				c.Duration = d
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a count of requests, not %q", name, value)
+		}
+		switch name {
+		case "parse-errors":
+			c.ParseErrors = n
+		case "unauthorized":
+			c.Unauthorized = n
+		case "rate-limited":
+			c.RateLimited = n
+		default:
+			return nil, fmt.Errorf("unknown offence %q", name)
+		}
+	}
+	if c.ParseErrors == 0 && c.Unauthorized == 0 && c.RateLimited == 0 {
+		return nil, fmt.Errorf("no offence has a count")
+	}
+	return c, nil
+}
+
+// offence is a kind of bad request counted towards a ban.
+type offence int
+
+const (
+	offenceParseError offence = iota
+	offenceUnauthorized
+	offenceRateLimited
+)
+
+var offenceNames = [...]string{"parse errors", "unauthorized requests", "rate-limited requests"}
+
+func (c *BanConfig) threshold(o offence) int {
+	return [...]int{c.ParseErrors, c.Unauthorized, c.RateLimited}[o]
+}
+
+// offenceRecord counts the bad requests from one address since start.
+type offenceRecord struct {
+	start  time.Time
+	counts [len(offenceNames)]int
+}
+
+// ban is one banned address.
+type ban struct {
+	until  time.Time
+	reason string
+}
+
+// banList holds the banned addresses of a server and the counts that lead
+// to bans. Its methods do nothing without -ban.
+type banList struct {
+	mu        sync.Mutex
+	records   map[string]*offenceRecord
+	bans      map[string]ban
+	lastSweep time.Time
+}
+
+func newBanList() *banList {
+	return &banList{records: make(map[string]*offenceRecord), bans: make(map[string]ban)}
+}
+
+// banned reports whether ip is banned.
+func (b *banList) banned(ip string) bool {
+	if config.Ban == nil || b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.bans[ip].until)
+}
+
+// offend counts a bad request from ip, banning it once it has made as
+// many of the kind as -ban allows within the window.
+func (b *banList) offend(ip string, o offence) {
+	c := config.Ban
+	if c == nil || c.threshold(o) == 0 || ip == "" {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+	r := b.records[ip]
+	if r == nil || now.Sub(r.start) > c.Window {
+		r = &offenceRecord{start: now}
+		b.records[ip] = r
+	}
+	r.counts[o]++
+	if r.counts[o] < c.threshold(o) {
+		return
+	}
+	reason := fmt.Sprintf("%d %s", r.counts[o], offenceNames[o])
+	log.Printf("Banning %s for %v after %s", ip, c.Duration, reason)
+	b.bans[ip] = ban{until: now.Add(c.Duration), reason: reason}
+	delete(b.records, ip)
+}
+
+// sweep forgets counts older than the window and bans that have run out,
+// at most once a window, so that addresses seen once don't pile up.
+func (b *banList) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < config.Ban.Window {
+		return
+	}
+	b.lastSweep = now
+	for ip, r := range b.records {
+		if now.Sub(r.start) > config.Ban.Window {
+			delete(b.records, ip)
+		}
+	}
+	for ip, ban := range b.bans {
+		if !now.Before(ban.until) {
+			delete(b.bans, ip)
+		}
+	}
+}
+
+// banStatus is the admin API's view of a ban.
+type banStatus struct {
+	IP     string `json:"ip"`
+	Until  string `json:"until"`
+	Reason string `json:"reason"`
+}
+
+// list returns the bans in force, by address.
+func (b *banList) list() []banStatus {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := []banStatus{}
+	for ip, ban := range b.bans {
+		if now.Before(ban.until) {
+			bans = append(bans, banStatus{IP: ip, Until: ban.until.UTC().Format(time.RFC3339), Reason: ban.reason})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// unban lifts the ban on ip, reporting whether there was one.
+func (b *banList) unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[ip]
+	delete(b.bans, ip)
+	delete(b.records, ip)
+	return ok && time.Now().Before(ban.until)
+}
+
+// bansFor returns the ban list of the server conn belongs to.
+func bansFor(conn net.Conn) *banList {
+	if sc, ok := conn.(*serverConn); ok {
+		return sc.tracker.bans
+	}
+	return nil
+}
+
+// countOffence counts the response just sent on conn towards a ban of the
+// client that made req, if it was one -ban counts.
+func countOffence(conn *serverConn, req *http.Request) {
+	switch conn.status {
+	case http.StatusUnauthorized:
+		conn.tracker.bans.offend(req.RemoteAddr, offenceUnauthorized)
+	case http.StatusTooManyRequests:
+		conn.tracker.bans.offend(req.RemoteAddr, offenceRateLimited)
+	}
+}
+
+// handleAdminBans lists the bans in force.
+func handleAdminBans(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": "GET, HEAD"})
+		return
+	}
+	b := bansFor(conn)
+	if b == nil {
+		handleNotFound(conn)
+		return
+	}
+	sendJSON(conn, http.StatusOK, map[string]any{"bans": b.list()}, true)
+}
+
+// handleAdminBan lifts the ban on one address with DELETE.
+func handleAdminBan(conn net.Conn, req *http.Request, ip string) {
+	if req.Method != http.MethodDelete {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodDelete})
+		return
+	}
+	b := bansFor(conn)
+	if b == nil || !b.unban(ip) {
+		handleNotFound(conn)
+		return
+	}
+	log.Printf("Lifted the ban on %s", ip)
+	sendResponse(conn, http.StatusNoContent, nil, nil)
+}
@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestBans(t *testing.T) {
+	addr := startTestServer(t, "-admin-token", "secret", "-trusted-proxies", "127.0.0.1/32", "-ban", "unauthorized=3,time=1m")
+	client := testClient()
+	get := func(method, path string, header map[string]string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+path, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	forwarded := map[string]string{"X-Forwarded-For": "192.0.2.1"}
+	admin := map[string]string{"Authorization": "Bearer secret"}
+
+	for i := 0; i < 3; i++ {
+		if status := get("GET", "/admin/cache", forwarded); status != 401 {
+			t.Fatalf("request %d: status = %d, want 401", i+1, status)
+		}
+	}
+	if status := get("GET", "/", forwarded); status != 403 {
+		t.Errorf("banned client: status = %d, want 403", status)
+	}
+	if status := get("GET", "/", nil); status != 200 {
+		t.Errorf("other client: status = %d, want 200", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/admin/bans", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct{ Bans []banStatus }
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Bans) != 1 || list.Bans[0].IP != "192.0.2.1" || list.Bans[0].Reason != "3 unauthorized requests" {
+		t.Errorf("bans = %+v", list.Bans)
+	}
+
+	if status := get("DELETE", "/admin/bans/192.0.2.1", admin); status != 204 {
+		t.Errorf("unban: status = %d, want 204", status)
+	}
+	if status := get("DELETE", "/admin/bans/192.0.2.1", admin); status != 404 {
+		t.Errorf("second unban: status = %d, want 404", status)
+	}
+	if status := get("GET", "/", forwarded); status != 200 {
+		t.Errorf("unbanned client: status = %d, want 200", status)
+	}
+}
+
+func TestBanParseErrors(t *testing.T) {
+	addr := startTestServer(t, "-ban", "parse-errors=2")
+	for i := 0; i < 2; i++ {
+		if status, _, err := roundTrip(addr, "NOT HTTP\r\n\r\n"); err != nil || status != 400 {
+			t.Fatalf("malformed request %d: status %d, error %v", i+1, status, err)
+		}
+	}
+	if _, _, err := roundTrip(addr, "GET / HTTP/1.1\r\nHost: a\r\n\r\n"); err == nil {
+		t.Error("banned client's connection was served")
+	}
+	if bans := connections.bans.list(); len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Errorf("bans = %+v", bans)
+	}
+}
@@ -0,0 +1,97 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// echoBodyLimit caps bodies sent to /echo/, which never reads them.
+const echoBodyLimit = 1024
+
+// BodyLimitRule caps the size of request bodies for paths that start with
+// Prefix or match the path.Match pattern Match. Exactly one of the two must
+// be given.
+type BodyLimitRule struct {
+	Prefix string `json:"prefix"`
+	Match  string `json:"match"`
+	Max    int64  `json:"max"`
+}
+
+func (r *BodyLimitRule) validate() error {
+	if (r.Prefix == "") == (r.Match == "") {
+		return fmt.Errorf("exactly one of prefix or match is required")
+	}
+	if r.Match != "" {
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return err
+		}
+	}
+	if r.Max <= 0 {
+		return fmt.Errorf("max must be positive")
+	}
+	return nil
+}
+
+func (r *BodyLimitRule) matches(p string) bool {
+	if r.Prefix != "" {
+		return strings.HasPrefix(p, r.Prefix)
+	}
+	ok, _ := path.Match(r.Match, p)
+	return ok
+}
+
+// bodyLimitFor returns the largest body accepted for req. Configured rules
+// are tried in order; without one, uploads, including WebDAV requests on
+// /files itself, and proxied bodies, which are streamed rather than
+// buffered, get -max-upload-size, /echo/ gets almost nothing and
+// everything else gets maxRequestSize.
+func bodyLimitFor(req *http.Request) int64 {
+	for i := range config.BodyLimits {
+		if config.BodyLimits[i].matches(req.URL.Path) {
+			return config.BodyLimits[i].Max
+		}
+	}
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/files/") || config.WebDAV && req.URL.Path == "/files" || req.URL.IsAbs() || matchProxyRoute(req) != nil || matchFastCGIRoute(req) != nil:
+		return config.MaxUploadSize
+	case strings.HasPrefix(req.URL.Path, "/echo/"):
+		return echoBodyLimit
+	}
+	return maxRequestSize
+}
+
+// limitBody caps the request body size at the limit for its route. It runs
+// after rewrites so the limit matches the route actually served. It
+// reports false if the declared Content-Length is already over the limit,
+// so the request can be refused without reading any of the body.
+func limitBody(conn net.Conn, req *http.Request) bool {
+	limit := bodyLimitFor(req)
+	if req.ContentLength > limit {
+		return false
+	}
+	req.Body = &limitedBody{ReadCloser: http.MaxBytesReader(nil, req.Body, limit), conn: conn}
+	return true
+}
+
+// limitedBody marks the connection to be closed once the body turns out
+// to be over its limit. The rest of the body is never read, so the
+// connection can't carry another request, and the 413 the handler sends
+// says so.
+type limitedBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		markClosing(b.conn)
+	}
+	return n, err
+}
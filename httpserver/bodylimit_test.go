@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyLimits(t *testing.T) {
+	addr := startTestServer(t)
+	config.BodyLimits = []BodyLimitRule{{Prefix: "/anything/small", Max: 10}}
+
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"echo over limit", "POST /echo/hi HTTP/1.1\r\nHost: a\r\nContent-Length: 2000\r\n\r\n" + strings.Repeat("x", 2000), 413},
+		{"echo under limit", "POST /echo/hi HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", 200},
+		{"rule declared length", "POST /anything/small HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello world", 413},
+		{"rule chunked", "POST /anything/small HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\n\r\n", 413},
+		{"rule under limit", "POST /anything/small HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", 200},
+		{"default", "POST /anything HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello world", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, tt.raw)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusRequestEntityTooLarge && !resp.Close {
+				t.Error("413 response doesn't close the connection")
+			}
+		})
+	}
+}
+
+func TestBodyLimitWebDAVRoot(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config.BodyLimits = nil
+	config.MaxUploadSize = 1 << 30
+	req, _ := http.NewRequest("PROPFIND", "/files", nil)
+	if got := bodyLimitFor(req); got != maxRequestSize {
+		t.Errorf("limit for /files without -webdav = %d, want %d", got, maxRequestSize)
+	}
+	config.WebDAV = true
+	if got := bodyLimitFor(req); got != config.MaxUploadSize {
+		t.Errorf("limit for /files with -webdav = %d, want -max-upload-size", got)
+	}
+}
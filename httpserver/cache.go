@@ -0,0 +1,393 @@
+package httpserver
+
+import (
+	"container/list"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	// file, when set, names the disk tier file that holds the body in
+	// place of body, and fileSize is its length.
+	file     string
+	fileSize int64
+
+	// stored is when the response was received, and initialAge how old the
+	// upstream said it already was at that point.
+	stored     time.Time
+	initialAge time.Duration
+	// expires is when the entry stops being fresh.
+	expires time.Time
+	// staleWhileRevalidate is how long past expires the entry may still be
+	// served while it is refreshed in the background (RFC 5861).
+	staleWhileRevalidate time.Duration
+
+	// path is the request path the entry answers, by which it can be
+	// purged.
+	path string
+
+	// modTime and size identify the version of a cached file; the entry is
+	// only valid while the file on disk still matches them.
+	modTime time.Time
+	size    int64
+}
+
+// age returns the current age of the entry as defined by RFC 9111 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// usableWhileRevalidating reports whether a stale entry is still within its
+// stale-while-revalidate window.
+func (e *cacheEntry) usableWhileRevalidating(now time.Time) bool {
+	return e.staleWhileRevalidate > 0 && now.Before(e.expires.Add(e.staleWhileRevalidate))
+}
+
+// bodySize returns the length of the stored body, wherever it is kept.
+func (e *cacheEntry) bodySize() int64 {
+	if e.file != "" {
+		return e.fileSize
+	}
+	return int64(len(e.body))
+}
+
+// hasValidators reports whether the entry can be revalidated with a
+// conditional request.
+func (e *cacheEntry) hasValidators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// responseCache is an in-memory store of responses keyed by an opaque
+// string chosen by the caller. When it grows past its byte budgets the
+// least recently used entries are evicted.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+
+	// lru orders the keys of entries from most to least recently used, and
+	// elems locates each key in it.
+	lru   *list.List
+	elems map[string]*list.Element
+
+	// maxBytes and maxDiskBytes cap the memory and disk tier space used by
+	// entries; zero means no limit. bytes and diskBytes are the current
+	// totals.
+	maxBytes     int64
+	maxDiskBytes int64
+	bytes        int64
+	diskBytes    int64
+
+	// refreshing holds the keys with a background refresh in flight.
+	refreshing map[string]bool
+
+	// disk, if set, holds entries too large to keep in memory.
+	disk *diskStore
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries:    make(map[string]*cacheEntry),
+		lru:        list.New(),
+		elems:      make(map[string]*list.Element),
+		refreshing: make(map[string]bool),
+	}
+}
+
+var (
+	// proxyCache holds responses from caching proxy routes.
+	proxyCache = newResponseCache()
+	// fileCache holds the contents of small, frequently read files.
+	fileCache = newResponseCache()
+)
+
+// setLimits sets the cache's byte budgets. It must be called before the
+// cache is used.
+func (c *responseCache) setLimits(maxBytes, maxDiskBytes int64) {
+	c.maxBytes = maxBytes
+	c.maxDiskBytes = maxDiskBytes
+}
+
+// memorySize estimates the memory held by entry: its body and headers.
+func (e *cacheEntry) memorySize() int64 {
+	size := int64(len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// get returns the entry stored under key, or nil, counting the lookup as a
+// hit or a miss.
+func (c *responseCache) get(key string) *cacheEntry {
+	return c.getIf(key, nil)
+}
+
+// getIf is get for entries that can go out of date: an entry for which
+// valid returns false is treated, and counted, as a miss.
+func (c *responseCache) getIf(key string, valid func(*cacheEntry) bool) *cacheEntry {
+	c.mu.Lock()
+	entry := c.entries[key]
+	if entry != nil {
+		c.lru.MoveToFront(c.elems[key])
+	}
+	c.mu.Unlock()
+
+	if entry == nil || (valid != nil && !valid(entry)) {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	return entry
+}
+
+// set stores entry under key and evicts least recently used entries until
+// the cache is back within budget. An entry that could never fit is not
+// stored, and whatever was under key is dropped instead.
+func (c *responseCache) set(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	old := c.removeLocked(key)
+	released := []*cacheEntry{entry}
+	if c.fits(entry) {
+		c.insertLocked(key, entry)
+		evicted := c.evictLocked(key)
+		c.evictions.Add(int64(len(evicted)))
+		released = evicted
+	}
+	c.mu.Unlock()
+
+	// A refreshed entry shares its predecessor's file.
+	if old != nil && old.file != entry.file {
+		released = append(released, old)
+	}
+	c.released(entry.file != "", released...)
+}
+
+func (c *responseCache) delete(key string) {
+	c.mu.Lock()
+	old := c.removeLocked(key)
+	c.mu.Unlock()
+
+	if old != nil {
+		c.evictions.Add(1)
+	}
+	c.released(false, old)
+}
+
+// fits reports whether entry is within the budgets on its own.
+func (c *responseCache) fits(entry *cacheEntry) bool {
+	if c.maxBytes > 0 && entry.memorySize() > c.maxBytes {
+		return false
+	}
+	return c.maxDiskBytes <= 0 || entry.fileSize <= c.maxDiskBytes
+}
+
+func (c *responseCache) insertLocked(key string, entry *cacheEntry) {
+	c.entries[key] = entry
+	c.elems[key] = c.lru.PushFront(key)
+	c.bytes += entry.memorySize()
+	c.diskBytes += entry.fileSize
+}
+
+func (c *responseCache) removeLocked(key string) *cacheEntry {
+	entry := c.entries[key]
+	if entry == nil {
+		return nil
+	}
+	delete(c.entries, key)
+	c.lru.Remove(c.elems[key])
+	delete(c.elems, key)
+	c.bytes -= entry.memorySize()
+	c.diskBytes -= entry.fileSize
+	return entry
+}
+
+// evictLocked removes least recently used entries, other than keep, until
+// both budgets are met. Only entries that use the tier that is over budget
+// are evicted, so a full disk tier doesn't empty memory or vice versa.
+func (c *responseCache) evictLocked(keep string) []*cacheEntry {
+	var evicted []*cacheEntry
+	for elem := c.lru.Back(); elem != nil; {
+		overMemory := c.maxBytes > 0 && c.bytes > c.maxBytes
+		overDisk := c.maxDiskBytes > 0 && c.diskBytes > c.maxDiskBytes
+		if !overMemory && !overDisk {
+			break
+		}
+
+		key := elem.Value.(string)
+		elem = elem.Prev()
+		if key == keep {
+			continue
+		}
+		entry := c.entries[key]
+		if (overMemory && entry.memorySize() > 0) || (overDisk && entry.fileSize > 0) {
+			evicted = append(evicted, c.removeLocked(key))
+		}
+	}
+	return evicted
+}
+
+// released removes the disk files of entries that have left the cache and
+// brings the disk index up to date if anything on disk changed.
+func (c *responseCache) released(changed bool, entries ...*cacheEntry) {
+	if c.disk == nil {
+		return
+	}
+	for _, e := range entries {
+		if e != nil && e.file != "" {
+			c.disk.remove(e.file)
+			changed = true
+		}
+	}
+	if changed {
+		if err := c.disk.writeIndex(c); err != nil {
+			log.Printf("Error writing cache index: %v", err)
+		}
+	}
+}
+
+// purge removes every entry for which match returns true and reports how
+// many were removed.
+func (c *responseCache) purge(match func(*cacheEntry) bool) int {
+	var purged []*cacheEntry
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if match(entry) {
+			purged = append(purged, c.removeLocked(key))
+		}
+	}
+	c.mu.Unlock()
+
+	c.evictions.Add(int64(len(purged)))
+	c.released(false, purged...)
+	return len(purged)
+}
+
+// cacheUsage is a point-in-time summary of a responseCache.
+type cacheUsage struct {
+	entries     int
+	memoryBytes int64
+	diskBytes   int64
+	ages        []time.Duration
+}
+
+func (c *responseCache) usage(now time.Time) cacheUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u := cacheUsage{
+		entries:     len(c.entries),
+		memoryBytes: c.bytes,
+		diskBytes:   c.diskBytes,
+		ages:        make([]time.Duration, 0, len(c.entries)),
+	}
+	for _, entry := range c.entries {
+		u.ages = append(u.ages, entry.age(now))
+	}
+	return u
+}
+
+// beginRefresh claims the right to refresh key, returning false if another
+// refresh of it is already running.
+func (c *responseCache) beginRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *responseCache) endRefresh(key string) {
+	c.mu.Lock()
+	delete(c.refreshing, key)
+	c.mu.Unlock()
+}
+
+// cacheControl holds parsed Cache-Control directives. Directives without
+// an argument map to the empty string.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive such as max-age.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime works out how long a response may be served from a
+// shared cache, following RFC 9111 4.2.1: s-maxage, then max-age, then
+// Expires relative to Date. It returns false if the response carries no
+// explicit freshness information.
+func freshnessLifetime(header http.Header, cc cacheControl) (time.Duration, bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid Expires means "already expired".
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(exp.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// staleWhileRevalidate returns the stale-while-revalidate window of a
+// response, or zero if it has none.
+func staleWhileRevalidate(cc cacheControl) time.Duration {
+	d, _ := cc.seconds("stale-while-revalidate")
+	return d
+}
@@ -0,0 +1,50 @@
+package httpserver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CacheControlRule sets the Cache-Control header for files whose request
+// path starts with Prefix or matches the path.Match pattern Match (for
+// example "/files/*.css"). Exactly one of the two must be given.
+type CacheControlRule struct {
+	Prefix string `json:"prefix"`
+	Match  string `json:"match"`
+	Value  string `json:"value"`
+}
+
+func (r *CacheControlRule) validate() error {
+	if (r.Prefix == "") == (r.Match == "") {
+		return fmt.Errorf("exactly one of prefix or match is required")
+	}
+	if r.Match != "" {
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return err
+		}
+	}
+	if r.Value == "" {
+		return fmt.Errorf("value is required")
+	}
+	return nil
+}
+
+func (r *CacheControlRule) matches(p string) bool {
+	if r.Prefix != "" {
+		return strings.HasPrefix(p, r.Prefix)
+	}
+	ok, _ := path.Match(r.Match, p)
+	return ok
+}
+
+// cacheControlFor returns the configured Cache-Control value for a request
+// path, or "" when no rule applies. Rules are tried in order.
+func cacheControlFor(p string) string {
+	for i := range config.CacheControl {
+		if config.CacheControl[i].matches(p) {
+			return config.CacheControl[i].Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgiPrefix is where the scripts in -cgi-dir are served.
+const cgiPrefix = "/cgi-bin/"
+
+// serverSoftware names this server to CGI scripts.
+const serverSoftware = "httpserver"
+
+// handleCGI runs a script from -cgi-dir as a CGI/1.1 script (RFC 3875):
+// /cgi-bin/name/more runs the script name with /more as its PATH_INFO.
+// Only executable regular files directly in the directory are run.
+func handleCGI(w *ResponseWriter, req *http.Request) error {
+	name, pathInfo, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, cgiPrefix), "/")
+	if !validFileName(name) {
+		return ErrNotFound
+	}
+	script, err := filepath.Abs(filepath.Join(config.CGIDir, name))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(script)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return ErrNotFound
+	}
+	if pathInfo != "" {
+		pathInfo = "/" + pathInfo
+	}
+
+	body, length, err := cgiBody(req)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(req.Context(), script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = append(cgiEnv(w.conn, req, cgiPrefix+name, script, pathInfo, length), "PATH="+os.Getenv("PATH"))
+	if length > 0 {
+		cmd.Stdin = body
+	}
+	cmd.Stderr = &cgiLogger{prefix: "CGI script " + name}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting CGI script %s: %w", name, err)
+	}
+	defer func() {
+		if err := cmd.Wait(); err != nil && req.Context().Err() == nil {
+			log.Printf("CGI script %s: %v", name, err)
+		}
+	}()
+
+	if err := relayCGIResponse(w, stdout); err != nil {
+		io.Copy(io.Discard, stdout)
+		return fmt.Errorf("CGI script %s: %w", name, err)
+	}
+	return nil
+}
+
+// cgiBody returns the body to give a script and its length. CONTENT_LENGTH
+// must give the length of the body, so a chunked one is read in full
+// first.
+func cgiBody(req *http.Request) (io.Reader, int64, error) {
+	if req.ContentLength >= 0 {
+		return req.Body, req.ContentLength, nil
+	}
+	data, err := readBody(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// relayCGIResponse sends the response a script writes to out: the header
+// it starts with, then the rest as the body, streamed as it arrives. A
+// header that can't be used is answered with 502 Bad Gateway.
+func relayCGIResponse(w *ResponseWriter, out io.Reader) error {
+	r := bufio.NewReader(out)
+	status, err := readCGIHeader(r, w.Header())
+	if err != nil {
+		return Errorf(http.StatusBadGateway, "%w", err)
+	}
+	w.WriteHeader(status)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// cgiEnv returns the environment of script, run for req as scriptName: the
+// meta-variables of RFC 3875 4.1, and one HTTP_ variable per request header
+// field. Credentials are left out, as the RFC allows, and so is Proxy,
+// whose HTTP_PROXY would tell the script's HTTP clients to use a proxy the
+// client chose.
+func cgiEnv(conn net.Conn, req *http.Request, scriptName, script, pathInfo string, length int64) []string {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+		_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=" + serverSoftware,
+		"SERVER_NAME=" + host,
+		"SERVER_PORT=" + port,
+		"SERVER_PROTOCOL=" + req.Proto,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.RequestURI,
+		"SCRIPT_NAME=" + scriptName,
+		"SCRIPT_FILENAME=" + script,
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + req.URL.RawQuery,
+		"REMOTE_ADDR=" + req.RemoteAddr,
+		"REMOTE_HOST=" + req.RemoteAddr,
+	}
+	if pathInfo != "" {
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(filepath.Dir(script), filepath.FromSlash(pathInfo)))
+	}
+	if length > 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(length, 10))
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		env = append(env, "CONTENT_TYPE="+contentType)
+	}
+	if p := currentPrincipal(req); p != nil {
+		env = append(env, "REMOTE_USER="+p.User, "AUTH_TYPE="+p.Via)
+	}
+	for field, values := range req.Header {
+		switch field {
+		case "Authorization", "Proxy-Authorization", "Proxy", "Content-Type", "Content-Length":
+			continue
+		}
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(field, "-", "_"))
+		env = append(env, key+"="+strings.Join(values, ", "))
+	}
+	return env
+}
+
+// readCGIHeader reads the header a script writes before its document into
+// header, and returns the status it asks for (RFC 3875 6.3). The Status
+// field sets the status; without one, a Location gives 302 Found and
+// anything else 200 OK. A redirect to a local path is sent to the client
+// like any other, rather than served in place of the script's response.
+func readCGIHeader(out *bufio.Reader, header http.Header) (int, error) {
+	fields, err := textproto.NewReader(out).ReadMIMEHeader()
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+	status := http.StatusOK
+	if fields.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	if value := fields.Get("Status"); value != "" {
+		code, _, _ := strings.Cut(value, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			return 0, fmt.Errorf("invalid Status %q", value)
+		}
+	}
+	if status == http.StatusOK && fields.Get("Content-Type") == "" {
+		return 0, errors.New("no Content-Type")
+	}
+	for field, values := range fields {
+		if field == "Status" {
+			continue
+		}
+		header[field] = values
+	}
+	return status, nil
+}
+
+// cgiLogger logs what a script writes to its standard error, a line at a
+// time.
+type cgiLogger struct {
+	prefix string
+	buf    []byte
+}
+
+func (l *cgiLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("%s: %s", l.prefix, l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
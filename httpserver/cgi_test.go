@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCGI(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"env": "#!/bin/sh\nprintf 'Content-Type: text/plain\\nX-Script: env\\n\\n'\n" +
+			"echo \"$REQUEST_METHOD $SCRIPT_NAME $PATH_INFO $QUERY_STRING $CONTENT_LENGTH $HTTP_X_TEST $HTTP_AUTHORIZATION\"\ncat\n",
+		"redirect": "#!/bin/sh\nprintf 'Location: /elsewhere\\n\\n'\n",
+		"teapot":   "#!/bin/sh\nprintf 'Status: 418 Teapot\\nContent-Type: text/plain\\n\\nshort and stout'\n",
+		"broken":   "#!/bin/sh\necho oops >&2\nexit 1\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plain"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-cgi-dir", dir)
+	client := testClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	send := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+path, strings.NewReader(body))
+		req.Header.Set("X-Test", "yes")
+		req.Header.Set("Authorization", "Basic c2VjcmV0")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+
+	resp, body := send("POST", "/cgi-bin/env/a/b?x=1", "hello")
+	if want := "POST /cgi-bin/env /a/b x=1 5 yes \nhello"; resp.StatusCode != 200 || body != want {
+		t.Errorf("env = %d %q, want 200 %q", resp.StatusCode, body, want)
+	}
+	if resp.Header.Get("X-Script") != "env" {
+		t.Errorf("X-Script = %q", resp.Header.Get("X-Script"))
+	}
+	if resp, _ := send("GET", "/cgi-bin/redirect", ""); resp.StatusCode != 302 || resp.Header.Get("Location") != "/elsewhere" {
+		t.Errorf("redirect = %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, body := send("GET", "/cgi-bin/teapot", ""); resp.StatusCode != 418 || body != "short and stout" {
+		t.Errorf("teapot = %d %q", resp.StatusCode, body)
+	}
+	for path, status := range map[string]int{"/cgi-bin/broken": 502, "/cgi-bin/plain": 404, "/cgi-bin/missing": 404, "/cgi-bin/.env": 404} {
+		if resp, _ := send("GET", path, ""); resp.StatusCode != status {
+			t.Errorf("%s = %d, want %d", path, resp.StatusCode, status)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package httpserver
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTruncatedResponse is how much of a response chosen for truncation is
+// held back before part of it is sent and the connection cut. Longer
+// responses, and streams, are cut somewhere within their first this many
+// bytes.
+const maxTruncatedResponse = 64 * 1024
+
+// chaosStatuses are the server errors -chaos answers with.
+var chaosStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// ChaosConfig injects faults into requests so that clients, and the retry
+// logic of proxies in front of this server, can be tested against them.
+// Each rate is the fraction of requests affected. A delayed request waits
+// up to MaxDelay and may then also suffer one of the other faults.
+type ChaosConfig struct {
+	DelayRate    float64
+	MaxDelay     time.Duration
+	DropRate     float64
+	TruncateRate float64
+	ErrorRate    float64
+}
+
+// parseChaos parses a -chaos spec such as
+// "delay=0.1,max-delay=2s,drop=0.01,truncate=0.01,error=0.05".
+func parseChaos(spec string) (*ChaosConfig, error) {
+	c := &ChaosConfig{MaxDelay: time.Second}
+	for _, item := range splitList(spec) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not name=value", item)
+		}
+		if name == "max-delay" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("max-delay must be a positive duration, not %q", value)
+			}
+			c.MaxDelay = d
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%s must be a rate between 0 and 1, not %q", name, value)
+		}
+		switch name {
+		case "delay":
+			c.DelayRate = rate
+		case "drop":
+			c.DropRate = rate
+		case "truncate":
+			c.TruncateRate = rate
+		case "error":
+			c.ErrorRate = rate
+		default:
+			return nil, fmt.Errorf("unknown fault %q", name)
+		}
+	}
+	if c.DropRate+c.TruncateRate+c.ErrorRate > 1 {
+		return nil, fmt.Errorf("drop, truncate and error add up to more than 1")
+	}
+	return c, nil
+}
+
+// apply injects the faults chosen for req, and reports whether the request
+// should still be served. A dropped connection is closed without a
+// response, and an error is answered with a random 5xx status. A request
+// whose response is to be truncated is served with conn set to cut it
+// short.
+func (c *ChaosConfig) apply(conn *serverConn, req *http.Request) bool {
+	if c == nil {
+		return true
+	}
+	if rand.Float64() < c.DelayRate {
+		if !sleep(req.Context(), time.Duration(rand.Int63n(int64(c.MaxDelay))+1)) {
+			return false
+		}
+	}
+
+	roll := rand.Float64()
+	switch {
+	case roll < c.DropRate:
+		log.Printf("Chaos: dropping the connection from %s for %s %s", conn.RemoteAddr(), req.Method, redactTarget(req.RequestURI))
+		conn.closing = true
+		conn.Conn.Close()
+		return false
+	case roll < c.DropRate+c.TruncateRate:
+		log.Printf("Chaos: truncating the response to %s for %s %s", conn.RemoteAddr(), req.Method, redactTarget(req.RequestURI))
+		conn.truncated = new(bytes.Buffer)
+		return true
+	case roll < c.DropRate+c.TruncateRate+c.ErrorRate:
+		status := chaosStatuses[rand.Intn(len(chaosStatuses))]
+		log.Printf("Chaos: answering %s %s from %s with %d", req.Method, redactTarget(req.RequestURI), conn.RemoteAddr(), status)
+		sendResponse(conn, status, []byte("Injected failure\n"), map[string]string{
+			"Content-Type": "text/plain; charset=utf-8",
+			"X-Chaos":      "error",
+		})
+		return false
+	}
+	return true
+}
+
+// cutResponse sends a random part of the response held back for
+// truncation, if there is one, and closes the connection.
+func (c *serverConn) cutResponse() {
+	if c.truncated == nil {
+		return
+	}
+	held := c.truncated.Bytes()
+	c.truncated = nil
+	c.closing = true
+	if len(held) > 0 {
+		c.Conn.Write(held[:rand.Intn(len(held))])
+	}
+	c.Conn.Close()
+}
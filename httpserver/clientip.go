@@ -0,0 +1,135 @@
+package httpserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHop is one proxy hop as reported by Forwarded or
+// X-Forwarded-For/-Proto.
+type forwardedHop struct {
+	addr  string
+	proto string
+}
+
+// clientIP returns the address of the client that originated req.
+// Forwarding headers are only consulted when the peer is a trusted proxy,
+// and are walked right to left so that a client cannot spoof its address by
+// prepending entries of its own.
+func clientIP(conn net.Conn, req *http.Request) string {
+	if addr := originHop(conn, req).addr; addr != "" {
+		return addr
+	}
+	// The proxies could not identify the client ("for=unknown"), so the
+	// nearest thing we know for certain is the peer itself.
+	return hostOnly(conn.RemoteAddr().String())
+}
+
+// requestScheme returns the scheme the client used to reach us, which may
+// differ from ours when a trusted proxy terminated TLS in front of us.
+func requestScheme(conn net.Conn, req *http.Request) string {
+	if proto := originHop(conn, req).proto; proto == "http" || proto == "https" {
+		return proto
+	}
+	return "http"
+}
+
+// originHop finds the first hop, counting back from this server, that is
+// not a trusted proxy. The Forwarded header takes precedence over the
+// X-Forwarded-* headers when both are present.
+func originHop(conn net.Conn, req *http.Request) forwardedHop {
+	peer := forwardedHop{addr: hostOnly(conn.RemoteAddr().String())}
+	if !isTrustedProxy(peer.addr) {
+		return peer
+	}
+
+	hops := forwardedHops(req.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = forwardedForHops(req.Header.Values("X-Forwarded-For"), req.Header.Get("X-Forwarded-Proto"))
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i].addr) {
+			return hops[i]
+		}
+	}
+
+	// Every hop was a trusted proxy, so the leftmost one is the best
+	// guess we have at the original client.
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return peer
+}
+
+// forwardedHops parses RFC 7239 Forwarded header values such as
+// `for=192.0.2.60;proto=https, for="[2001:db8::17]:4711"`. Hops whose
+// for= parameter is missing, "unknown" or an obfuscated identifier are
+// kept with an empty address so that they still count as untrusted.
+func forwardedHops(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(val, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					if addr := hostOnly(val); net.ParseIP(addr) != nil {
+						hop.addr = addr
+					}
+				case "proto":
+					hop.proto = strings.ToLower(val)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedForHops parses X-Forwarded-For. X-Forwarded-Proto is set by the
+// proxy that accepted the original request and describes that request as a
+// whole, so its first value applies to every hop.
+func forwardedForHops(values []string, proto string) []forwardedHop {
+	proto, _, _ = strings.Cut(proto, ",")
+	proto = strings.ToLower(strings.TrimSpace(proto))
+
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			addr = hostOnly(strings.TrimSpace(addr))
+			if net.ParseIP(addr) == nil {
+				addr = ""
+			}
+			hops = append(hops, forwardedHop{addr: addr, proto: proto})
+		}
+	}
+	return hops
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOnly strips an optional port (and IPv6 brackets) from addr.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
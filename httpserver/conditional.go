@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModified evaluates If-None-Match and If-Modified-Since against the
+// validators in header, following RFC 9110 section 13.2.2: when
+// If-None-Match is present If-Modified-Since is ignored, and both only
+// apply to GET and HEAD.
+func notModified(req *http.Request, header http.Header) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, header.Get("ETag"))
+	}
+
+	ims := req.Header.Get("If-Modified-Since")
+	lastModified := header.Get("Last-Modified")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether etag appears in an If-None-Match list using
+// the weak comparison function.
+func etagMatches(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedHeaders are the fields a 304 response carries over from the
+// full response it stands in for (RFC 9110 section 15.4.5).
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// notModifiedHeader picks the fields of header that belong on a 304.
+func notModifiedHeader(header http.Header) http.Header {
+	out := make(http.Header)
+	for _, name := range notModifiedHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			out[name] = values
+		}
+	}
+	return out
+}
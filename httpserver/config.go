@@ -0,0 +1,696 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config holds the settings that can be changed at startup.
+type Config struct {
+	// DataDir is the directory served under /files/.
+	DataDir string
+
+	// Storage is where /files/ are kept: "disk", in DataDir; "memory",
+	// where they are lost on restart and may take up to StorageMaxSize
+	// bytes for each host; "db", in the single file files.db in DataDir,
+	// which holds the files of every host; or "s3", in the bucket described
+	// by S3, which can only be set from the -config file.
+	Storage        string
+	StorageMaxSize int64
+	S3             *S3Config
+
+	// ContentAddressed stores each distinct file content once, under its
+	// SHA-256, checks it on every full read, and serves it at /blobs/ to
+	// callers who may read every file holding it.
+	ContentAddressed bool
+
+	// FileVersions is how many earlier versions of each file are kept when
+	// it is overwritten, none being kept longer than FileVersionMaxAge
+	// after it was replaced if that is set. Zero turns versioning off.
+	FileVersions      int
+	FileVersionMaxAge time.Duration
+
+	// EncryptionKeysPath names a file of AES-256 keys, and
+	// EncryptionKeysCommand a shell command printing them, with which
+	// files are encrypted at rest. Encryption is off when both are empty.
+	EncryptionKeysPath    string
+	EncryptionKeysCommand string
+
+	// ReplicateTo is a directory, or the URL of a standby server, to which
+	// changes to files on disk are copied in the background. A standby
+	// takes them at /admin/replica with ReplicateToken as its admin token.
+	ReplicateTo    string
+	ReplicateToken string
+
+	// MaxUploadSize is the largest body accepted by POST /files/.
+	MaxUploadSize int64
+
+	// FileCacheMaxSize is the largest file kept in memory by the /files/
+	// cache. Zero disables the cache.
+	FileCacheMaxSize int64
+
+	// CacheDir, if set, is where proxy responses too large for memory are
+	// cached. It must not be DataDir, since its contents are managed by the
+	// cache and files it doesn't recognise are deleted.
+	CacheDir string
+
+	// CacheMaxMemory caps the bytes each response cache keeps in memory,
+	// and CacheMaxDisk those the proxy cache keeps in CacheDir. The least
+	// recently used entries are evicted to stay within them.
+	CacheMaxMemory int64
+	CacheMaxDisk   int64
+
+	// MaxHeaderCount is the most header fields a request may carry.
+	MaxHeaderCount int
+
+	// TemplatesDir names a directory of HTML templates to use instead of
+	// the built-in ones, and TemplatesReload has them parsed again for
+	// every page, so that edits show up without a restart.
+	TemplatesDir    string
+	TemplatesReload bool
+
+	// CSP is the Content-Security-Policy sent with HTML responses, in
+	// which {nonce} stands for a nonce made for each response. Templates
+	// allow their inline styles and scripts by giving them that nonce.
+	CSP string
+
+	// AssetsDir names a directory of static files to serve under /assets/
+	// instead of the built-in ones.
+	AssetsDir string
+
+	// RequestTimeout bounds how long a handler may work on a request
+	// before its context is cancelled. Zero means no limit.
+	RequestTimeout time.Duration
+
+	// DuplicateHeaders says what to do when a singleton header such as
+	// Host or Content-Length appears more than once: "merge" accepts
+	// repeats of the same value and "reject" refuses any repeat. Repeats
+	// with different values are always refused.
+	DuplicateHeaders string
+
+	// SessionSecret signs session cookies. When it is empty a random key
+	// is used and sessions don't survive a restart.
+	SessionSecret string
+
+	// SessionStore is where session data is kept: "memory", or "file" for
+	// one file per session in SessionDir.
+	SessionStore string
+	SessionDir   string
+
+	// SessionIdleTimeout ends a session that hasn't been used for that
+	// long, and SessionMaxAge ends any session that old.
+	SessionIdleTimeout time.Duration
+	SessionMaxAge      time.Duration
+
+	// UsersPath names a JSON file of accounts for /auth/login. When it is
+	// empty the /auth/ endpoints are disabled.
+	UsersPath string
+
+	// OIDCProviders protect groups of paths with an external identity
+	// provider. They can only be set from the -config file.
+	OIDCProviders []*OIDCProvider
+
+	// RouteAuth rules require Basic or Digest authentication, or signed
+	// requests, for paths under their prefixes, proxy and FastCGI routes
+	// included. They can only be set from the -config file.
+	RouteAuth []*RouteAuth
+
+	// Policies say which roles a caller needs for which paths and methods,
+	// proxy and FastCGI routes included. The first matching policy
+	// applies. They can only be set from the -config file.
+	Policies []*Policy
+
+	// MaxConnsPerIP caps the connections each client address may have open
+	// at once, not counting trusted proxies. Extra connections are closed
+	// as soon as they are accepted. 0 means no limit.
+	MaxConnsPerIP int
+
+	// UserRateLimit is how many requests a minute each authenticated user
+	// may make, with bursts of up to UserRateBurst. Zero disables the
+	// limit; usage is counted either way.
+	UserRateLimit int
+	UserRateBurst int
+
+	// AuditLogPath names an append-only, hash-chained log of mutating
+	// requests by authenticated users. Auditing is off when it is empty.
+	AuditLogPath string
+
+	// User and Group name the account the server switches to once it has
+	// bound its port, and Chroot a directory it moves into first, so that
+	// it can be started as root to take a privileged port without serving
+	// requests as root. The files and directories the server writes to are
+	// handed over to User. Paths are resolved inside Chroot after the
+	// switch, so it must also hold the CA certificates and resolv.conf that
+	// OIDC, S3 and proxying over HTTPS need. Restart refuses to run in a
+	// Chroot.
+	User   string
+	Group  string
+	Chroot string
+
+	// CGIDir holds scripts run as CGI programs under /cgi-bin/, which
+	// is not served when it is empty.
+	CGIDir string
+
+	// WebDAV serves the files tree to WebDAV clients, so that it can be
+	// mounted as a network drive.
+	WebDAV bool
+
+	// Sandbox confines the lookups of files in the data directories to
+	// those directories, so that no symlink or path-handling bug can lead
+	// a request outside them. It needs Linux 5.6 or later.
+	Sandbox bool
+
+	// RecordPath names a file to which every request is appended, with up
+	// to RecordMaxBody bytes of its body, for the replay subcommand.
+	// Recording is off when it is empty.
+	RecordPath    string
+	RecordMaxBody int64
+	// RecordSecrets keeps credentials in the recorded requests, so that
+	// authenticated requests replay as they were sent. Without it they are
+	// redacted like in the log.
+	RecordSecrets bool
+
+	// RedactHeaders and RedactParams name request header fields and query
+	// parameters, beyond the built-in ones carrying credentials, whose
+	// values are masked in the log and in recorded requests.
+	RedactHeaders []string
+	RedactParams  []string
+
+	// SelfTest runs a set of requests against the server on a random port
+	// and exits, with status 1 if any of them failed.
+	SelfTest bool
+
+	// Ban, when set, bans clients for a while after too many bad requests.
+	Ban *BanConfig
+
+	// Chaos, when set, injects delays and failures into requests.
+	Chaos *ChaosConfig
+
+	// TrustedProxies lists the networks allowed to report the client
+	// address on our behalf via forwarding headers.
+	TrustedProxies []*net.IPNet
+
+	// RedirectHosts lists the hosts /redirect-to may send clients to.
+	// Relative targets on this server are always allowed.
+	RedirectHosts []string
+
+	// AdminToken is the bearer token required by /admin/ endpoints. When it
+	// is empty the admin endpoints are disabled.
+	AdminToken string
+
+	// ForwardProxyHosts lists the destinations this server will fetch or
+	// tunnel to when used as a forward proxy. An empty list disables the
+	// forward proxy. Entries may be "host", "host:port" or "*.domain".
+	ForwardProxyHosts []string
+
+	// RedirectMapPath names a file of fixed redirects served ahead of
+	// everything else. It is reloaded automatically when it changes.
+	RedirectMapPath string
+
+	// FixturesPath names a JSON file of canned responses, served ahead of
+	// everything else to the requests they match. It is reloaded
+	// automatically when it changes.
+	FixturesPath string
+
+	// ProxyRoutes are path prefixes forwarded to upstream servers. They
+	// can only be set from the -config file.
+	ProxyRoutes []ProxyRoute
+
+	// FastCGIRoutes are path prefixes served by FastCGI applications.
+	// They can only be set from the -config file.
+	FastCGIRoutes []*FastCGIRoute
+
+	// Rewrites are applied in order before routing; the first rule that
+	// matches wins. They can only be set from the -config file.
+	Rewrites []RewriteRule
+
+	// VirtualHosts select a different data directory, set of routes,
+	// proxy routes and rewrites by Host header. Requests for any other
+	// host use the top-level settings.
+	VirtualHosts []*VirtualHost
+
+	// CacheControl rules choose the Cache-Control header sent with files
+	// from /files/. They can only be set from the -config file.
+	CacheControl []CacheControlRule
+
+	// BodyLimits override the largest request body accepted on the paths
+	// they match. They can only be set from the -config file.
+	BodyLimits []BodyLimitRule
+}
+
+// fileConfig is the layout of the JSON file named by -config. It holds the
+// structured settings that don't fit on a command line.
+type fileConfig struct {
+	Proxy        []ProxyRoute       `json:"proxy"`
+	FastCGI      []*FastCGIRoute    `json:"fastcgi"`
+	Rewrites     []RewriteRule      `json:"rewrites"`
+	VirtualHosts []*VirtualHost     `json:"vhosts"`
+	CacheControl []CacheControlRule `json:"cache_control"`
+	BodyLimits   []BodyLimitRule    `json:"body_limits"`
+	OIDC         []*OIDCProvider    `json:"oidc"`
+	RouteAuth    []*RouteAuth       `json:"route_auth"`
+	Policies     []*Policy          `json:"policies"`
+	S3           *S3Config          `json:"s3"`
+}
+
+// ProxyRoute forwards requests whose path starts with Prefix to Upstream,
+// or spreads them across Upstreams using the Balance strategy
+// (round_robin, least_connections or ip_hash).
+type ProxyRoute struct {
+	Prefix      string   `json:"prefix"`
+	Upstream    string   `json:"upstream"`
+	Upstreams   []string `json:"upstreams"`
+	Balance     string   `json:"balance"`
+	StripPrefix bool     `json:"strip_prefix"`
+
+	HealthCheck *HealthCheck `json:"health_check"`
+	Retry       *RetryPolicy `json:"retry"`
+	Cache       *ProxyCache  `json:"cache"`
+
+	balancer    *balancer
+	retryBudget *retryBudget
+}
+
+const (
+	defaultMaxUploadSize  = 1 << 30 // 1GB
+	defaultMaxHeaderCount = 100
+	defaultStorageMaxSize = 256 * 1024 * 1024
+	defaultRecordMaxBody  = 1024 * 1024
+
+	defaultFileCacheMaxSize = 64 * 1024
+	defaultCacheMaxMemory   = 256 * 1024 * 1024
+	defaultCacheMaxDisk     = 10 * 1024 * 1024 * 1024
+
+	defaultSessionIdleTimeout = 30 * time.Minute
+	defaultSessionMaxAge      = 24 * time.Hour
+)
+
+// config is the configuration of the server, set by New.
+var config = DefaultConfig()
+
+// DefaultConfig returns the settings ParseFlags gives when no flags are
+// set, for programs embedding the server to start from.
+func DefaultConfig() Config {
+	return Config{
+		DataDir:            dataDir,
+		Storage:            "disk",
+		StorageMaxSize:     defaultStorageMaxSize,
+		FileCacheMaxSize:   defaultFileCacheMaxSize,
+		CacheMaxMemory:     defaultCacheMaxMemory,
+		CacheMaxDisk:       defaultCacheMaxDisk,
+		MaxUploadSize:      defaultMaxUploadSize,
+		MaxHeaderCount:     defaultMaxHeaderCount,
+		DuplicateHeaders:   "merge",
+		CSP:                defaultCSP,
+		SessionStore:       "memory",
+		SessionIdleTimeout: defaultSessionIdleTimeout,
+		SessionMaxAge:      defaultSessionMaxAge,
+		RecordMaxBody:      defaultRecordMaxBody,
+	}
+}
+
+// setDefaults gives the fields of cfg that are left at zero, where zero
+// isn't a setting of its own, their value in DefaultConfig.
+func (cfg *Config) setDefaults() {
+	def := DefaultConfig()
+	if cfg.DataDir == "" {
+		cfg.DataDir = def.DataDir
+	}
+	if cfg.Storage == "" {
+		cfg.Storage = def.Storage
+	}
+	if cfg.StorageMaxSize == 0 {
+		cfg.StorageMaxSize = def.StorageMaxSize
+	}
+	if cfg.CacheMaxMemory == 0 {
+		cfg.CacheMaxMemory = def.CacheMaxMemory
+	}
+	if cfg.CacheMaxDisk == 0 {
+		cfg.CacheMaxDisk = def.CacheMaxDisk
+	}
+	if cfg.MaxUploadSize == 0 {
+		cfg.MaxUploadSize = def.MaxUploadSize
+	}
+	if cfg.MaxHeaderCount == 0 {
+		cfg.MaxHeaderCount = def.MaxHeaderCount
+	}
+	if cfg.DuplicateHeaders == "" {
+		cfg.DuplicateHeaders = def.DuplicateHeaders
+	}
+	if cfg.SessionStore == "" {
+		cfg.SessionStore = def.SessionStore
+	}
+	if cfg.SessionIdleTimeout == 0 {
+		cfg.SessionIdleTimeout = def.SessionIdleTimeout
+	}
+	if cfg.SessionMaxAge == 0 {
+		cfg.SessionMaxAge = def.SessionMaxAge
+	}
+	if cfg.UserRateBurst == 0 {
+		cfg.UserRateBurst = max(cfg.UserRateLimit, 1)
+	}
+}
+
+// ParseFlags reads a Config from command-line arguments, and from the JSON
+// file named by -config if there is one.
+func ParseFlags(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&cfg.DataDir, "directory", dataDir, "directory to serve files from")
+	fs.StringVar(&cfg.Storage, "storage", "disk", "where /files/ are kept: disk, memory, db or s3")
+	fs.Int64Var(&cfg.StorageMaxSize, "storage-max-size", defaultStorageMaxSize, "bytes of files each host may keep with -storage=memory")
+	fs.BoolVar(&cfg.ContentAddressed, "content-addressed", false, "store /files/ by SHA-256, deduplicated and verified on read")
+	fs.IntVar(&cfg.FileVersions, "file-versions", 0, "earlier versions of each file kept when it is overwritten (0 disables versioning)")
+	fs.DurationVar(&cfg.FileVersionMaxAge, "file-version-max-age", 0, "how long an earlier version is kept after it was replaced (0 for no limit)")
+	fs.StringVar(&cfg.EncryptionKeysPath, "encryption-keys", "", "file of base64 AES-256 keys, newest first, for encrypting /files/ at rest")
+	fs.StringVar(&cfg.EncryptionKeysCommand, "encryption-keys-command", "", "shell command printing the -encryption-keys, for fetching them from a KMS")
+	fs.Int64Var(&cfg.FileCacheMaxSize, "file-cache-max-size", defaultFileCacheMaxSize, "largest file in bytes cached in memory for GET /files/ (0 disables)")
+	fs.StringVar(&cfg.CacheDir, "cache-dir", "", "directory for caching large proxy responses on disk (disabled when empty)")
+	fs.Int64Var(&cfg.CacheMaxMemory, "cache-max-memory", defaultCacheMaxMemory, "bytes each response cache may hold in memory")
+	fs.Int64Var(&cfg.CacheMaxDisk, "cache-max-disk", defaultCacheMaxDisk, "bytes the proxy cache may hold in -cache-dir")
+	fs.StringVar(&cfg.AdminToken, "admin-token", "", "bearer token for /admin/ endpoints (disabled when empty)")
+	fs.Int64Var(&cfg.MaxUploadSize, "max-upload-size", defaultMaxUploadSize, "largest accepted upload in bytes")
+	fs.IntVar(&cfg.MaxHeaderCount, "max-header-count", defaultMaxHeaderCount, "most header fields accepted in a request")
+	fs.StringVar(&cfg.CSP, "csp", defaultCSP, "Content-Security-Policy of HTML responses, with {nonce} for the nonce of each (empty to send none)")
+	fs.StringVar(&cfg.TemplatesDir, "templates", "", "directory of HTML templates replacing the built-in ones")
+	fs.BoolVar(&cfg.TemplatesReload, "templates-reload", false, "parse the HTML templates again for every page, for editing them")
+	fs.StringVar(&cfg.AssetsDir, "assets", "", "directory of static files served under /assets/, replacing the built-in ones")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", 0, "how long a request may take before it is abandoned with 503 (0 for no limit)")
+	fs.StringVar(&cfg.DuplicateHeaders, "duplicate-headers", "merge", "repeated Host or Content-Length: merge (identical values allowed) or reject")
+	fs.StringVar(&cfg.SessionSecret, "session-secret", "", "key for signing session cookies (random per run when empty)")
+	fs.StringVar(&cfg.SessionStore, "session-store", "memory", "where sessions are kept: memory or file")
+	fs.StringVar(&cfg.SessionDir, "session-dir", "", "directory for -session-store=file")
+	fs.DurationVar(&cfg.SessionIdleTimeout, "session-idle-timeout", defaultSessionIdleTimeout, "how long an unused session lasts")
+	fs.DurationVar(&cfg.SessionMaxAge, "session-max-age", defaultSessionMaxAge, "how long any session lasts")
+	fs.StringVar(&cfg.UsersPath, "users", "", "JSON file of users allowed to log in (disables /auth/ when empty)")
+	fs.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", 0, "connections each client address may have open at once, trusted proxies exempt (0 for no limit)")
+	fs.IntVar(&cfg.UserRateLimit, "user-rate-limit", 0, "requests per minute allowed to each authenticated user (0 for no limit)")
+	fs.IntVar(&cfg.UserRateBurst, "user-rate-burst", 0, "requests a user may make at once (defaults to -user-rate-limit)")
+	fs.StringVar(&cfg.ReplicateTo, "replicate-to", "", "directory or standby server URL to which files on disk are replicated")
+	fs.StringVar(&cfg.ReplicateToken, "replicate-token", "", "admin token of the -replicate-to standby server")
+	fs.StringVar(&cfg.User, "user", "", "user to run as once the port is bound, when started as root")
+	fs.StringVar(&cfg.Group, "group", "", "group to run as once the port is bound (defaults to that of -user)")
+	fs.StringVar(&cfg.Chroot, "chroot", "", "directory to chroot into once the port is bound, before switching to -user")
+	fs.StringVar(&cfg.CGIDir, "cgi-dir", "", "directory of executable scripts run as CGI programs under /cgi-bin/ (disabled when empty)")
+	fs.BoolVar(&cfg.WebDAV, "webdav", false, "serve /files/ to WebDAV clients, with PUT, DELETE, PROPFIND, COPY, MOVE, LOCK and UNLOCK")
+	fs.BoolVar(&cfg.Sandbox, "sandbox", false, "never follow symlinks or paths out of -directory when opening files (Linux 5.6+)")
+	fs.StringVar(&cfg.AuditLogPath, "audit-log", "", "file recording authenticated POST, PUT, PATCH and DELETE requests (disabled when empty)")
+	fs.StringVar(&cfg.RecordPath, "record", "", "file recording every request, for the replay subcommand (disabled when empty)")
+	fs.Int64Var(&cfg.RecordMaxBody, "record-max-body", defaultRecordMaxBody, "most bytes of each request body kept by -record")
+	fs.BoolVar(&cfg.RecordSecrets, "record-secrets", false, "keep credentials in -record files instead of redacting them")
+	fs.BoolVar(&cfg.SelfTest, "self-test", false, "serve on a random port, check every basic route and exit non-zero on failure")
+	ban := fs.String("ban", "", "ban clients after too many bad requests, as \"parse-errors=5,unauthorized=10,rate-limited=20,window=1m,time=10m\"")
+	chaos := fs.String("chaos", "", "faults to inject, as \"delay=0.1,max-delay=1s,drop=0.01,truncate=0.01,error=0.05\" (rates between 0 and 1)")
+	trustedProxies := fs.String("trusted-proxies", "", "comma-separated CIDRs of trusted reverse proxies")
+	redirectHosts := fs.String("redirect-hosts", "", "comma-separated hosts that /redirect-to may target")
+	forwardProxyHosts := fs.String("forward-proxy-hosts", "", "comma-separated destinations allowed through the forward proxy")
+	fs.StringVar(&cfg.RedirectMapPath, "redirect-map", "", "file of \"/source target [status]\" redirects, reloaded on change")
+	fs.StringVar(&cfg.FixturesPath, "fixtures", "", "JSON file of canned responses by method and path, reloaded on change")
+	redactHeaders := fs.String("redact-headers", "", "comma-separated request headers masked in logs and recordings, beyond Authorization, Cookie and API keys")
+	redactParams := fs.String("redact-params", "", "comma-separated query parameters masked in logs and recordings, beyond signature, token and the like")
+	configPath := fs.String("config", "", "path to a JSON file with proxy routes and other structured settings")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	networks, err := parseCIDRList(*trustedProxies)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -trusted-proxies: %w", err)
+	}
+	cfg.TrustedProxies = networks
+	if *ban != "" {
+		if cfg.Ban, err = parseBan(*ban); err != nil {
+			return Config{}, fmt.Errorf("invalid -ban: %w", err)
+		}
+	}
+	if *chaos != "" {
+		if cfg.Chaos, err = parseChaos(*chaos); err != nil {
+			return Config{}, fmt.Errorf("invalid -chaos: %w", err)
+		}
+	}
+	if cfg.UserRateBurst == 0 {
+		cfg.UserRateBurst = max(cfg.UserRateLimit, 1)
+	}
+	cfg.RedirectHosts = splitList(*redirectHosts)
+	cfg.ForwardProxyHosts = splitList(*forwardProxyHosts)
+	cfg.RedactHeaders = splitList(*redactHeaders)
+	cfg.RedactParams = splitList(*redactParams)
+
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath, &cfg); err != nil {
+			return Config{}, fmt.Errorf("loading %s: %w", *configPath, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// validate checks the settings that ParseFlags and New both refuse.
+func (cfg *Config) validate() error {
+	if cfg.MaxHeaderCount <= 0 {
+		return fmt.Errorf("-max-header-count must be positive")
+	}
+	if cfg.RequestTimeout < 0 {
+		return fmt.Errorf("-request-timeout may not be negative")
+	}
+	if cfg.DuplicateHeaders != "merge" && cfg.DuplicateHeaders != "reject" {
+		return fmt.Errorf("-duplicate-headers must be merge or reject, not %q", cfg.DuplicateHeaders)
+	}
+	if cfg.CacheMaxMemory <= 0 || cfg.CacheMaxDisk <= 0 {
+		return fmt.Errorf("-cache-max-memory and -cache-max-disk must be positive")
+	}
+	if cfg.CacheDir != "" && filepath.Clean(cfg.CacheDir) == filepath.Clean(cfg.DataDir) {
+		return fmt.Errorf("-cache-dir must differ from -directory")
+	}
+	switch cfg.Storage {
+	case "disk", "memory", "db", "s3":
+	default:
+		return fmt.Errorf("-storage must be disk, memory, db or s3, not %q", cfg.Storage)
+	}
+	if cfg.StorageMaxSize <= 0 {
+		return fmt.Errorf("-storage-max-size must be positive")
+	}
+	if cfg.EncryptionKeysPath != "" && cfg.EncryptionKeysCommand != "" {
+		return fmt.Errorf("-encryption-keys and -encryption-keys-command can't both be set")
+	}
+	if cfg.ReplicateTo != "" && cfg.Storage != "disk" {
+		return fmt.Errorf("-replicate-to needs -storage=disk")
+	}
+	if cfg.ReplicateTo != "" && filepath.Clean(cfg.ReplicateTo) == filepath.Clean(cfg.DataDir) {
+		return fmt.Errorf("-replicate-to must differ from -directory")
+	}
+	if cfg.FileVersions < 0 || cfg.FileVersionMaxAge < 0 {
+		return fmt.Errorf("-file-versions and -file-version-max-age may not be negative")
+	}
+	switch cfg.SessionStore {
+	case "memory":
+	case "file":
+		if cfg.SessionDir == "" || cfg.SessionSecret == "" {
+			return fmt.Errorf("-session-store=file needs -session-dir and -session-secret")
+		}
+	default:
+		return fmt.Errorf("-session-store must be memory or file, not %q", cfg.SessionStore)
+	}
+	if cfg.RecordMaxBody < 0 {
+		return fmt.Errorf("-record-max-body may not be negative")
+	}
+	if cfg.Chroot != "" && cfg.User == "" {
+		return fmt.Errorf("-chroot needs -user, since root can leave a chroot")
+	}
+	if cfg.MaxConnsPerIP < 0 {
+		return fmt.Errorf("-max-conns-per-ip may not be negative")
+	}
+	if cfg.UserRateLimit < 0 || cfg.UserRateBurst < 0 {
+		return fmt.Errorf("-user-rate-limit and -user-rate-burst may not be negative")
+	}
+	if cfg.SessionIdleTimeout <= 0 || cfg.SessionMaxAge <= 0 {
+		return fmt.Errorf("-session-idle-timeout and -session-max-age must be positive")
+	}
+	if cfg.Storage == "s3" && cfg.S3 == nil {
+		return fmt.Errorf("-storage=s3 needs an s3 section in -config")
+	}
+	return nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file fileConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return err
+	}
+
+	if err := prepareProxyRoutes(file.Proxy); err != nil {
+		return err
+	}
+	cfg.ProxyRoutes = file.Proxy
+
+	for _, r := range file.FastCGI {
+		if err := r.prepare(); err != nil {
+			return fmt.Errorf("fastcgi route %q: %w", r.Prefix, err)
+		}
+	}
+	cfg.FastCGIRoutes = file.FastCGI
+
+	if err := compileRewrites(file.Rewrites); err != nil {
+		return err
+	}
+	cfg.Rewrites = file.Rewrites
+
+	for _, vh := range file.VirtualHosts {
+		if len(vh.Hosts) == 0 {
+			return fmt.Errorf("virtual host without any hosts")
+		}
+		if vh.DataDir == "" {
+			vh.DataDir = cfg.DataDir
+		}
+		if err := prepareProxyRoutes(vh.Proxy); err != nil {
+			return fmt.Errorf("virtual host %s: %w", vh.Hosts[0], err)
+		}
+		if err := compileRewrites(vh.Rewrites); err != nil {
+			return fmt.Errorf("virtual host %s: %w", vh.Hosts[0], err)
+		}
+	}
+	cfg.VirtualHosts = file.VirtualHosts
+
+	for i := range file.CacheControl {
+		if err := file.CacheControl[i].validate(); err != nil {
+			return fmt.Errorf("cache_control rule %d: %w", i+1, err)
+		}
+	}
+	cfg.CacheControl = file.CacheControl
+
+	for i := range file.BodyLimits {
+		if err := file.BodyLimits[i].validate(); err != nil {
+			return fmt.Errorf("body_limits rule %d: %w", i+1, err)
+		}
+	}
+	cfg.BodyLimits = file.BodyLimits
+
+	names := make(map[string]bool)
+	for _, p := range file.OIDC {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("oidc provider %q: %w", p.Name, err)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("oidc provider %q listed twice", p.Name)
+		}
+		names[p.Name] = true
+	}
+	cfg.OIDCProviders = file.OIDC
+
+	for _, a := range file.RouteAuth {
+		if err := a.prepare(); err != nil {
+			return fmt.Errorf("route_auth %q: %w", a.Prefix, err)
+		}
+	}
+	cfg.RouteAuth = file.RouteAuth
+
+	for i, p := range file.Policies {
+		if err := p.prepare(); err != nil {
+			return fmt.Errorf("policy %d: %w", i+1, err)
+		}
+	}
+	cfg.Policies = file.Policies
+
+	if file.S3 != nil {
+		if err := file.S3.prepare(); err != nil {
+			return fmt.Errorf("s3: %w", err)
+		}
+	}
+	cfg.S3 = file.S3
+
+	return nil
+}
+
+func prepareProxyRoutes(routes []ProxyRoute) error {
+	for i := range routes {
+		route := &routes[i]
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("proxy route %q: prefix must start with /", route.Prefix)
+		}
+		upstreams := route.Upstreams
+		if route.Upstream != "" {
+			upstreams = append([]string{route.Upstream}, upstreams...)
+		}
+		b, err := newBalancer(route.Balance, upstreams)
+		if err != nil {
+			return fmt.Errorf("proxy route %q: %w", route.Prefix, err)
+		}
+		route.balancer = b
+
+		if route.HealthCheck != nil {
+			route.HealthCheck.setDefaults()
+		}
+		if route.Cache != nil {
+			route.Cache.setDefaults()
+		}
+		if route.Retry != nil {
+			route.Retry.setDefaults()
+			route.retryBudget = newRetryBudget(route.Retry.BudgetRatio)
+		}
+	}
+	return nil
+}
+
+func compileRewrites(rules []RewriteRule) error {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("rewrite %q: %w", rules[i].Match, err)
+		}
+	}
+	return nil
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs. Bare IP addresses
+// are accepted and treated as single-host networks.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range splitList(list) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,305 @@
+package httpserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// exchange writes raw to a new connection to addr in one go and reads
+// back responses until the server closes the connection or want of them
+// have arrived. It reports whether the server then closed the connection,
+// failing the test if it sent anything more.
+func exchange(t *testing.T, addr, raw string, want int) (statuses []int, bodies []string, closed bool) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for len(statuses) < want {
+		resp, err := http.ReadResponse(reader, nil)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNRESET) {
+			return statuses, bodies, true
+		}
+		if err != nil {
+			t.Fatalf("reading response %d: %v", len(statuses)+1, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("reading body of response %d: %v", len(statuses)+1, err)
+		}
+		statuses = append(statuses, resp.StatusCode)
+		bodies = append(bodies, string(body))
+	}
+
+	// A timeout means the connection was kept open. It was closed if it
+	// ended instead, or was reset because the server closed it with part
+	// of the request unread.
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = reader.ReadByte()
+	if err == nil {
+		t.Errorf("unexpected data after response %d", want)
+	}
+	var netErr net.Error
+	return statuses, bodies, err != nil && !(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// TestConformance sends raw requests covering the framing and parsing
+// rules of RFC 9112 and checks the responses and whether the connection
+// survives them.
+func TestConformance(t *testing.T) {
+	addr := startTestServer(t)
+	longHeader := "X-Long: " + strings.Repeat("a", maxHeaderBytes) + "\r\n"
+
+	tests := []struct {
+		name     string
+		raw      string
+		statuses []int
+		// bodies, when set, are the expected bodies in order.
+		bodies []string
+		closed bool
+	}{
+		// Request line and Host (RFC 9112 3, 3.2).
+		{
+			name:     "simple request",
+			raw:      "GET /echo/hi HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200},
+			bodies:   []string{"hi"},
+		},
+		{
+			name:     "missing Host",
+			raw:      "GET / HTTP/1.1\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "repeated Host",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "HTTP/1.0 without Host",
+			raw:      "GET /echo/old HTTP/1.0\r\n\r\n",
+			statuses: []int{200},
+			bodies:   []string{"old"},
+			closed:   true,
+		},
+		{
+			name:     "HTTP/1.0 keep-alive",
+			raw:      "GET /echo/one HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /echo/two HTTP/1.0\r\n\r\n",
+			statuses: []int{200, 200},
+			bodies:   []string{"one", "two"},
+			closed:   true,
+		},
+		{
+			name:     "unsupported version",
+			raw:      "GET / HTTP/2.0\r\nHost: a\r\n\r\n",
+			statuses: []int{505},
+			closed:   true,
+		},
+		{
+			name:     "malformed request line",
+			raw:      "GET /\r\nHost: a\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "extra space in request line",
+			raw:      "GET  / HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "empty line before request line",
+			raw:      "\r\nGET /echo/hi HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200},
+			bodies:   []string{"hi"},
+		},
+
+		// Line endings and field syntax (RFC 9112 2.2, 5).
+		{
+			name:     "bare LF line endings",
+			raw:      "GET /echo/lf HTTP/1.1\nHost: a\n\n",
+			statuses: []int{200},
+			bodies:   []string{"lf"},
+		},
+		{
+			name:     "bare CR in field value",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\rc\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "whitespace before colon",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\nX-A : b\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "obsolete line folding",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n c\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "field without colon",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\nX-A\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+
+		// Size limits.
+		{
+			name:     "oversized header field",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\n" + longHeader + "\r\n",
+			statuses: []int{431},
+			closed:   true,
+		},
+		{
+			name:     "oversized request line",
+			raw:      "GET /" + strings.Repeat("a", maxHeaderBytes) + " HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{414},
+			closed:   true,
+		},
+		{
+			name:     "too many header fields",
+			raw:      "GET / HTTP/1.1\r\nHost: a\r\n" + strings.Repeat("X-A: b\r\n", defaultMaxHeaderCount+1) + "\r\n",
+			statuses: []int{431},
+			closed:   true,
+		},
+
+		// Message body framing (RFC 9112 6, 7).
+		{
+			name:     "Content-Length body",
+			raw:      "POST /publish HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+			statuses: []int{200},
+		},
+		{
+			name:     "chunked body",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			statuses: []int{200},
+		},
+		{
+			name:     "chunk extensions and trailer",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\nX-Trailer: t\r\n\r\n",
+			statuses: []int{200},
+		},
+		{
+			name:     "uppercase hex chunk size",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nA\r\n0123456789\r\n0\r\n\r\n",
+			statuses: []int{200},
+		},
+		{
+			name:     "invalid chunk size",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "chunk data longer than its size",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "unknown transfer coding",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: compress, chunked\r\n\r\n0\r\n\r\n",
+			statuses: []int{501},
+			closed:   true,
+		},
+		{
+			name:     "chunked missing",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: compress\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "chunked not last",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "Content-Length and Transfer-Encoding",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+		{
+			name:     "invalid Content-Length",
+			raw:      "POST /anything HTTP/1.1\r\nHost: a\r\nContent-Length: five\r\n\r\nhello",
+			statuses: []int{400},
+			closed:   true,
+		},
+
+		// Persistence and pipelining (RFC 9112 9.3).
+		{
+			name:     "pipelined requests",
+			raw:      "GET /echo/1 HTTP/1.1\r\nHost: a\r\n\r\nGET /echo/2 HTTP/1.1\r\nHost: a\r\n\r\nGET /echo/3 HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200, 200, 200},
+			bodies:   []string{"1", "2", "3"},
+		},
+		{
+			name:     "pipelined after a Content-Length body",
+			raw:      "POST /publish HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabcGET /echo/next HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200, 200},
+		},
+		{
+			name:     "pipelined after a chunked body",
+			raw:      "POST /publish HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\nGET /echo/next HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200, 200},
+		},
+		{
+			name:     "pipelined after an unread body",
+			raw:      "POST /echo/first HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\n\r\nbodyGET /echo/second HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200, 200},
+			bodies:   []string{"first", "second"},
+		},
+		{
+			name:     "Connection: close ends the pipeline",
+			raw:      "GET /echo/1 HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\nGET /echo/2 HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{200},
+			bodies:   []string{"1"},
+			closed:   true,
+		},
+		{
+			name:     "error ends the pipeline",
+			raw:      "GET / HTTP/1.1\r\n\r\nGET /echo/2 HTTP/1.1\r\nHost: a\r\n\r\n",
+			statuses: []int{400},
+			closed:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses, bodies, closed := exchange(t, addr, tt.raw, len(tt.statuses))
+			if !slices.Equal(statuses, tt.statuses) {
+				t.Fatalf("statuses = %v, want %v", statuses, tt.statuses)
+			}
+			for i, want := range tt.bodies {
+				if bodies[i] != want {
+					t.Errorf("body %d = %q, want %q", i+1, bodies[i], want)
+				}
+			}
+			if closed != tt.closed {
+				t.Errorf("connection closed = %v, want %v", closed, tt.closed)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// idleTimeout is how long a connection may sit between requests.
+	idleTimeout = 60 * time.Second
+	// bodyReadTimeout is how long a client may stall while sending a
+	// request body before the connection is dropped.
+	bodyReadTimeout = 30 * time.Second
+	// maxBodyDrain is how much unread request body is discarded to reuse
+	// a connection; anything longer is cheaper to abandon.
+	maxBodyDrain = 256 * 1024
+)
+
+// errClientGone is the cause given to a request's context when the client
+// closes the connection before the response is complete.
+var errClientGone = errors.New("client closed the connection")
+
+// errIncompleteBody is returned by a request body that ends early, stalls,
+// or breaks its chunked framing.
+var errIncompleteBody = errors.New("incomplete request body")
+
+// bodyErrorStatus picks the response status for an error from reading a
+// request body.
+func bodyErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusRequestTimeout
+	}
+	return errorStatus(err)
+}
+
+// serverConn is a client connection that can carry several requests one
+// after the other. Handlers see it as a plain net.Conn.
+type serverConn struct {
+	net.Conn
+	tracker *connTracker
+	reader  *bufio.Reader
+	// ip is the client address counted against -max-conns-per-ip, or
+	// empty if the connection isn't held to it.
+	ip string
+
+	// ctx is cancelled when the server gives up on the connection, taking
+	// the context of the request in progress with it.
+	ctx   context.Context
+	abort context.CancelFunc
+
+	// req is the request being served, and cancel ends its context.
+	req    *http.Request
+	cancel context.CancelCauseFunc
+	// watching is closed once the goroutine watching for the client to
+	// hang up has stopped. Anything it read instead is kept in peeked for
+	// the next request.
+	watching chan struct{}
+	peeked   []byte
+	// closing is set once the connection can't be used for another
+	// request, either because the client asked for that or because
+	// something has left it in an unknown state.
+	closing bool
+	// body is the current request's body, and written counts the bytes
+	// sent since the request was read; together they give the traffic of
+	// one exchange.
+	body    *framedBody
+	written atomic.Int64
+	// status is the status code of the response sent, once there is one.
+	status int
+	// truncated, when set by -chaos, holds back the response until
+	// cutResponse sends part of it.
+	truncated *bytes.Buffer
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *serverConn) Write(p []byte) (int, error) {
+	if c.truncated != nil {
+		c.truncated.Write(p)
+		c.written.Add(int64(len(p)))
+		if c.truncated.Len() >= maxTruncatedResponse {
+			c.cutResponse()
+		}
+		return len(p), nil
+	}
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	if err != nil {
+		// The client may have part of a response, so nothing more can
+		// follow it.
+		c.closing = true
+	}
+	return n, err
+}
+
+// ReadFrom keeps io.Copy to the connection on the kernel's sendfile path,
+// which wrapping the connection would otherwise lose.
+func (c *serverConn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if c.truncated != nil {
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.Conn}, r)
+	}
+	c.written.Add(n)
+	if err != nil {
+		c.closing = true
+	}
+	return n, err
+}
+
+// startRequest gives req a context that is cancelled when the client hangs
+// up, when -request-timeout has passed, or when the server gives up on the
+// connection while shutting down.
+func (c *serverConn) startRequest(req *http.Request) *http.Request {
+	ctx, cancel := context.WithCancelCause(c.ctx)
+	c.cancel = cancel
+	if config.RequestTimeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, config.RequestTimeout)
+		c.cancel = func(cause error) {
+			cancel(cause)
+			stop()
+		}
+	}
+	return req.WithContext(ctx)
+}
+
+// watchForHangup reads from the connection in the background so that the
+// request's context is cancelled if the client closes it. It is started
+// once the request has been read in full, and only when nothing of the
+// next one is buffered yet, since whatever arrives belongs to that.
+func (c *serverConn) watchForHangup() {
+	if c.watching != nil || c.reader.Buffered() > 0 {
+		return
+	}
+	done := make(chan struct{})
+	c.watching = done
+	cancel := c.cancel
+	go func() {
+		defer close(done)
+		var buf [1]byte
+		n, err := c.Conn.Read(buf[:])
+		if n > 0 {
+			c.peeked = buf[:n]
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// stopWatching interrupted the read.
+			return
+		}
+		cancel(errClientGone)
+	}()
+}
+
+// stopWatching stops the goroutine started by watchForHangup, if there is
+// one, so that the connection can be read from again.
+func (c *serverConn) stopWatching() {
+	if c.watching == nil {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Unix(1, 0))
+	<-c.watching
+	c.Conn.SetReadDeadline(time.Time{})
+	c.watching = nil
+}
+
+// sleep waits for d, or until ctx is done, and reports whether it waited
+// the whole time.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// markClosing records that conn must be closed after the current response.
+// Handlers that read from the connection directly or take it over for
+// another protocol call it, since the request framing no longer holds.
+func markClosing(conn net.Conn) {
+	if sc, ok := conn.(*serverConn); ok {
+		sc.closing = true
+		sc.stopWatching()
+	}
+}
+
+// connClosing reports whether conn will be closed after the current
+// response, so that the response can say so.
+func connClosing(conn net.Conn) bool {
+	sc, ok := conn.(*serverConn)
+	return ok && sc.closing
+}
+
+// recordStatus notes the status code of the response being sent on conn.
+func recordStatus(conn net.Conn, status int) {
+	if sc, ok := conn.(*serverConn); ok && sc.status == 0 {
+		sc.status = status
+	}
+}
+
+// currentRequest returns the request being served on conn, if known.
+func currentRequest(conn net.Conn) *http.Request {
+	if sc, ok := conn.(*serverConn); ok {
+		return sc.req
+	}
+	return nil
+}
+
+// framedBody enforces the framing of a request body: each read must make
+// progress within bodyReadTimeout, and a body that ends before its declared
+// length is an error rather than a silent EOF. Any failure leaves the
+// connection out of step with the client, so it is marked for closing.
+type framedBody struct {
+	body io.ReadCloser
+	conn *serverConn
+	// remaining is the number of bytes still expected, or -1 for a chunked
+	// body, whose decoder detects truncation itself.
+	remaining int64
+	// read counts the body bytes delivered so far.
+	read int64
+}
+
+func (b *framedBody) Read(p []byte) (int, error) {
+	b.conn.SetReadDeadline(time.Now().Add(bodyReadTimeout))
+	n, err := b.body.Read(p)
+	b.conn.SetReadDeadline(time.Time{})
+	b.read += int64(n)
+
+	if b.remaining >= 0 {
+		b.remaining -= int64(n)
+		if err == io.EOF && b.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err == io.EOF {
+		b.conn.watchForHangup()
+	}
+	if err != nil && err != io.EOF {
+		b.conn.closing = true
+		err = fmt.Errorf("%w: %w", errIncompleteBody, err)
+	}
+	return n, err
+}
+
+func (b *framedBody) Close() error {
+	return b.body.Close()
+}
+
+// drain discards what the handler left unread so that the next request
+// starts where the client expects. It returns false if that isn't possible
+// cheaply.
+func (b *framedBody) drain() bool {
+	if b.remaining == 0 {
+		return true
+	}
+	n, err := io.CopyN(io.Discard, b, maxBodyDrain+1)
+	return err == io.EOF && n <= maxBodyDrain
+}
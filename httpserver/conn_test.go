@@ -0,0 +1,245 @@
+package httpserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHangupCancelsRequest(t *testing.T) {
+	addr := startTestServer(t)
+	tracker := connections
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET /drip?numbytes=100&duration=60 HTTP/1.1\r\nHost: a\r\n\r\n")
+	waitFor(t, "the request to start", func() bool { return tracker.busyConns() == 1 })
+	conn.Close()
+
+	// The drip would otherwise take a minute.
+	waitFor(t, "the handler to give up", func() bool { return tracker.busyConns() == 0 })
+}
+
+func TestRequestTimeout(t *testing.T) {
+	addr := startTestServer(t, "-request-timeout", "100ms")
+
+	start := time.Now()
+	status, _, err := roundTrip(addr, "GET /drip?delay=10 HTTP/1.1\r\nHost: a\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v", elapsed)
+	}
+
+	status, _, err = roundTrip(addr, "GET /echo/quick HTTP/1.1\r\nHost: a\r\n\r\n")
+	if err != nil || status != http.StatusOK {
+		t.Errorf("quick request: got %d, %v", status, err)
+	}
+}
+
+// TestNextRequestDuringResponse checks that a request arriving while the
+// previous one is being served, and so read by the hangup watcher, isn't
+// lost.
+func TestNextRequestDuringResponse(t *testing.T) {
+	addr := startTestServer(t)
+	tracker := connections
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /drip?numbytes=2&duration=0.2 HTTP/1.1\r\nHost: a\r\n\r\n")
+	waitFor(t, "the request to start", func() bool { return tracker.busyConns() == 1 })
+	io.WriteString(conn, "GET /echo/next HTTP/1.1\r\nHost: a\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"**", "next"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("got body %q, want %q", body, want)
+		}
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	openConns := func(addr string, n int) []net.Conn {
+		var conns []net.Conn
+		for i := 0; i < n; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns = append(conns, conn)
+		}
+		return conns
+	}
+	// refused reports whether the server closed conn without answering.
+	refused := func(conn net.Conn) bool {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+		_, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		return err != nil
+	}
+
+	addr := startTestServer(t, "-max-conns-per-ip", "2")
+	conns := openConns(addr, 2)
+	waitFor(t, "both connections to be accepted", func() bool {
+		connections.mu.Lock()
+		defer connections.mu.Unlock()
+		return connections.perIP["127.0.0.1"] == 2
+	})
+	if !refused(openConns(addr, 1)[0]) {
+		t.Error("third connection was served")
+	}
+	for _, conn := range conns {
+		if refused(conn) {
+			t.Error("connection within the limit was refused")
+		}
+	}
+	conns[0].Close()
+	waitFor(t, "the closed connection to be released", func() bool {
+		connections.mu.Lock()
+		defer connections.mu.Unlock()
+		return connections.perIP["127.0.0.1"] == 1
+	})
+	if refused(openConns(addr, 1)[0]) {
+		t.Error("connection refused after another was closed")
+	}
+
+	addr = startTestServer(t, "-max-conns-per-ip", "1", "-trusted-proxies", "127.0.0.1/32")
+	for _, conn := range openConns(addr, 3) {
+		if refused(conn) {
+			t.Error("connection from a trusted proxy was refused")
+		}
+	}
+}
+
+func TestStreamThenReuse(t *testing.T) {
+	addr := startTestServer(t)
+	saved := writeTimeout
+	writeTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { writeTimeout = saved })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// The second response goes out well after the stream's write
+	// deadline would have passed.
+	for i, target := range []string{"/drip?numbytes=2&duration=0", "/echo/next"} {
+		if i > 0 {
+			time.Sleep(3 * writeTimeout)
+		}
+		io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: a\r\n\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		io.ReadAll(resp.Body)
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: status = %d", target, resp.StatusCode)
+		}
+	}
+}
+
+func TestRequestBodyFraming(t *testing.T) {
+	addr := startTestServer(t)
+	tests := []struct {
+		name string
+		// raw is sent before the write side is shut, and next right after
+		// it on the same connection unless it is empty.
+		raw, next string
+		status    int
+		reused    bool
+	}{
+		{"unread body drained", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", "GET /echo/next HTTP/1.1\r\nHost: a\r\n\r\n", 200, true},
+		{"unread chunked body drained", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", "GET /echo/next HTTP/1.1\r\nHost: a\r\n\r\n", 200, true},
+		{"unread body too long to drain", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 300000\r\n\r\n" + strings.Repeat("x", 300000), "", 200, false},
+		{"truncated upload", "POST /files/framing HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\nhello", "", 400, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				io.WriteString(conn, tt.raw+tt.next)
+				if tt.next == "" {
+					conn.(*net.TCPConn).CloseWrite()
+				}
+			}()
+
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if !tt.reused {
+				// Closing with body unread may reset the connection
+				// rather than end it cleanly.
+				if _, err := reader.ReadByte(); err == nil {
+					t.Error("connection left open")
+				}
+				return
+			}
+			resp, err = http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("second request: %v", err)
+			}
+			if body, _ := io.ReadAll(resp.Body); string(body) != "next" {
+				t.Errorf("second response = %q", body)
+			}
+		})
+	}
+}
+
+func TestBodyErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{os.ErrDeadlineExceeded, http.StatusRequestTimeout},
+		{errIncompleteBody, http.StatusBadRequest},
+		{&http.MaxBytesError{Limit: 1}, http.StatusRequestEntityTooLarge},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if status := bodyErrorStatus(tt.err); status != tt.status {
+			t.Errorf("bodyErrorStatus(%v) = %d, want %d", tt.err, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contentIndexName is the blob holding a contentStorage's name index. It
+// can't be mistaken for a blob, whose names are hex digests.
+const contentIndexName = "index"
+
+// errCorruptFile is returned when stored contents no longer match their
+// digest.
+var errCorruptFile = errors.New("stored contents don't match their digest")
+
+// contentStorage is the -content-addressed layer over another Storage: each
+// distinct content is stored once, as a blob named by its SHA-256 in hex,
+// and an index maps file names to blobs. Reads are checked against the
+// digest, and a blob is removed when no name refers to it any more.
+type contentStorage struct {
+	blobs Storage
+	// spool is the local directory where Write keeps uploads while it
+	// learns their digest.
+	spool string
+
+	mu    sync.Mutex
+	index map[string]contentEntry
+	// pending counts the writes of each digest not yet in the index, whose
+	// blobs mustn't be released under them.
+	pending map[string]int
+}
+
+// contentEntry is what the index records for a name.
+type contentEntry struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// spoolPrefix starts the names of the files in a contentStorage's spool
+// directory.
+const spoolPrefix = ".spool-"
+
+// openContentStorage loads the index kept in blobs. Uploads are spooled in
+// the spool directory, which is created when first needed.
+func openContentStorage(blobs Storage, spool string) (*contentStorage, error) {
+	s := &contentStorage{blobs: blobs, spool: spool, index: make(map[string]contentEntry), pending: make(map[string]int)}
+	contentSpools = append(contentSpools, spool)
+	f, _, err := blobs.Open(contentIndexName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&s.index); err != nil {
+		return nil, fmt.Errorf("reading content index: %w", err)
+	}
+	return s, nil
+}
+
+// saveIndex writes out the index; s.mu must be held.
+func (s *contentStorage) saveIndex() error {
+	data, err := json.Marshal(s.index)
+	if err != nil {
+		return err
+	}
+	_, err = s.blobs.Write(contentIndexName, bytes.NewReader(data))
+	return err
+}
+
+func (s *contentStorage) lookup(name string) (contentEntry, error) {
+	if !validFileName(name) {
+		return contentEntry{}, fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index[name]
+	if !ok {
+		return contentEntry{}, fmt.Errorf("file %q: %w", name, fs.ErrNotExist)
+	}
+	return entry, nil
+}
+
+func (s *contentStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	entry, err := s.lookup(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	f, err := s.openBlob(entry.SHA256)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return f, FileInfo{Name: name, Size: entry.Size, ModTime: entry.ModTime}, nil
+}
+
+// openBlob opens the blob with the given hex digest, checking it as it is
+// read.
+func (s *contentStorage) openBlob(digest string) (io.ReadSeekCloser, error) {
+	f, _, err := s.blobs.Open(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{ReadSeekCloser: f, digest: digest, hash: sha256.New()}, nil
+}
+
+func (s *contentStorage) Stat(name string) (FileInfo, error) {
+	entry, err := s.lookup(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: entry.Size, ModTime: entry.ModTime}, nil
+}
+
+// Write spools r to a temporary file to learn its digest, then stores it
+// as a blob unless a blob with that digest is already there.
+func (s *contentStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	if !validFileName(name) {
+		return FileInfo{}, fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+
+	if err := os.MkdirAll(s.spool, 0755); err != nil {
+		return FileInfo{}, fmt.Errorf("creating spool directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.spool, spoolPrefix+"*")
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, digest), r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	sum := hex.EncodeToString(digest.Sum(nil))
+
+	s.mu.Lock()
+	s.pending[sum]++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.pending[sum]--; s.pending[sum] == 0 {
+			delete(s.pending, sum)
+		}
+		s.mu.Unlock()
+	}()
+
+	if _, err := s.blobs.Stat(sum); errors.Is(err, fs.ErrNotExist) {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return FileInfo{}, err
+		}
+		if _, err := s.blobs.Write(sum, tmp); err != nil {
+			return FileInfo{}, err
+		}
+	} else if err != nil {
+		return FileInfo{}, err
+	}
+
+	entry := contentEntry{SHA256: sum, Size: size, ModTime: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, replaced := s.index[name]
+	s.index[name] = entry
+	if err := s.saveIndex(); err != nil {
+		if replaced {
+			s.index[name] = old
+		} else {
+			delete(s.index, name)
+		}
+		return FileInfo{}, err
+	}
+	if replaced {
+		s.release(old.SHA256)
+	}
+	return FileInfo{Name: name, Size: size, ModTime: entry.ModTime}, nil
+}
+
+func (s *contentStorage) Delete(name string) error {
+	if !validFileName(name) {
+		return fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.index[name]
+	if !ok {
+		return fmt.Errorf("file %q: %w", name, fs.ErrNotExist)
+	}
+	delete(s.index, name)
+	if err := s.saveIndex(); err != nil {
+		s.index[name] = entry
+		return err
+	}
+	s.release(entry.SHA256)
+	return nil
+}
+
+// release removes the blob with the given digest unless some name still
+// refers to it or a write of it is under way; s.mu must be held. A blob
+// that can't be removed is only wasted space.
+func (s *contentStorage) release(digest string) {
+	if s.pending[digest] > 0 {
+		return
+	}
+	for _, entry := range s.index {
+		if entry.SHA256 == digest {
+			return
+		}
+	}
+	s.blobs.Delete(digest)
+}
+
+func (s *contentStorage) List() ([]FileInfo, error) {
+	s.mu.Lock()
+	files := make([]FileInfo, 0, len(s.index))
+	for name, entry := range s.index {
+		files = append(files, FileInfo{Name: name, Size: entry.Size, ModTime: entry.ModTime})
+	}
+	s.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// verifyingReader checks a blob against its digest when it has been read
+// from start to end, failing the final read if they differ. Seeking
+// anywhere but the start gives up on the check.
+type verifyingReader struct {
+	io.ReadSeekCloser
+	digest string
+	hash   hash.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+		if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.digest {
+			return n, fmt.Errorf("blob %s: %w", r.digest, errCorruptFile)
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if pos == 0 && r.hash != nil {
+		r.hash.Reset()
+	} else {
+		r.hash = nil
+	}
+	return pos, err
+}
+
+// validDigest reports whether s is a SHA-256 digest in lowercase hex.
+func validDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// namesOf returns the names whose contents have the given digest, sorted.
+func (s *contentStorage) namesOf(digest string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name, entry := range s.index {
+		if entry.SHA256 == digest {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleBlob serves GET /blobs/<sha256>: a file by the digest of its
+// contents rather than its name. It only exists with -content-addressed.
+// The caller must pass the route authentication and policies of every
+// /files/ name holding the contents, so that a blob is no easier to read
+// than the files it belongs to. The contents at a digest never change, so
+// they may be cached forever, by shared caches too if no check applies.
+func handleBlob(conn net.Conn, req *http.Request) {
+	store := contentLayer(virtualHost(req).storage)
+	digest := strings.TrimPrefix(req.URL.Path, "/blobs/")
+	if store == nil || !validDigest(digest) {
+		handleNotFound(conn)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": "GET, HEAD"})
+		return
+	}
+	names := store.namesOf(digest)
+	if len(names) == 0 {
+		handleNotFound(conn)
+		return
+	}
+	public := true
+	for _, name := range names {
+		file := req.Clone(req.Context())
+		file.URL.Path, file.URL.RawPath = "/files/"+name, ""
+		if matchRouteAuth(file) != nil || slices.ContainsFunc(config.Policies, func(p *Policy) bool { return p.matches(file) }) {
+			public = false
+		}
+		file, ok := requireRouteAuth(conn, file)
+		if !ok || !checkPolicy(conn, file) {
+			return
+		}
+	}
+
+	headers := map[string]string{
+		"ETag":          `"` + digest + `"`,
+		"Cache-Control": "public, max-age=31536000, immutable",
+	}
+	if !public {
+		headers["Cache-Control"] = "private, max-age=31536000, immutable"
+	}
+	if notModified(req, http.Header{"Etag": {headers["ETag"]}}) {
+		sendResponse(conn, http.StatusNotModified, nil, headers)
+		return
+	}
+
+	f, err := store.openBlob(digest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			handleNotFound(conn)
+		} else {
+			sendError(conn, fmt.Errorf("opening blob: %w", err))
+		}
+		return
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		sendError(conn, fmt.Errorf("reading blob: %w", err))
+		return
+	}
+
+	headers["Content-Type"] = "application/octet-stream"
+	sendResponse(conn, http.StatusOK, content, headers)
+}
@@ -0,0 +1,144 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlobFollowsFilePolicy(t *testing.T) {
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal([]map[string]any{{"name": "ann", "password": hash, "roles": []string{"reader"}}})
+	if err := os.WriteFile(usersPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-content-addressed", "-users", usersPath)
+	policy := &Policy{Prefix: "/files/secret", Methods: []string{"GET"}, Require: []string{"reader"}}
+	if err := policy.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	config.Policies = []*Policy{policy}
+	client := testClient()
+
+	for name, content := range map[string]string{"secret": "top secret", "public": "hello"} {
+		resp, err := client.Post("http://"+addr+"/files/"+name, "text/plain", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := testClient().Post("http://"+addr+"/auth/login", "application/json", strings.NewReader(`{"username":"ann","password":"hunter2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens tokenResponse
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	resp.Body.Close()
+
+	blob := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return "/blobs/" + hex.EncodeToString(sum[:])
+	}
+	tests := []struct {
+		path, token  string
+		status       int
+		cacheControl string
+	}{
+		{"/files/secret", "", 401, ""},
+		{blob("top secret"), "", 401, ""},
+		{blob("top secret"), tokens.AccessToken, 200, "private, max-age=31536000, immutable"},
+		{blob("hello"), "", 200, "public, max-age=31536000, immutable"},
+		{blob("never stored"), "", 404, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.cacheControl != "" && resp.Header.Get("Cache-Control") != tt.cacheControl {
+			t.Errorf("GET %s Cache-Control = %q, want %q", tt.path, resp.Header.Get("Cache-Control"), tt.cacheControl)
+		}
+	}
+
+	// The ETag of a file doesn't give away the address of its blob.
+	resp, err = client.Get("http://" + addr + "/files/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if etag := resp.Header.Get("ETag"); etag == "" || strings.Contains(blob("hello"), strings.Trim(etag, `"`)) {
+		t.Errorf("ETag of /files/public = %q, the digest of its contents", etag)
+	}
+}
+
+func TestContentStorage(t *testing.T) {
+	blobs := newMemoryStorage(1 << 20)
+	s, err := openContentStorage(blobs, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := s.Write(name, strings.NewReader("same")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := sha256.Sum256([]byte("same"))
+	digest := hex.EncodeToString(sum[:])
+	if stored, _ := blobs.List(); len(stored) != 2 || stored[0].Name != digest || stored[1].Name != contentIndexName {
+		t.Errorf("blobs = %+v, want one blob and the index", stored)
+	}
+
+	// Contents that no longer match their digest fail the read.
+	if _, err := blobs.Write(digest, strings.NewReader("evil")); err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := s.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(f); !errors.Is(err, errCorruptFile) {
+		t.Errorf("reading a tampered blob = %v, want errCorruptFile", err)
+	}
+	f.Close()
+	if _, err := blobs.Write(digest, strings.NewReader("same")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index survives reopening, and the blob goes with the last name.
+	if s, err = openContentStorage(blobs, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobs.Stat(digest); err != nil {
+		t.Errorf("blob removed while b.txt still holds it: %v", err)
+	}
+	if err := s.Delete("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobs.Stat(digest); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("blob kept once no name holds it: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// cookieOptions are the attributes of a cookie set by this server.
+type cookieOptions struct {
+	Path string
+	// MaxAge is how long the cookie lives. Zero makes a session cookie and
+	// a negative value deletes the cookie.
+	MaxAge   time.Duration
+	HttpOnly bool
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// newCookie builds a cookie for sendResponse. Unlike http.Cookie.String,
+// which silently drops a cookie with an invalid name and rewrites invalid
+// values, it reports what is wrong so the caller can reject the request.
+func newCookie(name, value string, opts cookieOptions) (*http.Cookie, error) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     opts.Path,
+		HttpOnly: opts.HttpOnly,
+		Secure:   opts.Secure,
+		SameSite: opts.SameSite,
+	}
+	switch {
+	case opts.MaxAge < 0:
+		cookie.MaxAge = -1
+	case opts.MaxAge > 0:
+		// Max-Age is in whole seconds; round up so a short lifetime
+		// doesn't become "delete now".
+		cookie.MaxAge = int((opts.MaxAge + time.Second - 1) / time.Second)
+	}
+
+	if err := cookie.Valid(); err != nil {
+		return nil, err
+	}
+	if cookie.SameSite == http.SameSiteNoneMode && !cookie.Secure {
+		// Browsers reject SameSite=None without Secure.
+		return nil, fmt.Errorf("http: cookie %q with SameSite=None must be Secure", name)
+	}
+	return cookie, nil
+}
+
+// defaultCookieOptions are the attributes used by the cookie endpoints.
+// Secure is set when the client reached us over HTTPS, possibly through a
+// TLS-terminating proxy.
+func defaultCookieOptions(conn net.Conn, req *http.Request) cookieOptions {
+	return cookieOptions{
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   requestScheme(conn, req) == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// requestCookie returns the value of the named cookie, using the same
+// first-occurrence rule as requestCookies.
+func requestCookie(req *http.Request, name string) (string, bool) {
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == name {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// requestCookies returns the cookies sent with req keyed by name. When a
+// name is repeated the first occurrence wins, matching how browsers order
+// cookies from most to least specific path.
+func requestCookies(req *http.Request) map[string]string {
+	cookies := make(map[string]string)
+	for _, cookie := range req.Cookies() {
+		if _, seen := cookies[cookie.Name]; !seen {
+			cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return cookies
+}
+
+func handleCookies(conn net.Conn, req *http.Request) {
+	sendJSON(conn, http.StatusOK, map[string]any{"cookies": requestCookies(req)}, true)
+}
+
+// handleSetCookies sets a cookie for every query parameter and then sends
+// the client back to /cookies so the result can be inspected.
+func handleSetCookies(conn net.Conn, req *http.Request) {
+	var cookies []*http.Cookie
+	for _, name := range sortedKeys(req.URL.Query()) {
+		cookie, err := newCookie(name, req.URL.Query().Get(name), defaultCookieOptions(conn, req))
+		if err != nil {
+			sendJSON(conn, http.StatusBadRequest, map[string]string{"error": err.Error()}, false)
+			return
+		}
+		cookies = append(cookies, cookie)
+	}
+	sendResponse(conn, http.StatusFound, nil, map[string]string{"Location": "/cookies"}, cookies...)
+}
+
+// handleDeleteCookies expires every cookie named in the query string.
+func handleDeleteCookies(conn net.Conn, req *http.Request) {
+	opts := defaultCookieOptions(conn, req)
+	opts.MaxAge = -1
+
+	var cookies []*http.Cookie
+	for _, name := range sortedKeys(req.URL.Query()) {
+		cookie, err := newCookie(name, "", opts)
+		if err != nil {
+			sendJSON(conn, http.StatusBadRequest, map[string]string{"error": err.Error()}, false)
+			return
+		}
+		cookies = append(cookies, cookie)
+	}
+	sendResponse(conn, http.StatusFound, nil, map[string]string{"Location": "/cookies"}, cookies...)
+}
+
+func sortedKeys(values url.Values) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,41 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultCSP is the Content-Security-Policy of HTML responses unless -csp
+// says otherwise. It lets pages load what this server serves, and the
+// inline styles and scripts of our templates that carry the nonce.
+const defaultCSP = "default-src 'self'; style-src 'self' 'nonce-{nonce}'; script-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'none'; frame-ancestors 'none'"
+
+// cspNoncePlaceholder stands in -csp for the nonce of each response.
+const cspNoncePlaceholder = "{nonce}"
+
+// newCSPNonce returns a fresh nonce for one response. It is base64url, so
+// that templates can put it in attributes without it being escaped.
+func newCSPNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// setCSP adds the -csp policy to the header of an HTML response, with
+// nonce in place of the placeholder. A policy the handler set itself is
+// left alone.
+func setCSP(header http.Header, nonce string) {
+	if config.CSP == "" || header.Get("Content-Security-Policy") != "" {
+		return
+	}
+	header.Set("Content-Security-Policy", strings.ReplaceAll(config.CSP, cspNoncePlaceholder, nonce))
+}
+
+// isHTML reports whether a response with the given header is an HTML page.
+func isHTML(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/html"
+}
@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// csrfToken returns the session's synchronizer token, creating one if the
+// session doesn't have it yet. Clients fetch it from /session and send it
+// back as an X-CSRF-Token header or a csrf_token form field.
+func csrfToken(sess *session) (string, error) {
+	if sess.data.CSRFToken == "" {
+		token, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		sess.data.CSRFToken = token
+		sess.changed = true
+	}
+	return sess.data.CSRFToken, nil
+}
+
+// checkCSRF refuses a state-changing request that rides on a session
+// cookie without also presenting the session's CSRF token. A browser sends
+// the cookie along with a forged cross-site form post, but the page that
+// built the form can't read the token. Requests without a live session
+// aren't authenticated by a cookie and so are left alone. It sends a 403
+// and returns false when the request is refused.
+func checkCSRF(conn net.Conn, req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	if _, ok := requestCookie(req, sessionCookieName); !ok {
+		return true
+	}
+	sess := loadSession(req)
+	if sess.isNew {
+		return true
+	}
+
+	token := req.Header.Get(csrfHeader)
+	if token == "" && isForm(req) {
+		var err error
+		if token, err = formCSRFToken(req); err != nil {
+			sendJSON(conn, formErrorStatus(err), map[string]string{"error": err.Error()}, false)
+			return false
+		}
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sess.data.CSRFToken)) != 1 {
+		log.Printf("Refusing %s %s from %s: missing or invalid CSRF token", req.Method, req.URL.Path, req.RemoteAddr)
+		sendJSON(conn, http.StatusForbidden, map[string]string{"error": "missing or invalid CSRF token"}, false)
+		return false
+	}
+	return true
+}
+
+// formCSRFToken reads the csrf_token field from an urlencoded body and
+// puts the body back so the handler can still read it.
+func formCSRFToken(req *http.Request) (string, error) {
+	if req.ContentLength > maxFormSize {
+		return "", errFormTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxFormSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxFormSize {
+		return "", errFormTooLarge
+	}
+	req.Body = multiReadCloser(bytes.NewReader(body), req.Body)
+
+	form, err := decodeForm(req.Header.Get("Content-Type"), body)
+	if err != nil {
+		return "", err
+	}
+	return form.String(csrfFormField, ""), nil
+}
@@ -0,0 +1,431 @@
+package httpserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storageDBName is the file in -directory that -storage=db keeps the files
+// of every host in.
+const storageDBName = "files.db"
+
+// storageDB is the database shared by the storage of every host with
+// -storage=db.
+var storageDB *fileDB
+
+// openStorageDB opens the database for -storage=db. A process started by
+// Restart shares the file with the one it replaces until it is ready, so
+// it leaves compacting it to the next fresh start.
+func openStorageDB() error {
+	storageDB = nil
+	if config.Storage != "db" {
+		return nil
+	}
+	_, restarted := os.LookupEnv(listenerFDEnv)
+	db, err := openFileDB(filepath.Join(config.DataDir, storageDBName), !restarted)
+	if err != nil {
+		return err
+	}
+	storageDB = db
+	return nil
+}
+
+// fileDB keeps files in a single append-only file. Each write appends a
+// record holding the whole file and is synced before it takes effect, so
+// a crash loses at most the write in progress, which is cut off the next
+// time the file is opened. Where the latest record of each file starts is
+// kept in memory, so metadata is looked up without reading the file, and a
+// record is never changed once written, so readers need no lock.
+type fileDB struct {
+	path string
+	f    *os.File
+
+	mu      sync.RWMutex
+	index   map[string]dbRecord
+	size    int64 // where the next record goes
+	garbage int64 // bytes of replaced and deleted records
+}
+
+// dbRecord locates the record of a file in a fileDB.
+type dbRecord struct {
+	offset  int64 // where the record starts
+	length  int64 // of the whole record
+	size    int64 // of the file's contents, which end the record
+	modTime time.Time
+}
+
+func (r dbRecord) data() int64 { return r.offset + r.length - r.size }
+
+// The file starts with dbMagic, followed by records. A record is a header
+// of an op, the lengths of the key and the data, the time it was written
+// and a CRC-32C of everything else in it, then the key and the data.
+const (
+	dbMagic      = "HTTPDB\x00\x01"
+	dbHeaderSize = 1 + 2 + 8 + 8 + 4
+
+	dbPut    = 1
+	dbDelete = 2
+)
+
+var dbCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// openFileDB opens the database at path, creating it if it doesn't exist.
+// If compact is set and at least half of the file is taken by replaced and
+// deleted files, it is rewritten without them.
+func openFileDB(path string, compact bool) (*fileDB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	db := &fileDB{path: path, f: f, index: make(map[string]dbRecord)}
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if compact && db.garbage > 0 && db.garbage >= db.size/2 {
+		if err := db.compact(); err != nil {
+			db.f.Close()
+			return nil, fmt.Errorf("compacting %s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// load reads the index from the file. A broken record at the end of the
+// file was being written when the server stopped and is cut off; one
+// anywhere else means the file is damaged, and loading fails.
+func (db *fileDB) load() error {
+	info, err := db.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := db.f.WriteAt([]byte(dbMagic), 0); err != nil {
+			return err
+		}
+		db.size = int64(len(dbMagic))
+		return db.f.Sync()
+	}
+	magic := make([]byte, len(dbMagic))
+	if _, err := db.f.ReadAt(magic, 0); err != nil || string(magic) != dbMagic {
+		return errors.New("not a file database")
+	}
+
+	end := info.Size()
+	offset := int64(len(dbMagic))
+	r := bufio.NewReader(io.NewSectionReader(db.f, offset, end-offset))
+	for offset < end {
+		op, key, rec, err := readDBRecord(r, offset)
+		if err != nil {
+			if rec.length > 0 && offset+rec.length < end {
+				return fmt.Errorf("damaged record at offset %d: %w", offset, err)
+			}
+			log.Printf("Cutting off %d bytes of an unfinished write at the end of %s", end-offset, db.path)
+			if err := db.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		db.apply(op, key, rec)
+		offset += rec.length
+	}
+	db.size = offset
+	return nil
+}
+
+// readDBRecord reads the record starting at offset from r. When the
+// header could be read, the returned record's length is set even with an
+// error.
+func readDBRecord(r io.Reader, offset int64) (op byte, key string, rec dbRecord, err error) {
+	header := make([]byte, dbHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", dbRecord{}, err
+	}
+	keyLen := int64(binary.LittleEndian.Uint16(header[1:]))
+	size := int64(binary.LittleEndian.Uint64(header[3:]))
+	if size < 0 {
+		return 0, "", dbRecord{}, errors.New("invalid size")
+	}
+	rec = dbRecord{
+		offset:  offset,
+		length:  dbHeaderSize + keyLen + size,
+		size:    size,
+		modTime: time.Unix(0, int64(binary.LittleEndian.Uint64(header[11:]))),
+	}
+	name := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return 0, "", rec, err
+	}
+	crc := crc32.New(dbCRCTable)
+	if _, err := io.CopyN(crc, r, size); err != nil {
+		return 0, "", rec, err
+	}
+	sum := crc32.Update(crc.Sum32(), dbCRCTable, header[:dbHeaderSize-4])
+	if sum = crc32.Update(sum, dbCRCTable, name); sum != binary.LittleEndian.Uint32(header[dbHeaderSize-4:]) {
+		return 0, "", rec, errors.New("checksum mismatch")
+	}
+	op = header[0]
+	if op != dbPut && op != dbDelete {
+		return 0, "", rec, fmt.Errorf("unknown op %d", op)
+	}
+	return op, string(name), rec, nil
+}
+
+// apply updates the index with a record. The caller holds db.mu or has
+// db to itself.
+func (db *fileDB) apply(op byte, key string, rec dbRecord) {
+	if old, ok := db.index[key]; ok {
+		db.garbage += old.length
+	}
+	switch op {
+	case dbPut:
+		db.index[key] = rec
+	case dbDelete:
+		delete(db.index, key)
+		db.garbage += rec.length
+	}
+}
+
+// lookup returns the record of key.
+func (db *fileDB) lookup(key string) (dbRecord, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rec, ok := db.index[key]
+	return rec, ok
+}
+
+// put stores everything read from r under key. The data is spooled to a
+// temporary file beside the database first, so that a slow upload doesn't
+// hold up other writes.
+func (db *fileDB) put(key string, r io.Reader) (dbRecord, error) {
+	spool, err := os.CreateTemp(filepath.Dir(db.path), "."+filepath.Base(db.path)+".upload-*")
+	if err != nil {
+		return dbRecord{}, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	crc := crc32.New(dbCRCTable)
+	size, err := io.Copy(io.MultiWriter(spool, crc), r)
+	if err != nil {
+		return dbRecord{}, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return dbRecord{}, err
+	}
+	return db.append(dbPut, key, io.LimitReader(spool, size), size, crc.Sum32())
+}
+
+// remove deletes key, returning fs.ErrNotExist if there's no such file.
+func (db *fileDB) remove(key string) error {
+	_, err := db.append(dbDelete, key, strings.NewReader(""), 0, 0)
+	return err
+}
+
+// append writes a record at the end of the file, syncs it and adds it to
+// the index. On failure the file is cut back to where it was, as far as
+// that can be done. Deleting a key that isn't there fails with
+// fs.ErrNotExist.
+func (db *fileDB) append(op byte, key string, data io.Reader, size int64, dataCRC uint32) (dbRecord, error) {
+	if len(key) > 1<<16-1 {
+		return dbRecord{}, fmt.Errorf("key %q: %w", key, fs.ErrInvalid)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.index[key]; op == dbDelete && !ok {
+		return dbRecord{}, fs.ErrNotExist
+	}
+
+	rec := dbRecord{offset: db.size, length: dbHeaderSize + int64(len(key)) + size, size: size, modTime: time.Now()}
+	head := make([]byte, dbHeaderSize, dbHeaderSize+len(key))
+	head[0] = op
+	binary.LittleEndian.PutUint16(head[1:], uint16(len(key)))
+	binary.LittleEndian.PutUint64(head[3:], uint64(size))
+	binary.LittleEndian.PutUint64(head[11:], uint64(rec.modTime.UnixNano()))
+	sum := crc32.Update(dataCRC, dbCRCTable, head[:dbHeaderSize-4])
+	binary.LittleEndian.PutUint32(head[dbHeaderSize-4:], crc32.Update(sum, dbCRCTable, []byte(key)))
+	head = append(head, key...)
+
+	w := io.NewOffsetWriter(db.f, rec.offset)
+	_, err := w.Write(head)
+	if err == nil {
+		_, err = io.Copy(w, data)
+	}
+	if err == nil {
+		err = db.f.Sync()
+	}
+	if err != nil {
+		db.f.Truncate(rec.offset)
+		return dbRecord{}, err
+	}
+	db.apply(op, key, rec)
+	db.size += rec.length
+	return rec, nil
+}
+
+// list returns the records of the keys starting with prefix, by the rest
+// of the key.
+func (db *fileDB) list(prefix string) map[string]dbRecord {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	found := make(map[string]dbRecord)
+	for key, rec := range db.index {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			found[rest] = rec
+		}
+	}
+	return found
+}
+
+// compact rewrites the database with only the latest record of each file,
+// into a temporary file that then replaces it. It is only called before
+// the database is in use.
+func (db *fileDB) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), "."+filepath.Base(db.path)+".upload-*")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.WriteString(dbMagic); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	index := make(map[string]dbRecord, len(keys))
+	offset := int64(len(dbMagic))
+	for _, key := range keys {
+		rec := db.index[key]
+		if _, err := io.Copy(tmp, io.NewSectionReader(db.f, rec.offset, rec.length)); err != nil {
+			return err
+		}
+		rec.offset = offset
+		index[key] = rec
+		offset += rec.length
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), db.path); err != nil {
+		return err
+	}
+	committed = true
+
+	log.Printf("Compacted %s from %d to %d bytes", db.path, db.size, offset)
+	db.f.Close()
+	db.f, db.index, db.size, db.garbage = tmp, index, offset, 0
+	return nil
+}
+
+// dbStorage is the Storage of one host in the -storage=db database, which
+// keeps its files under keys starting with the host's folder.
+type dbStorage struct {
+	db     *fileDB
+	prefix string
+}
+
+func newDBStorage(db *fileDB, folder string) *dbStorage {
+	prefix := ""
+	if folder != "" {
+		prefix = folder + "/"
+	}
+	return &dbStorage{db: db, prefix: prefix}
+}
+
+func (s *dbStorage) key(name string) (string, error) {
+	if !validFileName(name) {
+		return "", fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	return s.prefix + name, nil
+}
+
+func (s *dbStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	info, rec, err := s.stat(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return nopSeekCloser{io.NewSectionReader(s.db.f, rec.data(), rec.size)}, info, nil
+}
+
+func (s *dbStorage) Stat(name string) (FileInfo, error) {
+	info, _, err := s.stat(name)
+	return info, err
+}
+
+func (s *dbStorage) stat(name string) (FileInfo, dbRecord, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return FileInfo{}, dbRecord{}, err
+	}
+	rec, ok := s.db.lookup(key)
+	if !ok {
+		return FileInfo{}, dbRecord{}, fmt.Errorf("file %q: %w", name, fs.ErrNotExist)
+	}
+	return dbFileInfo(name, rec), rec, nil
+}
+
+func (s *dbStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	rec, err := s.db.put(key, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return dbFileInfo(name, rec), nil
+}
+
+func (s *dbStorage) Delete(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.remove(key); err != nil {
+		return fmt.Errorf("file %q: %w", name, err)
+	}
+	return nil
+}
+
+func (s *dbStorage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	for name, rec := range s.db.list(s.prefix) {
+		if validFileName(name) {
+			files = append(files, dbFileInfo(name, rec))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func dbFileInfo(name string, rec dbRecord) FileInfo {
+	return FileInfo{Name: name, Size: rec.size, ModTime: rec.modTime}
+}
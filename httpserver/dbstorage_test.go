@@ -0,0 +1,144 @@
+package httpserver
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readDBFile(t *testing.T, s Storage, name string) string {
+	t.Helper()
+	f, _, err := s.Open(name)
+	if err != nil {
+		t.Fatalf("opening %s: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDBStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), storageDBName)
+	db, err := openFileDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, other := newDBStorage(db, ""), newDBStorage(db, "example.com")
+	for _, w := range []struct {
+		s             Storage
+		name, content string
+	}{{files, "a.txt", "first"}, {files, "b.txt", "bee"}, {other, "a.txt", "other host"}} {
+		if _, err := w.s.Write(w.name, strings.NewReader(w.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A reader keeps the version it opened while the file is replaced.
+	old, _, err := files.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := files.Write("a.txt", strings.NewReader("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(old); string(data) != "first" {
+		t.Errorf("reader opened before the write got %q", data)
+	}
+	if info.Size != 6 || readDBFile(t, files, "a.txt") != "second" {
+		t.Errorf("after replacing a.txt: %+v, %q", info, readDBFile(t, files, "a.txt"))
+	}
+	if err := files.Delete("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Delete("b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleting b.txt twice = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := files.Write("../x", strings.NewReader("")); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("writing ../x = %v, want fs.ErrInvalid", err)
+	}
+
+	// Each host lists only its own files.
+	list, _ := files.List()
+	if len(list) != 1 || list[0].Name != "a.txt" || list[0].Size != 6 {
+		t.Errorf("default host lists %+v", list)
+	}
+
+	// A write cut short by a crash is dropped when the file is reopened,
+	// and the space taken by old versions is reclaimed.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\x01\x05\x00garbage")
+	f.Close()
+	before, _ := os.Stat(path)
+	db, err = openFileDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, other = newDBStorage(db, ""), newDBStorage(db, "example.com")
+	if got := readDBFile(t, files, "a.txt"); got != "second" {
+		t.Errorf("a.txt after reopening = %q", got)
+	}
+	if got := readDBFile(t, other, "a.txt"); got != "other host" {
+		t.Errorf("example.com's a.txt after reopening = %q", got)
+	}
+	if _, err := files.Stat("b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleted b.txt is back: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("database grew from %d to %d bytes on reopening", before.Size(), after.Size())
+	}
+	if _, err := files.Write("c.txt", strings.NewReader("sea")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFileDB(path, false); err != nil {
+		t.Errorf("reopening after compaction: %v", err)
+	}
+
+	// Damage before the end of the file is not mistaken for an unfinished
+	// write.
+	data, _ := os.ReadFile(path)
+	data[len(dbMagic)+dbHeaderSize+len("a.txt")] ^= 1
+	os.WriteFile(path, data, 0644)
+	if _, err := openFileDB(path, false); err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Errorf("opening a damaged database = %v", err)
+	}
+}
+
+func TestDBStorageServer(t *testing.T) {
+	dir := t.TempDir()
+	addr := startTestServer(t, "-storage", "db", "-directory", dir)
+	client := testClient()
+	resp, err := client.Post("http://"+addr+"/files/hello.txt", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("upload = %d, want 201", resp.StatusCode)
+	}
+	resp, err = client.Get("http://" + addr + "/files/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hi" {
+		t.Errorf("GET /files/hello.txt = %q", data)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != storageDBName {
+		t.Errorf("data directory holds %v, want only %s", entries, storageDBName)
+	}
+}
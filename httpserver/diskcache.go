@@ -0,0 +1,260 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const diskIndexName = "index.json"
+
+// diskStore keeps the bodies of cache entries that are too large to hold in
+// memory as files under -cache-dir. An index of those entries is rewritten
+// whenever it changes, so that they survive a restart.
+type diskStore struct {
+	dir string
+
+	// indexMu serialises index writes so that the last snapshot taken is
+	// also the last one written.
+	indexMu sync.Mutex
+}
+
+// diskRecord is the index entry for one disk-backed cache entry.
+type diskRecord struct {
+	Key                  string        `json:"key"`
+	File                 string        `json:"file"`
+	Size                 int64         `json:"size"`
+	Status               int           `json:"status"`
+	Header               http.Header   `json:"header"`
+	Path                 string        `json:"path"`
+	Stored               time.Time     `json:"stored"`
+	InitialAge           time.Duration `json:"initial_age"`
+	Expires              time.Time     `json:"expires"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate"`
+}
+
+// openDiskCache attaches a disk tier in dir to cache and recovers the
+// entries recorded in its index. Body files that the index doesn't mention,
+// or whose size no longer matches, are left over from a crash and removed.
+func openDiskCache(cache *responseCache, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	d := &diskStore{dir: dir}
+
+	var records []diskRecord
+	data, err := os.ReadFile(filepath.Join(dir, diskIndexName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &records); err != nil {
+			// A damaged index only costs us the cached bodies.
+			log.Printf("Error reading cache index, starting empty: %v", err)
+			records = nil
+		}
+	}
+
+	cache.mu.Lock()
+	for _, r := range records {
+		info, err := os.Stat(filepath.Join(dir, r.File))
+		if err != nil || info.Size() != r.Size || filepath.Base(r.File) != r.File {
+			continue
+		}
+		entry := &cacheEntry{
+			status:               r.Status,
+			header:               r.Header,
+			stored:               r.Stored,
+			initialAge:           r.InitialAge,
+			expires:              r.Expires,
+			staleWhileRevalidate: r.StaleWhileRevalidate,
+			path:                 r.Path,
+			file:                 r.File,
+			fileSize:             r.Size,
+		}
+		if cache.fits(entry) {
+			cache.removeLocked(r.Key)
+			cache.insertLocked(r.Key, entry)
+		}
+	}
+	// The index lists entries from the previous run in no particular
+	// order, so trimming to a smaller budget drops arbitrary ones.
+	cache.evictLocked("")
+
+	recovered := make(map[string]bool)
+	for _, entry := range cache.entries {
+		if entry.file != "" {
+			recovered[entry.file] = true
+		}
+	}
+	cache.mu.Unlock()
+
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name.Name() != diskIndexName && !recovered[name.Name()] {
+			os.Remove(filepath.Join(dir, name.Name()))
+		}
+	}
+
+	cache.disk = d
+	if len(recovered) > 0 {
+		log.Printf("Recovered %d cached responses from %s", len(recovered), dir)
+	}
+	return d.writeIndex(cache)
+}
+
+// spill writes head followed by the rest of body to a new file, as long as
+// the total is no more than limit bytes. On failure the file is removed and
+// the returned reader replays everything consumed from body, followed by
+// the remainder, so that the response can still be relayed. If the disk
+// itself failed, part of the body is lost and the reader reports the error.
+func (d *diskStore) spill(head []byte, body io.ReadCloser, limit int64) (file string, size int64, rest io.ReadCloser, err error) {
+	f, err := os.CreateTemp(d.dir, "body-*")
+	if err != nil {
+		return "", 0, multiReadCloser(bytes.NewReader(head), body), err
+	}
+
+	w := &recordingWriter{w: f}
+	size, err = io.Copy(w, io.LimitReader(io.MultiReader(bytes.NewReader(head), body), limit+1))
+	if err == nil && size > limit {
+		err = errCacheEntryTooLarge
+	}
+	if err == nil {
+		err = f.Close()
+		if err == nil {
+			return filepath.Base(f.Name()), size, nil, nil
+		}
+		os.Remove(f.Name())
+		return "", 0, failedBody(err, body), err
+	}
+
+	if w.err == nil {
+		_, w.err = f.Seek(0, io.SeekStart)
+	}
+	if w.err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", 0, failedBody(w.err, body), w.err
+	}
+	return "", 0, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(f, body), closerFunc(func() error {
+		f.Close()
+		os.Remove(f.Name())
+		return body.Close()
+	})}, err
+}
+
+var errCacheEntryTooLarge = errors.New("response too large to cache")
+
+// recordingWriter remembers the first error from w, so that a failed write
+// can be told apart from a failed read.
+type recordingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if err != nil && rw.err == nil {
+		rw.err = err
+	}
+	return n, err
+}
+
+// failedBody stands in for a response body that could not be recovered.
+func failedBody(err error, body io.Closer) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{errReader{err}, body}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func multiReadCloser(head io.Reader, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(head, body), body}
+}
+
+func (d *diskStore) open(file string) (*os.File, error) {
+	return os.Open(filepath.Join(d.dir, file))
+}
+
+func (d *diskStore) remove(file string) {
+	if err := os.Remove(filepath.Join(d.dir, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing cached body: %v", err)
+	}
+}
+
+// writeIndex records the disk-backed entries of cache, replacing the index
+// atomically.
+func (d *diskStore) writeIndex(cache *responseCache) error {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+
+	records := []diskRecord{}
+	cache.mu.Lock()
+	for key, e := range cache.entries {
+		if e.file == "" {
+			continue
+		}
+		records = append(records, diskRecord{
+			Key:                  key,
+			File:                 e.file,
+			Size:                 e.fileSize,
+			Status:               e.status,
+			Header:               e.header,
+			Path:                 e.path,
+			Stored:               e.stored,
+			InitialAge:           e.initialAge,
+			Expires:              e.expires,
+			StaleWhileRevalidate: e.staleWhileRevalidate,
+		})
+	}
+	cache.mu.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.dir, diskIndexName+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(d.dir, diskIndexName)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("replacing cache index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// acceptEncoding is a random Accept-Encoding header for testing/quick:
+// codings in any case, with valid, invalid or missing q-values, other
+// parameters and stray whitespace, spread over one or more field values.
+// Each coding appears at most once, so that the header has one meaning.
+type acceptEncoding struct {
+	values []string
+	// quality holds the q-value of each coding listed with a valid one,
+	// under its canonical name.
+	quality map[string]float64
+}
+
+var (
+	testCodings   = []string{"gzip", "x-gzip", "GZip", "identity", "IDENTITY", "*", "br", "deflate", "compress", "zstd"}
+	validQValues  = map[string]float64{"0": 0, "0.0": 0, "0.000": 0, "0.001": 0.001, "0.5": 0.5, "0.999": 0.999, "1": 1, "1.0": 1, "1.000": 1}
+	invalidQValue = []string{"1.5", "2", "-1", "abc", "0.0001", "NaN", "1e-1", "", "1.001"}
+)
+
+func (acceptEncoding) Generate(r *rand.Rand, size int) reflect.Value {
+	h := acceptEncoding{quality: make(map[string]float64)}
+	seen := make(map[string]bool)
+	var elements []string
+	for _, i := range r.Perm(len(testCodings))[:r.Intn(6)] {
+		coding := testCodings[i]
+		canonical := strings.ToLower(coding)
+		if canonical == "x-gzip" {
+			canonical = "gzip"
+		}
+		if seen[canonical] {
+			continue
+		}
+		seen[canonical] = true
+
+		element := coding
+		if r.Intn(4) == 0 {
+			element += ";level=5"
+		}
+		switch r.Intn(3) {
+		case 0:
+			h.quality[canonical] = 1
+		case 1:
+			keys := make([]string, 0, len(validQValues))
+			for k := range validQValues {
+				keys = append(keys, k)
+			}
+			q := keys[r.Intn(len(keys))]
+			element += pad(r, ";") + pad(r, "q") + "=" + q
+			h.quality[canonical] = validQValues[q]
+		default:
+			element += ";q=" + invalidQValue[r.Intn(len(invalidQValue))]
+		}
+		elements = append(elements, pad(r, element))
+	}
+	if r.Intn(5) == 0 {
+		elements = append(elements, "")
+	}
+
+	// Spread the elements over up to three field values.
+	h.values = []string{""}
+	for _, e := range elements {
+		if len(h.values) < 3 && r.Intn(3) == 0 {
+			h.values = append(h.values, "")
+		}
+		last := &h.values[len(h.values)-1]
+		if *last != "" {
+			*last += ","
+		}
+		*last += e
+	}
+	return reflect.ValueOf(h)
+}
+
+// pad surrounds s with a random amount of optional whitespace.
+func pad(r *rand.Rand, s string) string {
+	ws := []string{"", " ", "\t", "  "}
+	return ws[r.Intn(len(ws))] + s + ws[r.Intn(len(ws))]
+}
+
+func (h acceptEncoding) String() string {
+	return fmt.Sprintf("%q", h.values)
+}
+
+// wantGzip is the expected outcome of negotiation for h, worked out from
+// its q-values directly.
+func (h acceptEncoding) wantGzip() bool {
+	effective := func(coding string, unlisted float64) float64 {
+		if q, ok := h.quality[coding]; ok {
+			return q
+		}
+		if q, ok := h.quality["*"]; ok {
+			return q
+		}
+		return unlisted
+	}
+	gzip := effective("gzip", 0)
+	return gzip > 0 && gzip >= effective("identity", 1)
+}
+
+func (h acceptEncoding) request(url string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for _, v := range h.values {
+		req.Header.Add("Accept-Encoding", v)
+	}
+	return req
+}
+
+// TestAcceptsGzipProperties checks that gzip is chosen exactly when the
+// client gives it a positive q-value no lower than identity's, so that it
+// never gets gzip after refusing it and is never denied gzip it prefers.
+func TestAcceptsGzipProperties(t *testing.T) {
+	property := func(h acceptEncoding) bool {
+		return acceptsGzip(h.request("/")) == h.wantGzip()
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNegotiatedEncodingDecodes sends random Accept-Encoding headers to
+// the routes that compress, and checks that every response uses an
+// encoding the client accepted and decodes to the original content.
+func TestNegotiatedEncodingDecodes(t *testing.T) {
+	addr := startTestServer(t)
+	client := testClient()
+	content := strings.Repeat("compressible content ", 50)
+	resp, err := client.Post("http://"+addr+"/files/negotiate", "text/plain", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	check := func(url, want string) func(h acceptEncoding) bool {
+		return func(h acceptEncoding) bool {
+			resp, err := client.Do(h.request(url))
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+
+			switch enc := resp.Header.Get("Content-Encoding"); {
+			case enc == "gzip" && h.wantGzip():
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Logf("decoding gzip: %v", err)
+					return false
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Logf("decoding gzip: %v", err)
+					return false
+				}
+			case enc != "" || h.wantGzip():
+				t.Logf("Content-Encoding %q for %v", enc, h)
+				return false
+			}
+			return string(body) == want
+		}
+	}
+	for _, tt := range []struct{ path, want string }{
+		{"/echo/" + strings.Repeat("a", 100), strings.Repeat("a", 100)},
+		{"/files/negotiate", content},
+	} {
+		if err := quick.Check(check("http://"+addr+tt.path, tt.want), &quick.Config{MaxCount: 300}); err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+		}
+	}
+}
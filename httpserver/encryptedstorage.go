@@ -0,0 +1,441 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Files are encrypted in chunks of encryptedChunkSize bytes, each sealed
+// with AES-256-GCM on its own so that a file can be streamed and read
+// from any offset. A file is a header of
+//
+//	magic (4) | key id (8) | nonce prefix (8)
+//
+// followed by the chunks. The nonce of chunk i is the file's random
+// prefix and i, and its additional data says whether it is the last, so
+// chunks can't be reordered, swapped between files or dropped from the
+// end. The last chunk is shorter than the others, and empty when the size
+// is a multiple of the chunk size.
+const (
+	encryptedMagic     = "HSE1"
+	encryptedChunkSize = 64 * 1024
+	encryptedHeaderLen = 4 + 8 + 8
+	encryptedChunkLen  = encryptedChunkSize + 16
+)
+
+var errBadCiphertext = errors.New("stored file is damaged or not readable with the configured keys")
+
+// encryptionKey is an AES-256 key and the id files encrypted with it carry.
+type encryptionKey struct {
+	id   [8]byte
+	aead cipher.AEAD
+}
+
+func newEncryptionKey(raw []byte) (*encryptionKey, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, not 32", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &encryptionKey{aead: aead}
+	sum := sha256.Sum256(append([]byte("file encryption key id\x00"), raw...))
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// encryptionKeys are the keys from -encryption-keys or
+// -encryption-keys-command: new files are encrypted with the first, and
+// files under any of them can be read. To rotate keys, put a new one first
+// and call POST /admin/storage/rotate-keys before dropping the old one.
+var encryptionKeys []*encryptionKey
+
+// loadEncryptionKeys reads the keys, one base64 AES-256 key per line, from
+// the key file or from the output of the key command, which can fetch them
+// from a key management service.
+func loadEncryptionKeys() error {
+	var data []byte
+	var err error
+	switch {
+	case config.EncryptionKeysPath != "":
+		data, err = os.ReadFile(config.EncryptionKeysPath)
+	case config.EncryptionKeysCommand != "":
+		cmd := exec.Command("/bin/sh", "-c", config.EncryptionKeysCommand)
+		cmd.Stderr = os.Stderr
+		data, err = cmd.Output()
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return fmt.Errorf("key %d: not base64", n)
+		}
+		key, err := newEncryptionKey(raw)
+		if err != nil {
+			return fmt.Errorf("key %d: %w", n, err)
+		}
+		encryptionKeys = append(encryptionKeys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(encryptionKeys) == 0 {
+		return errors.New("no keys found")
+	}
+	return nil
+}
+
+// encryptedStorage encrypts the files of another Storage.
+type encryptedStorage struct {
+	inner Storage
+}
+
+// encryptedStorages lists every encryptedStorage, for key rotation.
+var encryptedStorages struct {
+	sync.Mutex
+	all []*encryptedStorage
+}
+
+func newEncryptedStorage(inner Storage) *encryptedStorage {
+	s := &encryptedStorage{inner: inner}
+	encryptedStorages.Lock()
+	encryptedStorages.all = append(encryptedStorages.all, s)
+	encryptedStorages.Unlock()
+	return s
+}
+
+// plainSize returns the size of the contents of a stored file.
+func plainSize(stored int64) (int64, error) {
+	body := stored - encryptedHeaderLen
+	if body < 16 || body%encryptedChunkLen < 16 {
+		return 0, errBadCiphertext
+	}
+	return body/encryptedChunkLen*encryptedChunkSize + body%encryptedChunkLen - 16, nil
+}
+
+func (s *encryptedStorage) plainInfo(info FileInfo) (FileInfo, error) {
+	size, err := plainSize(info.Size)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("%s: %w", info.Name, err)
+	}
+	info.Size = size
+	return info, nil
+}
+
+func (s *encryptedStorage) Stat(name string) (FileInfo, error) {
+	info, err := s.inner.Stat(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return s.plainInfo(info)
+}
+
+func (s *encryptedStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	f, info, err := s.inner.Open(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	if info, err = s.plainInfo(info); err != nil {
+		f.Close()
+		return nil, FileInfo{}, err
+	}
+
+	var header [encryptedHeaderLen]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		f.Close()
+		return nil, FileInfo{}, err
+	}
+	key, err := headerKey(header[:])
+	if err != nil {
+		f.Close()
+		return nil, FileInfo{}, fmt.Errorf("%s: %w", name, err)
+	}
+	r := &decryptingReader{inner: f, key: key, size: info.Size}
+	copy(r.prefix[:], header[12:])
+	return r, info, nil
+}
+
+// headerKey returns the key a file with the given header was encrypted
+// with.
+func headerKey(header []byte) (*encryptionKey, error) {
+	if string(header[:4]) != encryptedMagic {
+		return nil, errBadCiphertext
+	}
+	for _, key := range encryptionKeys {
+		if bytes.Equal(key.id[:], header[4:12]) {
+			return key, nil
+		}
+	}
+	return nil, errBadCiphertext
+}
+
+// Write encrypts r with the first key as it is streamed to the inner
+// storage.
+func (s *encryptedStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	key := encryptionKeys[0]
+	var prefix [8]byte
+	if _, err := rand.Read(prefix[:]); err != nil {
+		return FileInfo{}, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		pw.CloseWithError(encryptStream(pw, r, key, prefix))
+		close(done)
+	}()
+	info, err := s.inner.Write(name, pr)
+	// Stop the encryption if the storage gave up early, and wait for it so
+	// that r is no longer in use.
+	pr.CloseWithError(errors.New("storage stopped reading"))
+	<-done
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return s.plainInfo(info)
+}
+
+func encryptStream(w io.Writer, r io.Reader, key *encryptionKey, prefix [8]byte) error {
+	header := make([]byte, 0, encryptedHeaderLen)
+	header = append(header, encryptedMagic...)
+	header = append(header, key.id[:]...)
+	header = append(header, prefix[:]...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	plain := make([]byte, encryptedChunkSize)
+	sealed := make([]byte, 0, encryptedChunkLen)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(r, plain)
+		last := n < encryptedChunkSize
+		if last && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		sealed = key.aead.Seal(sealed[:0], chunkNonce(prefix, i), plain[:n], chunkAAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if i == 1<<32-1 {
+			return errors.New("file too large to encrypt")
+		}
+	}
+}
+
+func chunkNonce(prefix [8]byte, i uint32) []byte {
+	return binary.BigEndian.AppendUint32(prefix[:], i)
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (s *encryptedStorage) Delete(name string) error {
+	return s.inner.Delete(name)
+}
+
+func (s *encryptedStorage) List() ([]FileInfo, error) {
+	files, err := s.inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if files[i], err = s.plainInfo(files[i]); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// rotate re-encrypts with the first key every file encrypted with another,
+// returning how many it rewrote. The files' modification times change.
+func (s *encryptedStorage) rotate() (int, error) {
+	files, err := s.inner.List()
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, info := range files {
+		current, err := s.usesCurrentKey(info.Name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return rewritten, fmt.Errorf("%s: %w", info.Name, err)
+		}
+		if current {
+			continue
+		}
+
+		f, _, err := s.Open(info.Name)
+		if err != nil {
+			return rewritten, err
+		}
+		_, err = s.Write(info.Name, f)
+		f.Close()
+		if err != nil {
+			return rewritten, fmt.Errorf("%s: %w", info.Name, err)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func (s *encryptedStorage) usesCurrentKey(name string) (bool, error) {
+	f, _, err := s.inner.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var header [encryptedHeaderLen]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return false, err
+	}
+	if _, err := headerKey(header[:]); err != nil {
+		return false, err
+	}
+	return bytes.Equal(header[4:12], encryptionKeys[0].id[:]), nil
+}
+
+// decryptingReader reads an encrypted file one chunk at a time, checking
+// each before any of it is returned.
+type decryptingReader struct {
+	inner  io.ReadSeekCloser
+	key    *encryptionKey
+	prefix [8]byte
+	size   int64
+
+	// offset is the position in the contents, and chunk the decrypted
+	// chunk holding it when chunk is loaded.
+	offset int64
+	index  int64
+	chunk  []byte
+	loaded bool
+	buf    []byte
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / encryptedChunkSize
+	if !r.loaded || r.index != index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.offset-index*encryptedChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts chunk index.
+func (r *decryptingReader) load(index int64) error {
+	if !r.loaded || r.index+1 != index {
+		if _, err := r.inner.Seek(encryptedHeaderLen+index*encryptedChunkLen, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	last := index == r.size/encryptedChunkSize
+	length := encryptedChunkLen
+	if last {
+		length = int(r.size%encryptedChunkSize) + 16
+	}
+	if cap(r.buf) < length {
+		r.buf = make([]byte, encryptedChunkLen)
+	}
+	if _, err := io.ReadFull(r.inner, r.buf[:length]); err != nil {
+		return fmt.Errorf("reading encrypted chunk: %w", err)
+	}
+	plain, err := r.key.aead.Open(r.chunk[:0], chunkNonce(r.prefix, uint32(index)), r.buf[:length], chunkAAD(last))
+	if err != nil {
+		r.loaded = false
+		return errBadCiphertext
+	}
+	r.chunk, r.index, r.loaded = plain, index, true
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("encrypted file: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.inner.Close()
+}
+
+// handleAdminRotateKeys re-encrypts the files of every host with the
+// current key, so that older keys can be retired.
+func handleAdminRotateKeys(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+	if len(encryptionKeys) == 0 {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "files are not encrypted"}, false)
+		return
+	}
+
+	encryptedStorages.Lock()
+	all := encryptedStorages.all
+	encryptedStorages.Unlock()
+	total := 0
+	for _, s := range all {
+		n, err := s.rotate()
+		total += n
+		if err != nil {
+			log.Printf("Error rotating keys: %v", err)
+			sendJSON(conn, http.StatusInternalServerError, map[string]any{"error": err.Error(), "rewritten": total}, false)
+			return
+		}
+	}
+	sendJSON(conn, http.StatusOK, map[string]int{"rewritten": total}, false)
+}
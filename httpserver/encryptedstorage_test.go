@@ -0,0 +1,102 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testEncryptionKey(t *testing.T) *encryptionKey {
+	t.Helper()
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	key, err := newEncryptionKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func readStored(t *testing.T, s Storage, name string) ([]byte, error) {
+	t.Helper()
+	f, _, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	defer func(keys []*encryptionKey) { encryptionKeys = keys }(encryptionKeys)
+	oldKey, newKey := testEncryptionKey(t), testEncryptionKey(t)
+	encryptionKeys = []*encryptionKey{oldKey}
+	inner := newMemoryStorage(1 << 24)
+	s := newEncryptedStorage(inner)
+
+	plain := make([]byte, 2*encryptedChunkSize+100)
+	rand.Read(plain)
+	for name, data := range map[string][]byte{"big": plain, "even": plain[:encryptedChunkSize], "empty": nil} {
+		info, err := s.Write(name, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readStored(t, s, name)
+		if err != nil || !bytes.Equal(got, data) || info.Size != int64(len(data)) {
+			t.Errorf("%s: read back %d bytes, %v, size %d; want the %d written", name, len(got), err, info.Size, len(data))
+		}
+	}
+	raw, _ := readStored(t, inner, "big")
+	if bytes.Contains(raw, plain[:64]) {
+		t.Error("stored file holds the plaintext")
+	}
+
+	// Reading from an offset decrypts only the chunks it needs.
+	f, _, err := s.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(encryptedChunkSize-5, io.SeekStart)
+	part := make([]byte, 10)
+	if _, err := io.ReadFull(f, part); err != nil || !bytes.Equal(part, plain[encryptedChunkSize-5:encryptedChunkSize+5]) {
+		t.Errorf("read across a chunk boundary = %v", err)
+	}
+	f.Close()
+
+	// Changed, dropped or reordered chunks are refused.
+	flipped := bytes.Clone(raw)
+	flipped[encryptedHeaderLen+10] ^= 1
+	swapped := bytes.Clone(raw)
+	first := swapped[encryptedHeaderLen : encryptedHeaderLen+encryptedChunkLen]
+	second := swapped[encryptedHeaderLen+encryptedChunkLen : encryptedHeaderLen+2*encryptedChunkLen]
+	tmp := bytes.Clone(first)
+	copy(first, second)
+	copy(second, tmp)
+	for name, damaged := range map[string][]byte{
+		"flipped": flipped,
+		"swapped": swapped,
+		"cut":     raw[:encryptedHeaderLen+2*encryptedChunkLen],
+	} {
+		inner.Write("damaged", bytes.NewReader(damaged))
+		if _, err := readStored(t, s, "damaged"); !errors.Is(err, errBadCiphertext) {
+			t.Errorf("%s chunks: read = %v, want errBadCiphertext", name, err)
+		}
+	}
+	inner.Delete("damaged")
+
+	// After rotating, files are readable with only the new key.
+	encryptionKeys = []*encryptionKey{newKey, oldKey}
+	if n, err := s.rotate(); n != 3 || err != nil {
+		t.Errorf("rotating = %d, %v, want 3 files rewritten", n, err)
+	}
+	encryptionKeys = []*encryptionKey{newKey}
+	if got, err := readStored(t, s, "big"); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("reading with the new key after rotating: %v", err)
+	}
+	encryptionKeys = []*encryptionKey{oldKey}
+	if _, err := readStored(t, s, "big"); err == nil {
+		t.Error("file still readable with the retired key")
+	}
+}
@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Errors a handler can return, wrapped or not, to choose the status of the
+// response.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrBadRequest = errors.New("bad request")
+	ErrTooLarge   = errors.New("request too large")
+)
+
+// StatusError is an error answered with a particular status.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+// Errorf returns a StatusError for status with a message formatted as by
+// fmt.Errorf.
+func Errorf(status int, format string, args ...any) error {
+	return &StatusError{Status: status, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// errorStatus picks the response status for err. Errors that don't say
+// otherwise are the server's fault.
+func errorStatus(err error) int {
+	var statusErr *StatusError
+	var jsonErr *JSONError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.Status
+	case errors.As(err, &jsonErr):
+		return jsonErr.Status
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTooLarge), errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadRequest), errors.Is(err, errIncompleteBody):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// reportError returns the response status for err, logging err if it is
+// the server's fault, since the client is told nothing more than that.
+func reportError(err error) int {
+	status := errorStatus(err)
+	if status >= http.StatusInternalServerError {
+		log.Printf("Error %v", err)
+	}
+	return status
+}
+
+// sendError answers the request on conn with the status for err.
+func sendError(conn net.Conn, err error) {
+	sendResponse(conn, reportError(err), nil, nil)
+}
@@ -0,0 +1,101 @@
+package httpserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultEventInterval = time.Second
+	sseHeartbeatInterval = 15 * time.Second
+	sseRetry             = 3 * time.Second
+)
+
+// handleEvents streams Server-Sent Events. Each event carries an increasing
+// id so a reconnecting client can resume from its Last-Event-ID. The
+// interval (milliseconds) and count query parameters control the stream;
+// without a count it runs until the client goes away.
+func handleEvents(conn net.Conn, req *http.Request) {
+	query := req.URL.Query()
+
+	interval := defaultEventInterval
+	if v := query.Get("interval"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 1 {
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+		interval = time.Duration(ms) * time.Millisecond
+	}
+
+	count := 0
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+		count = n
+	}
+
+	nextID := 1
+	if v := req.Header.Get("Last-Event-ID"); v != "" {
+		if lastID, err := strconv.Atoi(v); err == nil && lastID >= 0 {
+			nextID = lastID + 1
+		}
+	}
+
+	stream, err := startStream(conn, http.StatusOK, map[string]string{
+		"Content-Type":  "text/event-stream",
+		"Cache-Control": "no-cache",
+	})
+	if err != nil {
+		log.Printf("Error starting event stream: %v", err)
+		return
+	}
+
+	if err := writeEvent(stream, fmt.Sprintf("retry: %d\n\n", sseRetry.Milliseconds())); err != nil {
+		return
+	}
+
+	events := time.NewTicker(interval)
+	defer events.Stop()
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for sent := 0; count == 0 || sent < count; {
+		var err error
+		select {
+		case now := <-events.C:
+			err = writeEvent(stream, fmt.Sprintf("id: %d\nevent: tick\ndata: {\"id\":%d,\"time\":%q}\n\n",
+				nextID, nextID, now.UTC().Format(time.RFC3339Nano)))
+			nextID++
+			sent++
+		case <-heartbeat.C:
+			err = writeEvent(stream, ": heartbeat\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		if err != nil {
+			// The client disconnected; there is nobody left to tell.
+			return
+		}
+	}
+
+	if err := stream.Close(); err != nil {
+		log.Printf("Error closing event stream: %v", err)
+	}
+}
+
+// writeEvent sends a single event and flushes it so the client sees it
+// immediately rather than when the buffer happens to fill.
+func writeEvent(stream *streamWriter, event string) error {
+	if _, err := stream.Write([]byte(event)); err != nil {
+		return err
+	}
+	return stream.Flush()
+}
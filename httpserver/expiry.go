@@ -0,0 +1,177 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// fileExpiriesName is the file the expiry times of a host are kept in.
+	fileExpiriesName = "expiries"
+	// goneRetention is how long GET answers 410 rather than 404 for a
+	// file that has expired.
+	goneRetention = 7 * 24 * time.Hour
+	// reapInterval is how often expired files are removed.
+	reapInterval = time.Minute
+)
+
+// fileExpiries records which files of a host were uploaded with a
+// time-to-live. Once one expires GET answers 410 Gone, the reaper removes
+// it, and the record is kept for goneRetention so that the answer stays
+// 410 until the name is uploaded again or forgotten.
+type fileExpiries struct {
+	files Storage
+	// meta holds the records, in a file of their own.
+	meta Storage
+
+	mu      sync.Mutex
+	entries map[string]fileExpiry
+	// uploading counts the uploads under way for each name, which the
+	// reaper leaves alone until they are recorded.
+	uploading map[string]int
+}
+
+type fileExpiry struct {
+	Expires time.Time `json:"expires"`
+	Removed bool      `json:"removed,omitempty"`
+}
+
+// defaultFileExpiries are the expiry records of the default host.
+var defaultFileExpiries *fileExpiries
+
+func openFileExpiries(files, meta Storage) (*fileExpiries, error) {
+	e := &fileExpiries{files: files, meta: meta, entries: make(map[string]fileExpiry), uploading: make(map[string]int)}
+	f, _, err := meta.Open(fileExpiriesName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&e.entries); err != nil {
+		return nil, fmt.Errorf("reading file expiries: %w", err)
+	}
+	return e, nil
+}
+
+// save writes out the records; e.mu must be held.
+func (e *fileExpiries) save() error {
+	data, err := json.Marshal(e.entries)
+	if err != nil {
+		return err
+	}
+	_, err = e.meta.Write(fileExpiriesName, bytes.NewReader(data))
+	return err
+}
+
+// set records that name expires at the given time, or that it doesn't
+// expire when that is zero.
+func (e *fileExpiries) set(name string, expires time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.entries[name]; !ok && expires.IsZero() {
+		return nil
+	}
+	if expires.IsZero() {
+		delete(e.entries, name)
+	} else {
+		e.entries[name] = fileExpiry{Expires: expires}
+	}
+	return e.save()
+}
+
+// startUpload notes that name is being uploaded, until the returned
+// function is called after set.
+func (e *fileExpiries) startUpload(name string) func() {
+	e.mu.Lock()
+	e.uploading[name]++
+	e.mu.Unlock()
+	return func() {
+		e.mu.Lock()
+		if e.uploading[name]--; e.uploading[name] == 0 {
+			delete(e.uploading, name)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// gone reports whether name has expired by now.
+func (e *fileExpiries) gone(name string, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	entry, ok := e.entries[name]
+	return ok && !now.Before(entry.Expires)
+}
+
+// reap removes the files that have expired by now and forgets those that
+// expired more than goneRetention ago. It returns how many it removed.
+func (e *fileExpiries) reap(now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	removed := 0
+	changed := false
+	for name, entry := range e.entries {
+		switch {
+		case now.Before(entry.Expires):
+		case entry.Removed:
+			if now.Sub(entry.Expires) > goneRetention {
+				delete(e.entries, name)
+				changed = true
+			}
+		default:
+			if e.uploading[name] > 0 {
+				continue
+			}
+			if err := e.files.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Error removing expired file %s: %v", name, err)
+				continue
+			}
+			entry.Removed = true
+			e.entries[name] = entry
+			removed++
+			changed = true
+		}
+	}
+	if changed {
+		if err := e.save(); err != nil {
+			log.Printf("Error saving file expiries: %v", err)
+		}
+	}
+	return removed
+}
+
+// uploadTTL returns the time-to-live requested for an upload with the
+// ttl query parameter or the X-TTL header, as a duration such as "90m" or
+// a number of seconds. It is zero when neither is given.
+func uploadTTL(req *http.Request) (time.Duration, error) {
+	value := req.URL.Query().Get("ttl")
+	if value == "" {
+		value = req.Header.Get("X-TTL")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.ParseInt(value, 10, 64)
+		if serr != nil || seconds > int64(math.MaxInt64/time.Second) {
+			return 0, errors.New("ttl must be a duration or a number of seconds")
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+	return ttl, nil
+}
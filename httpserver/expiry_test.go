@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadTTL(t *testing.T) {
+	for _, tt := range []struct {
+		query, header string
+		want          time.Duration
+		ok            bool
+	}{
+		{"", "", 0, true},
+		{"ttl=90m", "", 90 * time.Minute, true},
+		{"ttl=30", "", 30 * time.Second, true},
+		{"", "2h", 2 * time.Hour, true},
+		{"ttl=1m", "2h", time.Minute, true},
+		{"ttl=-5", "", 0, false},
+		{"ttl=soon", "", 0, false},
+		{"ttl=99999999999999999", "", 0, false},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "/files/a?"+tt.query, nil)
+		if tt.header != "" {
+			req.Header.Set("X-TTL", tt.header)
+		}
+		got, err := uploadTTL(req)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ttl for %q, X-TTL %q = %v, %v", tt.query, tt.header, got, err)
+		}
+	}
+}
+
+func TestFileExpiry(t *testing.T) {
+	addr := startTestServer(t)
+	client := testClient()
+	do := func(method, path, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+path, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := do("POST", "/files/a.txt?ttl=soon", "hi"); status != http.StatusBadRequest {
+		t.Errorf("upload with a bad ttl = %d, want 400", status)
+	}
+	if status := do("POST", "/files/a.txt?ttl=1h", "hi"); status != http.StatusCreated {
+		t.Fatalf("upload with a ttl = %d", status)
+	}
+	if status := do("GET", "/files/a.txt", ""); status != http.StatusOK {
+		t.Errorf("file before it expires = %d, want 200", status)
+	}
+
+	// Once expired, the file is gone before the reaper has removed it, and
+	// stays gone after.
+	if err := defaultFileExpiries.set("a.txt", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if status := do("GET", "/files/a.txt", ""); status != http.StatusGone {
+		t.Errorf("expired file = %d, want 410", status)
+	}
+	if n := defaultFileExpiries.reap(time.Now()); n != 1 {
+		t.Errorf("reaper removed %d files, want 1", n)
+	}
+	if _, err := fileStorage.Stat("a.txt"); err == nil {
+		t.Error("expired file still stored after reaping")
+	}
+	if status := do("GET", "/files/a.txt", ""); status != http.StatusGone {
+		t.Errorf("reaped file = %d, want 410", status)
+	}
+	defaultFileExpiries.reap(time.Now().Add(goneRetention + time.Minute))
+	if status := do("GET", "/files/a.txt", ""); status != http.StatusNotFound {
+		t.Errorf("file expired long ago = %d, want 404", status)
+	}
+
+	// Uploading the name again without a ttl makes it permanent.
+	do("POST", "/files/b.txt?ttl=1h", "hi")
+	do("POST", "/files/b.txt", "hi")
+	if defaultFileExpiries.gone("b.txt", time.Now().Add(2*time.Hour)) {
+		t.Error("file uploaded again without a ttl still expires")
+	}
+}
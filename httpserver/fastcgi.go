@@ -0,0 +1,298 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FastCGIRoute sends requests whose path starts with Prefix to the
+// FastCGI responder (such as php-fpm) listening at Address, either
+// "host:port" or "unix:" and the path of a socket. The script run is the
+// request path under Root, with Index added to paths ending in a slash,
+// or Script for every request when it is set, in which case what follows
+// the prefix is the PATH_INFO. Params are passed on top of the usual CGI
+// variables. Requests pass through authorize first, as those for the
+// built-in endpoints do.
+type FastCGIRoute struct {
+	Prefix  string            `json:"prefix"`
+	Address string            `json:"address"`
+	Root    string            `json:"root"`
+	Index   string            `json:"index"`
+	Script  string            `json:"script"`
+	Params  map[string]string `json:"params"`
+}
+
+func (r *FastCGIRoute) prepare() error {
+	if !strings.HasPrefix(r.Prefix, "/") {
+		return fmt.Errorf("prefix must start with /")
+	}
+	if r.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if r.Root == "" && r.Script == "" {
+		return fmt.Errorf("root or script is required")
+	}
+	if r.Index == "" {
+		r.Index = "index.php"
+	}
+	return nil
+}
+
+// matchFastCGIRoute returns the FastCGI route with the longest prefix
+// matching req's path, or nil if there is none.
+func matchFastCGIRoute(req *http.Request) *FastCGIRoute {
+	var best *FastCGIRoute
+	for _, route := range config.FastCGIRoutes {
+		if strings.HasPrefix(req.URL.Path, route.Prefix) && (best == nil || len(route.Prefix) > len(best.Prefix)) {
+			best = route
+		}
+	}
+	return best
+}
+
+// script returns the SCRIPT_NAME, SCRIPT_FILENAME and PATH_INFO of req.
+func (r *FastCGIRoute) script(req *http.Request) (name, filename, pathInfo string) {
+	if r.Script != "" {
+		name = strings.TrimSuffix(r.Prefix, "/")
+		return name, r.Script, strings.TrimPrefix(req.URL.Path, name)
+	}
+	name = path.Clean("/" + req.URL.Path)
+	if strings.HasSuffix(req.URL.Path, "/") {
+		name = path.Join(name, r.Index)
+	}
+	return name, filepath.Join(r.Root, filepath.FromSlash(name)), ""
+}
+
+// Serve runs req as one FastCGI request on a connection of its own: the
+// CGI variables go as the params, the request body as the stdin, and the
+// stdout is relayed like the output of a CGI script as it arrives.
+func (r *FastCGIRoute) Serve(w *ResponseWriter, req *http.Request) error {
+	body, length, err := cgiBody(req)
+	if err != nil {
+		return err
+	}
+	name, filename, pathInfo := r.script(req)
+	params := cgiEnv(w.conn, req, name, filename, pathInfo, length)
+	if r.Root != "" {
+		params = append(params, "DOCUMENT_ROOT="+r.Root)
+	}
+	for key, value := range r.Params {
+		params = append(params, key+"="+value)
+	}
+
+	network, address := "tcp", r.Address
+	if socket, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", socket
+	}
+	dialer := net.Dialer{Timeout: proxyDialTimeout}
+	conn, err := dialer.DialContext(req.Context(), network, address)
+	if err != nil {
+		return Errorf(http.StatusBadGateway, "FastCGI %s: %w", r.Address, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+	defer stop()
+
+	fc := &fcgiConn{w: bufio.NewWriter(conn)}
+	fc.writeRecord(fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0})
+	fc.writeStream(fcgiParams, encodeFCGIParams(params))
+	fc.writeRecord(fcgiParams, nil)
+	if err := fc.flush(); err != nil {
+		return Errorf(http.StatusBadGateway, "FastCGI %s: %w", r.Address, err)
+	}
+
+	// The body is sent while the response is read, as the application
+	// may start answering before it has read it all.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		if length > 0 {
+			if _, err := io.Copy(fcgiStreamWriter{fc, fcgiStdin}, body); err != nil {
+				return
+			}
+		}
+		fc.writeRecord(fcgiStdin, nil)
+		fc.flush()
+	}()
+	defer func() {
+		conn.Close()
+		<-sent
+	}()
+
+	resp := &fcgiResponse{r: bufio.NewReader(conn), stderr: cgiLogger{prefix: "FastCGI " + name}}
+	if err := relayCGIResponse(w, resp); err != nil {
+		return fmt.Errorf("FastCGI %s: %w", name, err)
+	}
+	return nil
+}
+
+// Record types and roles of the FastCGI protocol.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+
+	// fcgiRequestID is the id of the one request sent on each connection.
+	fcgiRequestID = 1
+
+	fcgiHeaderLength = 8
+	fcgiMaxContent   = 65535
+)
+
+// fcgiConn writes FastCGI records. The first error sticks, and is
+// returned by flush.
+type fcgiConn struct {
+	w   *bufio.Writer
+	err error
+}
+
+// writeRecord writes one record of the given type, padded to a multiple
+// of 8 bytes as the specification recommends.
+func (c *fcgiConn) writeRecord(recType byte, content []byte) {
+	if c.err != nil {
+		return
+	}
+	padding := -len(content) & 7
+	header := [fcgiHeaderLength]byte{fcgiVersion, recType, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	c.w.Write(header[:])
+	c.w.Write(content)
+	_, c.err = c.w.Write(make([]byte, padding))
+}
+
+// writeStream writes data to a stream as records of the largest size
+// allowed. It doesn't end the stream, which takes an empty record.
+func (c *fcgiConn) writeStream(recType byte, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), fcgiMaxContent)
+		c.writeRecord(recType, data[:n])
+		data = data[n:]
+	}
+}
+
+func (c *fcgiConn) flush() error {
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+	return c.err
+}
+
+// fcgiStreamWriter writes to one stream of a fcgiConn, a record per
+// write.
+type fcgiStreamWriter struct {
+	c       *fcgiConn
+	recType byte
+}
+
+func (s fcgiStreamWriter) Write(p []byte) (int, error) {
+	s.c.writeStream(s.recType, p)
+	if err := s.c.flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// encodeFCGIParams encodes "name=value" pairs as the name-value pairs
+// of a params stream, each length in one byte when it is under 128 and in
+// four otherwise.
+func encodeFCGIParams(params []string) []byte {
+	var buf []byte
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		for _, n := range []int{len(name), len(value)} {
+			if n < 128 {
+				buf = append(buf, byte(n))
+			} else {
+				buf = binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+			}
+		}
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// fcgiResponse reads the stdout stream of a FastCGI request, logging its
+// stderr, until the end of the request.
+type fcgiResponse struct {
+	r       *bufio.Reader
+	stderr  cgiLogger
+	content []byte
+	stdout  []byte
+	done    bool
+}
+
+func (f *fcgiResponse) Read(p []byte) (int, error) {
+	for len(f.stdout) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.stdout)
+	f.stdout = f.stdout[n:]
+	return n, nil
+}
+
+// next reads the next record.
+func (f *fcgiResponse) next() error {
+	var header [fcgiHeaderLength]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if header[0] != fcgiVersion {
+		return fmt.Errorf("unsupported FastCGI version %d", header[0])
+	}
+	length := int(binary.BigEndian.Uint16(header[4:])) + int(header[6])
+	if cap(f.content) < length {
+		f.content = make([]byte, length)
+	}
+	f.content = f.content[:length]
+	if _, err := io.ReadFull(f.r, f.content); err != nil {
+		return err
+	}
+	content := f.content[:binary.BigEndian.Uint16(header[4:])]
+	if binary.BigEndian.Uint16(header[2:]) != fcgiRequestID {
+		return nil
+	}
+
+	switch header[1] {
+	case fcgiStdout:
+		f.stdout = content
+	case fcgiStderr:
+		f.stderr.Write(content)
+	case fcgiEndRequest:
+		if len(content) < 8 {
+			return errors.New("short FastCGI end request record")
+		}
+		if status := content[4]; status != 0 {
+			return fmt.Errorf("FastCGI request refused with protocol status %d", status)
+		}
+		if app := binary.BigEndian.Uint32(content); app != 0 {
+			log.Printf("%s: exited with status %d", f.stderr.prefix, app)
+		}
+		f.done = true
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package httpserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"testing"
+)
+
+func TestFastCGI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/app/missing.php" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.URL.Path, env["SCRIPT_FILENAME"], env["APP_ENV"], body)
+		fmt.Fprint(w, strings.Repeat("x", 100000))
+	}))
+
+	addr := startTestServer(t)
+	config.FastCGIRoutes = []*FastCGIRoute{
+		{Prefix: "/app/", Address: ln.Addr().String(), Root: "/srv/www", Params: map[string]string{"APP_ENV": "test"}},
+		{Prefix: "/front/", Address: ln.Addr().String(), Script: "/srv/www/index.php"},
+	}
+	for _, route := range config.FastCGIRoutes {
+		if err := route.prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := testClient()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"POST", "/app/form.php?x=1", "a=b", 200, "POST /app/form.php /srv/www/app/form.php test a=b"},
+		{"GET", "/app/", "", 200, "GET /app/ /srv/www/app/index.php test "},
+		{"GET", "/front/users/7", "", 200, "GET /front/users/7 /srv/www/index.php  "},
+		{"GET", "/app/missing.php", "", 404, "404 page not found\n"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "http://"+addr+tt.path, strings.NewReader(tt.body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body := strings.TrimRight(string(data), "x")
+		if resp.StatusCode != tt.status || body != tt.want {
+			t.Errorf("%s %s = %d %q, want %d %q", tt.method, tt.path, resp.StatusCode, body, tt.status, tt.want)
+		}
+		if tt.status == 200 && len(data)-len(body) != 100000 {
+			t.Errorf("%s %s: body has %d bytes", tt.method, tt.path, len(data))
+		}
+	}
+
+	front := config.FastCGIRoutes[1]
+	req, _ := http.NewRequest("GET", "/front/users/7", nil)
+	if name, filename, pathInfo := front.script(req); name != "/front" || filename != "/srv/www/index.php" || pathInfo != "/users/7" {
+		t.Errorf("front controller script = %q, %q, %q", name, filename, pathInfo)
+	}
+
+	ln.Close()
+	resp, err := client.Get("http://" + addr + "/app/down.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 502 {
+		t.Errorf("with the backend down: status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestFastCGIPolicy(t *testing.T) {
+	addr := startTestServer(t)
+	// Nothing listens at the backend's address, so a request that gets
+	// past the policy fails with 502.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	config.FastCGIRoutes = []*FastCGIRoute{{Prefix: "/php/", Address: ln.Addr().String(), Root: "/srv/www"}}
+	policy := &Policy{Prefix: "/php/admin/", Require: []string{"admin"}}
+	if err := policy.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	config.Policies = []*Policy{policy}
+	for _, route := range config.FastCGIRoutes {
+		if err := route.prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]int{"/php/admin/x.php": 401, "/php/x.php": 502} {
+		resp, err := testClient().Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: status = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fileCacheKey identifies a cached file variant: its identity bytes, or
+// those bytes in a content coding. Each virtual host has its own storage,
+// told apart by address.
+func fileCacheKey(store Storage, name, encoding string) string {
+	return fmt.Sprintf("file %s %p %s", encoding, store, name)
+}
+
+// lookupFile returns the contents of name in store, served at reqPath,
+// along with its validators (ETag and Last-Modified). Files up to
+// -file-cache-max-size are served from memory for as long as their
+// modification time and size are unchanged.
+func lookupFile(store Storage, name, reqPath string) (*cacheEntry, error) {
+	key := fileCacheKey(store, name, "identity")
+	if config.FileCacheMaxSize > 0 {
+		info, err := store.Stat(name)
+		if err != nil {
+			fileCache.delete(key)
+			fileCache.delete(fileCacheKey(store, name, "gzip"))
+			return nil, err
+		}
+
+		current := func(entry *cacheEntry) bool {
+			return entry.modTime.Equal(info.ModTime) && entry.size == info.Size
+		}
+		if entry := fileCache.getIf(key, current); entry != nil {
+			return entry, nil
+		}
+	}
+
+	// Record the metadata of the version actually read, so a write racing
+	// with this read invalidates the entry on the next lookup.
+	f, info, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	etag := newETagHash()
+	etag.Write(content)
+	header.Set("ETag", formatETag(etag))
+	header.Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+
+	entry := &cacheEntry{
+		status:  http.StatusOK,
+		header:  header,
+		body:    content,
+		stored:  time.Now(),
+		path:    reqPath,
+		modTime: info.ModTime,
+		size:    info.Size,
+	}
+	if config.FileCacheMaxSize > 0 && info.Size <= config.FileCacheMaxSize && int64(len(content)) == info.Size {
+		fileCache.set(key, entry)
+	}
+	return entry, nil
+}
+
+// lookupGzipFile is lookupFile for clients that accept gzip. The compressed
+// variant is cached alongside the identity one and is tied to the same file
+// version, so the two are invalidated together. Files that don't shrink
+// when compressed are served as they are.
+func lookupGzipFile(store Storage, name, reqPath string) (*cacheEntry, error) {
+	identity, err := lookupFile(store, name, reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fileCacheKey(store, name, "gzip")
+	sameVersion := func(entry *cacheEntry) bool {
+		return entry.modTime.Equal(identity.modTime) && entry.size == identity.size
+	}
+	if entry := fileCache.getIf(key, sameVersion); entry != nil {
+		return entry, nil
+	}
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	if _, err := gzipWriter.Write(identity.body); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	entry := identity
+	if buf.Len() < len(identity.body) {
+		header := identity.header.Clone()
+		header.Set("Content-Encoding", "gzip")
+		header.Set("ETag", strings.TrimSuffix(identity.header.Get("ETag"), `"`)+`-gzip"`)
+
+		entry = &cacheEntry{
+			status:  http.StatusOK,
+			header:  header,
+			body:    buf.Bytes(),
+			stored:  time.Now(),
+			path:    reqPath,
+			modTime: identity.modTime,
+			size:    identity.size,
+		}
+	}
+	if config.FileCacheMaxSize > 0 && identity.size <= config.FileCacheMaxSize {
+		fileCache.set(key, entry)
+	}
+	return entry, nil
+}
+
+// etagDomain is hashed ahead of a file's contents to make its ETag, so
+// that the ETag isn't the SHA-256 at which -content-addressed storage
+// serves the same contents under /blobs/.
+const etagDomain = "httpserver file\x00"
+
+// newETagHash returns a hash to write a file's contents to, for
+// formatETag.
+func newETagHash() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte(etagDomain))
+	return h
+}
+
+func formatETag(h hash.Hash) string {
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
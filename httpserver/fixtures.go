@@ -0,0 +1,177 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Fixture is a canned response served in place of any handler to requests
+// whose path matches Match, and whose method is Method if that is set. The
+// body is Body, the JSON encoding of JSON, or the contents of BodyFile,
+// read relative to the fixtures file. Latency delays the response.
+type Fixture struct {
+	Method   string            `json:"method"`
+	Match    string            `json:"match"`
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	JSON     json.RawMessage   `json:"json"`
+	BodyFile string            `json:"body_file"`
+	Latency  duration          `json:"latency"`
+
+	pattern *regexp.Regexp
+	body    []byte
+}
+
+// fixtures is the currently loaded -fixtures file, swapped atomically
+// whenever the file changes on disk.
+var fixtures atomic.Pointer[[]*Fixture]
+
+// loadFixtures parses a fixtures file: a JSON array of fixtures, tried in
+// order.
+func loadFixtures(path string) ([]*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Fixture
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&list); err != nil {
+		return nil, err
+	}
+	for i, f := range list {
+		if err := f.prepare(filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("fixture %d (%q): %w", i+1, f.Match, err)
+		}
+	}
+	return list, nil
+}
+
+func (f *Fixture) prepare(dir string) error {
+	pattern, err := regexp.Compile(f.Match)
+	if err != nil {
+		return err
+	}
+	f.pattern = pattern
+	f.Method = strings.ToUpper(f.Method)
+	if f.Status == 0 {
+		f.Status = http.StatusOK
+	}
+	if f.Status < 100 || f.Status > 999 {
+		return fmt.Errorf("invalid status %d", f.Status)
+	}
+	if f.Latency < 0 {
+		return fmt.Errorf("latency may not be negative")
+	}
+
+	bodies := 0
+	for _, set := range []bool{f.Body != "", f.JSON != nil, f.BodyFile != ""} {
+		if set {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return fmt.Errorf("only one of body, json and body_file may be set")
+	}
+	switch {
+	case f.JSON != nil:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, f.JSON); err != nil {
+			return err
+		}
+		f.body = append(buf.Bytes(), '\n')
+		if f.header("Content-Type") == "" {
+			f.setHeader("Content-Type", "application/json; charset=utf-8")
+		}
+	case f.BodyFile != "":
+		name := f.BodyFile
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		f.body = data
+	default:
+		f.body = []byte(f.Body)
+	}
+	return nil
+}
+
+// header looks up a header of the fixture without regard to case.
+func (f *Fixture) header(name string) string {
+	for k, v := range f.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+func (f *Fixture) setHeader(name, value string) {
+	if f.Headers == nil {
+		f.Headers = make(map[string]string)
+	}
+	f.Headers[name] = value
+}
+
+// matches reports whether the fixture answers req. A fixture for GET also
+// answers HEAD.
+func (f *Fixture) matches(req *http.Request) bool {
+	if f.Method != "" && f.Method != req.Method && !(f.Method == http.MethodGet && req.Method == http.MethodHead) {
+		return false
+	}
+	return f.pattern.MatchString(req.URL.Path)
+}
+
+// watchFixtures loads path and then reloads it whenever it changes. A file
+// that fails to load is reported and the previous fixtures stay in effect.
+func watchFixtures(path string) error {
+	list, err := loadFixtures(path)
+	if err != nil {
+		return err
+	}
+	fixtures.Store(&list)
+
+	return watchFile(path, func() {
+		list, err := loadFixtures(path)
+		if err != nil {
+			log.Printf("Error reloading fixtures %s: %v", path, err)
+			return
+		}
+		fixtures.Store(&list)
+		log.Printf("Reloaded fixtures %s (%d fixtures)", path, len(list))
+	})
+}
+
+// applyFixtures answers req with the first fixture that matches it,
+// reporting whether there was one.
+func applyFixtures(conn net.Conn, req *http.Request) bool {
+	list := fixtures.Load()
+	if list == nil {
+		return false
+	}
+	for _, f := range *list {
+		if !f.matches(req) {
+			continue
+		}
+		if f.Latency > 0 && !sleep(req.Context(), time.Duration(f.Latency)) {
+			return true
+		}
+		sendResponse(conn, f.Status, f.body, f.Headers)
+		return true
+	}
+	return false
+}
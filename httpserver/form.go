@@ -0,0 +1,177 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFormSize is the default limit on an urlencoded body.
+const maxFormSize = 64 * 1024
+
+var (
+	errNotForm            = errors.New("request body is not application/x-www-form-urlencoded")
+	errFormTooLarge       = errors.New("form body too large")
+	errUnsupportedCharset = errors.New("unsupported form charset")
+)
+
+// isForm reports whether req carries an urlencoded body.
+func isForm(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// parseForm reads an application/x-www-form-urlencoded body of at most
+// limit bytes and decodes it with decodeForm.
+func parseForm(req *http.Request, limit int64) (formValues, error) {
+	if !isForm(req) {
+		return nil, errNotForm
+	}
+	if req.ContentLength > limit {
+		return nil, errFormTooLarge
+	}
+
+	body := []byte{}
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, limit+1))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(body)) > limit {
+		return nil, errFormTooLarge
+	}
+	return decodeForm(req.Header.Get("Content-Type"), body)
+}
+
+// decodeForm decodes an urlencoded body sent with the given Content-Type.
+// Values are returned as UTF-8: bodies declared as ISO-8859-1 are
+// converted, and charsets other than UTF-8 and US-ASCII are rejected.
+func decodeForm(contentType string, body []byte) (formValues, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errNotForm
+	}
+
+	var latin1 bool
+	switch charset := strings.ToLower(params["charset"]); charset {
+	case "", "utf-8", "us-ascii":
+	case "iso-8859-1", "latin1":
+		latin1 = true
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedCharset, charset)
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	if !latin1 {
+		return formValues(values), nil
+	}
+
+	converted := make(formValues, len(values))
+	for name, vs := range values {
+		name = latin1ToUTF8(name)
+		for _, v := range vs {
+			converted[name] = append(converted[name], latin1ToUTF8(v))
+		}
+	}
+	return converted, nil
+}
+
+// formErrorStatus picks the response status for an error from parseForm.
+func formErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errNotForm), errors.Is(err, errUnsupportedCharset):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errFormTooLarge), errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func latin1ToUTF8(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+// formValues is a parsed form with typed accessors. Each accessor returns
+// def when the field is absent or empty, and an error naming the field
+// when its value can't be converted.
+type formValues url.Values
+
+func (f formValues) String(name, def string) string {
+	if v := url.Values(f).Get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (f formValues) Strings(name string) []string {
+	return f[name]
+}
+
+func (f formValues) Int(name string, def int) (int, error) {
+	v := url.Values(f).Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("field %s: invalid integer %q", name, v)
+	}
+	return n, nil
+}
+
+func (f formValues) Float(name string, def float64) (float64, error) {
+	v := url.Values(f).Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("field %s: invalid number %q", name, v)
+	}
+	return n, nil
+}
+
+// Bool accepts strconv.ParseBool's spellings plus "on", which is what an
+// HTML checkbox sends by default.
+func (f formValues) Bool(name string, def bool) (bool, error) {
+	v := url.Values(f).Get(name)
+	switch v {
+	case "":
+		return def, nil
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("field %s: invalid boolean %q", name, v)
+	}
+	return b, nil
+}
+
+// Seconds parses a non-negative, possibly fractional, number of seconds.
+func (f formValues) Seconds(name string, def time.Duration) (time.Duration, error) {
+	d, err := querySeconds(url.Values(f).Get(name), def)
+	if err != nil {
+		return 0, fmt.Errorf("field %s: %w", name, err)
+	}
+	return d, nil
+}
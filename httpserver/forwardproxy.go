@@ -0,0 +1,116 @@
+package httpserver
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tunnelDialTimeout = 10 * time.Second
+
+// handleForwardProxy serves an absolute-form request such as
+// "GET http://example.com/ HTTP/1.1" by fetching it from the named host.
+func handleForwardProxy(conn net.Conn, req *http.Request) {
+	if req.URL.Scheme != "http" {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	if !forwardProxyAllowed(req.URL.Host, "80") {
+		sendResponse(conn, http.StatusForbidden, nil, nil)
+		return
+	}
+
+	relayRequest(conn, req, forwardProxyTransport, req.URL)
+}
+
+// handleConnect opens a TCP tunnel to the authority named by a CONNECT
+// request and shuttles bytes in both directions until either side closes.
+// reader is the connection's buffered reader, which may already hold the
+// first bytes the client sent through the tunnel.
+func handleConnect(conn net.Conn, reader *bufio.Reader, req *http.Request) {
+	target := req.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	if !forwardProxyAllowed(target, "") {
+		sendResponse(conn, http.StatusForbidden, nil, nil)
+		return
+	}
+	// Whatever the tunnel's outcome, the bytes that follow aren't HTTP.
+	markClosing(conn)
+
+	upstream, err := net.DialTimeout("tcp", target, tunnelDialTimeout)
+	if err != nil {
+		log.Printf("Error opening tunnel to %s: %v", target, err)
+		sendResponse(conn, proxyErrorStatus(err), nil, nil)
+		return
+	}
+	defer upstream.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, reader)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes conn so the peer sees EOF while replies can still
+// flow the other way.
+func closeWrite(conn net.Conn) {
+	if sc, ok := conn.(*serverConn); ok {
+		conn = sc.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// forwardProxyAllowed reports whether authority (host with optional port)
+// matches the -forward-proxy-hosts allowlist. defaultPort is assumed when
+// authority carries no port of its own.
+func forwardProxyAllowed(authority, defaultPort string) bool {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, defaultPort
+	}
+
+	for _, entry := range config.ForwardProxyHosts {
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if strings.HasPrefix(entryHost, "*.") {
+			if strings.HasSuffix(strings.ToLower(host), strings.ToLower(entryHost[1:])) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(host, entryHost) {
+			return true
+		}
+	}
+	return false
+}
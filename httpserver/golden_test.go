@@ -0,0 +1,120 @@
+package httpserver
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the files in testdata/golden with the responses seen")
+
+// checkGolden compares got with testdata/golden/<name>.golden, or writes it
+// there with -update. A mismatch is reported as the lines that differ,
+// quoted so that line endings and trailing spaces show.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response differs from %s (run go test -update if the change is intended):\n%s", path, lineDiff(want, got))
+	}
+}
+
+// lineDiff lists the lines of want and got that differ, position by
+// position. It is meant for responses a few lines long, where anything
+// cleverer isn't needed.
+func lineDiff(want, got []byte) string {
+	wantLines := strings.SplitAfter(string(want), "\n")
+	gotLines := strings.SplitAfter(string(got), "\n")
+	var b strings.Builder
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w == g {
+			continue
+		}
+		if i < len(wantLines) {
+			fmt.Fprintf(&b, "  line %d: -%q\n", i+1, w)
+		}
+		if i < len(gotLines) {
+			fmt.Fprintf(&b, "  line %d: +%q\n", i+1, g)
+		}
+	}
+	return b.String()
+}
+
+// wireResponse sends raw, which should ask for the connection to be
+// closed, and returns every byte the server wrote back.
+func wireResponse(t *testing.T, addr, raw string) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// TestGoldenResponses pins the exact bytes of responses, status line and
+// header order included, so that changes to how they are written show up.
+func TestGoldenResponses(t *testing.T) {
+	addr := startTestServer(t)
+	request := func(method, target, extra string) string {
+		return method + " " + target + " HTTP/1.1\r\nHost: golden\r\nUser-Agent: golden/1.0\r\n" + extra + "Connection: close\r\n\r\n"
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"root", request("GET", "/", "")},
+		{"echo", request("GET", "/echo/abc", "")},
+		{"echo_gzip", request("GET", "/echo/abc", "Accept-Encoding: gzip\r\n")},
+		{"echo_head", request("HEAD", "/echo/abc", "")},
+		{"user_agent", request("GET", "/user-agent", "")},
+		{"not_found", request("GET", "/nowhere", "")},
+		{"file_missing", request("GET", "/files/missing", "")},
+		{"file_upload", request("POST", "/files/golden", "Content-Length: 5\r\n") + "hello"},
+		{"json", request("GET", "/json", "")},
+		{"bad_request", "GET / HTTP/1.1\r\n\r\n"},
+		{"http10", "GET /echo/old HTTP/1.0\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGolden(t, tt.name, wireResponse(t, addr, tt.raw))
+		})
+	}
+}
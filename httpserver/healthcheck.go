@@ -0,0 +1,136 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// duration is a time.Duration that reads from JSON as a string such as
+// "5s" or "250ms".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// HealthCheck configures active probing of a proxy route's upstreams. An
+// upstream is taken out of rotation after UnhealthyThreshold consecutive
+// failed probes and returned after HealthyThreshold consecutive successes.
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	Interval           duration `json:"interval"`
+	Timeout            duration `json:"timeout"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+func (hc *HealthCheck) setDefaults() {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = duration(10 * time.Second)
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = duration(2 * time.Second)
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+}
+
+// startHealthChecks launches a prober for every upstream of every route
+// that has a health check configured.
+func startHealthChecks() {
+	for _, route := range allProxyRoutes() {
+		if route.HealthCheck == nil {
+			continue
+		}
+		for _, u := range route.balancer.upstreams {
+			go probeUpstream(u, *route.HealthCheck)
+		}
+	}
+}
+
+func probeUpstream(u *upstream, hc HealthCheck) {
+	client := &http.Client{
+		Transport: u.transport,
+		Timeout:   time.Duration(hc.Timeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	target := strings.TrimRight(u.target.String(), "/") + hc.Path
+
+	ticker := time.NewTicker(time.Duration(hc.Interval))
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		err := probe(client, target)
+		u.recordProbe(err, hc)
+	}
+}
+
+// probe issues one health check request. Any 2xx or 3xx answer counts as
+// healthy.
+func probe(client *http.Client, target string) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordProbe updates u's health from the outcome of a probe, flipping its
+// state once the relevant threshold of consecutive results is reached.
+func (u *upstream) recordProbe(err error, hc HealthCheck) {
+	u.healthMu.Lock()
+	defer u.healthMu.Unlock()
+
+	u.lastCheck = time.Now()
+	if err != nil {
+		u.lastError = err.Error()
+		u.successes = 0
+		u.failures++
+		if u.failures >= hc.UnhealthyThreshold && u.healthy.Load() {
+			u.healthy.Store(false)
+			log.Printf("Upstream %s marked unhealthy: %v", u.target, err)
+		}
+		return
+	}
+
+	u.lastError = ""
+	u.failures = 0
+	u.successes++
+	if u.successes >= hc.HealthyThreshold && !u.healthy.Load() {
+		u.healthy.Store(true)
+		log.Printf("Upstream %s marked healthy", u.target)
+	}
+}
@@ -0,0 +1,96 @@
+package httpserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// lifecycleHooks are the functions registered to be called as the server
+// runs. Like routes, they are registered before the server starts and
+// only read after that.
+type lifecycleHooks struct {
+	start     []func(addr net.Addr)
+	connOpen  []func(ctx context.Context, conn net.Conn) context.Context
+	connClose []func(conn net.Conn)
+	request   []func(req *http.Request)
+	response  []func(req *http.Request, status int, written int64)
+	shutdown  []func()
+}
+
+var hooks lifecycleHooks
+
+// OnStart registers f to be called with the address of each listener the
+// server starts serving.
+func (s *Server) OnStart(f func(addr net.Addr)) {
+	hooks.start = append(hooks.start, f)
+}
+
+// OnConnectionOpen registers f to be called for each connection accepted.
+// The context f returns, derived from ctx, becomes the parent of the
+// contexts of the requests on the connection, so that values f adds to it
+// can be read by handlers.
+func (s *Server) OnConnectionOpen(f func(ctx context.Context, conn net.Conn) context.Context) {
+	hooks.connOpen = append(hooks.connOpen, f)
+}
+
+// OnConnectionClose registers f to be called once a connection is closed.
+func (s *Server) OnConnectionClose(f func(conn net.Conn)) {
+	hooks.connClose = append(hooks.connClose, f)
+}
+
+// OnRequest registers f to be called with each request before it is
+// routed. f may change the request's header.
+func (s *Server) OnRequest(f func(req *http.Request)) {
+	hooks.request = append(hooks.request, f)
+}
+
+// OnResponse registers f to be called once the response to req has been
+// sent, with its status and the number of bytes written, head included.
+// The status is 0 if no response was sent.
+func (s *Server) OnResponse(f func(req *http.Request, status int, written int64)) {
+	hooks.response = append(hooks.response, f)
+}
+
+// OnShutdown registers f to be called when Shutdown is, before the server
+// stops accepting connections.
+func (s *Server) OnShutdown(f func()) {
+	hooks.shutdown = append(hooks.shutdown, f)
+}
+
+func (h *lifecycleHooks) started(addr net.Addr) {
+	for _, f := range h.start {
+		f(addr)
+	}
+}
+
+func (h *lifecycleHooks) connOpened(ctx context.Context, conn net.Conn) context.Context {
+	for _, f := range h.connOpen {
+		ctx = f(ctx, conn)
+	}
+	return ctx
+}
+
+func (h *lifecycleHooks) connClosed(conn net.Conn) {
+	for _, f := range h.connClose {
+		f(conn)
+	}
+}
+
+func (h *lifecycleHooks) requested(req *http.Request) {
+	for _, f := range h.request {
+		f(req)
+	}
+}
+
+func (h *lifecycleHooks) responded(req *http.Request, status int, written int64) {
+	for _, f := range h.response {
+		f(req, status, written)
+	}
+}
+
+func (h *lifecycleHooks) shuttingDown() {
+	for _, f := range h.shutdown {
+		f()
+	}
+}
@@ -0,0 +1,79 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type connTagKey struct{}
+
+func TestLifecycleHooks(t *testing.T) {
+	t.Cleanup(func() {
+		hooks = lifecycleHooks{}
+		routes = nil
+	})
+	var mu sync.Mutex
+	var events []string
+	record := func(format string, args ...any) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	srv := &Server{}
+	srv.OnConnectionOpen(func(ctx context.Context, conn net.Conn) context.Context {
+		record("open")
+		return context.WithValue(ctx, connTagKey{}, "tagged")
+	})
+	srv.OnConnectionClose(func(conn net.Conn) { record("close") })
+	srv.OnRequest(func(req *http.Request) {
+		record("request %s", req.URL.Path)
+		req.Header.Set("X-Hooked", "yes")
+	})
+	srv.OnResponse(func(req *http.Request, status int, written int64) {
+		record("response %s %d", req.URL.Path, status)
+	})
+	srv.HandleFunc("GET", "/tag", func(w *ResponseWriter, req *http.Request) error {
+		_, err := fmt.Fprintf(w, "%v %s", req.Context().Value(connTagKey{}), req.Header.Get("X-Hooked"))
+		return err
+	})
+	addr := startTestServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /tag HTTP/1.1\r\nHost: a\r\n\r\nGET /missing HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "tagged yes" {
+		t.Errorf("body = %q, want %q", body, "tagged yes")
+	}
+	io.Copy(io.Discard, reader)
+	conn.Close()
+
+	want := []string{"open", "request /tag", "response /tag 200", "request /missing", "response /missing 404", "close"}
+	waitFor(t, "the connection to close", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == len(want)
+	})
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events = %q, want %q", events, want)
+			break
+		}
+	}
+}
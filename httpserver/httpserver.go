@@ -0,0 +1,223 @@
+// Package httpserver is an HTTP/1.1 server with file storage, a caching
+// reverse proxy, sessions and authentication, and a set of httpbin-style
+// test endpoints. Programs embed it by creating a Server from a Config,
+// adding routes of their own with Handle or HandleFunc, and calling
+// ListenAndServe.
+//
+// Much of the server's state is kept at package level, so a process may
+// run only one Server at a time.
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe once Shutdown has
+// been called.
+var ErrServerClosed = errors.New("httpserver: Server closed")
+
+// Server serves requests as its Config says.
+type Server struct {
+	conns *connTracker
+}
+
+// A Handler answers a request by writing its response to w. If it returns
+// an error instead, the response is replaced by one with the status for
+// the error: 404 Not Found for ErrNotFound, 400 Bad
+// Request for ErrBadRequest, 413 Content Too Large for ErrTooLarge, the
+// status of a StatusError, and otherwise 500 Internal Server Error, with
+// the error logged. Once the response has been flushed it can only be cut
+// short.
+type Handler interface {
+	Serve(w *ResponseWriter, req *http.Request) error
+}
+
+// HandlerFunc lets an ordinary function be used as a Handler.
+type HandlerFunc func(w *ResponseWriter, req *http.Request) error
+
+func (f HandlerFunc) Serve(w *ResponseWriter, req *http.Request) error {
+	return f(w, req)
+}
+
+// route is a handler registered with Handle.
+type route struct {
+	method  string
+	pattern string
+	handler Handler
+}
+
+// routes are consulted before the built-in routes.
+var routes []route
+
+// New sets the server up as cfg says: it loads the files cfg names, opens
+// storage, sessions and logs, and starts the background jobs. Fields of
+// cfg left at zero take their value in DefaultConfig, unless zero means
+// something for them, such as turning a feature off.
+func New(cfg Config) (*Server, error) {
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	config = cfg
+	if config.SelfTest {
+		if err := prepareSelfTest(); err != nil {
+			return nil, fmt.Errorf("setting up self-test: %w", err)
+		}
+	}
+
+	if config.RedirectMapPath != "" {
+		if err := watchRedirectMap(config.RedirectMapPath); err != nil {
+			return nil, fmt.Errorf("loading redirect map: %w", err)
+		}
+	}
+	if config.FixturesPath != "" {
+		if err := watchFixtures(config.FixturesPath); err != nil {
+			return nil, fmt.Errorf("loading fixtures: %w", err)
+		}
+	}
+	if err := loadTemplates(); err != nil {
+		return nil, fmt.Errorf("loading templates: %w", err)
+	}
+	openAssets()
+	fileCache, proxyCache = newResponseCache(), newResponseCache()
+	fileCache.setLimits(config.CacheMaxMemory, 0)
+	proxyCache.setLimits(config.CacheMaxMemory, config.CacheMaxDisk)
+	if config.CacheDir != "" {
+		if err := openDiskCache(proxyCache, config.CacheDir); err != nil {
+			return nil, fmt.Errorf("opening cache directory: %w", err)
+		}
+	}
+	if err := openStorage(); err != nil {
+		return nil, fmt.Errorf("opening storage: %w", err)
+	}
+	if err := openSessions(); err != nil {
+		return nil, fmt.Errorf("setting up sessions: %w", err)
+	}
+	var err error
+	users, recorder, audit = nil, nil, nil
+	if config.UsersPath != "" {
+		if users, err = loadUsers(config.UsersPath); err != nil {
+			return nil, fmt.Errorf("loading users: %w", err)
+		}
+	}
+	if config.RecordPath != "" {
+		if recorder, err = openRequestRecorder(config.RecordPath, config.RecordMaxBody); err != nil {
+			return nil, fmt.Errorf("opening request recording: %w", err)
+		}
+	}
+	if config.AuditLogPath != "" {
+		if audit, err = openAuditLog(config.AuditLogPath); err != nil {
+			return nil, fmt.Errorf("opening audit log: %w", err)
+		}
+	}
+	startHealthChecks()
+	startMaintenance()
+
+	return &Server{conns: newConnTracker()}, nil
+}
+
+// Handle serves requests for method and pattern with handler. An empty
+// method matches any, and GET matches HEAD too. A pattern ending in a
+// slash matches every path under it; otherwise the path must be equal to
+// it. The longest matching pattern wins, and one registered for a method
+// wins over one for any method.
+//
+// Registered routes are consulted ahead of the built-in ones, so they can
+// replace them. A path that a registered route matches but not with the
+// request's method, and that no built-in route serves either, is answered
+// with 405 Method Not Allowed.
+//
+// Handle must be called before the server starts serving. It panics if
+// pattern doesn't start with a slash or was already registered for method.
+func (s *Server) Handle(method, pattern string, handler Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("httpserver: pattern %q doesn't start with /", pattern))
+	}
+	method = strings.ToUpper(method)
+	for _, r := range routes {
+		if r.method == method && r.pattern == pattern {
+			panic(fmt.Sprintf("httpserver: %s %s registered twice", method, pattern))
+		}
+	}
+	routes = append(routes, route{method: method, pattern: pattern, handler: handler})
+}
+
+// HandleFunc is Handle for a function.
+func (s *Server) HandleFunc(method, pattern string, handler func(w *ResponseWriter, req *http.Request) error) {
+	s.Handle(method, pattern, HandlerFunc(handler))
+}
+
+// matchRoute returns the registered handler for method and path, if
+// there is one, and otherwise the methods that routes matching path accept.
+func matchRoute(method, path string) (Handler, []string) {
+	var best *route
+	var allowed []string
+	for i := range routes {
+		r := &routes[i]
+		if r.pattern != path && !(strings.HasSuffix(r.pattern, "/") && strings.HasPrefix(path, r.pattern)) {
+			continue
+		}
+		if r.method != "" && r.method != method && !(r.method == http.MethodGet && method == http.MethodHead) {
+			if !slices.Contains(allowed, r.method) {
+				allowed = append(allowed, r.method)
+			}
+			continue
+		}
+		if best == nil || len(r.pattern) > len(best.pattern) || (len(r.pattern) == len(best.pattern) && best.method == "") {
+			best = r
+		}
+	}
+	if best != nil {
+		return best.handler, nil
+	}
+	return nil, allowed
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections
+// until Shutdown is called. In a process started by Restart, it serves the
+// listener handed over instead.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	if err := dropPrivileges(); err != nil {
+		listener.Close()
+		return fmt.Errorf("dropping privileges: %w", err)
+	}
+	log.Println("Starting server on", addr)
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until Shutdown is called, and
+// then returns ErrServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	signalReady()
+	hooks.started(listener.Addr())
+	s.conns.serve(listener)
+	return ErrServerClosed
+}
+
+// Shutdown stops the server from accepting connections, closes idle ones,
+// and waits for requests in flight to finish. If ctx ends first, the
+// connections still open are closed and its error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	hooks.shuttingDown()
+	return s.conns.shutdown(ctx)
+}
+
+// Commands are the subcommands the server program provides besides
+// serving, by name. Each takes the arguments following its name.
+var Commands = map[string]func(args []string){
+	"hash-password":    func([]string) { runHashPassword() },
+	"verify-audit-log": runVerifyAuditLog,
+	"loadtest":         runLoadTest,
+	"replay":           runReplay,
+}
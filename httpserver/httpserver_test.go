@@ -0,0 +1,66 @@
+package httpserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewFillsDefaults(t *testing.T) {
+	srv, err := New(Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/echo/hi", nil)
+	req.Header.Set("X-Test", "1")
+	resp, err := testClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /echo/hi with a header = %d, want 200", resp.StatusCode)
+	}
+	if config.MaxHeaderCount != defaultMaxHeaderCount || config.SessionIdleTimeout != defaultSessionIdleTimeout || config.MaxUploadSize != defaultMaxUploadSize {
+		t.Errorf("New left defaults unset: %+v", config)
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	for _, cfg := range []Config{
+		{Storage: "tape"},
+		{SessionStore: "file"},
+		{MaxHeaderCount: -1},
+		{Chroot: "/srv"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestParseFlagsDefaults(t *testing.T) {
+	cfg, err := ParseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.setDefaults()
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("ParseFlags(nil) = %+v\nwant DefaultConfig() = %+v", cfg, want)
+	}
+}
@@ -0,0 +1,110 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxJSONBody is the largest request body BindJSON decodes.
+const maxJSONBody = 64 * 1024
+
+// JSONError describes why a request body isn't the JSON a handler expects.
+// Returned from a Handler, it is answered with its Status and itself as
+// the JSON body, so that clients can tell what to fix.
+type JSONError struct {
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+	// Field is the field whose value was wrong, and Offset the byte of
+	// the body where decoding failed, when known.
+	Field  string `json:"field,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+func (e *JSONError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s (field %s)", e.Message, e.Field)
+	}
+	return e.Message
+}
+
+// BindJSON decodes the JSON body of req into v. A body declared as some
+// other type is refused, as is one larger than 64KiB, one holding fields v
+// lacks, and one holding anything after the value.
+func BindJSON(req *http.Request, v any) error {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return &JSONError{Status: http.StatusUnsupportedMediaType, Message: "Content-Type must be application/json"}
+		}
+	}
+	if req.Body == nil {
+		return &JSONError{Status: http.StatusBadRequest, Message: "body is empty"}
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, req.Body, maxJSONBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return jsonDecodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the value")
+		}
+		return jsonDecodeError(err)
+	}
+	return nil
+}
+
+// jsonDecodeError turns an error from decoding a request body into the
+// JSONError to answer with, or returns it as it is if it came from reading
+// the body rather than from what it holds.
+func jsonDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &tooLarge):
+		return &JSONError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("body is larger than %d bytes", tooLarge.Limit)}
+	case errors.Is(err, errIncompleteBody), errors.As(err, &netErr):
+		return err
+	case errors.As(err, &syntaxErr):
+		return &JSONError{Status: http.StatusBadRequest, Message: "malformed JSON: " + syntaxErr.Error(), Offset: syntaxErr.Offset}
+	case errors.As(err, &typeErr):
+		return &JSONError{Status: http.StatusBadRequest, Message: fmt.Sprintf("expected %s, not %s", typeErr.Type, typeErr.Value), Field: typeErr.Field, Offset: typeErr.Offset}
+	case err == io.EOF:
+		return &JSONError{Status: http.StatusBadRequest, Message: "body is empty"}
+	case err == io.ErrUnexpectedEOF:
+		return &JSONError{Status: http.StatusBadRequest, Message: "body ends part way through the JSON"}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &JSONError{Status: http.StatusBadRequest, Message: "unknown field", Field: field}
+	default:
+		return &JSONError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+}
+
+// JSON answers with v encoded as JSON.
+func (w *ResponseWriter) JSON(status int, v any) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(v)
+}
+
+// sendBindError answers a request whose body BindJSON refused.
+func sendBindError(conn net.Conn, err error) {
+	var jsonErr *JSONError
+	if errors.As(err, &jsonErr) {
+		sendJSON(conn, jsonErr.Status, jsonErr, false)
+		return
+	}
+	sendResponse(conn, bodyErrorStatus(err), nil, nil)
+}
@@ -0,0 +1,78 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBindJSON(t *testing.T) {
+	t.Cleanup(func() { routes = nil })
+	srv := &Server{}
+	srv.HandleFunc("POST", "/greet", func(w *ResponseWriter, req *http.Request) error {
+		var body struct {
+			Name  string `json:"name"`
+			Times int    `json:"times"`
+		}
+		if err := BindJSON(req, &body); err != nil {
+			return err
+		}
+		return w.JSON(http.StatusOK, map[string]string{"greeting": strings.Repeat("hi ", body.Times) + body.Name})
+	})
+	addr := startTestServer(t)
+
+	tests := []struct {
+		name, contentType, body string
+		status                  int
+		want                    map[string]any
+	}{
+		{"ok", "application/json", `{"name":"ann","times":2}`, 200, map[string]any{"greeting": "hi hi ann"}},
+		{"no content type", "", `{"name":"ann"}`, 200, map[string]any{"greeting": "ann"}},
+		{"form", "application/x-www-form-urlencoded", `name=ann`, 415, map[string]any{"error": "Content-Type must be application/json"}},
+		{"empty", "application/json", ``, 400, map[string]any{"error": "body is empty"}},
+		{"malformed", "application/json", `{"name":}`, 400, map[string]any{"error": "malformed JSON: invalid character '}' looking for beginning of value", "offset": 9.0}},
+		{"wrong type", "application/json", `{"times":"two"}`, 400, map[string]any{"error": "expected int, not string", "field": "times", "offset": 14.0}},
+		{"unknown field", "application/json", `{"nmae":"ann"}`, 400, map[string]any{"error": "unknown field", "field": "nmae"}},
+		{"truncated", "application/json", `{"name":"ann"`, 400, map[string]any{"error": "body ends part way through the JSON"}},
+		{"trailing data", "application/json", `{"name":"ann"} {}`, 400, nil},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("a", maxJSONBody) + `"}`, 413, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/greet", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := testClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var got map[string]any
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if tt.want == nil {
+				if got["error"] == nil {
+					t.Errorf("response %v has no error", got)
+				}
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("response = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTestOptions are the flags of the loadtest subcommand.
+type loadTestOptions struct {
+	url         string
+	method      string
+	body        []byte
+	header      http.Header
+	concurrency int
+	duration    time.Duration
+	requests    int
+	timeout     time.Duration
+	keepAlive   bool
+}
+
+// loadTestResult is what one worker saw.
+type loadTestResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    map[string]int
+	bytes     int64
+}
+
+// headerFlags collects repeated -H "Name: value" flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string { return "" }
+
+func (h headerFlags) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || !isToken(name) {
+		return fmt.Errorf("header %q is not Name: value", s)
+	}
+	http.Header(h).Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// runLoadTest implements "loadtest [flags] <url>": it sends requests to url
+// from -c workers for -d, or until -n requests have been sent, and reports
+// throughput, status codes and latency percentiles.
+func runLoadTest(args []string) {
+	opts := loadTestOptions{header: make(http.Header)}
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	fs.StringVar(&opts.method, "X", http.MethodGet, "request method")
+	body := fs.String("body", "", "request body; @file reads it from a file")
+	fs.Var(headerFlags(opts.header), "H", "request header as \"Name: value\" (repeatable)")
+	fs.IntVar(&opts.concurrency, "c", 10, "concurrent workers, each with its own connection")
+	fs.DurationVar(&opts.duration, "d", 10*time.Second, "how long to run")
+	fs.IntVar(&opts.requests, "n", 0, "stop after this many requests (0 for no limit)")
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout for each request")
+	fs.BoolVar(&opts.keepAlive, "keepalive", true, "reuse connections between requests")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest [flags] <url>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || opts.concurrency < 1 || opts.duration <= 0 || opts.requests < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts.url = fs.Arg(0)
+	if name, ok := strings.CutPrefix(*body, "@"); ok {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			log.Fatalf("Error reading body: %v", err)
+		}
+		opts.body = data
+	} else {
+		opts.body = []byte(*body)
+	}
+	if _, err := http.NewRequest(opts.method, opts.url, nil); err != nil {
+		log.Fatalf("Invalid request: %v", err)
+	}
+
+	if opts.requests > 0 {
+		fmt.Printf("Sending %d requests to %s %s with %d workers, for at most %v\n", opts.requests, opts.method, opts.url, opts.concurrency, opts.duration)
+	} else {
+		fmt.Printf("Running %s %s with %d workers for %v\n", opts.method, opts.url, opts.concurrency, opts.duration)
+	}
+	start := time.Now()
+	results := loadTest(opts)
+	printLoadTestReport(os.Stdout, results, time.Since(start))
+}
+
+// loadTest runs the workers and returns what each of them saw.
+func loadTest(opts loadTestOptions) []loadTestResult {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: opts.concurrency,
+		DisableKeepAlives:   !opts.keepAlive,
+		DisableCompression:  true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   opts.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.duration)
+	defer cancel()
+	// tickets hands out the -n requests; it is nil when there is no limit.
+	var tickets chan struct{}
+	if opts.requests > 0 {
+		tickets = make(chan struct{}, opts.requests)
+		for i := 0; i < opts.requests; i++ {
+			tickets <- struct{}{}
+		}
+		close(tickets)
+	}
+
+	results := make([]loadTestResult, opts.concurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(r *loadTestResult) {
+			defer wg.Done()
+			r.statuses = make(map[int]int)
+			r.errors = make(map[string]int)
+			for ctx.Err() == nil {
+				if tickets != nil {
+					if _, ok := <-tickets; !ok {
+						return
+					}
+				}
+				r.send(ctx, client, opts)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// send makes one request and records its outcome. Requests cut off by the
+// end of the run aren't counted.
+func (r *loadTestResult) send(ctx context.Context, client *http.Client, opts loadTestOptions) {
+	req, err := http.NewRequestWithContext(ctx, opts.method, opts.url, bytes.NewReader(opts.body))
+	if err != nil {
+		r.errors[err.Error()]++
+		return
+	}
+	req.Header = opts.header.Clone()
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		r.bytes += n
+	}
+	if ctx.Err() != nil && errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if err != nil {
+		r.errors[loadTestErrorKind(err)]++
+		return
+	}
+	r.latencies = append(r.latencies, time.Since(start))
+	r.statuses[resp.StatusCode]++
+}
+
+// loadTestErrorKind shortens an error to something that can be counted,
+// dropping the URL that net/http puts in front of it.
+func loadTestErrorKind(err error) string {
+	msg := err.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return msg
+}
+
+func printLoadTestReport(w io.Writer, results []loadTestResult, elapsed time.Duration) {
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	errs := make(map[string]int)
+	var bytes int64
+	failed := 0
+	for _, r := range results {
+		latencies = append(latencies, r.latencies...)
+		for status, n := range r.statuses {
+			statuses[status] += n
+		}
+		for msg, n := range r.errors {
+			errs[msg] += n
+			failed += n
+		}
+		bytes += r.bytes
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	seconds := elapsed.Seconds()
+	fmt.Fprintf(w, "\nRequests:   %d completed, %d failed in %.2fs\n", len(latencies), failed, seconds)
+	fmt.Fprintf(w, "Throughput: %.1f requests/s, %.1f KiB/s\n", float64(len(latencies))/seconds, float64(bytes)/1024/seconds)
+
+	if len(latencies) > 0 {
+		var total time.Duration
+		for _, l := range latencies {
+			total += l
+		}
+		fmt.Fprintf(w, "\nLatency:\n")
+		fmt.Fprintf(w, "  min   %v\n", latencies[0].Round(time.Microsecond))
+		fmt.Fprintf(w, "  mean  %v\n", (total / time.Duration(len(latencies))).Round(time.Microsecond))
+		for _, p := range []float64{50, 90, 95, 99, 99.9} {
+			fmt.Fprintf(w, "  p%-4g %v\n", p, percentile(latencies, p).Round(time.Microsecond))
+		}
+		fmt.Fprintf(w, "  max   %v\n", latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+
+	if len(statuses) > 0 {
+		codes := make([]int, 0, len(statuses))
+		for status := range statuses {
+			codes = append(codes, status)
+		}
+		sort.Ints(codes)
+		fmt.Fprintf(w, "\nStatus codes:\n")
+		for _, status := range codes {
+			fmt.Fprintf(w, "  %d  %d\n", status, statuses[status])
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "\nErrors:\n")
+		for msg, n := range errs {
+			fmt.Fprintf(w, "  %d  %s\n", n, msg)
+		}
+	}
+}
+
+// percentile returns the p-th percentile of sorted, by the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
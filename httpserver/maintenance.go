@@ -0,0 +1,336 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maintenanceJitter is the fraction of its interval by which each run
+	// of a job is moved earlier or later at random, so that servers started
+	// together don't all do the same work at the same moment.
+	maintenanceJitter = 0.1
+	// tempFileMaxAge is how long a temporary file must have gone untouched
+	// before it is taken to be left over from an interrupted write.
+	tempFileMaxAge = time.Hour
+)
+
+// maintenanceJob is a task run in the background every interval. run
+// returns how many things it cleaned up or updated.
+type maintenanceJob struct {
+	name     string
+	interval time.Duration
+	run      func(now time.Time) (int, error)
+
+	mu           sync.Mutex
+	runs         int64
+	failures     int64
+	items        int64
+	lastRun      time.Time
+	lastDuration time.Duration
+}
+
+// maintenanceJobs are started by startMaintenance and reported by
+// /metrics.
+var maintenanceJobs = []*maintenanceJob{
+	{name: "temp_files", interval: 10 * time.Minute, run: removeOrphanedTempFiles},
+	{name: "storage_usage", interval: 5 * time.Minute, run: recalculateStorageUsage},
+	{name: "cache_compaction", interval: 10 * time.Minute, run: compactCaches},
+	{name: "sessions", interval: time.Minute, run: purgeSessions},
+	{name: "expired_files", interval: reapInterval, run: reapExpiredFiles},
+}
+
+// startMaintenance runs every maintenance job on its own schedule.
+func startMaintenance() {
+	for _, job := range maintenanceJobs {
+		go func(job *maintenanceJob) {
+			for {
+				time.Sleep(jittered(job.interval))
+				job.runOnce(time.Now())
+			}
+		}(job)
+	}
+}
+
+// jittered returns d moved by up to maintenanceJitter of itself either way.
+func jittered(d time.Duration) time.Duration {
+	spread := int64(float64(d) * maintenanceJitter)
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// runOnce runs the job, unless Restart has handed the server's state over
+// to a new process.
+func (j *maintenanceJob) runOnce(now time.Time) {
+	if !stateWrites.enter() {
+		return
+	}
+	n, err := j.run(now)
+	stateWrites.leave()
+	took := time.Since(now)
+	if err != nil {
+		log.Printf("Error in maintenance job %s: %v", j.name, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runs++
+	if err != nil {
+		j.failures++
+	}
+	j.items += int64(n)
+	j.lastRun = now
+	j.lastDuration = took
+}
+
+// removeOrphanedTempFiles removes the temporary files of writes that never
+// finished, such as uploads cut short by a crash: those beside the files in
+// each data directory or the -storage=db database, the spooled uploads of -content-addressed storage,
+// body files the disk cache no longer refers to, and half-written
+// sessions.
+func removeOrphanedTempFiles(now time.Time) (int, error) {
+	before := now.Add(-tempFileMaxAge)
+	removed := 0
+	var errs []error
+	sweep := func(dir string, recurse bool, orphaned func(name string) bool) {
+		n, err := removeStaleFiles(dir, recurse, before, orphaned)
+		removed += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.Storage == "disk" {
+		upload := func(name string) bool {
+			return strings.HasPrefix(name, ".") && strings.Contains(name, ".upload-")
+		}
+		sweep(config.DataDir, true, upload)
+		for _, vh := range config.VirtualHosts {
+			sweep(vh.DataDir, true, upload)
+		}
+	}
+	if config.Storage == "db" {
+		sweep(config.DataDir, false, func(name string) bool {
+			return strings.HasPrefix(name, "."+storageDBName+".upload-")
+		})
+	}
+	for _, dir := range contentSpools {
+		sweep(dir, false, func(name string) bool { return strings.HasPrefix(name, spoolPrefix) })
+	}
+	if config.CacheDir != "" {
+		referenced := make(map[string]bool)
+		proxyCache.mu.Lock()
+		for _, entry := range proxyCache.entries {
+			if entry.file != "" {
+				referenced[entry.file] = true
+			}
+		}
+		proxyCache.mu.Unlock()
+		sweep(config.CacheDir, false, func(name string) bool {
+			return name != diskIndexName && !referenced[name]
+		})
+	}
+	if config.SessionStore == "file" {
+		sweep(config.SessionDir, false, func(name string) bool { return strings.HasPrefix(name, ".session-") })
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d orphaned temporary files", removed)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// removeStaleFiles removes the files in dir, and in its subdirectories if
+// recurse is set, that orphaned accepts and that were last modified before
+// the given time.
+func removeStaleFiles(dir string, recurse bool, before time.Time, orphaned func(name string) bool) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && !recurse {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !orphaned(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// contentSpools lists the spool directory of every contentStorage, swept
+// by the temp_files job.
+var contentSpools []string
+
+// memoryStorages lists every memoryStorage, whose sizes are recalculated
+// by the storage_usage job.
+var memoryStorages []*memoryStorage
+
+// storageUsage holds the bytes of files kept by each host, as last
+// counted by the storage_usage job.
+var storageUsage struct {
+	sync.Mutex
+	bytes map[string]int64
+}
+
+// recalculateStorageUsage counts the bytes each host keeps under /files/
+// and corrects the running total that -storage-max-size is enforced
+// against in memory storage. It returns how many totals had drifted.
+func recalculateStorageUsage(now time.Time) (int, error) {
+	corrected := 0
+	for _, s := range memoryStorages {
+		if s.recalculate() {
+			corrected++
+		}
+	}
+
+	hosts := map[string]Storage{"": fileStorage}
+	for _, vh := range config.VirtualHosts {
+		hosts[vh.Hosts[0]] = vh.storage
+	}
+	usage := make(map[string]int64, len(hosts))
+	var errs []error
+	for host, store := range hosts {
+		files, err := store.List()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing files of %q: %w", host, err))
+			continue
+		}
+		for _, f := range files {
+			usage[host] += f.Size
+		}
+	}
+
+	storageUsage.Lock()
+	storageUsage.bytes = usage
+	storageUsage.Unlock()
+	return corrected, errors.Join(errs...)
+}
+
+// recalculate sets the running total of stored bytes from the files
+// themselves, reporting whether it was wrong.
+func (s *memoryStorage) recalculate() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var size int64
+	for _, f := range s.files {
+		size += int64(len(f.data))
+	}
+	drifted := size != s.size
+	s.size = size
+	return drifted
+}
+
+// compactCaches drops the proxy cache entries that can be neither served
+// nor revalidated any more, which would otherwise stay until evicted.
+func compactCaches(now time.Time) (int, error) {
+	n := proxyCache.purge(func(e *cacheEntry) bool {
+		return !e.fresh(now) && !e.usableWhileRevalidating(now) && !e.hasValidators()
+	})
+	return n, nil
+}
+
+func purgeSessions(now time.Time) (int, error) {
+	n := sessions.sweep(now)
+	if n > 0 {
+		log.Printf("Removed %d expired sessions", n)
+	}
+	return n, nil
+}
+
+func reapExpiredFiles(now time.Time) (int, error) {
+	all := []*fileExpiries{defaultFileExpiries}
+	for _, vh := range config.VirtualHosts {
+		all = append(all, vh.expiries)
+	}
+	total := 0
+	for _, e := range all {
+		total += e.reap(now)
+	}
+	if total > 0 {
+		log.Printf("Removed %d expired files", total)
+	}
+	return total, nil
+}
+
+// writeMaintenanceMetrics writes one series per job for each maintenance
+// metric, and the storage usage last counted.
+func writeMaintenanceMetrics(buf *bytes.Buffer) {
+	type snapshot struct {
+		name                  string
+		runs, failures, items int64
+		lastRun               time.Time
+		lastDuration          time.Duration
+	}
+	jobs := make([]snapshot, len(maintenanceJobs))
+	for i, j := range maintenanceJobs {
+		j.mu.Lock()
+		jobs[i] = snapshot{j.name, j.runs, j.failures, j.items, j.lastRun, j.lastDuration}
+		j.mu.Unlock()
+	}
+
+	family := func(name, kind, help string, value func(s snapshot) any) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range jobs {
+			fmt.Fprintf(buf, "%s{job=%q} %v\n", name, s.name, value(s))
+		}
+	}
+	family("http_maintenance_runs_total", "counter", "Times each maintenance job has run.", func(s snapshot) any {
+		return s.runs
+	})
+	family("http_maintenance_failures_total", "counter", "Maintenance job runs that reported an error.", func(s snapshot) any {
+		return s.failures
+	})
+	family("http_maintenance_items_total", "counter", "Things cleaned up or updated by each maintenance job.", func(s snapshot) any {
+		return s.items
+	})
+	family("http_maintenance_last_duration_seconds", "gauge", "How long the last run of each maintenance job took.", func(s snapshot) any {
+		return s.lastDuration.Seconds()
+	})
+	family("http_maintenance_last_run_timestamp_seconds", "gauge", "When each maintenance job last ran, or 0 if it hasn't.", func(s snapshot) any {
+		if s.lastRun.IsZero() {
+			return 0
+		}
+		return s.lastRun.Unix()
+	})
+
+	storageUsage.Lock()
+	hosts := make([]string, 0, len(storageUsage.bytes))
+	for host := range storageUsage.bytes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	fmt.Fprintf(buf, "# HELP http_storage_used_bytes Bytes of files kept by each host, as last counted.\n# TYPE http_storage_used_bytes gauge\n")
+	for _, host := range hosts {
+		fmt.Fprintf(buf, "http_storage_used_bytes{host=%q} %d\n", host, storageUsage.bytes[host])
+	}
+	storageUsage.Unlock()
+}
@@ -0,0 +1,132 @@
+package httpserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJittered(t *testing.T) {
+	const d = 10 * time.Minute
+	spread := time.Duration(float64(d) * maintenanceJitter)
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		got := jittered(d)
+		if got < d-spread || got > d+spread {
+			t.Fatalf("jittered(%v) = %v, want within %v of it", d, got, spread)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("jittered(%v) always returned %v", d, jittered(d))
+	}
+	if got := jittered(5); got != 5 {
+		t.Errorf("jittered(5ns) = %v, want it unchanged", got)
+	}
+}
+
+func TestRemoveStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-2 * tempFileMaxAge)
+	files := map[string]time.Time{
+		".a.upload-1":     old,
+		".b.upload-2":     now,
+		"kept":            old,
+		"sub/.c.upload-3": old,
+	}
+	for name, modTime := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload := func(name string) bool { return strings.Contains(name, ".upload-") }
+	before := now.Add(-tempFileMaxAge)
+
+	tests := []struct {
+		recurse bool
+		removed int
+		left    []string
+	}{
+		{false, 1, []string{".b.upload-2", "kept", "sub/.c.upload-3"}},
+		{true, 1, []string{".b.upload-2", "kept"}},
+	}
+	for _, tt := range tests {
+		n, err := removeStaleFiles(dir, tt.recurse, before, upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.removed {
+			t.Errorf("recurse=%v: removed %d files, want %d", tt.recurse, n, tt.removed)
+		}
+		var left []string
+		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				rel, _ := filepath.Rel(dir, path)
+				left = append(left, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		sort.Strings(left)
+		if strings.Join(left, " ") != strings.Join(tt.left, " ") {
+			t.Errorf("recurse=%v: left %q, want %q", tt.recurse, left, tt.left)
+		}
+	}
+
+	if n, err := removeStaleFiles(filepath.Join(dir, "missing"), true, before, upload); n != 0 || err != nil {
+		t.Errorf("missing directory: removed %d, %v", n, err)
+	}
+}
+
+func TestRemoveOrphanedSpooledUploads(t *testing.T) {
+	defer func(spools []string) { contentSpools = spools }(contentSpools)
+	contentSpools = nil
+	addr := startTestServer(t, "-content-addressed")
+	spool := filepath.Join(config.DataDir, ".blobs")
+	if len(contentSpools) != 1 || contentSpools[0] != spool {
+		t.Fatalf("spool directories = %q, want [%q]", contentSpools, spool)
+	}
+
+	resp, err := testClient().Post("http://"+addr+"/files/a.txt", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want 201", resp.StatusCode)
+	}
+	if left, _ := filepath.Glob(filepath.Join(spool, spoolPrefix+"*")); len(left) != 0 {
+		t.Errorf("upload left %q in the spool", left)
+	}
+
+	old := time.Now().Add(-2 * tempFileMaxAge)
+	for _, name := range []string{spoolPrefix + "1", "upload-2"} {
+		path := filepath.Join(spool, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := removeOrphanedTempFiles(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(spool, spoolPrefix+"1")); !os.IsNotExist(err) {
+		t.Errorf("stale spooled upload was kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(spool, "upload-2")); err != nil {
+		t.Errorf("file that isn't the server's was removed: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package httpserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// cacheAgeBuckets are the upper bounds, in seconds, of the
+// http_cache_entry_age_seconds histogram.
+var cacheAgeBuckets = []float64{1, 10, 60, 300, 900, 3600, 21600, 86400}
+
+// handleMetrics reports server and cache metrics in the Prometheus text
+// exposition format.
+func handleMetrics(conn net.Conn, req *http.Request) {
+	var buf bytes.Buffer
+	stats := currentStats()
+
+	writeMetric(&buf, "http_uptime_seconds", "gauge", "Seconds since the server started.", stats.UptimeSeconds)
+	writeMetric(&buf, "http_goroutines", "gauge", "Number of running goroutines.", stats.Goroutines)
+	writeMetric(&buf, "http_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.", stats.HeapAllocBytes)
+	writeMetric(&buf, "http_active_connections", "gauge", "Connections currently open.", stats.ActiveConnections)
+	writeMetric(&buf, "http_connections_total", "counter", "Connections accepted.", stats.TotalConnections)
+	writeMetric(&buf, "http_connections_refused_total", "counter", "Connections refused for being over -max-conns-per-ip or from a banned address.", stats.RefusedConnections)
+	writeMetric(&buf, "http_requests_total", "counter", "Requests parsed.", stats.TotalRequests)
+
+	writeCacheMetrics(&buf, []namedCache{{"files", fileCache}, {"proxy", proxyCache}})
+	writeMaintenanceMetrics(&buf)
+
+	sendResponse(conn, http.StatusOK, buf.Bytes(), map[string]string{
+		"Content-Type": "text/plain; version=0.0.4; charset=utf-8",
+	})
+}
+
+func writeMetric(buf *bytes.Buffer, name, kind, help string, value any) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+type namedCache struct {
+	name  string
+	cache *responseCache
+}
+
+// writeCacheMetrics writes one series per cache for each cache metric,
+// labelled with the cache's name.
+func writeCacheMetrics(buf *bytes.Buffer, named []namedCache) {
+	now := time.Now()
+	names := make([]string, len(named))
+	caches := make(map[string]*responseCache, len(named))
+	usage := make(map[string]cacheUsage, len(named))
+	for i, nc := range named {
+		names[i] = nc.name
+		caches[nc.name] = nc.cache
+		usage[nc.name] = nc.cache.usage(now)
+	}
+
+	family := func(name, kind, help string, value func(name string) any) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, cache := range names {
+			fmt.Fprintf(buf, "%s{cache=%q} %v\n", name, cache, value(cache))
+		}
+	}
+
+	family("http_cache_entries", "gauge", "Entries currently cached.", func(name string) any {
+		return usage[name].entries
+	})
+	fmt.Fprintf(buf, "# HELP http_cache_size_bytes Bytes of cached bodies, by where they are kept.\n# TYPE http_cache_size_bytes gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "http_cache_size_bytes{cache=%q,tier=\"memory\"} %d\n", name, usage[name].memoryBytes)
+		fmt.Fprintf(buf, "http_cache_size_bytes{cache=%q,tier=\"disk\"} %d\n", name, usage[name].diskBytes)
+	}
+	family("http_cache_hits_total", "counter", "Lookups answered from the cache.", func(name string) any {
+		return caches[name].hits.Load()
+	})
+	family("http_cache_misses_total", "counter", "Lookups that found no usable entry.", func(name string) any {
+		return caches[name].misses.Load()
+	})
+	family("http_cache_hit_ratio", "gauge", "Hits as a fraction of all lookups since startup.", func(name string) any {
+		hits, misses := caches[name].hits.Load(), caches[name].misses.Load()
+		if hits+misses == 0 {
+			return 0
+		}
+		return float64(hits) / float64(hits+misses)
+	})
+	family("http_cache_evictions_total", "counter", "Entries evicted to stay within budget or purged.", func(name string) any {
+		return caches[name].evictions.Load()
+	})
+
+	fmt.Fprintf(buf, "# HELP http_cache_entry_age_seconds Age of the entries currently cached.\n# TYPE http_cache_entry_age_seconds histogram\n")
+	for _, name := range names {
+		ages := usage[name].ages
+		var sum float64
+		counts := make([]int, len(cacheAgeBuckets))
+		for _, age := range ages {
+			seconds := age.Seconds()
+			sum += seconds
+			for i, bound := range cacheAgeBuckets {
+				if seconds <= bound {
+					counts[i]++
+				}
+			}
+		}
+		for i, bound := range cacheAgeBuckets {
+			fmt.Fprintf(buf, "http_cache_entry_age_seconds_bucket{cache=%q,le=\"%g\"} %d\n", name, bound, counts[i])
+		}
+		fmt.Fprintf(buf, "http_cache_entry_age_seconds_bucket{cache=%q,le=\"+Inf\"} %d\n", name, len(ages))
+		fmt.Fprintf(buf, "http_cache_entry_age_seconds_sum{cache=%q} %g\n", name, sum)
+		fmt.Fprintf(buf, "http_cache_entry_age_seconds_count{cache=%q} %d\n", name, len(ages))
+	}
+}
@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var (
+	errEncodedSeparator = errors.New("encoded path separator")
+	errControlInPath    = errors.New("control character in path")
+)
+
+// normalizePath puts an origin-form request path into the canonical form
+// the router and the filesystem layer expect: percent-decoded, with "."
+// and ".." segments resolved (RFC 3986 5.2.4) and duplicate slashes
+// collapsed. Paths that only make sense as an attack, such as an encoded
+// slash that would let "..%2f" slip past segment handling or an encoded
+// NUL, are rejected.
+func normalizePath(u *url.URL) error {
+	escaped := strings.ToLower(u.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+		return errEncodedSeparator
+	}
+	for i := 0; i < len(u.Path); i++ {
+		if c := u.Path[i]; c < 0x20 || c == 0x7f {
+			return errControlInPath
+		}
+	}
+
+	u.Path = removeDotSegments(u.Path)
+	u.RawPath = ""
+	return nil
+}
+
+// removeDotSegments resolves "." and ".." in an absolute path. A ".." at
+// the root stays at the root rather than escaping it. Trailing slashes are
+// kept, since /echo/ and /echo are different routes.
+func removeDotSegments(path string) string {
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments[1:] {
+		last := i == len(segments)-2
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		case "":
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
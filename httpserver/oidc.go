@@ -0,0 +1,500 @@
+package httpserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcClockSkew is how far the provider's clock may be from ours.
+const oidcClockSkew = 2 * time.Minute
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// OIDCProvider protects the paths under Prefixes with an OpenID Connect
+// identity provider: visitors without a session from it are sent to log in
+// there, and come back to /oidc/<name>/callback, which must be registered
+// with the provider as a redirect URI.
+type OIDCProvider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	Prefixes     []string `json:"prefixes"`
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+}
+
+// oidcDiscovery is the part of the provider's metadata document
+// (OpenID Connect Discovery 1.0, section 3) that we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcPending is kept in the session between sending a visitor to the
+// provider and their return to the callback.
+type oidcPending struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+func (p *OIDCProvider) validate() error {
+	switch {
+	case p.Name == "" || strings.ContainsAny(p.Name, "/?#"):
+		return errors.New("name is required and may not contain / ? or #")
+	case p.Issuer == "" || p.ClientID == "":
+		return errors.New("issuer and client_id are required")
+	}
+	for _, prefix := range p.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("prefix %q must start with /", prefix)
+		}
+	}
+	if !slices.Contains(p.Scopes, "openid") {
+		p.Scopes = append([]string{"openid"}, p.Scopes...)
+	}
+	return nil
+}
+
+func (p *OIDCProvider) callbackPath() string {
+	return "/oidc/" + p.Name + "/callback"
+}
+
+func (p *OIDCProvider) protects(path string) bool {
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireOIDC sends visitors to a protected path off to log in unless their
+// session came from the path's provider. It returns false when it has
+// responded.
+func requireOIDC(conn net.Conn, req *http.Request) bool {
+	for _, p := range config.OIDCProviders {
+		if req.URL.Path == p.callbackPath() {
+			handleOIDCCallback(conn, req, p)
+			return false
+		}
+		if !p.protects(req.URL.Path) {
+			continue
+		}
+
+		sess := loadSession(req)
+		if sess.data.AuthProvider == p.Name {
+			return true
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			// Only a navigation can be replayed after logging in.
+			sendResponse(conn, http.StatusUnauthorized, nil, nil)
+			return false
+		}
+		startOIDCLogin(conn, req, p, sess)
+		return false
+	}
+	return true
+}
+
+// startOIDCLogin redirects to the provider's authorization endpoint using
+// the authorization code flow with PKCE (RFC 7636).
+func startOIDCLogin(conn net.Conn, req *http.Request, p *OIDCProvider, sess *session) {
+	discovery, err := p.discover()
+	if err != nil {
+		log.Printf("Error discovering OpenID provider %s: %v", p.Name, err)
+		sendResponse(conn, http.StatusBadGateway, nil, nil)
+		return
+	}
+
+	pending := oidcPending{ReturnTo: req.URL.RequestURI()}
+	for _, field := range []*string{&pending.State, &pending.Nonce, &pending.Verifier} {
+		if *field, err = randomToken(); err != nil {
+			sendError(conn, fmt.Errorf("starting OpenID login: %w", err))
+			return
+		}
+	}
+	encoded, err := json.Marshal(pending)
+	if err != nil {
+		sendError(conn, fmt.Errorf("encoding OpenID login state: %w", err))
+		return
+	}
+	sess.Set("oidc:"+p.Name, string(encoded))
+	cookie, err := sess.save(conn, req)
+	if err != nil {
+		sendError(conn, fmt.Errorf("saving session: %w", err))
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(pending.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {oidcRedirectURI(conn, req, p)},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {pending.State},
+		"nonce":                 {pending.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	location := discovery.AuthorizationEndpoint
+	if strings.Contains(location, "?") {
+		location += "&" + query.Encode()
+	} else {
+		location += "?" + query.Encode()
+	}
+	sendResponse(conn, http.StatusFound, nil, map[string]string{"Location": location}, sessionCookies(cookie)...)
+}
+
+// handleOIDCCallback completes a login: it checks the state against the
+// session, exchanges the code for an ID token, validates the token and
+// starts a session for its subject.
+func handleOIDCCallback(conn net.Conn, req *http.Request, p *OIDCProvider) {
+	query := req.URL.Query()
+	if e := query.Get("error"); e != "" {
+		sendJSON(conn, http.StatusUnauthorized, map[string]string{"error": e, "error_description": query.Get("error_description")}, false)
+		return
+	}
+
+	sess := loadSession(req)
+	stored, _ := sess.Get("oidc:" + p.Name)
+	var pending oidcPending
+	if stored == "" || json.Unmarshal([]byte(stored), &pending) != nil || query.Get("state") != pending.State {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "unexpected or stale login response"}, false)
+		return
+	}
+
+	claims, err := p.exchange(query.Get("code"), pending, oidcRedirectURI(conn, req, p))
+	if err != nil {
+		log.Printf("OpenID login through %s failed: %v", p.Name, err)
+		sendJSON(conn, http.StatusUnauthorized, map[string]string{"error": "login failed"}, false)
+		return
+	}
+
+	if err := sess.Renew(); err != nil {
+		sendError(conn, fmt.Errorf("renewing session: %w", err))
+		return
+	}
+	sess.Delete("oidc:" + p.Name)
+	sess.logIn(claims.Subject, p.Name)
+	cookie, err := sess.save(conn, req)
+	if err != nil {
+		sendError(conn, fmt.Errorf("saving session: %w", err))
+		return
+	}
+	sendResponse(conn, http.StatusFound, nil, map[string]string{"Location": pending.ReturnTo}, sessionCookies(cookie)...)
+}
+
+func oidcRedirectURI(conn net.Conn, req *http.Request, p *OIDCProvider) string {
+	return requestScheme(conn, req) + "://" + req.Host + p.callbackPath()
+}
+
+// idTokenClaims are the ID token claims we check (OpenID Connect Core
+// 1.0, section 2).
+type idTokenClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expires  int64           `json:"exp"`
+	IssuedAt int64           `json:"iat"`
+	Nonce    string          `json:"nonce"`
+}
+
+// exchange redeems an authorization code at the token endpoint and returns
+// the validated claims of the ID token it yields.
+func (p *OIDCProvider) exchange(code string, pending oidcPending, redirectURI string) (*idTokenClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {pending.Verifier},
+	}
+	tokenReq, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := fetchJSON(tokenReq, &tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token endpoint returned no id_token")
+	}
+
+	claims, err := p.verifyIDToken(tokens.IDToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != pending.Nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// verifyIDToken checks an ID token's signature against the provider's
+// published keys and its issuer, audience and lifetime.
+func (p *OIDCProvider) verifyIDToken(token string, now time.Time) (*idTokenClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifyJWTSignature(header.Alg, key, digest[:], signature) {
+		return nil, errors.New("bad ID token signature")
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	case !audienceIncludes(claims.Audience, p.ClientID):
+		return nil, errors.New("ID token is for another client")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	case now.Add(-oidcClockSkew).Unix() >= claims.Expires:
+		return nil, errors.New("ID token has expired")
+	case claims.IssuedAt > now.Add(oidcClockSkew).Unix():
+		return nil, errors.New("ID token issued in the future")
+	}
+	return &claims, nil
+}
+
+// verifyJWTSignature checks an RS256 or ES256 signature over digest. Other
+// algorithms, "none" above all, are refused.
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func audienceIncludes(raw json.RawMessage, clientID string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) != nil {
+		return false
+	}
+	for _, aud := range many {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed ID token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed ID token")
+	}
+	return nil
+}
+
+// discover fetches and caches the provider's metadata.
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d oidcDiscovery
+	if err := fetchJSON(req, &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("metadata names issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("metadata is missing an endpoint")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the provider's signing key with the given id, refetching the
+// key set when the id is unknown, as happens after the provider rotates
+// its keys. Refetches are limited to one a minute.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetch) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetch = time.Now()
+
+	req, err := http.NewRequest(http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := fetchJSON(req, &set); err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jsonWebKey is an RSA or P-256 public key in JWK form (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	field := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("malformed key")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := field(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := field(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("malformed key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := field(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := field(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("key is not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// fetchJSON sends req and decodes a 200 response's JSON body into v.
+func fetchJSON(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,189 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOIDCProvider is an OpenID provider that signs ID tokens for whoever
+// redeems a code, with claims the test can change.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string // code_challenge of the last authorization request
+	claims    map[string]any
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key}
+	coord := func(n interface{ FillBytes([]byte) []byte }) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kty: "EC", Kid: "k1", Crv: "P-256", X: coord(key.X), Y: coord(key.Y),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, `{"alg":"ES256","kid":"k1"}`, p.claims)})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) sign(t *testing.T, header string, claims map[string]any) string {
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeOIDCProvider(t)
+	addr := startTestServer(t)
+	client := testClient()
+	resp, err := client.Post("http://"+addr+"/files/private.txt", "text/plain", strings.NewReader("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	provider := &OIDCProvider{Name: "test", Issuer: idp.URL, ClientID: "app", Prefixes: []string{"/files/private"}}
+	if err := provider.validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.OIDCProviders = []*OIDCProvider{provider}
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	// login sends the visitor to the provider and back to the callback
+	// with the given code, returning the callback's response.
+	login := func(code string, claims map[string]any) *http.Response {
+		t.Helper()
+		resp := get("/files/private.txt")
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		if resp.StatusCode != http.StatusFound || location.Path != "/authorize" {
+			t.Fatalf("protected file without a session = %d to %s, want a redirect to the provider", resp.StatusCode, location)
+		}
+		query := location.Query()
+		idp.mu.Lock()
+		idp.challenge = query.Get("code_challenge")
+		idp.claims = map[string]any{
+			"iss": idp.URL, "sub": "alice", "aud": "app", "nonce": query.Get("nonce"),
+			"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			idp.claims[k] = v
+		}
+		idp.mu.Unlock()
+		return get(provider.callbackPath() + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode())
+	}
+
+	for name, tt := range map[string]struct {
+		code   string
+		claims map[string]any
+	}{
+		"wrong code":       {"bad-code", nil},
+		"wrong nonce":      {"good-code", map[string]any{"nonce": "replayed"}},
+		"wrong audience":   {"good-code", map[string]any{"aud": "other-app"}},
+		"expired":          {"good-code", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}},
+		"no subject":       {"good-code", map[string]any{"sub": ""}},
+		"another provider": {"good-code", map[string]any{"iss": "https://evil.example"}},
+	} {
+		if resp := login(tt.code, tt.claims); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: callback = %d, want 401", name, resp.StatusCode)
+		}
+	}
+	if resp := get(provider.callbackPath() + "?code=good-code&state=guessed"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with a wrong state = %d, want 400", resp.StatusCode)
+	}
+
+	resp = login("good-code", nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/files/private.txt" {
+		t.Fatalf("callback = %d to %q, want a redirect back", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := get("/files/private.txt"); resp.StatusCode != http.StatusOK {
+		t.Errorf("protected file after logging in = %d, want 200", resp.StatusCode)
+	}
+	// Another visitor still has to log in.
+	resp, err = testClient().Get("http://" + addr + "/files/private.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("protected file for another visitor = %d, want 302", resp.StatusCode)
+	}
+}
+
+func TestOIDCRefusesUnsignedTokens(t *testing.T) {
+	idp := newFakeOIDCProvider(t)
+	provider := &OIDCProvider{Name: "test", Issuer: idp.URL, ClientID: "app"}
+	claims := map[string]any{"iss": idp.URL, "sub": "alice", "aud": "app", "exp": time.Now().Add(time.Hour).Unix()}
+	good := idp.sign(t, `{"alg":"ES256","kid":"k1"}`, claims)
+	if _, err := provider.verifyIDToken(good, time.Now()); err != nil {
+		t.Fatalf("verifying a good token: %v", err)
+	}
+
+	parts := strings.Split(good, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+	claims["sub"] = "mallory"
+	payload, _ := json.Marshal(claims)
+	forged := base64.RawURLEncoding.EncodeToString(payload)
+	for name, token := range map[string]string{
+		"alg none":       none + "." + parts[1] + ".",
+		"changed claims": parts[0] + "." + forged + "." + parts[2],
+		"unknown key":    idp.sign(t, `{"alg":"ES256","kid":"k2"}`, claims),
+	} {
+		if _, err := provider.verifyIDToken(token, time.Now()); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Policy requires the caller of matching requests to hold every role in
+// Require. A request matches when its path starts with Prefix and its
+// method is one of Methods, or any method if Methods is empty. Roles come
+// from the users file, or from the access token issued at login.
+type Policy struct {
+	Prefix  string   `json:"prefix"`
+	Methods []string `json:"methods"`
+	Require []string `json:"require"`
+}
+
+func (p *Policy) prepare() error {
+	if !strings.HasPrefix(p.Prefix, "/") {
+		return errors.New("prefix must start with /")
+	}
+	if len(p.Require) == 0 {
+		return errors.New("require lists no roles")
+	}
+	for i, method := range p.Methods {
+		p.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+func (p *Policy) matches(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, p.Prefix) &&
+		(len(p.Methods) == 0 || slices.Contains(p.Methods, req.Method))
+}
+
+// policyError is the body of a 401 or 403 from checkPolicy.
+type policyError struct {
+	Error    string   `json:"error"`
+	Path     string   `json:"path"`
+	Method   string   `json:"method"`
+	Required []string `json:"required"`
+	Missing  []string `json:"missing"`
+}
+
+// checkPolicy applies the first policy matching req, once authentication
+// has run. An anonymous caller gets a 401 and one lacking a role a 403,
+// each with a body saying what was required. It returns false when it has
+// responded.
+func checkPolicy(conn net.Conn, req *http.Request) bool {
+	i := slices.IndexFunc(config.Policies, func(p *Policy) bool { return p.matches(req) })
+	if i < 0 {
+		return true
+	}
+	policy := config.Policies[i]
+
+	body := policyError{Path: req.URL.Path, Method: req.Method, Required: policy.Require}
+	p := currentPrincipal(req)
+	if p == nil {
+		body.Error = "authentication required"
+		body.Missing = policy.Require
+		sendPolicyError(conn, http.StatusUnauthorized, body)
+		return false
+	}
+
+	for _, role := range policy.Require {
+		if !slices.Contains(p.Roles, role) {
+			body.Missing = append(body.Missing, role)
+		}
+	}
+	if len(body.Missing) > 0 {
+		body.Error = "forbidden"
+		sendPolicyError(conn, http.StatusForbidden, body)
+		return false
+	}
+	return true
+}
+
+func sendPolicyError(conn net.Conn, status int, body policyError) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		sendError(conn, fmt.Errorf("encoding JSON: %w", err))
+		return
+	}
+	headers := map[string]string{"Content-Type": "application/json; charset=utf-8"}
+	if status == http.StatusUnauthorized {
+		// A 401 must say how to authenticate (RFC 9110 15.5.2).
+		headers["WWW-Authenticate"] = `Bearer realm="policy"`
+	}
+	sendResponse(conn, status, append(encoded, '\n'), headers)
+}
@@ -0,0 +1,116 @@
+package httpserver
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+)
+
+// message is a payload delivered to long-poll subscribers.
+type message struct {
+	contentType string
+	body        []byte
+}
+
+// hub fans published messages out to every current subscriber. Delivery
+// never blocks the publisher: a subscriber that already has a message
+// pending simply misses later ones.
+type hub struct {
+	mu          sync.Mutex
+	subscribers map[chan message]struct{}
+}
+
+func newHub() *hub {
+	return &hub{subscribers: make(map[chan message]struct{})}
+}
+
+func (h *hub) subscribe() chan message {
+	ch := make(chan message, 1)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan message) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+// publish delivers msg to all subscribers and returns how many received it.
+func (h *hub) publish(msg message) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delivered := 0
+	for ch := range h.subscribers {
+		select {
+		case ch <- msg:
+			delivered++
+		default:
+		}
+	}
+	return delivered
+}
+
+var pollHub = newHub()
+
+// handlePoll holds the request open until a message is published, the
+// timeout (?timeout=<seconds>) elapses, or the client disconnects.
+func handlePoll(conn net.Conn, req *http.Request) {
+	timeout := defaultPollTimeout
+	if v := req.URL.Query().Get("timeout"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPollTimeout {
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	ch := pollHub.subscribe()
+	defer pollHub.unsubscribe(ch)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-ch:
+		sendResponse(conn, http.StatusOK, msg.body, map[string]string{"Content-Type": msg.contentType})
+	case <-timer.C:
+		sendResponse(conn, http.StatusNoContent, nil, nil)
+	case <-req.Context().Done():
+		// Nobody is listening any more; just release the subscription.
+	}
+}
+
+func handlePublish(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, nil)
+		return
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		sendResponse(conn, bodyErrorStatus(err), nil, nil)
+		return
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	delivered := pollHub.publish(message{contentType: contentType, body: body})
+	sendJSON(conn, http.StatusOK, map[string]int{"delivered": delivered}, false)
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package httpserver
+
+import "errors"
+
+// dropPrivileges can't switch users on this system, so it fails if asked
+// to.
+func dropPrivileges() error {
+	if config.User != "" || config.Group != "" || config.Chroot != "" {
+		return errors.New("-user, -group and -chroot aren't supported on this system")
+	}
+	return nil
+}
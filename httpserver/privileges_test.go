@@ -0,0 +1,66 @@
+//go:build unix
+
+package httpserver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestChownWritablePaths(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	defer func(c Config) { config = c }(config)
+	config.SessionStore = "file"
+	config.SessionDir = filepath.Join(t.TempDir(), "sessions")
+	config.CacheDir = filepath.Join(t.TempDir(), "cache")
+	config.Storage = "disk"
+	config.DataDir = filepath.Join(t.TempDir(), "data")
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	config.RecordPath = filepath.Join(t.TempDir(), "record.jsonl")
+	if _, err := newFileSessionStore(config.SessionDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := openDiskCache(newResponseCache(), config.CacheDir); err != nil {
+		t.Fatal(err)
+	}
+	body := filepath.Join(config.CacheDir, "body-1")
+	if err := os.WriteFile(body, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{config.AuditLogPath, config.RecordPath} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another user's file in a writable directory is left alone.
+	other := filepath.Join(config.CacheDir, "other")
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(other, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chownWritablePaths(65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{config.SessionDir, config.CacheDir, body, config.DataDir, config.AuditLogPath, config.RecordPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); st.Uid != 65534 || st.Gid != 65534 {
+			t.Errorf("%s is owned by %d:%d, want 65534:65534", path, st.Uid, st.Gid)
+		}
+	}
+	if info, err := os.Stat(other); err != nil {
+		t.Fatal(err)
+	} else if st := info.Sys().(*syscall.Stat_t); st.Uid != 1 {
+		t.Errorf("another user's file was handed over to %d", st.Uid)
+	}
+}
@@ -0,0 +1,155 @@
+//go:build unix
+
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to -user and -group, after moving
+// it into -chroot if that is set. It runs once the listener is bound, so
+// that a server started as root can take a privileged port without
+// serving any requests as root. The files and directories New created
+// for the server to write to are handed over to the new user first, so
+// that a process started by Restart can open them too. Everything
+// opened at startup stays open, but paths used from then on, such as that
+// of the data directory, are resolved inside the chroot.
+//
+// Besides those paths, the chroot must hold what the server reads from
+// the system while serving: the CA certificates in /etc/ssl to reach an
+// OIDC provider, S3 or an upstream over HTTPS, and /etc/resolv.conf and
+// /etc/hosts to look up their names.
+func dropPrivileges() error {
+	if config.User == "" && config.Group == "" && config.Chroot == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	var groups []int
+	if config.User != "" {
+		u, err := osuser.Lookup(config.User)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+		ids, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("listing the groups of %s: %w", config.User, err)
+		}
+		for _, id := range ids {
+			n, _ := strconv.Atoi(id)
+			groups = append(groups, n)
+		}
+	}
+	if config.Group != "" {
+		g, err := osuser.LookupGroup(config.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+		groups = []int{gid}
+	}
+
+	// A process restarted with SIGUSR2 inherits what the one before it
+	// had already given up.
+	if config.Chroot == "" && (uid < 0 || uid == os.Getuid()) && (gid < 0 || gid == os.Getgid()) {
+		return nil
+	}
+	if err := chownWritablePaths(uid, gid); err != nil {
+		return err
+	}
+	if config.Chroot != "" {
+		if err := syscall.Chroot(config.Chroot); err != nil {
+			return fmt.Errorf("chroot to %s: %w", config.Chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	// Groups go first, as changing them needs the privileges that setuid
+	// gives up.
+	if gid >= 0 {
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setting supplementary groups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setting group %d: %w", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setting user %d: %w", uid, err)
+		}
+	}
+	log.Printf("Running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	return nil
+}
+
+// writablePaths are the files and directories that New creates or opens
+// for writing, as root if the server is started as root, and that the
+// server or a process started by Restart writes to once it has switched
+// user.
+func writablePaths() []string {
+	var paths []string
+	switch config.Storage {
+	case "disk":
+		paths = append(paths, config.DataDir)
+		for _, vh := range config.VirtualHosts {
+			paths = append(paths, vh.DataDir)
+		}
+	case "db":
+		paths = append(paths, config.DataDir)
+	}
+	if config.SessionStore == "file" {
+		paths = append(paths, config.SessionDir)
+	}
+	for _, path := range []string{config.CacheDir, config.AuditLogPath, config.RecordPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// chownWritablePaths gives writablePaths, and everything in the
+// directories among them, to uid and gid, either of which may be -1 to
+// leave it as it is. Only what this process's user owns is changed, which
+// leaves alone files put there for other users. A data directory that
+// doesn't exist yet is created first, as the new user may not be able to.
+func chownWritablePaths(uid, gid int) error {
+	if config.Storage == "disk" {
+		if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+			return err
+		}
+	}
+	for _, root := range writablePaths() {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+				return nil
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return fmt.Errorf("handing %s over to uid %d, gid %d: %w", root, uid, gid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyDialTimeout     = 5 * time.Second
+	proxyResponseTimeout = 30 * time.Second
+)
+
+// forwardProxyTransport carries forward proxy requests. Reverse proxy
+// upstreams each get their own transport from newUpstreamTransport.
+var forwardProxyTransport = newUpstreamTransport()
+
+// newUpstreamTransport returns a transport for talking to upstream servers.
+// Compression is left to the upstream and the client, so Accept-Encoding
+// passes straight through and bodies are relayed as-is.
+func newUpstreamTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: proxyDialTimeout}).DialContext,
+		ResponseHeaderTimeout: proxyResponseTimeout,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// hopByHopHeaders apply to a single connection and must not be forwarded
+// by a proxy (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// matchProxyRoute returns the proxy route of req's virtual host with the
+// longest prefix matching its path, or nil if it should be served locally.
+func matchProxyRoute(req *http.Request) *ProxyRoute {
+	vh := virtualHost(req)
+
+	var best *ProxyRoute
+	for i := range vh.Proxy {
+		route := &vh.Proxy[i]
+		if strings.HasPrefix(req.URL.Path, route.Prefix) && (best == nil || len(route.Prefix) > len(best.Prefix)) {
+			best = route
+		}
+	}
+	return best
+}
+
+var (
+	errNoUpstream         = errors.New("no healthy upstream")
+	errUpstreamsExhausted = errors.New("every upstream failed")
+)
+
+// proxyRequest forwards req to one of the route's upstreams and relays the
+// response back to the client, streaming bodies in both directions.
+func proxyRequest(conn net.Conn, req *http.Request, route *ProxyRoute) {
+	if route.Cache != nil && isCacheableRequest(req) {
+		proxyCached(conn, req, route)
+		return
+	}
+
+	resp, err := routeRoundTrip(conn, req, route)
+	if err != nil {
+		log.Printf("Error proxying %s: %v", req.URL.Path, err)
+		sendResponse(conn, proxyErrorStatus(err), nil, nil)
+		return
+	}
+	writeProxiedResponse(conn, resp)
+}
+
+// routeRoundTrip sends req to one of the route's upstreams. Failed attempts
+// are retried on other upstreams according to the route's retry policy.
+// The caller must close the response body, which also releases the
+// upstream's active-connection slot.
+func routeRoundTrip(conn net.Conn, req *http.Request, route *ProxyRoute) (*http.Response, error) {
+	client := clientIP(conn, req)
+	tried := make(map[*upstream]bool)
+	route.retryBudget.deposit()
+
+	for attempt := 1; ; attempt++ {
+		u := route.balancer.pick(client, tried)
+		if u == nil {
+			if len(tried) == 0 {
+				return nil, errNoUpstream
+			}
+			return nil, errUpstreamsExhausted
+		}
+		tried[u] = true
+
+		u.active.Add(1)
+		resp, err := forwardRequest(conn, req, u.transport, upstreamURL(u.target, route, req.URL))
+
+		if route.Retry.allows(attempt, req, resp, err) && route.retryBudget.withdraw() {
+			if resp != nil {
+				io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+				resp.Body.Close()
+			}
+			u.active.Add(-1)
+			log.Printf("Retrying %s %s after attempt %d against %s failed", req.Method, req.URL.Path, attempt, u.target.Host)
+			if !sleep(req.Context(), route.Retry.backoff(attempt)) {
+				return nil, context.Cause(req.Context())
+			}
+			continue
+		}
+
+		if err != nil {
+			u.active.Add(-1)
+			return nil, fmt.Errorf("%s: %w", u.target.Host, err)
+		}
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { u.active.Add(-1) }}
+		return resp, nil
+	}
+}
+
+// releasingBody runs release once when the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// relayRequest sends req on to target and copies the response back to the
+// client without any retries.
+func relayRequest(conn net.Conn, req *http.Request, transport http.RoundTripper, target *url.URL) {
+	resp, err := forwardRequest(conn, req, transport, target)
+	if err != nil {
+		log.Printf("Error proxying %s to %s: %v", req.URL.Path, target.Host, err)
+		sendResponse(conn, proxyErrorStatus(err), nil, nil)
+		return
+	}
+	writeProxiedResponse(conn, resp)
+}
+
+// forwardRequest sends a copy of req to target with hop-by-hop headers
+// removed and forwarding headers added.
+func forwardRequest(conn net.Conn, req *http.Request, transport http.RoundTripper, target *url.URL) (*http.Response, error) {
+	outreq := req.Clone(req.Context())
+	outreq.RequestURI = ""
+	outreq.Host = ""
+	outreq.URL = target
+	if req.ContentLength == 0 {
+		outreq.Body = nil
+	}
+
+	removeHopByHopHeaders(outreq.Header)
+	setForwardedHeaders(conn, req, outreq.Header)
+
+	return transport.RoundTrip(outreq)
+}
+
+// writeProxiedResponse relays an upstream response to the client and closes
+// its body.
+func writeProxiedResponse(conn net.Conn, resp *http.Response) {
+	defer resp.Body.Close()
+
+	removeHopByHopHeaders(resp.Header)
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	stream, err := startStreamHeader(conn, resp.StatusCode, resp.Header)
+	if err != nil {
+		log.Printf("Error writing proxied response: %v", err)
+		return
+	}
+	if _, err := io.Copy(stream, resp.Body); err != nil {
+		log.Printf("Error relaying proxied body: %v", err)
+		return
+	}
+	if err := stream.Close(); err != nil {
+		log.Printf("Error finishing proxied response: %v", err)
+	}
+}
+
+// upstreamURL maps the incoming request URL onto an upstream base URL.
+func upstreamURL(base *url.URL, route *ProxyRoute, in *url.URL) *url.URL {
+	path := in.Path
+	if route.StripPrefix {
+		path = "/" + strings.TrimLeft(strings.TrimPrefix(path, route.Prefix), "/")
+	}
+
+	out := *base
+	out.Path = strings.TrimRight(out.Path, "/") + path
+	out.RawPath = ""
+	out.RawQuery = in.RawQuery
+	return &out
+}
+
+// removeHopByHopHeaders deletes the standard hop-by-hop headers as well as
+// any header named in Connection.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// setForwardedHeaders records the original client and request on the
+// outbound request so the upstream can see past the proxy. Forwarding
+// headers from a trusted peer are extended; from anyone else they are
+// replaced.
+func setForwardedHeaders(conn net.Conn, req *http.Request, header http.Header) {
+	peer := hostOnly(conn.RemoteAddr().String())
+	scheme := requestScheme(conn, req)
+	trusted := isTrustedProxy(peer)
+
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" && trusted {
+		header.Set("X-Forwarded-For", prior+", "+peer)
+	} else {
+		header.Set("X-Forwarded-For", peer)
+	}
+	header.Set("X-Forwarded-Host", req.Host)
+	header.Set("X-Forwarded-Proto", scheme)
+
+	element := fmt.Sprintf("for=%s;host=%q;proto=%s", forwardedNode(peer), req.Host, scheme)
+	if prior := strings.Join(req.Header.Values("Forwarded"), ", "); prior != "" && trusted {
+		header.Set("Forwarded", prior+", "+element)
+	} else {
+		header.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats addr for a Forwarded for= parameter, which
+// requires IPv6 addresses to be bracketed and quoted.
+func forwardedNode(addr string) string {
+	if strings.Contains(addr, ":") {
+		return `"[` + addr + `]"`
+	}
+	return addr
+}
+
+// proxyErrorStatus picks the status reported to the client when the
+// upstream could not be reached or did not answer in time.
+func proxyErrorStatus(err error) int {
+	if errors.Is(err, errNoUpstream) {
+		return http.StatusServiceUnavailable
+	}
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
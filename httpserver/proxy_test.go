@@ -0,0 +1,63 @@
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyAuthorization(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	addr := startTestServer(t)
+	routes := []ProxyRoute{{Prefix: "/up/", Upstream: upstream.URL}}
+	if err := prepareProxyRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	config.ProxyRoutes = routes
+	policy := &Policy{Prefix: "/up/admin/", Require: []string{"admin"}}
+	if err := policy.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	config.Policies = []*Policy{policy}
+	client := testClient()
+
+	get := func(path, authorization string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get("/up/admin/x", ""); status != 401 {
+		t.Errorf("anonymous request under a policy: status = %d, want 401", status)
+	}
+	if status, _ := get("/up/x", ""); status != 200 {
+		t.Errorf("anonymous request outside the policy: status = %d, want 200", status)
+	}
+	// A JWT of the upstream's own isn't ours to refuse.
+	if status, body := get("/up/x", "Bearer a.b.c"); status != 200 || body != "Bearer a.b.c" {
+		t.Errorf("upstream's token: status = %d, upstream saw %q", status, body)
+	}
+
+	rule := &RouteAuth{Prefix: "/up/hooks/", Scheme: "hmac", Keys: map[string]string{"hook": "s3cret"}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	config.RouteAuth = []*RouteAuth{rule}
+	if status, _ := get("/up/hooks/x", ""); status != 401 {
+		t.Errorf("unsigned request under a route_auth rule: status = %d, want 401", status)
+	}
+}
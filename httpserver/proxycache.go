@@ -0,0 +1,398 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyCache enables caching of a proxy route's responses. Responses
+// larger than MaxEntrySize bytes are relayed but not stored in memory;
+// when -cache-dir is set, those up to MaxDiskEntrySize are stored there
+// instead.
+//
+// Cache keys always include the request's Accept-Encoding, plus any
+// request headers listed in Vary. A response whose own Vary header names
+// anything outside that set is not stored, since the key could not tell
+// its variants apart.
+type ProxyCache struct {
+	MaxEntrySize     int64    `json:"max_entry_size"`
+	MaxDiskEntrySize int64    `json:"max_disk_entry_size"`
+	Vary             []string `json:"vary"`
+}
+
+const (
+	defaultMaxCacheEntrySize     = 1024 * 1024       // 1MB
+	defaultMaxDiskCacheEntrySize = 100 * 1024 * 1024 // 100MB
+)
+
+func (pc *ProxyCache) setDefaults() {
+	if pc.MaxEntrySize <= 0 {
+		pc.MaxEntrySize = defaultMaxCacheEntrySize
+	}
+	if pc.MaxDiskEntrySize <= 0 {
+		pc.MaxDiskEntrySize = defaultMaxDiskCacheEntrySize
+	}
+
+	keyed := []string{"Accept-Encoding"}
+	for _, name := range pc.Vary {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" && !slices.Contains(keyed, name) {
+			keyed = append(keyed, name)
+		}
+	}
+	pc.Vary = keyed
+}
+
+// coversVary reports whether every header named in a response's Vary is
+// part of the cache key.
+func (pc *ProxyCache) coversVary(header http.Header) bool {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" || !slices.Contains(pc.Vary, http.CanonicalHeaderKey(name)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isCacheableRequest reports whether req may be answered from, or its
+// response stored in, the cache.
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return !parseCacheControl(req.Header).has("no-store")
+}
+
+// proxyCacheKey identifies the stored variant of a response for req: the
+// target URL plus the normalised value of every header the route varies on.
+func proxyCacheKey(req *http.Request, pc *ProxyCache) string {
+	var key strings.Builder
+	key.WriteString("proxy " + req.Host + " " + req.URL.RequestURI())
+	for _, name := range pc.Vary {
+		key.WriteString("\n" + name + ": ")
+		if name == "Accept-Encoding" {
+			key.WriteString(normalizeAcceptEncoding(req.Header.Values(name)))
+		} else {
+			key.WriteString(strings.Join(req.Header.Values(name), ", "))
+		}
+	}
+	return key.String()
+}
+
+// normalizeAcceptEncoding reduces Accept-Encoding to the sorted set of
+// codings the client accepts, so that "gzip, br" and "br,gzip;q=1" share a
+// cache entry while "gzip;q=0" does not collide with "gzip".
+func normalizeAcceptEncoding(values []string) string {
+	var codings []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" || qualityIsZero(params) || slices.Contains(codings, coding) {
+				continue
+			}
+			codings = append(codings, coding)
+		}
+	}
+	sort.Strings(codings)
+	return strings.Join(codings, ",")
+}
+
+// qualityIsZero reports whether the parameters of an Accept-* element set
+// q=0, which means "not acceptable".
+func qualityIsZero(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q == 0
+		}
+	}
+	return false
+}
+
+// proxyCached serves a cacheable request on a caching proxy route: fresh
+// entries are returned directly, stale ones are revalidated with the
+// upstream, and misses are fetched and stored when the response allows it.
+func proxyCached(conn net.Conn, req *http.Request, route *ProxyRoute) {
+	key := proxyCacheKey(req, route.Cache)
+	now := time.Now()
+	revalidate := parseCacheControl(req.Header).has("no-cache")
+
+	entry := proxyCache.get(key)
+	if entry != nil && !revalidate {
+		if entry.fresh(now) {
+			writeCachedResponse(conn, req, entry, "HIT")
+			return
+		}
+		if entry.usableWhileRevalidating(now) {
+			writeCachedResponse(conn, req, entry, "STALE")
+			refreshInBackground(conn, req, route, key, entry)
+			return
+		}
+	}
+
+	outreq := upstreamCacheRequest(req, entry)
+	resp, err := routeRoundTrip(conn, outreq, route)
+	if err != nil {
+		log.Printf("Error proxying %s: %v", req.URL.Path, err)
+		sendResponse(conn, proxyErrorStatus(err), nil, nil)
+		return
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		refreshed := refreshEntry(entry, resp)
+		proxyCache.set(key, refreshed)
+		writeCachedResponse(conn, req, refreshed, "REVALIDATED")
+		return
+	}
+
+	stored, ok := newCacheEntry(req, resp, route.Cache)
+	if !ok {
+		if req.Method == http.MethodHead {
+			resp.Body.Close()
+			resp.Body = http.NoBody
+		}
+		resp.Header.Set("X-Cache", "MISS")
+		writeProxiedResponse(conn, resp)
+		return
+	}
+
+	proxyCache.set(key, stored)
+	writeCachedResponse(conn, req, stored, "MISS")
+}
+
+// upstreamCacheRequest returns the request to send upstream when entry
+// (which may be nil) can't be served as is. Stale entries are revalidated
+// with the cache's own validators, and HEAD is upgraded to GET so that the
+// response can be stored.
+func upstreamCacheRequest(req *http.Request, entry *cacheEntry) *http.Request {
+	outreq := req
+	if entry != nil && entry.hasValidators() {
+		outreq = req.Clone(req.Context())
+		outreq.Header.Del("If-None-Match")
+		outreq.Header.Del("If-Modified-Since")
+		if etag := entry.header.Get("ETag"); etag != "" {
+			outreq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.header.Get("Last-Modified"); lastModified != "" {
+			outreq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	if req.Method == http.MethodHead {
+		outreq = outreq.Clone(req.Context())
+		outreq.Method = http.MethodGet
+	}
+	return outreq
+}
+
+// refreshInBackground revalidates a stale entry that has just been served
+// under stale-while-revalidate. At most one refresh per key runs at a time.
+func refreshInBackground(conn net.Conn, req *http.Request, route *ProxyRoute, key string, entry *cacheEntry) {
+	if !proxyCache.beginRefresh(key) {
+		return
+	}
+
+	// The client's request is finished by the time the refresh runs, so
+	// detach it from the request's lifetime and body.
+	bg := req.Clone(context.Background())
+	bg.Body = nil
+	bg.ContentLength = 0
+	bg.Header.Del("If-None-Match")
+	bg.Header.Del("If-Modified-Since")
+
+	go func() {
+		defer proxyCache.endRefresh(key)
+
+		resp, err := routeRoundTrip(conn, upstreamCacheRequest(bg, entry), route)
+		if err != nil {
+			log.Printf("Error refreshing cached %s: %v", req.URL.Path, err)
+			return
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			proxyCache.set(key, refreshEntry(entry, resp))
+			return
+		}
+		stored, ok := newCacheEntry(bg, resp, route.Cache)
+		if !ok {
+			resp.Body.Close()
+			proxyCache.delete(key)
+			return
+		}
+		proxyCache.set(key, stored)
+	}()
+}
+
+// newCacheEntry buffers resp into a cache entry if it may be stored. When
+// it may not, resp is returned to the caller untouched apart from its body,
+// which still yields the complete response.
+func newCacheEntry(req *http.Request, resp *http.Response, pc *ProxyCache) (*cacheEntry, bool) {
+	memorySize := pc.MaxEntrySize
+	maxSize := memorySize
+	if proxyCache.disk != nil {
+		maxSize = max(maxSize, pc.MaxDiskEntrySize)
+	}
+	cc := parseCacheControl(resp.Header)
+	reqCC := parseCacheControl(req.Header)
+
+	switch {
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNonAuthoritativeInfo &&
+		resp.StatusCode != http.StatusMovedPermanently && resp.StatusCode != http.StatusNotFound &&
+		resp.StatusCode != http.StatusGone:
+		return nil, false
+	case cc.has("no-store") || cc.has("private") || reqCC.has("no-store"):
+		return nil, false
+	case req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage"):
+		return nil, false
+	case resp.Header.Get("Set-Cookie") != "" || !pc.coversVary(resp.Header):
+		return nil, false
+	case resp.ContentLength > maxSize:
+		return nil, false
+	}
+
+	lifetime, ok := freshnessLifetime(resp.Header, cc)
+	if !ok {
+		return nil, false
+	}
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, memorySize+1))
+	var file string
+	var fileSize int64
+	switch {
+	case err == nil && int64(len(body)) > memorySize && maxSize > memorySize:
+		var rest io.ReadCloser
+		file, fileSize, rest, err = proxyCache.disk.spill(body, resp.Body, maxSize)
+		if err != nil {
+			if !errors.Is(err, errCacheEntryTooLarge) {
+				log.Printf("Error writing %s to the disk cache: %v", req.URL.Path, err)
+			}
+			resp.Body = rest
+			return nil, false
+		}
+		body = nil
+	case err != nil || int64(len(body)) > memorySize:
+		// Too big (or broken) to keep: hand back a body that replays what
+		// was read followed by the rest.
+		resp.Body = multiReadCloser(bytes.NewReader(body), resp.Body)
+		return nil, false
+	}
+	resp.Body.Close()
+
+	now := time.Now()
+	header := resp.Header.Clone()
+	removeHopByHopHeaders(header)
+	header.Del("X-Cache")
+
+	entry := &cacheEntry{
+		status:               resp.StatusCode,
+		header:               header,
+		body:                 body,
+		file:                 file,
+		fileSize:             fileSize,
+		stored:               now,
+		expires:              now.Add(lifetime),
+		staleWhileRevalidate: staleWhileRevalidate(cc),
+		path:                 req.URL.Path,
+	}
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && age > 0 {
+		entry.initialAge = time.Duration(age) * time.Second
+		entry.expires = entry.expires.Add(-entry.initialAge)
+	}
+	header.Del("Age")
+	return entry, true
+}
+
+// refreshEntry applies the headers of a 304 response to a stored entry, as
+// RFC 9111 4.3.4 requires, and restarts its freshness lifetime.
+func refreshEntry(entry *cacheEntry, resp *http.Response) *cacheEntry {
+	header := entry.header.Clone()
+	for name, values := range resp.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Age", "Connection", "Keep-Alive", "Transfer-Encoding":
+			continue
+		}
+		header[name] = values
+	}
+
+	now := time.Now()
+	cc := parseCacheControl(header)
+	lifetime, _ := freshnessLifetime(header, cc)
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+	return &cacheEntry{
+		status:               entry.status,
+		header:               header,
+		body:                 entry.body,
+		file:                 entry.file,
+		fileSize:             entry.fileSize,
+		stored:               now,
+		expires:              now.Add(lifetime),
+		staleWhileRevalidate: staleWhileRevalidate(cc),
+		path:                 entry.path,
+	}
+}
+
+// writeCachedResponse sends entry to the client, adding Age and an X-Cache
+// header describing how the response was obtained.
+//
+// Conditional requests that the entry satisfies get a 304 instead, so the
+// stored body is never sent to a client that already has it.
+func writeCachedResponse(conn net.Conn, req *http.Request, entry *cacheEntry, status string) {
+	code := entry.status
+	header := entry.header.Clone()
+	var body io.Reader = bytes.NewReader(entry.body)
+	if code == http.StatusOK && notModified(req, entry.header) {
+		code = http.StatusNotModified
+		header = notModifiedHeader(entry.header)
+	} else {
+		header.Set("Content-Length", strconv.FormatInt(entry.bodySize(), 10))
+		if entry.file != "" && req.Method != http.MethodHead {
+			f, err := proxyCache.disk.open(entry.file)
+			if err != nil {
+				sendError(conn, fmt.Errorf("opening cached body: %w", err))
+				return
+			}
+			defer f.Close()
+			body = f
+		}
+	}
+	header.Set("Age", strconv.FormatInt(int64(entry.age(time.Now())/time.Second), 10))
+	header.Set("X-Cache", status)
+
+	stream, err := startStreamHeader(conn, code, header)
+	if err != nil {
+		log.Printf("Error writing cached response: %v", err)
+		return
+	}
+	if req.Method != http.MethodHead && code != http.StatusNotModified {
+		if _, err := io.Copy(stream, body); err != nil {
+			return
+		}
+	}
+	if err := stream.Close(); err != nil {
+		log.Printf("Error writing cached response: %v", err)
+	}
+}
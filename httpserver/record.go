@@ -0,0 +1,256 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedRequest is one line of a -record file: a request as it arrived
+// and the status it was answered with.
+type recordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	Target string      `json:"target"`
+	Proto  string      `json:"proto"`
+	Host   string      `json:"host,omitempty"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+	// BodyTruncated is set when more of the body arrived than
+	// -record-max-body, or the handler left some of it unread.
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+	Status        int  `json:"status"`
+}
+
+// requestRecorder appends the requests served to a file, for the replay
+// subcommand. Credentials in headers and the query are redacted unless
+// -record-secrets is set, but bodies are kept as they were sent, so the
+// file is created readable by its owner only.
+type requestRecorder struct {
+	maxBody int64
+
+	mu  sync.Mutex
+	out *os.File
+}
+
+// recorder is set by -record.
+var recorder *requestRecorder
+
+func openRequestRecorder(path string, maxBody int64) (*requestRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRecorder{maxBody: maxBody, out: f}, nil
+}
+
+// start notes the parts of req that serving it may change, and wraps its
+// body so that what the handler reads is kept. The returned function
+// writes the record once the response has been sent.
+func (r *requestRecorder) start(req *http.Request) (io.ReadCloser, func(status int)) {
+	rec := &recordedRequest{
+		Time:   time.Now().UTC(),
+		Method: req.Method,
+		Target: req.RequestURI,
+		Proto:  req.Proto,
+		Host:   req.Host,
+		Header: req.Header.Clone(),
+	}
+	if !config.RecordSecrets {
+		rec.Target = redactTarget(rec.Target)
+		rec.Header = redactHeader(req.Header)
+	}
+	body := &captureReader{ReadCloser: req.Body, limit: r.maxBody}
+	return body, func(status int) {
+		rec.Body = body.buf.Bytes()
+		rec.BodyTruncated = body.over || (req.ContentLength != 0 && !body.done)
+		rec.Status = status
+		r.write(rec)
+	}
+}
+
+func (r *requestRecorder) write(rec *recordedRequest) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Error encoding recorded request: %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Error recording request: %v", err)
+	}
+}
+
+// captureReader keeps up to limit bytes of what is read through it.
+type captureReader struct {
+	io.ReadCloser
+	limit int64
+	buf   bytes.Buffer
+	// over is set once more than limit bytes have been read, and done once
+	// the body has been read to its end.
+	over bool
+	done bool
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	room := c.limit - int64(c.buf.Len())
+	if int64(n) > room {
+		c.over = true
+	}
+	c.buf.Write(p[:min(int64(n), room)])
+	if err == io.EOF {
+		c.done = true
+	}
+	return n, err
+}
+
+// replayOptions are the flags of the replay subcommand.
+type replayOptions struct {
+	base     *url.URL
+	keepHost bool
+	timing   bool
+}
+
+// runReplay implements "replay [flags] <file> <url>": it sends the
+// requests recorded in file, in order, to the server at url and reports
+// those answered with a different status than when they were recorded. It
+// exits with status 1 if there were any.
+func runReplay(args []string) {
+	var opts replayOptions
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.BoolVar(&opts.keepHost, "keep-host", true, "send the recorded Host header rather than the target's")
+	fs.BoolVar(&opts.timing, "timing", false, "wait between requests as long as the recorded ones were apart")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: replay [flags] <file> <url>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	base, err := url.Parse(fs.Arg(1))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		log.Fatalf("Invalid target URL %q", fs.Arg(1))
+	}
+	opts.base = base
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Error opening recording: %v", err)
+	}
+	defer f.Close()
+
+	summary, err := replay(f, opts, os.Stdout)
+	if err != nil {
+		log.Fatalf("Error replaying: %v", err)
+	}
+	fmt.Printf("\n%d replayed, %d matched, %d differed, %d failed, %d skipped\n",
+		summary.replayed, summary.matched, summary.differed, summary.failed, summary.skipped)
+	if summary.differed > 0 || summary.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+type replaySummary struct {
+	replayed, matched, differed, failed, skipped int
+}
+
+// replay sends each request recorded in r and writes a line to w for every
+// one that is skipped, fails, or gets a different status.
+func replay(r io.Reader, opts replayOptions, w io.Writer) (replaySummary, error) {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var summary replaySummary
+	var last time.Time
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var rec recordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return summary, fmt.Errorf("line %d: %w", n, err)
+		}
+		label := fmt.Sprintf("line %d: %s %s", n, rec.Method, rec.Target)
+
+		if opts.timing && !last.IsZero() && rec.Time.After(last) {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		req, reason := rec.request(opts)
+		if req == nil {
+			fmt.Fprintf(w, "%s: skipped, %s\n", label, reason)
+			summary.skipped++
+			continue
+		}
+		summary.replayed++
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", label, err)
+			summary.failed++
+			continue
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024*1024))
+		resp.Body.Close()
+		if resp.StatusCode != rec.Status {
+			fmt.Fprintf(w, "%s: recorded %d, got %d\n", label, rec.Status, resp.StatusCode)
+			summary.differed++
+			continue
+		}
+		summary.matched++
+	}
+	return summary, scanner.Err()
+}
+
+// request rebuilds the recorded request against opts.base, or explains why
+// it can't be.
+func (rec *recordedRequest) request(opts replayOptions) (*http.Request, string) {
+	switch {
+	case rec.BodyTruncated:
+		return nil, "body was not recorded in full"
+	case rec.Method == http.MethodConnect || !strings.HasPrefix(rec.Target, "/"):
+		return nil, "not an origin-form request"
+	case rec.Status == 0:
+		return nil, "no response was recorded"
+	}
+
+	target, err := url.Parse(rec.Target)
+	if err != nil {
+		return nil, err.Error()
+	}
+	u := *opts.base
+	u.Path = strings.TrimSuffix(opts.base.Path, "/") + target.Path
+	u.RawPath = ""
+	u.RawQuery = target.RawQuery
+
+	req, err := http.NewRequest(rec.Method, u.String(), bytes.NewReader(rec.Body))
+	if err != nil {
+		return nil, err.Error()
+	}
+	req.Header = rec.Header.Clone()
+	for _, name := range []string{"Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive"} {
+		req.Header.Del(name)
+	}
+	if opts.keepHost && rec.Host != "" {
+		req.Host = rec.Host
+	}
+	return req, ""
+}
@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redacted replaces secrets in logs and recordings.
+const redacted = "REDACTED"
+
+// sensitiveHeaders carry credentials, and are always redacted along with
+// those named by -redact-headers.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// sensitiveParams are query parameters that carry credentials, such as
+// the signature of a signed /files/ URL, and are always redacted along
+// with those named by -redact-params.
+var sensitiveParams = []string{
+	"signature",
+	"code",
+	"token",
+	"access_token",
+	"api_key",
+}
+
+// redactHeader returns a copy of h with the values of sensitive fields
+// replaced, so that it can be logged or recorded.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, names := range [][]string{sensitiveHeaders, config.RedactHeaders} {
+		for _, name := range names {
+			name = http.CanonicalHeaderKey(name)
+			for i := range h[name] {
+				h[name][i] = redacted
+			}
+		}
+	}
+	return h
+}
+
+// sensitiveParam reports whether the value of the query parameter name
+// must be redacted. Parameter names are matched ignoring case.
+func sensitiveParam(name string) bool {
+	for _, names := range [][]string{sensitiveParams, config.RedactParams} {
+		for _, n := range names {
+			if strings.EqualFold(n, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactTarget returns a request target with the values of sensitive query
+// parameters replaced. The rest of the target is left byte for byte as it
+// was, so the line still shows what the client sent.
+func redactTarget(target string) string {
+	path, query, ok := strings.Cut(target, "?")
+	if !ok {
+		return target
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		key, _, hasValue := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if hasValue && sensitiveParam(name) {
+			params[i] = key + "=" + redacted
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
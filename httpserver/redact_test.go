@@ -0,0 +1,54 @@
+package httpserver
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRedactTarget(t *testing.T) {
+	defer func(params []string) { config.RedactParams = params }(config.RedactParams)
+	config.RedactParams = []string{"session"}
+
+	tests := []struct {
+		target, want string
+	}{
+		{"/files/a", "/files/a"},
+		{"/files/a?expires=1&signature=abc", "/files/a?expires=1&signature=REDACTED"},
+		{"/cb?CODE=xyz&state=1", "/cb?CODE=REDACTED&state=1"},
+		{"/x?session=s%20t&a=1&a=2", "/x?session=REDACTED&a=1&a=2"},
+		{"/x?acc%65ss_token=t", "/x?acc%65ss_token=REDACTED"},
+		{"/x?token&b=", "/x?token&b="},
+	}
+	for _, tt := range tests {
+		if got := redactTarget(tt.target); got != tt.want {
+			t.Errorf("redactTarget(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	defer func(headers []string) { config.RedactHeaders = headers }(config.RedactHeaders)
+	config.RedactHeaders = []string{"x-tenant-secret"}
+
+	h := http.Header{
+		"Authorization":   {"Bearer secret"},
+		"Cookie":          {"a=1", "b=2"},
+		"X-Tenant-Secret": {"s"},
+		"User-Agent":      {"curl"},
+	}
+	got := redactHeader(h)
+	want := http.Header{
+		"Authorization":   {redacted},
+		"Cookie":          {redacted, redacted},
+		"X-Tenant-Secret": {redacted},
+		"User-Agent":      {"curl"},
+	}
+	for name := range want {
+		if len(got[name]) != len(want[name]) || got.Get(name) != want.Get(name) {
+			t.Errorf("%s = %q, want %q", name, got[name], want[name])
+		}
+	}
+	if h.Get("Authorization") != "Bearer secret" {
+		t.Error("redactHeader changed the header it was given")
+	}
+}
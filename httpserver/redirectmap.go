@@ -0,0 +1,127 @@
+package httpserver
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// watchPollInterval is how often files reloaded on change are checked.
+const watchPollInterval = 2 * time.Second
+
+type redirectEntry struct {
+	target string
+	status int
+}
+
+// redirectMap is the currently loaded -redirect-map, swapped atomically
+// whenever the file changes on disk.
+var redirectMap atomic.Pointer[map[string]redirectEntry]
+
+// loadRedirectMap parses a redirect map file. Each non-blank line that
+// doesn't start with # has the form
+//
+//	/source/path  https://target/url  [status]
+//
+// where status defaults to 301.
+func loadRedirectMap(path string) (map[string]redirectEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]redirectEntry)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 || !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("line %d: expected \"/source target [status]\"", lineNo)
+		}
+
+		entry := redirectEntry{target: fields[1], status: http.StatusMovedPermanently}
+		if len(fields) == 3 {
+			status, err := strconv.Atoi(fields[2])
+			if err != nil || status < 300 || status > 308 {
+				return nil, fmt.Errorf("line %d: invalid redirect status %q", lineNo, fields[2])
+			}
+			entry.status = status
+		}
+		entries[fields[0]] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// watchRedirectMap loads path and then polls it for changes, replacing the
+// active map after every successful reload. A file that fails to parse is
+// reported and the previous map stays in effect.
+func watchRedirectMap(path string) error {
+	entries, err := loadRedirectMap(path)
+	if err != nil {
+		return err
+	}
+	redirectMap.Store(&entries)
+
+	return watchFile(path, func() {
+		entries, err := loadRedirectMap(path)
+		if err != nil {
+			log.Printf("Error reloading redirect map %s: %v", path, err)
+			return
+		}
+		redirectMap.Store(&entries)
+		log.Printf("Reloaded redirect map %s (%d entries)", path, len(entries))
+	})
+}
+
+// watchFile polls path in the background and calls changed whenever its
+// modification time or size differs from the last time it was looked at.
+func watchFile(path string, changed func()) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	lastMod, lastSize := info.ModTime(), info.Size()
+
+	go func() {
+		for range time.Tick(watchPollInterval) {
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(lastMod) && info.Size() == lastSize) {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+			changed()
+		}
+	}()
+	return nil
+}
+
+// applyRedirectMap answers req with a redirect if its path is listed in
+// the redirect map, reporting whether it did so.
+func applyRedirectMap(conn net.Conn, req *http.Request) bool {
+	entries := redirectMap.Load()
+	if entries == nil {
+		return false
+	}
+
+	entry, ok := (*entries)[req.URL.Path]
+	if !ok {
+		return false
+	}
+	sendRedirect(conn, entry.status, withQuery(entry.target, req.URL.RawQuery))
+	return true
+}
@@ -0,0 +1,655 @@
+package httpserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replicationJournalName is the journal kept in the data directory of
+	// the default host.
+	replicationJournalName = ".replication-journal"
+	// replicaVhostsDir is where a mirror directory keeps the files of
+	// virtual hosts, one subdirectory per host.
+	replicaVhostsDir = ".vhosts"
+	// replicaRetryInterval is how long shipping waits after a failure.
+	replicaRetryInterval = 5 * time.Second
+)
+
+// replication is set by -replicate-to.
+var replication *replicator
+
+// replicaEntry names a file that changed: its path, with slashes, relative
+// to the data directory of a host, the default host being "".
+type replicaEntry struct {
+	Host string `json:"host,omitempty"`
+	Path string `json:"path"`
+}
+
+// replicaTarget is where a replicator sends copies of changed files.
+type replicaTarget interface {
+	// manifest lists what the target holds for host.
+	manifest(host string) (map[string]FileInfo, error)
+	put(e replicaEntry, r io.Reader, info FileInfo) error
+	// remove deletes a file; one already gone is not an error.
+	remove(e replicaEntry) error
+	String() string
+}
+
+// replicator copies the files written to disk storage to a mirror
+// directory or a standby server, in the background. Each change is
+// appended to a journal before it is made and the journal is only emptied
+// once the mirror has caught up, so changes not yet shipped when the
+// server stops are shipped when it starts again. Shipping copies a file as
+// it is then, or removes it if it is gone, so repeating an entry is
+// harmless.
+type replicator struct {
+	target replicaTarget
+	// roots maps each host to its data directory.
+	roots map[string]string
+
+	mu      sync.Mutex
+	journal *os.File
+	queue   []replicaEntry
+	queued  map[replicaEntry]bool
+	// writing counts the changes journalled but not yet made, while which
+	// the journal mustn't be emptied.
+	writing int
+	wake    chan struct{}
+
+	shipped     int64
+	lastShipped time.Time
+	lastError   string
+	syncing     bool
+}
+
+// openReplication starts replicating to -replicate-to. Entries left in the
+// journal are shipped first; when there is no journal at all the mirror is
+// new and everything is compared with it.
+func openReplication() error {
+	replication = nil
+	if config.ReplicateTo == "" {
+		return nil
+	}
+	var target replicaTarget
+	if u, err := url.Parse(config.ReplicateTo); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		target = &peerTarget{base: u, token: config.ReplicateToken, client: &http.Client{Transport: newUpstreamTransport()}}
+	} else {
+		target = &dirTarget{dir: config.ReplicateTo}
+	}
+
+	r := &replicator{
+		target: target,
+		roots:  map[string]string{"": config.DataDir},
+		queued: make(map[replicaEntry]bool),
+		wake:   make(chan struct{}, 1),
+	}
+	for _, vh := range config.VirtualHosts {
+		r.roots[vh.Hosts[0]] = vh.DataDir
+	}
+
+	journalPath := filepath.Join(config.DataDir, replicationJournalName)
+	_, err := os.Stat(journalPath)
+	fresh := errors.Is(err, fs.ErrNotExist)
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return err
+	}
+	if r.journal, err = os.OpenFile(journalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(r.journal)
+	for scanner.Scan() {
+		var e replicaEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line of a journal cut short by a crash.
+			continue
+		}
+		r.enqueue(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading replication journal: %w", err)
+	}
+	if len(r.queue) > 0 {
+		log.Printf("Replicating %d changes left from the last run", len(r.queue))
+	}
+
+	replication = r
+	go r.run()
+	if fresh {
+		go r.catchUp()
+	}
+	return nil
+}
+
+// wrap returns store, the disk storage of dir, replicating its changes.
+func (r *replicator) wrap(store Storage, dir string) Storage {
+	var found *replicatedStorage
+	for host, root := range r.roots {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			rel = ""
+		}
+		// A virtual host's directory may lie inside the default host's.
+		if found == nil || len(rel) < len(found.dir) {
+			found = &replicatedStorage{Storage: store, rep: r, host: host, dir: filepath.ToSlash(rel)}
+		}
+	}
+	if found == nil {
+		return store
+	}
+	return found
+}
+
+// begin journals a change about to be made, which commit then queues for
+// shipping. A change can't be made if it can't be journalled.
+func (r *replicator) begin(e replicaEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing replication journal: %w", err)
+	}
+	if err := r.journal.Sync(); err != nil {
+		return fmt.Errorf("writing replication journal: %w", err)
+	}
+	r.writing++
+	return nil
+}
+
+func (r *replicator) commit(e replicaEntry) {
+	r.mu.Lock()
+	r.writing--
+	r.enqueue(e)
+	r.mu.Unlock()
+}
+
+// enqueue adds e to the queue unless it is waiting already; r.mu must be
+// held.
+func (r *replicator) enqueue(e replicaEntry) {
+	if r.queued[e] {
+		return
+	}
+	r.queued[e] = true
+	r.queue = append(r.queue, e)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run ships queued changes in order, retrying the first until it succeeds.
+func (r *replicator) run() {
+	for {
+		r.mu.Lock()
+		if len(r.queue) == 0 {
+			if r.writing == 0 {
+				if err := r.journal.Truncate(0); err != nil {
+					log.Printf("Error emptying replication journal: %v", err)
+				}
+			}
+			r.mu.Unlock()
+			<-r.wake
+			continue
+		}
+		e := r.queue[0]
+		r.queue = r.queue[1:]
+		delete(r.queued, e)
+		r.mu.Unlock()
+
+		err := r.ship(e)
+		r.mu.Lock()
+		if err != nil {
+			r.lastError = err.Error()
+			if !r.queued[e] {
+				r.queued[e] = true
+				r.queue = append([]replicaEntry{e}, r.queue...)
+			}
+		} else {
+			r.shipped++
+			r.lastShipped = time.Now()
+			r.lastError = ""
+		}
+		r.mu.Unlock()
+		if err != nil {
+			log.Printf("Error replicating %s: %v", e.Path, err)
+			time.Sleep(replicaRetryInterval)
+		}
+	}
+}
+
+// ship makes the target's copy of e match the local file.
+func (r *replicator) ship(e replicaEntry) error {
+	root, ok := r.roots[e.Host]
+	if !ok {
+		// A host removed from the configuration since it was journalled.
+		return nil
+	}
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(e.Path)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return r.target.remove(e)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return r.target.put(e, f, diskFileInfo(info))
+}
+
+// catchUp compares every host's files with the target's and queues
+// whatever differs, including files the target has that are gone here.
+func (r *replicator) catchUp() error {
+	r.mu.Lock()
+	if r.syncing {
+		r.mu.Unlock()
+		return nil
+	}
+	r.syncing = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.syncing = false
+		r.mu.Unlock()
+	}()
+
+	queued := 0
+	for host, root := range r.roots {
+		local, err := replicaFiles(root, r.otherRoots(host))
+		if err != nil {
+			log.Printf("Error listing files to replicate: %v", err)
+			return err
+		}
+		remote, err := r.target.manifest(host)
+		if err != nil {
+			log.Printf("Error listing %s: %v", r.target, err)
+			return err
+		}
+		var changed []string
+		for name, info := range local {
+			if theirs, ok := remote[name]; !ok || theirs.Size != info.Size || !theirs.ModTime.Equal(info.ModTime) {
+				changed = append(changed, name)
+			}
+		}
+		for name := range remote {
+			if _, ok := local[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		for _, name := range changed {
+			e := replicaEntry{Host: host, Path: name}
+			if err := r.begin(e); err != nil {
+				return err
+			}
+			r.commit(e)
+		}
+		queued += len(changed)
+	}
+	log.Printf("Replication catch-up with %s queued %d files", r.target, queued)
+	return nil
+}
+
+// otherRoots returns the data directories of hosts other than host, which
+// may lie inside its own.
+func (r *replicator) otherRoots(host string) map[string]bool {
+	others := make(map[string]bool)
+	for h, root := range r.roots {
+		if h != host {
+			others[filepath.Clean(root)] = true
+		}
+	}
+	return others
+}
+
+// replicaFiles lists the files under root by slash-separated path,
+// skipping temporary files, the journal and the directories in skip.
+func replicaFiles(root string, skip map[string]bool) (map[string]FileInfo, error) {
+	files := make(map[string]FileInfo)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && skip[filepath.Clean(p)] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !validFileName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		files[rel] = FileInfo{Name: rel, Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// replicatedStorage journals the changes made to a disk storage so that
+// they are replicated. dir is the storage's directory relative to the
+// host's data directory.
+type replicatedStorage struct {
+	Storage
+	rep  *replicator
+	host string
+	dir  string
+}
+
+func (s *replicatedStorage) entry(name string) replicaEntry {
+	return replicaEntry{Host: s.host, Path: path.Join(s.dir, name)}
+}
+
+func (s *replicatedStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	if !validFileName(name) {
+		return s.Storage.Write(name, r)
+	}
+	e := s.entry(name)
+	if err := s.rep.begin(e); err != nil {
+		return FileInfo{}, err
+	}
+	defer s.rep.commit(e)
+	return s.Storage.Write(name, r)
+}
+
+func (s *replicatedStorage) Delete(name string) error {
+	if !validFileName(name) {
+		return s.Storage.Delete(name)
+	}
+	e := s.entry(name)
+	if err := s.rep.begin(e); err != nil {
+		return err
+	}
+	defer s.rep.commit(e)
+	return s.Storage.Delete(name)
+}
+
+// dirTarget mirrors the data directory into another directory, such as a
+// mount shared with a standby. Virtual hosts go in subdirectories of
+// replicaVhostsDir.
+type dirTarget struct {
+	dir string
+}
+
+func (t *dirTarget) String() string { return t.dir }
+
+func (t *dirTarget) root(host string) string {
+	if host == "" {
+		return t.dir
+	}
+	return filepath.Join(t.dir, replicaVhostsDir, host)
+}
+
+func (t *dirTarget) manifest(host string) (map[string]FileInfo, error) {
+	skip := map[string]bool{}
+	if host == "" {
+		skip[filepath.Join(filepath.Clean(t.dir), replicaVhostsDir)] = true
+	}
+	return replicaFiles(t.root(host), skip)
+}
+
+func (t *dirTarget) put(e replicaEntry, r io.Reader, info FileInfo) error {
+	return writeReplica(t.root(e.Host), e.Path, r, info.ModTime)
+}
+
+func (t *dirTarget) remove(e replicaEntry) error {
+	err := os.Remove(filepath.Join(t.root(e.Host), filepath.FromSlash(e.Path)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeReplica stores a replicated file under root, keeping the original's
+// modification time so that a later catch-up can tell it is unchanged.
+func writeReplica(root, rel string, r io.Reader, modTime time.Time) error {
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if _, err := newDiskStorage(filepath.Dir(p)).Write(filepath.Base(p), r); err != nil {
+		return err
+	}
+	return os.Chtimes(p, time.Time{}, modTime)
+}
+
+// peerTarget sends files to a standby server's /admin/replica endpoint.
+type peerTarget struct {
+	base   *url.URL
+	token  string
+	client *http.Client
+}
+
+func (t *peerTarget) String() string { return t.base.String() }
+
+func (t *peerTarget) url(e replicaEntry) string {
+	u := t.base.JoinPath("/admin/replica", e.Path)
+	u.RawQuery = url.Values{"host": {e.Host}}.Encode()
+	return u.String()
+}
+
+// do sends a request to the peer, turning a 404 into fs.ErrNotExist and
+// any other failure into an error.
+func (t *peerTarget) do(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, fs.ErrNotExist)
+	}
+	return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+}
+
+func (t *peerTarget) manifest(host string) (map[string]FileInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, t.url(replicaEntry{Host: host}), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var files []FileInfo
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("reading replica manifest: %w", err)
+	}
+	manifest := make(map[string]FileInfo, len(files))
+	for _, f := range files {
+		manifest[f.Name] = f
+	}
+	return manifest, nil
+}
+
+func (t *peerTarget) put(e replicaEntry, r io.Reader, info FileInfo) error {
+	req, err := http.NewRequest(http.MethodPut, t.url(e), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Modified", info.ModTime.UTC().Format(time.RFC3339Nano))
+	resp, err := t.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *peerTarget) remove(e replicaEntry) error {
+	req, err := http.NewRequest(http.MethodDelete, t.url(e), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// handleAdminReplica is the receiving end of a peerTarget, on the standby:
+// GET /admin/replica lists a host's files, and PUT and DELETE
+// /admin/replica/<path> change one. The host is chosen by ?host=, the
+// first of a virtual host's names, and is the default host when empty.
+func handleAdminReplica(conn net.Conn, req *http.Request) {
+	host := req.URL.Query().Get("host")
+	root := config.DataDir
+	if host != "" {
+		root = ""
+		for _, vh := range config.VirtualHosts {
+			if strings.EqualFold(vh.Hosts[0], host) {
+				root = vh.DataDir
+			}
+		}
+		if root == "" {
+			sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "no such virtual host"}, false)
+			return
+		}
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/admin/replica"), "/")
+	if rel == "" {
+		if req.Method != http.MethodGet {
+			sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodGet})
+			return
+		}
+		var skip map[string]bool
+		if host == "" {
+			skip = make(map[string]bool)
+			for _, vh := range config.VirtualHosts {
+				skip[filepath.Clean(vh.DataDir)] = true
+			}
+		}
+		manifest, err := replicaFiles(root, skip)
+		if err != nil {
+			sendError(conn, fmt.Errorf("listing replica files: %w", err))
+			return
+		}
+		files := make([]FileInfo, 0, len(manifest))
+		for _, f := range manifest {
+			files = append(files, f)
+		}
+		sendJSON(conn, http.StatusOK, files, false)
+		return
+	}
+	if !fs.ValidPath(rel) || !validFileName(path.Base(rel)) {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		modTime, err := time.Parse(time.RFC3339Nano, req.Header.Get("X-Modified"))
+		if err != nil {
+			modTime = time.Now()
+		}
+		if err := writeReplica(root, rel, req.Body, modTime); err != nil {
+			sendResponse(conn, storageErrorStatus(err), nil, nil)
+			return
+		}
+		sendResponse(conn, http.StatusNoContent, nil, nil)
+	case http.MethodDelete:
+		err := os.Remove(filepath.Join(root, filepath.FromSlash(rel)))
+		if errors.Is(err, fs.ErrNotExist) {
+			handleNotFound(conn)
+			return
+		}
+		if err != nil {
+			sendError(conn, fmt.Errorf("removing replica file: %w", err))
+			return
+		}
+		sendResponse(conn, http.StatusNoContent, nil, nil)
+	default:
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": "PUT, DELETE"})
+	}
+}
+
+type replicationStatus struct {
+	Target      string `json:"target"`
+	Pending     int    `json:"pending"`
+	Shipped     int64  `json:"shipped"`
+	LastShipped string `json:"last_shipped,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Syncing     bool   `json:"syncing"`
+}
+
+// handleAdminReplication reports how far replication has got.
+func handleAdminReplication(conn net.Conn, req *http.Request) {
+	r := replication
+	if r == nil {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "replication is not enabled"}, false)
+		return
+	}
+	r.mu.Lock()
+	status := replicationStatus{
+		Target:    r.target.String(),
+		Pending:   len(r.queue),
+		Shipped:   r.shipped,
+		LastError: r.lastError,
+		Syncing:   r.syncing,
+	}
+	if !r.lastShipped.IsZero() {
+		status.LastShipped = r.lastShipped.UTC().Format(time.RFC3339)
+	}
+	r.mu.Unlock()
+	sendJSON(conn, http.StatusOK, status, true)
+}
+
+// handleAdminReplicationSync starts comparing every file with the mirror,
+// for when the mirror was changed or replaced behind the server's back.
+func handleAdminReplicationSync(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+	if replication == nil {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "replication is not enabled"}, false)
+		return
+	}
+	go replication.catchUp()
+	sendResponse(conn, http.StatusAccepted, nil, nil)
+}
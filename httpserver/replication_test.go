@@ -0,0 +1,69 @@
+package httpserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForMirror waits for path to hold want, or to be missing if want is
+// empty.
+func waitForMirror(t *testing.T, path, want string) {
+	t.Helper()
+	var got []byte
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got, err = os.ReadFile(path)
+		if want == "" && os.IsNotExist(err) || err == nil && string(got) == want {
+			return
+		}
+	}
+	t.Errorf("mirror copy %s = %q, %v; want %q", filepath.Base(path), got, err, want)
+}
+
+func TestReplicationToDirectory(t *testing.T) {
+	data, mirror := t.TempDir(), t.TempDir()
+	// A change journalled by a run that stopped before shipping it.
+	if err := os.WriteFile(filepath.Join(data, "left.txt"), []byte("left over"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, replicationJournalName), []byte(`{"path":"left.txt"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-directory", data, "-replicate-to", mirror, "-webdav")
+	waitForMirror(t, filepath.Join(mirror, "left.txt"), "left over")
+
+	client := testClient()
+	resp, err := client.Post("http://"+addr+"/files/a.txt", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForMirror(t, filepath.Join(mirror, "a.txt"), "hello")
+	info, _ := os.Stat(filepath.Join(data, "a.txt"))
+	if copied, err := os.Stat(filepath.Join(mirror, "a.txt")); err != nil || !copied.ModTime().Equal(info.ModTime()) {
+		t.Errorf("mirror copy's modification time differs from the original's")
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://"+addr+"/files/a.txt", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete = %d", resp.StatusCode)
+	}
+	waitForMirror(t, filepath.Join(mirror, "a.txt"), "")
+
+	// Once everything is shipped the journal is emptied.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if info, err := os.Stat(filepath.Join(data, replicationJournalName)); err == nil && info.Size() == 0 {
+			return
+		}
+	}
+	t.Error("replication journal not emptied once the mirror caught up")
+}
@@ -0,0 +1,361 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// maxHeaderBytes bounds the request line and header block together.
+const maxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// parseError is a request that was received but must be refused. After
+// one of these the framing of the connection can't be trusted, so the
+// caller answers with status and closes it. The status says what was wrong:
+//
+//	400 the request line or a header is malformed, or the head was cut short
+//	408 the client stopped sending partway through the head
+//	414 the request line is too long
+//	431 the header block is too large or has too many fields
+//	501 the body uses a transfer coding this server doesn't implement
+//	505 the request is not HTTP/1.x
+type parseError struct {
+	status int
+	reason string
+}
+
+func (e *parseError) Error() string {
+	return e.reason
+}
+
+func badRequest(format string, args ...any) *parseError {
+	return &parseError{status: http.StatusBadRequest, reason: fmt.Sprintf(format, args...)}
+}
+
+// parseRequest reads one request from reader. The head is read and checked
+// here before http.ReadRequest sees it, because ReadRequest is lenient in
+// exactly the places where a front-end proxy and this server could
+// disagree about where a request ends: it folds obsolete line continuations
+// and lets Transfer-Encoding silently override Content-Length. The body is
+// then framed by this function from the validated headers.
+func parseRequest(reader *bufio.Reader) (*http.Request, error) {
+	head, err := readHead(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err = validateHeaderFields(head)
+	if err != nil {
+		return nil, err
+	}
+	framing, err := checkFraming(head)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if req.ProtoMajor != 1 {
+		return nil, &parseError{status: http.StatusHTTPVersionNotSupported, reason: "unsupported protocol " + req.Proto}
+	}
+
+	switch {
+	case framing.chunked:
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Body = &chunkedBody{r: httputil.NewChunkedReader(reader), src: reader}
+	case framing.contentLength > 0:
+		req.ContentLength = framing.contentLength
+		req.Body = io.NopCloser(io.LimitReader(reader, framing.contentLength))
+	default:
+		req.ContentLength = 0
+		req.Body = http.NoBody
+	}
+	return req, nil
+}
+
+// readHead reads the request line and headers up to and including the
+// blank line that ends them. Running out of input before the first byte is
+// reported as is, since that is how an idle connection ends; running out
+// partway through is the client's fault and becomes a parseError.
+func readHead(reader *bufio.Reader) ([]byte, error) {
+	var head []byte
+	// skipped counts the empty lines ignored before the request line, as
+	// RFC 9112 2.2 asks, which still count towards the size limit.
+	skipped := 0
+	for {
+		line, err := readLine(reader, maxHeaderBytes-len(head)-skipped)
+		if err != nil {
+			var perr *parseError
+			switch {
+			case errors.As(err, &perr) && len(head) == 0:
+				return nil, &parseError{status: http.StatusRequestURITooLong, reason: "request line too long"}
+			case perr != nil:
+				return nil, err
+			case len(head)+len(line) == 0:
+				return nil, err
+			default:
+				return nil, incompleteHead(err)
+			}
+		}
+		blank := string(line) == "\r\n" || string(line) == "\n"
+		if blank && len(head) == 0 {
+			skipped += len(line)
+			continue
+		}
+		head = append(head, line...)
+		if blank {
+			return head, nil
+		}
+	}
+}
+
+// incompleteHead classifies an error that interrupted a request head.
+func incompleteHead(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &parseError{status: http.StatusRequestTimeout, reason: "timed out reading request head"}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return badRequest("request head ended early")
+	default:
+		return err
+	}
+}
+
+// readLine reads up to and including the next LF, failing with 431 if that
+// takes more than limit bytes.
+func readLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return nil, &parseError{status: http.StatusRequestHeaderFieldsTooLarge, reason: "request header too large"}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return line, err
+	}
+}
+
+// validateHeaderFields checks every header line against the field syntax
+// of RFC 9110 section 5: the name must be a non-empty token followed
+// directly by a colon, and the value may not contain control characters
+// other than horizontal tab. http.ReadRequest tolerates some of these, and
+// each one it tolerates is a chance for this server and a proxy in front
+// of it to read the same bytes differently; "Transfer-Encoding : chunked"
+// is the classic example. It also enforces -max-header-count and the
+// -duplicate-headers policy for singleton headers, returning head with any
+// merged repeats removed.
+func validateHeaderFields(head []byte) ([]byte, error) {
+	lines := strings.Split(strings.TrimRight(string(head), "\r\n"), "\n")
+	if len(lines)-1 > config.MaxHeaderCount {
+		return nil, &parseError{status: http.StatusRequestHeaderFieldsTooLarge, reason: "too many header fields"}
+	}
+
+	kept := []string{strings.TrimSuffix(lines[0], "\r")}
+	singletons := make(map[string]string)
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			// Obsolete line folding, reported by checkFraming.
+			kept = append(kept, line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, badRequest("header line without a colon")
+		}
+		if !isToken(name) {
+			return nil, badRequest("invalid header field name %q", name)
+		}
+		for i := 0; i < len(value); i++ {
+			if c := value[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+				return nil, badRequest("control character in header %s", name)
+			}
+		}
+
+		if key := strings.ToLower(name); singletonHeaders[key] {
+			value = strings.Trim(value, " \t")
+			if seen, dup := singletons[key]; dup {
+				if seen != value || config.DuplicateHeaders == "reject" {
+					return nil, badRequest("repeated %s header", name)
+				}
+				continue
+			}
+			singletons[key] = value
+		}
+		kept = append(kept, line)
+	}
+
+	if len(kept) == len(lines) {
+		return head, nil
+	}
+	return []byte(strings.Join(kept, "\r\n") + "\r\n\r\n"), nil
+}
+
+// singletonHeaders may appear only once, since a second copy changes which
+// virtual host serves the request or where its body ends depending on which
+// copy a parser believes.
+var singletonHeaders = map[string]bool{
+	"host":           true,
+	"content-length": true,
+}
+
+// isToken reports whether s is an RFC 9110 token: one or more tchars.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// bodyFraming describes how a request's body is delimited.
+type bodyFraming struct {
+	chunked       bool
+	contentLength int64
+}
+
+// checkFraming rejects the header combinations used for request smuggling
+// (RFC 9112 sections 5.2, 6.1 and 6.3): obsolete line folding, both
+// Content-Length and Transfer-Encoding, conflicting or malformed
+// Content-Length values, and any Transfer-Encoding other than a lone
+// "chunked" on an HTTP/1.1 request.
+func checkFraming(head []byte) (bodyFraming, error) {
+	lines := strings.Split(strings.TrimRight(string(head), "\r\n"), "\n")
+	requestLine := strings.TrimSuffix(lines[0], "\r")
+
+	var contentLengths, transferEncodings []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			return bodyFraming{}, badRequest("obsolete line folding")
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.Trim(value, " \t")
+		switch strings.ToLower(name) {
+		case "content-length":
+			contentLengths = append(contentLengths, strings.Split(value, ",")...)
+		case "transfer-encoding":
+			transferEncodings = append(transferEncodings, strings.Split(value, ",")...)
+		}
+	}
+
+	if len(transferEncodings) > 0 {
+		if len(contentLengths) > 0 {
+			return bodyFraming{}, badRequest("both Content-Length and Transfer-Encoding")
+		}
+		if strings.HasSuffix(requestLine, " HTTP/1.0") {
+			return bodyFraming{}, badRequest("Transfer-Encoding in an HTTP/1.0 request")
+		}
+		last := strings.ToLower(strings.Trim(transferEncodings[len(transferEncodings)-1], " \t"))
+		if last != "chunked" {
+			return bodyFraming{}, badRequest("Transfer-Encoding does not end in chunked")
+		}
+		if len(transferEncodings) > 1 {
+			return bodyFraming{}, &parseError{status: http.StatusNotImplemented, reason: "unsupported transfer coding"}
+		}
+		return bodyFraming{chunked: true}, nil
+	}
+
+	framing := bodyFraming{}
+	for i, value := range contentLengths {
+		value = strings.Trim(value, " \t")
+		n, err := parseContentLength(value)
+		if err != nil {
+			return bodyFraming{}, err
+		}
+		if i > 0 && n != framing.contentLength {
+			return bodyFraming{}, badRequest("conflicting Content-Length values")
+		}
+		framing.contentLength = n
+	}
+	return framing, nil
+}
+
+// parseContentLength accepts only a plain run of digits: no sign, no
+// whitespace, no hex, as RFC 9110 8.6 requires.
+func parseContentLength(value string) (int64, error) {
+	if value == "" {
+		return 0, badRequest("empty Content-Length")
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return 0, badRequest("invalid Content-Length %q", value)
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, badRequest("invalid Content-Length %q", value)
+	}
+	return n, nil
+}
+
+// chunkedBody decodes a chunked request body and, once the last chunk has
+// been read, consumes the trailer section so that the connection is left
+// at the end of the request.
+type chunkedBody struct {
+	r    io.Reader
+	src  *bufio.Reader
+	done bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.done = true
+		if err := skipTrailer(b.src); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (b *chunkedBody) Close() error {
+	return nil
+}
+
+// skipTrailer discards trailer fields up to the blank line that ends the
+// message. Trailers are not made available to handlers.
+func skipTrailer(reader *bufio.Reader) error {
+	total := 0
+	for {
+		line, err := readLine(reader, maxHeaderBytes-total)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		total += len(line)
+		if string(line) == "\r\n" || string(line) == "\n" {
+			return nil
+		}
+	}
+}
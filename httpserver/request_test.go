@@ -0,0 +1,434 @@
+package httpserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func parse(raw string) (*http.Request, *bufio.Reader, error) {
+	reader := bufio.NewReader(strings.NewReader(raw))
+	req, err := parseRequest(reader)
+	return req, reader, err
+}
+
+func TestParseRequestRejectsSmuggling(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{
+			name:   "CL.TE",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "TE.CL",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "conflicting Content-Length",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "conflicting Content-Length list",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 6\r\n\r\nhello!",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "signed Content-Length",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "hex Content-Length",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nhello",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "obs-fold",
+			raw:    "GET / HTTP/1.1\r\nHost: a\r\nX-Foo: bar\r\n baz\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "obs-fold hiding Transfer-Encoding",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nX-Foo: bar\r\n\tTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Transfer-Encoding not ending in chunked",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "obfuscated Transfer-Encoding",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "empty Transfer-Encoding",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Transfer-Encoding in HTTP/1.0",
+			raw:    "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "stacked transfer codings",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+			status: http.StatusNotImplemented,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parse(tt.raw)
+			var perr *parseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("parseRequest error = %v, want a parseError", err)
+			}
+			if perr.status != tt.status {
+				t.Errorf("status = %d, want %d (%v)", perr.status, tt.status, perr)
+			}
+		})
+	}
+}
+
+func TestParseRequestValidatesHeaderFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"space before colon", "Transfer-Encoding : chunked"},
+		{"tab before colon", "Content-Length\t: 3"},
+		{"space in name", "X Foo: bar"},
+		{"separator in name", "X(Foo): bar"},
+		{"empty name", ": bar"},
+		{"no colon", "X-Foo bar"},
+		{"NUL in value", "X-Foo: a\x00b"},
+		{"bare CR in value", "X-Foo: a\rb"},
+		{"DEL in value", "X-Foo: a\x7fb"},
+		{"non-ASCII name", "X-F\xc3\xb6o: bar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parse("GET / HTTP/1.1\r\nHost: a\r\n" + tt.header + "\r\n\r\n")
+			var perr *parseError
+			if !errors.As(err, &perr) || perr.status != http.StatusBadRequest {
+				t.Fatalf("parseRequest error = %v, want 400", err)
+			}
+		})
+	}
+
+	req, _, err := parse("GET / HTTP/1.1\r\nHost: a\r\nX-Tab: a\tb\r\nX-Latin1: caf\xe9\r\nX-Empty:\r\n\r\n")
+	if err != nil {
+		t.Fatalf("parseRequest rejected valid fields: %v", err)
+	}
+	if got := req.Header.Get("X-Tab"); got != "a\tb" {
+		t.Errorf("X-Tab = %q, want %q", got, "a\tb")
+	}
+}
+
+func TestParseRequestHeaderCount(t *testing.T) {
+	defer func(n int) { config.MaxHeaderCount = n }(config.MaxHeaderCount)
+	config.MaxHeaderCount = 3
+
+	if _, _, err := parse("GET / HTTP/1.1\r\nHost: a\r\nA: 1\r\nB: 2\r\n\r\n"); err != nil {
+		t.Fatalf("parseRequest rejected %d headers: %v", config.MaxHeaderCount, err)
+	}
+
+	_, _, err := parse("GET / HTTP/1.1\r\nHost: a\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n")
+	var perr *parseError
+	if !errors.As(err, &perr) || perr.status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("parseRequest error = %v, want 431", err)
+	}
+}
+
+func TestParseRequestDuplicateHeaders(t *testing.T) {
+	defer func(policy string) { config.DuplicateHeaders = policy }(config.DuplicateHeaders)
+
+	tests := []struct {
+		name   string
+		policy string
+		header string
+		ok     bool
+	}{
+		{"identical Host merged", "merge", "Host: a\r\nHost: a", true},
+		{"different Host", "merge", "Host: a\r\nHost: b", false},
+		{"identical Host rejected", "reject", "Host: a\r\nHost: a", false},
+		{"identical Content-Length merged", "merge", "Host: a\r\nContent-Length: 0\r\ncontent-length: 0", true},
+		{"different Content-Length", "merge", "Host: a\r\nContent-Length: 0\r\nContent-Length: 1", false},
+		{"identical Content-Length rejected", "reject", "Host: a\r\nContent-Length: 0\r\nContent-Length: 0", false},
+		{"other headers may repeat", "reject", "Host: a\r\nAccept: a\r\nAccept: a", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DuplicateHeaders = tt.policy
+			req, _, err := parse("POST / HTTP/1.1\r\n" + tt.header + "\r\n\r\n")
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("parseRequest: %v", err)
+				}
+				if n := len(req.Header.Values("Content-Length")); n > 1 {
+					t.Errorf("Content-Length has %d values after merging", n)
+				}
+				return
+			}
+			var perr *parseError
+			if !errors.As(err, &perr) || perr.status != http.StatusBadRequest {
+				t.Fatalf("parseRequest error = %v, want 400", err)
+			}
+		})
+	}
+}
+
+func TestParseRequestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"malformed request line", "GET /\r\nHost: a\r\n\r\n", http.StatusBadRequest},
+		{"malformed version", "GET / HTTP/one\r\nHost: a\r\n\r\n", http.StatusBadRequest},
+		{"unsupported version", "GET / HTTP/2.0\r\nHost: a\r\n\r\n", http.StatusHTTPVersionNotSupported},
+		{"truncated head", "GET / HTTP/1.1\r\nHost: a\r\n", http.StatusBadRequest},
+		{"long request line", "GET /" + strings.Repeat("a", maxHeaderBytes) + " HTTP/1.1\r\n\r\n", http.StatusRequestURITooLong},
+		{"long header", "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", maxHeaderBytes) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parse(tt.raw)
+			var perr *parseError
+			if !errors.As(err, &perr) || perr.status != tt.status {
+				t.Fatalf("parseRequest error = %v, want %d", err, tt.status)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		reader := bufio.NewReader(io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\nHo"), timeoutReader{}))
+		_, err := parseRequest(reader)
+		var perr *parseError
+		if !errors.As(err, &perr) || perr.status != http.StatusRequestTimeout {
+			t.Fatalf("parseRequest error = %v, want 408", err)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		if _, _, err := parse(""); err != io.EOF {
+			t.Fatalf("parseRequest error = %v, want io.EOF", err)
+		}
+	})
+}
+
+// timeoutReader fails every read the way a connection past its read
+// deadline does.
+type timeoutReader struct{}
+
+func (timeoutReader) Read([]byte) (int, error) {
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestParseRequestFramesBody(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		body string
+	}{
+		{
+			name: "Content-Length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhelloGET /next HTTP/1.1\r\n\r\n",
+			body: "hello",
+		},
+		{
+			name: "identical Content-Length values",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhelloGET /next HTTP/1.1\r\n\r\n",
+			body: "hello",
+		},
+		{
+			name: "chunked with trailer",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Trailer: 1\r\n\r\nGET /next HTTP/1.1\r\n\r\n",
+			body: "hello",
+		},
+		{
+			name: "no body",
+			raw:  "GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /next HTTP/1.1\r\n\r\n",
+			body: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, reader, err := parse(tt.raw)
+			if err != nil {
+				t.Fatalf("parseRequest: %v", err)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+
+			// The reader must be left exactly at the next request.
+			next, err := parseRequest(reader)
+			if err != nil {
+				t.Fatalf("parsing the following request: %v", err)
+			}
+			if next.URL.Path != "/next" {
+				t.Errorf("next request path = %q, want /next", next.URL.Path)
+			}
+		})
+	}
+}
+
+// The fuzz targets below run their seeds as ordinary tests. Run one with
+// "go test ./app -fuzz FuzzParseRequestLine" to explore further; any input
+// that fails is written under testdata/fuzz and replayed by go test from
+// then on.
+
+func FuzzParseRequestLine(f *testing.F) {
+	for _, line := range []string{
+		"GET / HTTP/1.1",
+		"GET /echo/abc HTTP/1.1",
+		"GET http://localhost:4221/echo/hi?x=1 HTTP/1.1",
+		"OPTIONS * HTTP/1.1",
+		"CONNECT example.com:443 HTTP/1.1",
+		"GET /files/../../etc/passwd HTTP/1.1",
+		"GET /files/..%2f..%2fetc/passwd HTTP/1.1",
+		"GET /files/%2e%2e/secret HTTP/1.1",
+		"GET //files///a.txt HTTP/1.1",
+		"GET /a%00b HTTP/1.1",
+		"GET /%zz HTTP/1.1",
+		"GET / HTTP/2.0",
+		"GET / HTTP/1.1 extra",
+		"GET  /  HTTP/1.1",
+		"GET /\tHTTP/1.1",
+		"get / http/1.1",
+		"GET",
+		"",
+	} {
+		f.Add(line)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		req, _, err := parse(line + "\r\nHost: a\r\n\r\n")
+		if err != nil {
+			checkParseError(t, err)
+			return
+		}
+		if req.URL.IsAbs() || !strings.HasPrefix(req.URL.Path, "/") {
+			return
+		}
+		if normalizePath(req.URL) != nil {
+			return
+		}
+		for _, segment := range strings.Split(req.URL.Path, "/") {
+			if segment == ".." || segment == "." {
+				t.Fatalf("normalized path %q still has dot segments", req.URL.Path)
+			}
+		}
+	})
+}
+
+func FuzzParseRequestHeaders(f *testing.F) {
+	for _, header := range []string{
+		"Host: a",
+		"Host: a\r\nHost: a",
+		"Host: a\r\nHost: b",
+		"Host: a\r\nContent-Length: 5",
+		"Host: a\r\nContent-Length: 5\r\ncontent-length: 5",
+		"Host: a\r\nContent-Length: 5, 6",
+		"Host: a\r\nContent-Length: -1",
+		"Host: a\r\nContent-Length: 99999999999999999999",
+		"Host: a\r\nTransfer-Encoding: chunked",
+		"Host: a\r\nTransfer-Encoding : chunked",
+		"Host: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3",
+		"Host: a\r\nTransfer-Encoding: gzip, chunked",
+		"Host: a\r\nX-Foo: bar\r\n baz",
+		"Host: a\r\nX-Foo: a\x00b",
+		"Host: a\nX-Bare-LF: 1",
+		": empty",
+		"no colon",
+	} {
+		f.Add(header)
+	}
+
+	f.Fuzz(func(t *testing.T, header string) {
+		req, _, err := parse("POST / HTTP/1.1\r\n" + header + "\r\n\r\n")
+		if err != nil {
+			checkParseError(t, err)
+			return
+		}
+		if len(req.Header) > config.MaxHeaderCount {
+			t.Fatalf("accepted %d header fields, limit is %d", len(req.Header), config.MaxHeaderCount)
+		}
+		if req.ContentLength > 0 && len(req.TransferEncoding) > 0 {
+			t.Fatalf("accepted both Content-Length and Transfer-Encoding")
+		}
+		for _, name := range []string{"Host", "Content-Length"} {
+			if n := len(req.Header.Values(name)); n > 1 {
+				t.Fatalf("accepted %d %s values", n, name)
+			}
+		}
+	})
+}
+
+func FuzzParseChunkedBody(f *testing.F) {
+	for _, body := range []string{
+		"0\r\n\r\n",
+		"5\r\nhello\r\n0\r\n\r\n",
+		"5;ext=1\r\nhello\r\n0\r\n\r\n",
+		"5\r\nhello\r\n0\r\nX-Trailer: 1\r\n\r\n",
+		"A\r\n0123456789\r\n0\r\n\r\n",
+		"5\r\nhello world\r\n0\r\n\r\n",
+		"5\r\nhel",
+		"-1\r\n\r\n",
+		"ffffffffffffffff\r\n",
+		"5\nhello\n0\n\n",
+		"0\r\n",
+		"",
+	} {
+		f.Add(body)
+	}
+
+	f.Fuzz(func(t *testing.T, body string) {
+		req, _, err := parse("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" + body)
+		if err != nil {
+			t.Fatalf("parseRequest: %v", err)
+		}
+		data, err := io.ReadAll(req.Body)
+		if err == nil && len(data) > len(body) {
+			t.Fatalf("decoded %d bytes from %d bytes of chunked input", len(data), len(body))
+		}
+	})
+}
+
+// checkParseError fails t unless err is one parseRequest may return: a
+// parseError with a client error or 501 status, or the input ending early.
+func checkParseError(t *testing.T, err error) {
+	t.Helper()
+	var perr *parseError
+	if errors.As(err, &perr) {
+		if perr.status < 400 || perr.status >= 600 || perr.status == http.StatusInternalServerError {
+			t.Fatalf("parseError status %d for %v", perr.status, perr)
+		}
+		return
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error type %T: %v", err, err)
+	}
+}
@@ -0,0 +1,187 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter builds the response to one request. Header fields are
+// collected until the status is written, and the body is held back until
+// the handler returns, when it goes out with a Content-Length. Flush sends
+// what there is so far instead, and the rest of the body follows in
+// chunks as it is written.
+type ResponseWriter struct {
+	conn   net.Conn
+	req    *http.Request
+	header http.Header
+	// status is 0 until WriteHeader is called.
+	status int
+	body   bytes.Buffer
+	// stream carries the body once Flush has sent the header, and err is
+	// the first error sending it, after which the response is abandoned.
+	stream  *streamWriter
+	err     error
+	written int64
+}
+
+func newResponseWriter(conn net.Conn, req *http.Request) *ResponseWriter {
+	return &ResponseWriter{conn: conn, req: req, header: make(http.Header)}
+}
+
+// Header returns the header fields to be sent. Changes made after the
+// header has been flushed have no effect.
+func (w *ResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader sets the response status. Only the first call counts.
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		log.Printf("Ignoring status %d for a response that already has %d", status, w.status)
+		return
+	}
+	w.status = status
+}
+
+// Write adds p to the body, setting the status to 200 OK if it hasn't
+// been set. The body of a response to HEAD is counted but not sent.
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.written += int64(len(p))
+	if w.stream == nil {
+		return w.body.Write(p)
+	}
+	if w.isHead() {
+		return len(p), nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.stream.Write(p)
+	w.err = err
+	return n, err
+}
+
+// Flush sends the header and the body written so far, so that the client
+// sees them without waiting for the handler to finish.
+func (w *ResponseWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.stream == nil {
+		w.stream, w.err = startStreamHeader(w.conn, w.status, w.header)
+		if w.err == nil && !w.isHead() {
+			_, w.err = w.body.WriteTo(w.stream)
+		}
+		w.body.Reset()
+		if w.err != nil {
+			return w.err
+		}
+	}
+	w.err = w.stream.Flush()
+	return w.err
+}
+
+func (w *ResponseWriter) isHead() bool {
+	return w.req != nil && w.req.Method == http.MethodHead
+}
+
+// Status returns the status of the response, or 0 if none has been set.
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// Written returns the number of body bytes written so far.
+func (w *ResponseWriter) Written() int64 {
+	return w.written
+}
+
+// finish completes the response once the handler has returned. A
+// streamed response is left unterminated if it failed, or if the request
+// was cancelled and the handler may have given up on it part way, so that
+// the client doesn't take it for complete.
+func (w *ResponseWriter) finish() {
+	if w.err != nil {
+		return
+	}
+	if w.stream != nil {
+		if w.req != nil && w.req.Context().Err() != nil {
+			return
+		}
+		if err := w.stream.Close(); err != nil {
+			log.Printf("Error closing response: %v", err)
+		}
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.wantsErrorPage() {
+		w.writeErrorPage()
+	}
+	if isHTML(w.header) {
+		setCSP(w.header, newCSPNonce())
+	}
+
+	resp := &http.Response{
+		Status:        http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		// With the request attached, Write leaves out the body of a
+		// response to HEAD.
+		Request: w.req,
+	}
+	if connClosing(w.conn) {
+		resp.Header.Set("Connection", "close")
+	}
+
+	recordStatus(w.conn, w.status)
+	if err := resp.Write(w.conn); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// serveWith runs handler for req and sends the response it makes, or the
+// one for the error it returns.
+func serveWith(conn net.Conn, req *http.Request, handler Handler) {
+	w := newResponseWriter(conn, req)
+	if err := handler.Serve(w, req); err != nil {
+		w.fail(err)
+	}
+	w.finish()
+}
+
+// fail replaces the response with the one for err, or abandons it if it
+// has already been flushed.
+func (w *ResponseWriter) fail(err error) {
+	status := reportError(err)
+	if w.stream != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	w.header = make(http.Header)
+	w.body.Reset()
+	w.status = 0
+	var jsonErr *JSONError
+	if errors.As(err, &jsonErr) {
+		w.JSON(status, jsonErr)
+		return
+	}
+	w.status = status
+}
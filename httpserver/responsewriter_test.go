@@ -0,0 +1,88 @@
+package httpserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestResponseWriter(t *testing.T) {
+	t.Cleanup(func() { routes = nil })
+	srv := &Server{}
+	srv.HandleFunc("GET", "/buffered", func(w *ResponseWriter, req *http.Request) error {
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "hello ")
+		io.WriteString(w, "world")
+		return nil
+	})
+	var status int
+	var written int64
+	srv.HandleFunc("GET", "/flushed", func(w *ResponseWriter, req *http.Request) error {
+		io.WriteString(w, "hello ")
+		if err := w.Flush(); err != nil {
+			t.Errorf("Flush: %v", err)
+		}
+		io.WriteString(w, "world")
+		status, written = w.Status(), w.Written()
+		return nil
+	})
+	srv.HandleFunc("GET", "/missing", func(w *ResponseWriter, req *http.Request) error {
+		w.Header().Set("X-Test", "yes")
+		io.WriteString(w, "partial")
+		return fmt.Errorf("looking up %s: %w", req.URL.Path, ErrNotFound)
+	})
+	srv.HandleFunc("GET", "/teapot", func(w *ResponseWriter, req *http.Request) error {
+		return Errorf(http.StatusTeapot, "short and stout")
+	})
+	addr := startTestServer(t)
+	client := testClient()
+
+	tests := []struct {
+		path          string
+		status        int
+		body          string
+		header        string
+		contentLength int64
+		chunked       bool
+	}{
+		{path: "/buffered", status: http.StatusCreated, body: "hello world", header: "yes", contentLength: 11},
+		{path: "/flushed", status: http.StatusOK, body: "hello world", contentLength: -1, chunked: true},
+		{path: "/missing", status: http.StatusNotFound},
+		{path: "/teapot", status: http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := client.Get("http://" + addr + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := resp.Header.Get("X-Test"); got != tt.header {
+				t.Errorf("X-Test = %q, want %q", got, tt.header)
+			}
+			if resp.ContentLength != tt.contentLength {
+				t.Errorf("ContentLength = %d, want %d", resp.ContentLength, tt.contentLength)
+			}
+			if chunked := len(resp.TransferEncoding) > 0; chunked != tt.chunked {
+				t.Errorf("chunked = %v, want %v", chunked, tt.chunked)
+			}
+		})
+	}
+
+	if status != http.StatusOK || written != 11 {
+		t.Errorf("Status, Written = %d, %d; want 200, 11", status, written)
+	}
+}
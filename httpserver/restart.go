@@ -0,0 +1,223 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A restarted server finds the listener it inherits, and the pipe on which
+// to say that it is serving, at the file descriptors these name.
+const (
+	listenerFDEnv = "HTTPSERVER_LISTENER_FD"
+	readyFDEnv    = "HTTPSERVER_READY_FD"
+)
+
+// restartReadyTimeout is how long a replacement process has to start
+// serving before the restart is abandoned.
+const restartReadyTimeout = 30 * time.Second
+
+// listen returns the listener handed over by the process this one
+// replaces, if there is one, and otherwise listens on addr.
+func listen(addr string) (net.Listener, error) {
+	fd := os.Getenv(listenerFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(listenerFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", listenerFDEnv, err)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inheriting listener: %w", err)
+	}
+	log.Println("Took over listener on", listener.Addr())
+	return listener, nil
+}
+
+// signalReady tells the process this one replaces that it is serving.
+func signalReady() {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		log.Printf("Error signalling readiness: invalid %s %q", readyFDEnv, fd)
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("Error signalling readiness: %v", err)
+	}
+}
+
+// stateGate keeps the files holding the server's state, such as the audit
+// log, content index, users file and expiry index, from being written by
+// two processes at once. Requests that may change state and maintenance
+// jobs pass through it; Restart closes it before the new process loads
+// those files, and keeps it closed once the new process serves.
+type stateGate struct {
+	mu      sync.Mutex
+	closed  bool
+	writers int
+	// drained is closed when the last writer leaves the closed gate.
+	drained chan struct{}
+}
+
+// stateWrites is the gate of this process.
+var stateWrites stateGate
+
+// enter reports whether the caller may change state, in which case it
+// must call leave when done.
+func (g *stateGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.writers++
+	return true
+}
+
+func (g *stateGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.writers--; g.writers == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+// close turns away new writers and waits up to timeout for those inside
+// to leave. If they don't, the gate is opened again and an error returned.
+func (g *stateGate) close(timeout time.Duration) error {
+	g.mu.Lock()
+	g.closed = true
+	if g.writers == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	drained := make(chan struct{})
+	g.drained = drained
+	g.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+		g.open()
+		return errors.New("timed out waiting for requests changing state to finish")
+	}
+}
+
+func (g *stateGate) open() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = false
+	g.drained = nil
+}
+
+// changesState reports whether a request with method may change what the
+// server stores.
+func changesState(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// Restart starts a new copy of the running program, with the same
+// arguments and environment, and hands it the server's listener. It
+// returns once the new process is serving, after which the caller shuts
+// this server down to finish the requests in flight.
+//
+// So that the new process loads state that nothing else is changing, this
+// server first stops accepting connections, lets those open close after
+// their current request, and waits for the requests and maintenance jobs
+// that may change state to finish; from then on it refuses to change state
+// itself. Connections made meanwhile wait in the listener's backlog for
+// the new process, so none is refused.
+//
+// If the new process fails to start serving, Restart stops it and
+// returns an error, and this server carries on as before. A server in
+// -chroot can't restart.
+func (s *Server) Restart() (err error) {
+	if config.Chroot != "" {
+		// The new process would have neither the program nor the root
+		// privileges needed to chroot again.
+		return errors.New("can't restart inside -chroot")
+	}
+	listenerFile, err := s.conns.listenerFile()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+
+	s.conns.pause()
+	defer func() {
+		if err != nil {
+			stateWrites.open()
+			s.conns.resume()
+		}
+	}()
+	if err := stateWrites.close(restartReadyTimeout); err != nil {
+		return err
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// ExtraFiles start at descriptor 3.
+	cmd.ExtraFiles = []*os.File{listenerFile, readyWriter}
+	cmd.Env = append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("starting new process: %w", err)
+	}
+	go cmd.Wait()
+
+	// The read fails if the new process exits without writing, since
+	// nothing else holds the pipe open.
+	done := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(restartReadyTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d didn't start serving: %w", cmd.Process.Pid, err)
+	}
+	log.Printf("New process %d is serving", cmd.Process.Pid)
+	return nil
+}
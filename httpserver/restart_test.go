@@ -0,0 +1,194 @@
+//go:build unix
+
+package httpserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// handOverFD returns a duplicate of f's descriptor for the function under
+// test to take over and close, so that f can still be closed safely.
+func handOverFD(t *testing.T, f *os.File) string {
+	t.Helper()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strconv.Itoa(fd)
+}
+
+func TestListenInheritsListener(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+	f, err := parent.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	t.Setenv(listenerFDEnv, handOverFD(t, f))
+
+	listener, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if got, want := listener.Addr().String(), parent.Addr().String(); got != want {
+		t.Errorf("listening on %s, want the inherited %s", got, want)
+	}
+	if _, ok := os.LookupEnv(listenerFDEnv); ok {
+		t.Errorf("%s is still set, and would be passed on to children", listenerFDEnv)
+	}
+
+	conn, err := net.Dial("tcp", parent.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	parent.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accepting on the inherited listener: %v", err)
+	}
+	accepted.Close()
+
+	t.Setenv(listenerFDEnv, "x")
+	if _, err := listen("127.0.0.1:0"); err == nil {
+		t.Errorf("listen with %s=x succeeded", listenerFDEnv)
+	}
+}
+
+func TestSignalReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	t.Setenv(readyFDEnv, handOverFD(t, w))
+	w.Close()
+
+	signalReady()
+	if _, ok := os.LookupEnv(readyFDEnv); ok {
+		t.Errorf("%s is still set, and would be passed on to children", readyFDEnv)
+	}
+	// signalReady closed the last write end, so the byte is followed by EOF.
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "\x01" {
+		t.Errorf("read %q, %v from the ready pipe, want one byte", data, err)
+	}
+
+	// Without the variable, as when not started by Restart, it does nothing.
+	signalReady()
+}
+
+func TestStateGate(t *testing.T) {
+	var g stateGate
+	if !g.enter() {
+		t.Fatal("enter refused on an open gate")
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- g.close(time.Second) }()
+	select {
+	case <-closed:
+		t.Fatal("close returned with a writer inside")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if g.enter() {
+		t.Fatal("enter allowed while closing")
+	}
+	g.leave()
+	if err := <-closed; err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if g.enter() {
+		t.Fatal("enter allowed on a closed gate")
+	}
+
+	g.open()
+	if !g.enter() {
+		t.Fatal("enter refused after open")
+	}
+	if err := g.close(10 * time.Millisecond); err == nil {
+		t.Fatal("close didn't time out with a writer inside")
+	}
+	if !g.enter() {
+		t.Fatal("gate left closed after close timed out")
+	}
+	g.leave()
+	g.leave()
+}
+
+func TestRestartHandover(t *testing.T) {
+	addr := startTestServer(t)
+	defer stateWrites.open()
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	connections.pause()
+	if err := stateWrites.close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Error("idle connection left open while handing over")
+	}
+
+	// A connection made while paused waits rather than being refused.
+	waiting, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("connection refused while handing over: %v", err)
+	}
+	defer waiting.Close()
+	waiting.SetDeadline(time.Now().Add(5 * time.Second))
+	answered := make(chan string, 1)
+	go func() {
+		waiting.Write([]byte("POST /files/a.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhi"))
+		line, _ := bufio.NewReader(waiting).ReadString('\n')
+		answered <- line
+	}()
+	select {
+	case line := <-answered:
+		t.Fatalf("answered %q while paused", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Had the new process failed, this one carries on, refusing to
+	// change state only while the gate is closed.
+	connections.resume()
+	if line := <-answered; !strings.Contains(line, " 503 ") {
+		t.Errorf("upload while state was handed over got %q, want 503", line)
+	}
+	stateWrites.open()
+	resp, err := testClient().Post("http://"+addr+"/files/a.txt", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload after resuming = %d, want 201", resp.StatusCode)
+	}
+}
+
+func TestRestartRefusedInChroot(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config.Chroot = "/var/empty"
+	s := &Server{conns: newConnTracker()}
+	if err := s.Restart(); err == nil || !strings.Contains(err.Error(), "chroot") {
+		t.Errorf("Restart in -chroot = %v, want an error", err)
+	}
+}
@@ -0,0 +1,131 @@
+package httpserver
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// retryBudgetWindow is how often a route's retry budget is refilled.
+	retryBudgetWindow = 10 * time.Second
+	// retryBudgetMinimum is the number of retries always allowed per
+	// window, so that lightly used routes can still fail over.
+	retryBudgetMinimum = 10
+)
+
+// RetryPolicy controls failover for a proxy route. A request is retried on
+// another healthy upstream when the upstream could not be reached, or when
+// an idempotent request received a 502, 503 or 504, up to Attempts tries in
+// total. Requests with a body are never retried since it has already been
+// streamed to the failed upstream.
+type RetryPolicy struct {
+	Attempts int      `json:"attempts"`
+	Backoff  duration `json:"backoff"`
+	// BudgetRatio caps retries at this fraction of the route's requests
+	// (plus a small fixed allowance) to avoid retry storms.
+	BudgetRatio float64 `json:"budget_ratio"`
+}
+
+func (p *RetryPolicy) setDefaults() {
+	if p.Attempts <= 0 {
+		p.Attempts = 2
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = duration(25 * time.Millisecond)
+	}
+	if p.BudgetRatio <= 0 {
+		p.BudgetRatio = 0.2
+	}
+}
+
+// allows reports whether another attempt should follow the given outcome.
+// A nil policy never retries.
+func (p *RetryPolicy) allows(attempt int, req *http.Request, resp *http.Response, err error) bool {
+	if p == nil || attempt >= p.Attempts || req.ContentLength != 0 {
+		return false
+	}
+	if err != nil {
+		return isDialError(err) || isIdempotent(req.Method)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return isIdempotent(req.Method)
+	}
+	return false
+}
+
+// backoff returns the pause before the attempt following attempt: an
+// exponentially growing base with full jitter.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	base := time.Duration(p.Backoff) << (attempt - 1)
+	return time.Duration(rand.Int63n(int64(base) + 1))
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isDialError reports whether err happened while connecting, in which case
+// the upstream never saw the request and retrying is always safe.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryBudget limits retries to a fraction of recent requests.
+type retryBudget struct {
+	ratio float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, windowStart: time.Now()}
+}
+
+// deposit records a request routed through the budget's route.
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.requests++
+}
+
+// withdraw takes one retry from the budget, reporting false when it is
+// exhausted. A nil budget always refuses.
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+
+	if float64(b.retries) >= retryBudgetMinimum+b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *retryBudget) refill() {
+	if time.Since(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule maps request paths matching Match onto Replace, which may
+// refer to capture groups as $1, ${name} and so on. With Redirect set to a
+// 3xx status the client is redirected to the new location; otherwise the
+// request is rewritten internally and routed as if it had asked for it.
+type RewriteRule struct {
+	Match    string `json:"match"`
+	Replace  string `json:"replace"`
+	Redirect int    `json:"redirect"`
+
+	pattern *regexp.Regexp
+}
+
+func (r *RewriteRule) compile() error {
+	pattern, err := regexp.Compile(r.Match)
+	if err != nil {
+		return err
+	}
+	if r.Redirect != 0 && (r.Redirect < 300 || r.Redirect > 308) {
+		return fmt.Errorf("redirect status %d is not a 3xx code", r.Redirect)
+	}
+	r.pattern = pattern
+	return nil
+}
+
+// applyRewrites runs the first rewrite rule matching the request path. It
+// returns false if it has already answered the request with a redirect.
+func applyRewrites(conn net.Conn, req *http.Request) bool {
+	rules := virtualHost(req).Rewrites
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.pattern.MatchString(req.URL.Path) {
+			continue
+		}
+
+		target := rule.pattern.ReplaceAllString(req.URL.Path, rule.Replace)
+		if rule.Redirect != 0 {
+			sendRedirect(conn, rule.Redirect, withQuery(target, req.URL.RawQuery))
+			return false
+		}
+
+		path, query, _ := strings.Cut(target, "?")
+		req.URL.Path = path
+		req.URL.RawPath = ""
+		req.URL.RawQuery = mergeQuery(query, req.URL.RawQuery)
+		return true
+	}
+	return true
+}
+
+// withQuery appends rawQuery to target, respecting any query target
+// already carries.
+func withQuery(target, rawQuery string) string {
+	if rawQuery == "" {
+		return target
+	}
+	if strings.Contains(target, "?") {
+		return target + "&" + rawQuery
+	}
+	return target + "?" + rawQuery
+}
+
+// mergeQuery combines the query produced by a rewrite with the original
+// one. Parameters from the rewrite come first so they take precedence with
+// url.Values.Get.
+func mergeQuery(rewritten, original string) string {
+	switch {
+	case rewritten == "":
+		return original
+	case original == "":
+		return rewritten
+	}
+	if _, err := url.ParseQuery(rewritten); err != nil {
+		return original
+	}
+	return rewritten + "&" + original
+}
@@ -0,0 +1,126 @@
+package httpserver
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/http-server-starter-go/internal/websocket"
+)
+
+// roomSendBuffer is how many messages may queue for a member before it is
+// considered too slow and disconnected.
+const roomSendBuffer = 64
+
+type roomMessage struct {
+	op   websocket.Opcode
+	data []byte
+}
+
+// roomMember is one WebSocket client in a room. Messages reach the client
+// through send, which is drained by a dedicated writer goroutine so that a
+// slow reader never stalls a broadcast.
+type roomMember struct {
+	ws   *websocket.Conn
+	send chan roomMessage
+}
+
+// roomHub tracks the members of every named room.
+type roomHub struct {
+	mu    sync.Mutex
+	rooms map[string]map[*roomMember]struct{}
+}
+
+func newRoomHub() *roomHub {
+	return &roomHub{rooms: make(map[string]map[*roomMember]struct{})}
+}
+
+func (h *roomHub) join(room string, m *roomMember) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*roomMember]struct{})
+		h.rooms[room] = members
+	}
+	members[m] = struct{}{}
+}
+
+// leave removes m from room and closes its send queue. It is safe to call
+// more than once.
+func (h *roomHub) leave(room string, m *roomMember) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(room, m)
+}
+
+func (h *roomHub) removeLocked(room string, m *roomMember) {
+	members := h.rooms[room]
+	if _, ok := members[m]; !ok {
+		return
+	}
+
+	delete(members, m)
+	close(m.send)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// broadcast queues msg for every member of room. Members whose queue is
+// full are dropped rather than allowed to hold up everyone else.
+func (h *roomHub) broadcast(room string, msg roomMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for m := range h.rooms[room] {
+		select {
+		case m.send <- msg:
+		default:
+			h.removeLocked(room, m)
+			go m.ws.Close(websocket.ClosePolicyViolation, "too slow")
+		}
+	}
+}
+
+var rooms = newRoomHub()
+
+// handleRoom joins the client to the room named in /ws/{room} and relays
+// every message it sends to all members of that room, itself included.
+func handleRoom(conn net.Conn, req *http.Request) {
+	room := strings.TrimPrefix(req.URL.Path, "/ws/")
+	if room == "" || strings.Contains(room, "/") {
+		handleNotFound(conn)
+		return
+	}
+
+	ws := upgradeWebSocket(conn, req)
+	if ws == nil {
+		return
+	}
+
+	member := &roomMember{ws: ws, send: make(chan roomMessage, roomSendBuffer)}
+	rooms.join(room, member)
+	defer rooms.leave(room, member)
+
+	go func() {
+		for msg := range member.send {
+			if err := ws.WriteMessage(msg.op, msg.data); err != nil {
+				log.Printf("Error writing to room %q: %v", room, err)
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		op, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		rooms.broadcast(room, roomMessage{op: op, data: data})
+	}
+}
@@ -0,0 +1,442 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestNonceLifetime is how long a Digest nonce is accepted. A request
+// with an older one is answered with stale=true, so the client retries
+// with a fresh nonce without asking the user again.
+const digestNonceLifetime = 5 * time.Minute
+
+// RouteAuth requires HTTP authentication (RFC 9110 11) for paths starting
+// with Prefix, for the given Methods or all of them if there are none.
+// Scheme "basic" (RFC 7617) checks passwords against -users; "digest"
+// (RFC 7616) checks against DigestFile, whose lines are "user:realm:hash",
+// the hash being hex MD5 or SHA-256 of "user:realm:password" as htdigest
+// writes it. Digest never sends the password, so it is the one to use
+// where there is no TLS. "hmac" checks requests signed with one of Keys,
+// which maps key ids to secrets, as for webhooks; see checkHMAC.
+//
+// Checking a Basic password costs a 600,000-iteration PBKDF2 hash, tens
+// of milliseconds of CPU. A right password is then remembered for
+// basicCacheTTL, but every wrong one costs a hash, so a public Basic
+// route wants -ban with unauthorized= to stop clients that keep guessing.
+// Clients making many requests are better off with a token from
+// /auth/login.
+type RouteAuth struct {
+	Prefix     string            `json:"prefix"`
+	Methods    []string          `json:"methods"`
+	Scheme     string            `json:"scheme"`
+	Realm      string            `json:"realm"`
+	DigestFile string            `json:"digest_file"`
+	Keys       map[string]string `json:"keys"`
+
+	// digests maps "user:ALGORITHM" to the stored hash.
+	digests map[string][]byte
+}
+
+func (a *RouteAuth) prepare() error {
+	if !strings.HasPrefix(a.Prefix, "/") {
+		return errors.New("prefix must start with /")
+	}
+	if a.Realm == "" {
+		a.Realm = a.Prefix
+	}
+	if strings.ContainsAny(a.Realm, "\"\\") {
+		return errors.New("realm may not contain quotes or backslashes")
+	}
+	for i, method := range a.Methods {
+		a.Methods[i] = strings.ToUpper(method)
+	}
+
+	switch a.Scheme {
+	case "basic":
+		return nil
+	case "digest":
+		if a.DigestFile == "" {
+			return errors.New("digest_file is required for digest")
+		}
+		digests, err := loadDigestFile(a.DigestFile, a.Realm)
+		if err != nil {
+			return err
+		}
+		a.digests = digests
+		return nil
+	case "hmac":
+		if len(a.Keys) == 0 {
+			return errors.New("keys are required for hmac")
+		}
+		return nil
+	default:
+		return fmt.Errorf("scheme must be basic, digest or hmac, not %q", a.Scheme)
+	}
+}
+
+// loadDigestFile reads the entries for realm from an htdigest-style file.
+func loadDigestFile(path, realm string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	digests := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want user:realm:hash", path, n)
+		}
+		if fields[1] != realm {
+			continue
+		}
+		sum, err := hex.DecodeString(fields[2])
+		var algorithm string
+		switch {
+		case err == nil && len(sum) == md5.Size:
+			algorithm = "MD5"
+		case err == nil && len(sum) == sha256.Size:
+			algorithm = "SHA-256"
+		default:
+			return nil, fmt.Errorf("%s:%d: hash is neither hex MD5 nor hex SHA-256", path, n)
+		}
+		digests[fields[0]+":"+algorithm] = sum
+	}
+	return digests, scanner.Err()
+}
+
+// matchRouteAuth returns the rule covering req, if any.
+func matchRouteAuth(req *http.Request) *RouteAuth {
+	for _, a := range config.RouteAuth {
+		if strings.HasPrefix(req.URL.Path, a.Prefix) && (len(a.Methods) == 0 || slices.Contains(a.Methods, req.Method)) {
+			return a
+		}
+	}
+	return nil
+}
+
+// requireRouteAuth checks the credentials for a path covered by a
+// RouteAuth rule and attaches the authenticated user to the request. It
+// sends a 401 challenge and returns false when they are missing or wrong.
+func requireRouteAuth(conn net.Conn, req *http.Request) (*http.Request, bool) {
+	a := matchRouteAuth(req)
+	if a == nil {
+		return req, true
+	}
+
+	var name string
+	var ok, stale bool
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	switch {
+	case a.Scheme == "basic" && strings.EqualFold(scheme, "Basic"):
+		name, ok = checkBasic(credentials)
+	case a.Scheme == "digest" && strings.EqualFold(scheme, "Digest"):
+		name, ok, stale = a.checkDigest(req, credentials, time.Now())
+	case a.Scheme == "hmac" && strings.EqualFold(scheme, signatureScheme):
+		name, ok = a.checkHMAC(req, credentials, time.Now())
+	}
+	if !ok {
+		sendAuthChallenge(conn, a, stale)
+		return req, false
+	}
+
+	p := &principal{User: name, Via: a.Scheme}
+	if users != nil {
+		if u, found := users.lookup(name); found {
+			p.Roles = u.Roles
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), principalContextKey{}, p)), true
+}
+
+func sendAuthChallenge(conn net.Conn, a *RouteAuth, stale bool) {
+	resp := &http.Response{
+		Status:     http.StatusText(http.StatusUnauthorized),
+		StatusCode: http.StatusUnauthorized,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    currentRequest(conn),
+	}
+	if connClosing(conn) {
+		resp.Header.Set("Connection", "close")
+	}
+
+	switch a.Scheme {
+	case "basic":
+		resp.Header.Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, a.Realm))
+	case "hmac":
+		resp.Header.Set("WWW-Authenticate", fmt.Sprintf(`%s realm="%s"`, signatureScheme, a.Realm))
+	default:
+		// One challenge per algorithm, preferred first (RFC 7616 3.7).
+		nonce := newDigestNonce(time.Now())
+		for _, algorithm := range []string{"SHA-256", "MD5"} {
+			resp.Header.Add("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s", stale=%t`,
+				a.Realm, algorithm, nonce, stale))
+		}
+	}
+	recordStatus(conn, http.StatusUnauthorized)
+	resp.Write(conn)
+}
+
+// checkBasic returns the user named by Basic credentials if their password
+// is right.
+func checkBasic(credentials string) (string, bool) {
+	if users == nil {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+	name, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	if u, ok := users.lookup(name); ok && verifiedBasic.has(u, password, now) {
+		return u.Name, true
+	}
+	u, ok := users.authenticate(name, password)
+	if !ok {
+		return "", false
+	}
+	verifiedBasic.add(u, password, now)
+	return u.Name, true
+}
+
+const (
+	// basicCacheTTL is how long a verified Basic password is remembered,
+	// and maxBasicCache how many are at once.
+	basicCacheTTL = 5 * time.Minute
+	maxBasicCache = 10000
+)
+
+// basicCache remembers Basic credentials that were verified recently, so
+// that a client sending them with every request costs one password hash
+// every basicCacheTTL rather than one a request. Entries are keyed by an
+// HMAC, under a key made at startup, of the user, the password and the
+// stored hash, so the passwords aren't kept and a changed password stops
+// matching at once.
+type basicCache struct {
+	mu       sync.Mutex
+	key      []byte
+	verified map[string]time.Time
+}
+
+var verifiedBasic = newBasicCache()
+
+func newBasicCache() *basicCache {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &basicCache{key: key, verified: make(map[string]time.Time)}
+}
+
+func (c *basicCache) entry(u *user, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	for _, s := range []string{u.Name, password, u.Password} {
+		binary.Write(mac, binary.BigEndian, uint32(len(s)))
+		mac.Write([]byte(s))
+	}
+	return string(mac.Sum(nil))
+}
+
+// has reports whether password was verified for u within basicCacheTTL.
+func (c *basicCache) has(u *user, password string, now time.Time) bool {
+	key := c.entry(u, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.verified[key]
+	return ok && now.Before(expires)
+}
+
+// add records that password was verified for u. Once the cache is full
+// of live entries, nothing more is added until they expire.
+func (c *basicCache) add(u *user, password string, now time.Time) {
+	key := c.entry(u, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.verified) >= maxBasicCache {
+		for k, expires := range c.verified {
+			if !now.Before(expires) {
+				delete(c.verified, k)
+			}
+		}
+		if len(c.verified) >= maxBasicCache {
+			return
+		}
+	}
+	c.verified[key] = now.Add(basicCacheTTL)
+}
+
+// checkDigest verifies a Digest response with qop=auth. It also reports
+// whether the response would have been right but for an expired nonce.
+func (a *RouteAuth) checkDigest(req *http.Request, credentials string, now time.Time) (name string, ok, stale bool) {
+	params := parseAuthParams(credentials)
+	name = params["username"]
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch algorithm {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", false, false
+	}
+
+	ha1, known := a.digests[name+":"+strings.ToUpper(algorithm)]
+	if !known || params["realm"] != a.Realm || params["qop"] != "auth" || params["uri"] != req.RequestURI {
+		return "", false, false
+	}
+	issued, valid := checkDigestNonce(params["nonce"])
+	if !valid {
+		return "", false, false
+	}
+
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	want := h(hex.EncodeToString(ha1), params["nonce"], params["nc"], params["cnonce"], "auth", h(req.Method, params["uri"]))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", false, false
+	}
+	if now.Sub(issued) > digestNonceLifetime {
+		return "", false, true
+	}
+	if !digestNonces.use(params["nonce"], params["nc"], issued) {
+		// A replayed or reordered request.
+		return "", false, false
+	}
+	return name, true, false
+}
+
+// parseAuthParams splits the auth-params of a credentials header value:
+// comma-separated name=value pairs whose values may be quoted strings.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+		params[name] = value.String()
+	}
+}
+
+// A Digest nonce is the time it was issued and an HMAC of that time, so
+// that any instance with the same -session-secret can check it without
+// keeping state.
+func newDigestNonce(now time.Time) string {
+	stamp := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(stamp, digestNonceMAC(stamp)...))
+}
+
+func checkDigestNonce(nonce string) (time.Time, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(raw[8:], digestNonceMAC(raw[:8])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8]))), true
+}
+
+func digestNonceMAC(stamp []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("digest nonce"))
+	mac.Write(stamp)
+	return mac.Sum(nil)
+}
+
+// digestNonceCounts remembers the highest nonce count seen for each nonce
+// in use, so that a captured request can't be replayed.
+type digestNonceCounts struct {
+	mu     sync.Mutex
+	counts map[string]digestNonceUse
+}
+
+type digestNonceUse struct {
+	count  uint64
+	issued time.Time
+}
+
+var digestNonces = &digestNonceCounts{counts: make(map[string]digestNonceUse)}
+
+// use records nc for nonce, reporting false unless it is higher than any
+// count seen before.
+func (d *digestNonceCounts) use(nonce, nc string, issued time.Time) bool {
+	count, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil || len(nc) != 8 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if seen, ok := d.counts[nonce]; ok && count <= seen.count {
+		return false
+	}
+	d.counts[nonce] = digestNonceUse{count: count, issued: issued}
+	for n, use := range d.counts {
+		if time.Since(use.issued) > digestNonceLifetime {
+			delete(d.counts, n)
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package httpserver
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBasicCache(t *testing.T) {
+	c := newBasicCache()
+	u := &user{Name: "ann", Password: "pbkdf2-sha256$1$salt$old"}
+	now := time.Now()
+	c.add(u, "hunter2", now)
+
+	if !c.has(u, "hunter2", now.Add(time.Minute)) {
+		t.Error("verified password not remembered")
+	}
+	if c.has(u, "hunter3", now) {
+		t.Error("other password accepted")
+	}
+	if c.has(&user{Name: "ann", Password: "pbkdf2-sha256$1$salt$new"}, "hunter2", now) {
+		t.Error("password accepted after it was changed")
+	}
+	if c.has(u, "hunter2", now.Add(basicCacheTTL)) {
+		t.Error("password remembered past basicCacheTTL")
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	sum := func(newHash func() hash.Hash, parts ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	path := filepath.Join(t.TempDir(), "htdigest")
+	lines := "ann:files:" + sum(sha256.New, "ann", "files", "hunter2") + "\n" +
+		"bob:files:" + sum(md5.New, "bob", "files", "letmein") + "\n" +
+		"ann:other:" + sum(md5.New, "ann", "other", "hunter2") + "\n"
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &RouteAuth{Prefix: "/files/", Scheme: "digest", Realm: "files", DigestFile: path}
+	if err := a.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	nonce := newDigestNonce(now)
+	// credentials answers the challenge for GET /files/a.txt.
+	credentials := func(user, password, algorithm, nonce, nc, uri string) string {
+		newHash := md5.New
+		if algorithm == "SHA-256" {
+			newHash = sha256.New
+		}
+		ha1 := sum(newHash, user, "files", password)
+		response := sum(newHash, ha1, nonce, nc, "xyz", "auth", sum(newHash, "GET", uri))
+		return fmt.Sprintf(`username="%s", realm="files", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="xyz", response="%s"`,
+			user, nonce, uri, algorithm, nc, response)
+	}
+	tests := []struct {
+		name          string
+		credentials   string
+		now           time.Time
+		wantOK, stale bool
+	}{
+		{"sha-256", credentials("ann", "hunter2", "SHA-256", nonce, "00000001", "/files/a.txt"), now, true, false},
+		{"replayed", credentials("ann", "hunter2", "SHA-256", nonce, "00000001", "/files/a.txt"), now, false, false},
+		{"next count", credentials("ann", "hunter2", "SHA-256", nonce, "00000002", "/files/a.txt"), now, true, false},
+		{"md5", credentials("bob", "letmein", "MD5", nonce, "00000003", "/files/a.txt"), now, true, false},
+		{"no such algorithm for the user", credentials("ann", "hunter2", "MD5", nonce, "00000004", "/files/a.txt"), now, false, false},
+		{"wrong password", credentials("ann", "hunter3", "SHA-256", nonce, "00000005", "/files/a.txt"), now, false, false},
+		{"other uri", credentials("ann", "hunter2", "SHA-256", nonce, "00000006", "/files/b.txt"), now, false, false},
+		{"forged nonce", credentials("ann", "hunter2", "SHA-256", "AAAA"+nonce[4:], "00000001", "/files/a.txt"), now, false, false},
+		{"expired nonce", credentials("ann", "hunter2", "SHA-256", nonce, "00000007", "/files/a.txt"), now.Add(digestNonceLifetime + time.Second), false, true},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/files/a.txt", nil)
+		req.RequestURI = "/files/a.txt"
+		name, ok, stale := a.checkDigest(req, tt.credentials, tt.now)
+		if ok != tt.wantOK || stale != tt.stale || (ok && name == "") {
+			t.Errorf("%s: checkDigest = %q, %v, stale %v; want %v, stale %v", tt.name, name, ok, stale, tt.wantOK, tt.stale)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	got := parseAuthParams(`username="a\\b\"c", realm = "x, y" ,nc=00000001, qop=auth`)
+	want := map[string]string{"username": `a\b"c`, "realm": "x, y", "nc": "00000001", "qop": "auth"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseAuthParams = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,491 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each part of a multipart upload. Files up to
+// this size are sent with a single PUT; S3 requires parts other than the
+// last to be at least 5MB.
+const s3PartSize = 8 * 1024 * 1024
+
+// S3Config names a bucket on Amazon S3 or a compatible object store used
+// by -storage=s3. Files are stored under Prefix, and each virtual host
+// gets its own folder below that named after its first host. When the
+// keys are empty they are read from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY.
+type S3Config struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Prefix          string `json:"prefix"`
+	// PathStyle addresses the bucket as the first path segment rather
+	// than as a subdomain of the endpoint, which most S3-compatible
+	// servers need.
+	PathStyle bool `json:"path_style"`
+
+	endpoint *url.URL
+}
+
+func (c *S3Config) prepare() error {
+	if c.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("endpoint %q is not an http or https URL", c.Endpoint)
+	}
+	c.endpoint = endpoint
+	if c.AccessKeyID == "" && c.SecretAccessKey == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("access_key_id and secret_access_key are required")
+	}
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix += "/"
+	}
+	return nil
+}
+
+// s3Storage keeps files as objects in a bucket, talking to it over the
+// S3 REST API with requests signed by AWS Signature Version 4.
+type s3Storage struct {
+	config *S3Config
+	prefix string
+	client *http.Client
+}
+
+func newS3Storage(c *S3Config, folder string) *s3Storage {
+	prefix := c.Prefix
+	if folder != "" {
+		prefix += folder + "/"
+	}
+	return &s3Storage{config: c, prefix: prefix, client: &http.Client{Transport: newUpstreamTransport()}}
+}
+
+// s3Error is the error document S3 returns with a failed request.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// objectURL returns the URL of key, or of the bucket when key is empty.
+func (s *s3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.config.endpoint
+	path := "/" + key
+	if s.config.PathStyle {
+		path = "/" + s.config.Bucket + path
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = s3EscapePath(path)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do sends a signed request. body may be nil; when it isn't, it is sent
+// with its SHA-256 in the signature. A 404 becomes fs.ErrNotExist and any
+// other failure an error carrying S3's explanation.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signS3Request(req, s.config, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, fs.ErrNotExist)
+	}
+	var e s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, e.Code, e.Message)
+}
+
+func (s *s3Storage) key(name string) (string, error) {
+	if !validFileName(name) {
+		return "", fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	return s.prefix + name, nil
+}
+
+func (s *s3Storage) Stat(name string) (FileInfo, error) {
+	info, _, err := s.head(name)
+	return info, err
+}
+
+// head returns the details of an object along with its ETag.
+func (s *s3Storage) head(name string) (FileInfo, string, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return FileInfo{}, "", err
+	}
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, "", err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, resp.Header.Get("ETag"), nil
+}
+
+// Open fetches the object in ranges as it is read, each request pinned to
+// the version first seen with If-Match so that a concurrent Write can't
+// splice two versions together.
+func (s *s3Storage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	info, etag, err := s.head(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	key, _ := s.key(name)
+	return &s3Object{storage: s, key: key, etag: etag, size: info.Size}, info, nil
+}
+
+// Write sends small files with a single PUT and larger ones as a multipart
+// upload, holding one part in memory at a time.
+func (s *s3Storage) Write(name string, r io.Reader) (FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	part, err := io.ReadAll(io.LimitReader(r, s3PartSize))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if len(part) < s3PartSize {
+		resp, err := s.do(http.MethodPut, key, nil, nil, part)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		resp.Body.Close()
+		return FileInfo{Name: name, Size: int64(len(part)), ModTime: time.Now()}, nil
+	}
+
+	size, err := s.writeMultipart(key, part, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: size, ModTime: time.Now()}, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *s3Storage) writeMultipart(key string, first []byte, r io.Reader) (int64, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return 0, fmt.Errorf("s3 starting upload of %s: no upload id in response", key)
+	}
+	uploadID := initiated.UploadID
+
+	completed := false
+	defer func() {
+		if !completed {
+			// Abandoned parts are kept, and billed, until aborted.
+			if resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var parts []s3CompletedPart
+	var size int64
+	part := first
+	for len(part) > 0 {
+		number := len(parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(http.MethodPut, key, query, nil, part)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		size += int64(len(part))
+
+		if part, err = io.ReadAll(io.LimitReader(r, s3PartSize)); err != nil {
+			return 0, err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return 0, err
+	}
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// S3 can report a failed completion in the body of a 200.
+	var result struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return 0, fmt.Errorf("s3 completing upload of %s: %s %s", key, result.Code, result.Message)
+	}
+	completed = true
+	return size, nil
+}
+
+// Delete removes an object. S3 doesn't say whether there was one, so it
+// is looked up first.
+func (s *s3Storage) Delete(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.head(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}, "delimiter": {"/"}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 listing %s: %w", s.prefix, err)
+		}
+
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(object.Key, s.prefix)
+			if validFileName(name) {
+				files = append(files, FileInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// s3Object reads an object with ranged GETs. A request is made on the
+// first Read after opening or seeking, and runs to the end of the object.
+type s3Object struct {
+	storage *s3Storage
+	key     string
+	etag    string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{
+			"Range":    {fmt.Sprintf("bytes=%d-", o.offset)},
+			"If-Match": {o.etag},
+		}
+		resp, err := o.storage.do(http.MethodGet, o.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to
+// req, covering the host, every header already set and the payload hash.
+func signS3Request(req *http.Request, c *S3Config, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := day + "/" + c.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, part := range []string{day, c.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery sorts and encodes query parameters as SigV4 requires,
+// which differs from url.Values.Encode in how spaces are written.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3EscapePath percent-encodes each segment of an object path.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, and slashes too when escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// sysOpenat2 is the number of the openat2 system call, which is the same
+// on every architecture but MIPS.
+const sysOpenat2 = 437
+
+// oPath is O_PATH, which package syscall lacks: it opens a file only to
+// refer to it, without reading it.
+const oPath = 0x200000
+
+// Flags for the resolve field of openHow, from linux/openat2.h.
+const (
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+)
+
+// openHow is struct open_how, the argument of openat2.
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// openat2 opens name relative to the directory dirfd without letting the
+// lookup leave that directory, whether by "..", an absolute path or a
+// symlink.
+func openat2(dirfd int, name string, flags int) (int, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{flags: uint64(flags | syscall.O_CLOEXEC), resolve: resolveBeneath | resolveNoMagiclinks}
+	for {
+		fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return -1, errno
+		}
+		return int(fd), nil
+	}
+}
+
+// checkSandbox reports whether the kernel can confine file lookups for
+// -sandbox.
+func checkSandbox() error {
+	fd, err := openat2(-100 /* AT_FDCWD */, ".", oPath)
+	if errors.Is(err, syscall.ENOSYS) {
+		return fmt.Errorf("-sandbox needs Linux 5.6 or later")
+	}
+	if err != nil {
+		return fmt.Errorf("-sandbox: %w", err)
+	}
+	syscall.Close(fd)
+	return nil
+}
+
+// openBeneath opens the file name in dir with the given flags, refusing
+// to follow anything out of dir. A file that can only be reached by
+// leaving dir is reported as not existing.
+func openBeneath(dir, name string, flags int) (*os.File, error) {
+	path := filepath.Join(dir, name)
+	dirfd, err := syscall.Open(dir, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer syscall.Close(dirfd)
+	fd, err := openat2(dirfd, name, flags)
+	if errors.Is(err, syscall.EXDEV) {
+		err = fmt.Errorf("%w: leads outside %s", fs.ErrNotExist, dir)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// statBeneath is os.Stat for the file name in dir, confined like
+// openBeneath.
+func statBeneath(dir, name string) (fs.FileInfo, error) {
+	f, err := openBeneath(dir, name, oPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
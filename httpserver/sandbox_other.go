@@ -0,0 +1,23 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package httpserver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+var errNoSandbox = errors.New("-sandbox needs Linux")
+
+func checkSandbox() error {
+	return errNoSandbox
+}
+
+func openBeneath(dir, name string, flags int) (*os.File, error) {
+	return nil, errNoSandbox
+}
+
+func statBeneath(dir, name string) (fs.FileInfo, error) {
+	return nil, errNoSandbox
+}
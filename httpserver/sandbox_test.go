@@ -0,0 +1,50 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package httpserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	if err := checkSandbox(); err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "inside"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("inside", filepath.Join(dir, "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sandbox := range []bool{false, true} {
+		args := []string{"-directory", dir}
+		want := map[string]int{"/files/inside": 200, "/files/alias": 200, "/files/escape": 200}
+		if sandbox {
+			args = append(args, "-sandbox")
+			want["/files/escape"] = 404
+		}
+		addr := startTestServer(t, args...)
+		for path, status := range want {
+			resp, err := http.Get("http://" + addr + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("sandbox %v: GET %s = %d, want %d", sandbox, path, resp.StatusCode, status)
+			}
+		}
+	}
+}
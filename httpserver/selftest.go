@@ -0,0 +1,149 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfTestDir is the data directory used by -self-test, removed when it
+// finishes.
+var selfTestDir string
+
+// prepareSelfTest adjusts config so that -self-test neither touches the
+// real data nor has effects outside the process: files go to a temporary
+// directory on disk, and replication, recording, auditing and -chaos are
+// off.
+func prepareSelfTest() error {
+	dir, err := os.MkdirTemp("", "self-test-")
+	if err != nil {
+		return err
+	}
+	selfTestDir = dir
+	config.DataDir = dir
+	config.Storage = "disk"
+	config.ReplicateTo = ""
+	config.RecordPath = ""
+	config.AuditLogPath = ""
+	config.Chaos = nil
+	return nil
+}
+
+// selfTestCheck is one request made by -self-test and what its response
+// must look like.
+type selfTestCheck struct {
+	method string
+	path   string
+	header map[string]string
+	body   string
+
+	status int
+	// want, when set, is the expected body once any gzip encoding has been
+	// removed, and gzip says the response must have had one.
+	want string
+	gzip bool
+}
+
+// selfTestFile is uploaded and read back by -self-test. It is repetitive
+// enough that the server chooses to compress it.
+var selfTestFile = strings.Repeat("self-test file\n", 64)
+
+var selfTestChecks = []selfTestCheck{
+	{method: "GET", path: "/", status: http.StatusOK},
+	{method: "GET", path: "/echo/self-test", status: http.StatusOK, want: "self-test"},
+	{method: "GET", path: "/echo/self-test", header: map[string]string{"Accept-Encoding": "gzip"}, status: http.StatusOK, want: "self-test", gzip: true},
+	{method: "GET", path: "/user-agent", header: map[string]string{"User-Agent": "self-test/1.0"}, status: http.StatusOK, want: "self-test/1.0"},
+	{method: "POST", path: "/files/self-test", body: selfTestFile, status: http.StatusCreated},
+	{method: "GET", path: "/files/self-test", status: http.StatusOK, want: selfTestFile},
+	{method: "GET", path: "/files/self-test", header: map[string]string{"Accept-Encoding": "gzip"}, status: http.StatusOK, want: selfTestFile, gzip: true},
+	{method: "GET", path: "/files/self-test-missing", status: http.StatusNotFound},
+}
+
+// RunSelfTest serves on a random local port, makes a request to each of
+// the basic routes and prints how it went. It returns the exit status for
+// the -self-test flag: 1 if any check failed.
+func (s *Server) RunSelfTest() int {
+	defer os.RemoveAll(selfTestDir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("FAIL listen: %v\n", err)
+		return 1
+	}
+	defer listener.Close()
+	go s.conns.serve(listener)
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := "http://" + listener.Addr().String()
+	failed := 0
+	for _, check := range selfTestChecks {
+		label := check.method + " " + check.path
+		if enc := check.header["Accept-Encoding"]; enc != "" {
+			label += " (" + enc + ")"
+		}
+		if err := check.run(client, base); err != nil {
+			fmt.Printf("FAIL %s: %v\n", label, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", label)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(selfTestChecks))
+		return 1
+	}
+	fmt.Printf("All %d checks passed\n", len(selfTestChecks))
+	return 0
+}
+
+func (c selfTestCheck) run(client *http.Client, base string) error {
+	req, err := http.NewRequest(c.method, base+c.path, strings.NewReader(c.body))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != c.status {
+		return fmt.Errorf("status %d, want %d", resp.StatusCode, c.status)
+	}
+	gzipped := resp.Header.Get("Content-Encoding") == "gzip"
+	if c.gzip && !gzipped {
+		return fmt.Errorf("response isn't gzip-encoded")
+	}
+	if gzipped {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("decoding gzip: %w", err)
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return fmt.Errorf("decoding gzip: %w", err)
+		}
+	}
+	if c.want != "" && string(body) != c.want {
+		return fmt.Errorf("body %q, want %q", body, c.want)
+	}
+	return nil
+}
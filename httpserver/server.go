@@ -0,0 +1,772 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codecrafters-io/http-server-starter-go/internal/uuid"
+)
+
+const (
+	dataDir        = "/tmp/data/codecrafters.io/http-server-tester"
+	maxRequestSize = 1024 * 1024 // 1MB
+	maxRedirects   = 100
+	maxUUIDs       = 100
+)
+
+var startTime = time.Now()
+
+// handleConnection serves requests from one client until it closes the
+// connection, asks for it to be closed, goes idle, leaves it in a state
+// where the next request can't be found reliably, or the server shuts
+// down.
+func handleConnection(conn *serverConn) {
+	defer conn.Close()
+
+	serverStats.totalConnections.Add(1)
+	serverStats.activeConnections.Add(1)
+	defer serverStats.activeConnections.Add(-1)
+
+	reader := bufio.NewReader(conn)
+	conn.reader = reader
+	for {
+		conn.req = nil
+		if !conn.tracker.setIdle(conn, true) {
+			return
+		}
+		// A streamed response leaves a write deadline behind, which must
+		// not carry over to the next one.
+		conn.SetWriteDeadline(time.Time{})
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		req, err := parseRequest(reader)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			var netErr net.Error
+			if err == io.EOF || errors.Is(err, net.ErrClosed) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				// The client is done, has gone quiet between requests, or
+				// the server closed the connection to shut down.
+				return
+			}
+			log.Printf("Error parsing request from %s: %v", conn.RemoteAddr(), err)
+			var perr *parseError
+			if errors.As(err, &perr) {
+				if peer := hostOnly(conn.RemoteAddr().String()); !isTrustedProxy(peer) {
+					conn.tracker.bans.offend(peer, offenceParseError)
+				}
+				conn.closing = true
+				sendResponse(conn, perr.status, nil, nil)
+			}
+			return
+		}
+		if !conn.tracker.setIdle(conn, false) {
+			return
+		}
+		serverStats.totalRequests.Add(1)
+		if req.ProtoAtLeast(1, 1) && req.Host == "" {
+			// RFC 9112 3.2 requires a Host header on HTTP/1.1 requests.
+			log.Printf("Rejecting request without Host from %s", conn.RemoteAddr())
+			conn.closing = true
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+
+		req = conn.startRequest(req)
+		var finishRecord func(status int)
+		if recorder != nil {
+			req.Body, finishRecord = recorder.start(req)
+		}
+		body := &framedBody{body: req.Body, conn: conn, remaining: req.ContentLength}
+		req.Body = body
+		conn.req = req
+		conn.body = body
+		conn.closing = req.Close
+		conn.written.Store(0)
+		conn.status = 0
+		if req.ContentLength == 0 {
+			conn.watchForHangup()
+		}
+		hooks.requested(req)
+
+		if config.Chaos.apply(conn, req) {
+			serveRequest(conn, reader, req)
+			conn.cutResponse()
+		}
+		finishRequest(conn, req)
+		hooks.responded(req, conn.status, conn.written.Load())
+		countOffence(conn, req)
+		drained := !conn.closing && body.drain()
+		conn.stopWatching()
+		if finishRecord != nil {
+			finishRecord(conn.status)
+		}
+		if !drained {
+			return
+		}
+	}
+}
+
+// finishRequest deals with a request whose context ended while it was
+// being served. The handler may have abandoned its response part way, so
+// the connection can't be used again; if it sent nothing because time ran
+// out, the client is told so.
+func finishRequest(conn *serverConn, req *http.Request) {
+	defer conn.cancel(nil)
+	cause := context.Cause(req.Context())
+	if cause == nil {
+		return
+	}
+	conn.closing = true
+	if cause == context.DeadlineExceeded && conn.written.Load() == 0 {
+		log.Printf("Request %s %s from %s timed out after %v", req.Method, redactTarget(req.RequestURI), conn.RemoteAddr(), config.RequestTimeout)
+		sendResponse(conn, http.StatusServiceUnavailable, nil, nil)
+	}
+}
+
+// serveRequest routes one request to its handler.
+func serveRequest(conn net.Conn, reader *bufio.Reader, req *http.Request) {
+	if err := resolveAbsoluteForm(conn, req); err != nil {
+		log.Printf("Rejecting request for %q from %s: %v", redactTarget(req.RequestURI), conn.RemoteAddr(), err)
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/") && !req.URL.IsAbs() {
+		if err := normalizePath(req.URL); err != nil {
+			log.Printf("Rejecting request for %q from %s: %v", redactTarget(req.RequestURI), conn.RemoteAddr(), err)
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+	}
+
+	// From here on RemoteAddr names the real client rather than whichever
+	// trusted proxy relayed the request.
+	req.RemoteAddr = clientIP(conn, req)
+	if bansFor(conn).banned(req.RemoteAddr) {
+		markClosing(conn)
+		sendResponse(conn, http.StatusForbidden, nil, nil)
+		return
+	}
+	req = selectVirtualHost(req)
+
+	if !req.URL.IsAbs() && (applyFixtures(conn, req) || applyRedirectMap(conn, req) || !applyRewrites(conn, req)) {
+		return
+	}
+	if !limitBody(conn, req) {
+		markClosing(conn)
+		sendResponse(conn, http.StatusRequestEntityTooLarge, nil, nil)
+		return
+	}
+	if changesState(req.Method) {
+		if !stateWrites.enter() {
+			// Restart has handed state over to a new process, which the
+			// client reaches on a new connection.
+			markClosing(conn)
+			sendResponse(conn, http.StatusServiceUnavailable, nil, map[string]string{"Retry-After": "1"})
+			return
+		}
+		defer stateWrites.leave()
+	}
+
+	if req.Method == methodPurge {
+		handlePurge(conn, req)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		handleConnect(conn, reader, req)
+		return
+	}
+	if req.URL.IsAbs() {
+		handleForwardProxy(conn, req)
+		return
+	}
+	if !requireOIDC(conn, req) {
+		return
+	}
+
+	proxy := matchProxyRoute(req)
+	if proxy == nil && !virtualHost(req).allowsRoute(req.URL.Path) {
+		handleNotFound(conn)
+		return
+	}
+	req, ok := authorize(conn, req)
+	if p := currentPrincipal(req); p != nil && audit != nil && isMutation(req.Method) {
+		// Refused attempts are recorded too, with the status they got.
+		defer recordAudit(conn, req, p)
+	}
+	if !ok {
+		return
+	}
+	if p := currentPrincipal(req); p != nil {
+		defer recordTransfer(conn, p)
+	}
+	if proxy != nil {
+		proxyRequest(conn, req, proxy)
+		return
+	}
+	if route := matchFastCGIRoute(req); route != nil {
+		serveWith(conn, req, route)
+		return
+	}
+
+	handler, allowed := matchRoute(req.Method, req.URL.Path)
+	if handler != nil {
+		serveWith(conn, req, handler)
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/":
+		serveWith(conn, req, HandlerFunc(handleRoot))
+	case req.URL.Path == "/user-agent":
+		serveWith(conn, req, HandlerFunc(handleUserAgent))
+	case req.URL.Path == "/ip":
+		serveWith(conn, req, HandlerFunc(handleIP))
+	case req.URL.Path == "/json":
+		handleJSON(conn, req)
+	case req.URL.Path == "/anything" || strings.HasPrefix(req.URL.Path, "/anything/"):
+		handleAnything(conn, req)
+	case req.URL.Path == "/uuid":
+		handleUUID(conn, req)
+	case req.URL.Path == "/metrics":
+		handleMetrics(conn, req)
+	case req.URL.Path == "/redirect-to":
+		handleRedirectTo(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/admin/"):
+		handleAdmin(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/auth/"):
+		handleAuth(conn, req)
+	case req.URL.Path == "/ws":
+		handleWebSocket(conn, req)
+	case req.URL.Path == "/poll":
+		handlePoll(conn, req)
+	case req.URL.Path == "/publish":
+		handlePublish(conn, req)
+	case req.URL.Path == "/events":
+		handleEvents(conn, req)
+	case req.URL.Path == "/cookies":
+		handleCookies(conn, req)
+	case req.URL.Path == "/cookies/set":
+		handleSetCookies(conn, req)
+	case req.URL.Path == "/cookies/delete":
+		handleDeleteCookies(conn, req)
+	case req.URL.Path == "/session":
+		handleSession(conn, req)
+	case req.URL.Path == "/session/set":
+		handleSetSession(conn, req)
+	case req.URL.Path == "/session/delete":
+		handleDeleteSession(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/redirect/"):
+		handleRedirect(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/echo/"):
+		serveWith(conn, req, HandlerFunc(handleEcho))
+	case req.URL.Path == "/stats/stream":
+		handleStatsStream(conn, req)
+	case req.URL.Path == "/snapshots":
+		handleSnapshots(conn, req)
+	case req.URL.Path == "/drip":
+		handleDrip(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/ws/"):
+		handleRoom(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/stream/"):
+		serveWith(conn, req, HandlerFunc(handleStream))
+	case strings.HasPrefix(req.URL.Path, "/base64/"):
+		handleBase64(conn, req)
+	case strings.HasPrefix(req.URL.Path, "/assets/") || req.URL.Path == "/favicon.ico":
+		handleAsset(conn, req)
+	case config.WebDAV && (req.URL.Path == "/files" || strings.HasPrefix(req.URL.Path, "/files/")) && isWebDAVMethod(req.Method):
+		serveWith(conn, req, HandlerFunc(handleWebDAV))
+	case req.URL.Path == "/files/":
+		serveWith(conn, req, HandlerFunc(handleFileList))
+	case strings.HasPrefix(req.URL.Path, "/files/"):
+		handleFiles(conn, req)
+	case config.CGIDir != "" && strings.HasPrefix(req.URL.Path, cgiPrefix):
+		serveWith(conn, req, HandlerFunc(handleCGI))
+	case strings.HasPrefix(req.URL.Path, "/blobs/"):
+		handleBlob(conn, req)
+	case len(allowed) > 0:
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": strings.Join(allowed, ", ")})
+	default:
+		handleNotFound(conn)
+	}
+}
+
+func handleRoot(w *ResponseWriter, req *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func handleUserAgent(w *ResponseWriter, req *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := io.WriteString(w, req.Header.Get("User-Agent"))
+	return err
+}
+
+func handleIP(w *ResponseWriter, req *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := io.WriteString(w, req.RemoteAddr)
+	return err
+}
+
+// sampleDocument is the fixed payload served by /json.
+var sampleDocument = map[string]any{
+	"slideshow": map[string]any{
+		"author": "Yours Truly",
+		"date":   "date of publication",
+		"title":  "Sample Slide Show",
+		"slides": []map[string]any{
+			{"type": "all", "title": "Wake up to WonderWidgets!"},
+			{
+				"type":  "all",
+				"title": "Overview",
+				"items": []string{
+					"Why <em>WonderWidgets</em> are great",
+					"Who <em>buys</em> WonderWidgets",
+				},
+			},
+		},
+	},
+}
+
+func handleJSON(conn net.Conn, req *http.Request) {
+	pretty, _ := strconv.ParseBool(req.URL.Query().Get("pretty"))
+	sendJSON(conn, http.StatusOK, sampleDocument, pretty)
+}
+
+// reflectedRequest is the JSON shape returned by /anything.
+type reflectedRequest struct {
+	Method       string              `json:"method"`
+	URL          string              `json:"url"`
+	Path         string              `json:"path"`
+	Args         map[string][]string `json:"args"`
+	Headers      map[string]string   `json:"headers"`
+	Origin       string              `json:"origin"`
+	Body         string              `json:"body"`
+	BodyEncoding string              `json:"body_encoding"`
+	Form         map[string][]string `json:"form,omitempty"`
+}
+
+func handleAnything(conn net.Conn, req *http.Request) {
+	body, err := readBody(req)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		sendResponse(conn, bodyErrorStatus(err), nil, nil)
+		return
+	}
+
+	reflected := reflectedRequest{
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		Path:         req.URL.Path,
+		Args:         req.URL.Query(),
+		Headers:      make(map[string]string, len(req.Header)),
+		Origin:       clientIP(conn, req),
+		Body:         string(body),
+		BodyEncoding: "utf-8",
+	}
+	if req.Host != "" {
+		reflected.Headers["Host"] = req.Host
+	}
+	for name, values := range req.Header {
+		reflected.Headers[name] = strings.Join(values, ", ")
+	}
+	if !utf8.Valid(body) {
+		reflected.Body = base64.StdEncoding.EncodeToString(body)
+		reflected.BodyEncoding = "base64"
+	}
+	if isForm(req) {
+		form, err := decodeForm(req.Header.Get("Content-Type"), body)
+		if err != nil {
+			sendResponse(conn, formErrorStatus(err), nil, nil)
+			return
+		}
+		reflected.Form = url.Values(form)
+	}
+
+	sendJSON(conn, http.StatusOK, reflected, true)
+}
+
+func handleUUID(conn net.Conn, req *http.Request) {
+	count := 1
+	countParam := req.URL.Query().Get("count")
+	if countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil || n < 1 || n > maxUUIDs {
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+		count = n
+	}
+
+	ids := make([]string, count)
+	for i := range ids {
+		id, err := uuid.NewV4()
+		if err != nil {
+			sendError(conn, fmt.Errorf("generating UUID: %w", err))
+			return
+		}
+		ids[i] = id.String()
+	}
+
+	switch {
+	case !acceptsJSON(req):
+		content := []byte(strings.Join(ids, "\n") + "\n")
+		sendResponse(conn, http.StatusOK, content, map[string]string{"Content-Type": "text/plain"})
+	case countParam == "":
+		sendJSON(conn, http.StatusOK, map[string]string{"uuid": ids[0]}, false)
+	default:
+		sendJSON(conn, http.StatusOK, map[string][]string{"uuids": ids}, false)
+	}
+}
+
+func handleEcho(w *ResponseWriter, req *http.Request) error {
+	parts := strings.SplitN(req.URL.Path, "/", 3)
+	if len(parts) < 3 {
+		return ErrNotFound
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if !acceptsGzip(req) {
+		_, err := io.WriteString(w, parts[2])
+		return err
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gzipWriter := gzip.NewWriter(w)
+	if _, err := io.WriteString(gzipWriter, parts[2]); err != nil {
+		return fmt.Errorf("compressing content: %w", err)
+	}
+	return gzipWriter.Close()
+}
+
+func handleBase64(conn net.Conn, req *http.Request) {
+	parts := strings.SplitN(req.URL.Path, "/", 3)
+	if len(parts) < 3 || parts[2] == "" {
+		handleNotFound(conn)
+		return
+	}
+
+	if req.URL.Query().Get("op") == "encode" {
+		content := []byte(base64.URLEncoding.EncodeToString([]byte(parts[2])))
+		sendResponse(conn, http.StatusOK, content, map[string]string{"Content-Type": "text/plain"})
+		return
+	}
+
+	// Accept both padded and unpadded input; clients rarely agree on which
+	// form a URL-safe value should take.
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		sendResponse(conn, http.StatusBadRequest, []byte("invalid base64url value"), map[string]string{"Content-Type": "text/plain"})
+		return
+	}
+
+	sendResponse(conn, http.StatusOK, content, map[string]string{"Content-Type": "application/octet-stream"})
+}
+
+func handleFiles(conn net.Conn, req *http.Request) {
+	name := filepath.Base(req.URL.Path)
+	vh := virtualHost(req)
+	store := vh.storage
+
+	switch req.Method {
+	case http.MethodGet:
+		if vh.expiries.gone(name, time.Now()) {
+			sendResponse(conn, http.StatusGone, nil, nil)
+			return
+		}
+		query := req.URL.Query()
+		if query.Has("versions") {
+			handleFileVersions(conn, store, name)
+			return
+		}
+		if version := query.Get("version"); version != "" {
+			var ok bool
+			if store, name, ok = resolveFileVersion(conn, store, name, version); !ok {
+				return
+			}
+		}
+		if follow, _ := strconv.ParseBool(query.Get("follow")); follow {
+			followFile(req.Context(), conn, store, name)
+			return
+		}
+		serveStoredFile(conn, req, store, name, "application/octet-stream")
+
+	case http.MethodPost:
+		if req.ContentLength > config.MaxUploadSize {
+			sendResponse(conn, http.StatusRequestEntityTooLarge, nil, nil)
+			return
+		}
+
+		ttl, err := uploadTTL(req)
+		if err != nil {
+			sendJSON(conn, http.StatusBadRequest, map[string]string{"error": err.Error()}, false)
+			return
+		}
+
+		if !davLocks.allows(req, store, name) {
+			sendResponse(conn, http.StatusLocked, nil, nil)
+			return
+		}
+
+		defer vh.expiries.startUpload(name)()
+		etag := newETagHash()
+		if _, err := store.Write(name, io.TeeReader(req.Body, etag)); err != nil {
+			sendResponse(conn, storageErrorStatus(err), nil, nil)
+			return
+		}
+		var expires time.Time
+		if ttl > 0 {
+			expires = time.Now().Add(ttl)
+		}
+		if err := vh.expiries.set(name, expires); err != nil {
+			sendError(conn, fmt.Errorf("recording file expiry: %w", err))
+			return
+		}
+
+		sendResponse(conn, http.StatusCreated, nil, map[string]string{"ETag": formatETag(etag)})
+
+	default:
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, nil)
+	}
+}
+
+// serveStoredFile answers req with name from store, compressed if the
+// client takes gzip and it helps, and with validators for conditional
+// requests.
+func serveStoredFile(conn net.Conn, req *http.Request, store Storage, name, contentType string) {
+	lookup := lookupFile
+	if acceptsGzip(req) {
+		lookup = lookupGzipFile
+	}
+	file, err := lookup(store, name, req.URL.Path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			handleNotFound(conn)
+		} else {
+			sendError(conn, fmt.Errorf("reading file: %w", err))
+		}
+		return
+	}
+
+	headers := map[string]string{
+		"ETag":          file.header.Get("ETag"),
+		"Last-Modified": file.header.Get("Last-Modified"),
+		"Vary":          "Accept-Encoding",
+	}
+	if cc := cacheControlFor(req.URL.Path); cc != "" {
+		headers["Cache-Control"] = cc
+	}
+	if notModified(req, file.header) {
+		sendResponse(conn, http.StatusNotModified, nil, headers)
+		return
+	}
+
+	headers["Content-Type"] = contentType
+	if encoding := file.header.Get("Content-Encoding"); encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	sendResponse(conn, http.StatusOK, file.body, headers)
+}
+
+func handleRedirect(conn net.Conn, req *http.Request) {
+	n, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/redirect/"))
+	if err != nil || n < 1 || n > maxRedirects {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+
+	location := "/"
+	if n > 1 {
+		location = "/redirect/" + strconv.Itoa(n-1)
+	}
+	sendRedirect(conn, http.StatusFound, location)
+}
+
+func handleRedirectTo(conn net.Conn, req *http.Request) {
+	query := req.URL.Query()
+
+	target := query.Get("url")
+	if target == "" {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	if !redirectAllowed(target) {
+		sendResponse(conn, http.StatusForbidden, nil, nil)
+		return
+	}
+
+	status := http.StatusFound
+	if code := query.Get("status_code"); code != "" {
+		parsed, err := strconv.Atoi(code)
+		if err != nil || parsed < 300 || parsed > 308 {
+			sendResponse(conn, http.StatusBadRequest, nil, nil)
+			return
+		}
+		status = parsed
+	}
+
+	sendRedirect(conn, status, target)
+}
+
+// redirectAllowed reports whether target is a safe place to send a client:
+// either a path on this server or an absolute URL whose host is listed in
+// the -redirect-hosts allowlist.
+func redirectAllowed(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	if u.Scheme == "" && u.Host == "" {
+		// Reject scheme-relative and backslash tricks such as "//evil" or
+		// "/\\evil" that browsers treat as absolute.
+		return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "/\\")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	for _, host := range config.RedirectHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleNotFound(conn net.Conn) {
+	sendResponse(conn, http.StatusNotFound, nil, nil)
+}
+
+// sendResponse sends a whole response with a ResponseWriter, for handlers
+// that take the connection rather than a ResponseWriter.
+func sendResponse(conn net.Conn, status int, content []byte, headers map[string]string, cookies ...*http.Cookie) {
+	w := newResponseWriter(conn, currentRequest(conn))
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+	for _, cookie := range cookies {
+		if v := cookie.String(); v != "" {
+			w.Header().Add("Set-Cookie", v)
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(content)
+	w.finish()
+}
+
+// readBody reads the whole request body, which is capped at the route's
+// limit by limitBody. Requests without a body yield an empty slice.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return []byte{}, nil
+	}
+	return io.ReadAll(req.Body)
+}
+
+func sendJSON(conn net.Conn, status int, v any, pretty bool, cookies ...*http.Cookie) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+
+	if err := encoder.Encode(v); err != nil {
+		sendError(conn, fmt.Errorf("encoding JSON: %w", err))
+		return
+	}
+
+	sendResponse(conn, status, buf.Bytes(), map[string]string{"Content-Type": "application/json; charset=utf-8"}, cookies...)
+}
+
+func sendRedirect(conn net.Conn, status int, location string) {
+	sendResponse(conn, status, nil, map[string]string{"Location": location})
+}
+
+func acceptsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// acceptsGzip reports whether Accept-Encoding makes gzip acceptable, and
+// at least as welcome as no encoding at all (RFC 9110 12.5.3).
+func acceptsGzip(req *http.Request) bool {
+	values := req.Header.Values("Accept-Encoding")
+	q := codingQuality(values, "gzip")
+	return q > 0 && q >= codingQuality(values, "identity")
+}
+
+// qvaluePattern is the syntax of a q-value, between 0 and 1 with at most
+// three decimals (RFC 9110 12.4.2).
+var qvaluePattern = regexp.MustCompile(`^(0(\.[0-9]{0,3})?|1(\.0{0,3})?)$`)
+
+// codingQuality returns the q-value that Accept-Encoding values give
+// coding: that of its own element, or else that of "*". Failing both,
+// identity is acceptable and any other coding isn't. "x-gzip" counts as
+// gzip, and elements with an invalid q-value are ignored.
+func codingQuality(values []string, coding string) float64 {
+	own, wildcard := -1.0, -1.0
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			if name != coding && name != "*" {
+				continue
+			}
+			q, ok := parseQuality(params)
+			if !ok {
+				continue
+			}
+			if name == "*" {
+				wildcard = q
+			} else {
+				own = q
+			}
+		}
+	}
+	switch {
+	case own >= 0:
+		return own
+	case wildcard >= 0:
+		return wildcard
+	case coding == "identity":
+		return 1
+	}
+	return 0
+}
+
+// parseQuality returns the q parameter among the parameters of an Accept-*
+// element, or 1 if there is none. It reports false if q isn't valid.
+func parseQuality(params string) (float64, bool) {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if !qvaluePattern.MatchString(value) {
+			return 0, false
+		}
+		q, _ := strconv.ParseFloat(value, 64)
+		return q, true
+	}
+	return 1, true
+}
@@ -0,0 +1,479 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connections tracks the connections of the server last started by
+// startTestServer.
+var connections *connTracker
+
+// startTestServer runs the server on an ephemeral port with the given
+// command-line flags and a data directory of its own, returning its
+// address. Its connections are tracked by connections, and it shuts down
+// when the test ends.
+func startTestServer(t *testing.T, args ...string) string {
+	t.Helper()
+	cfg, err := ParseFlags(append([]string{"-directory", t.TempDir()}, args...))
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connections = srv.conns
+	go srv.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down: %v", err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// testClient neither follows redirects nor asks for compression, so that
+// responses are seen exactly as the server sent them.
+func testClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar:       jar,
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	addr := startTestServer(t, "-admin-token", "secret")
+	client := testClient()
+
+	tests := []struct {
+		method      string
+		path        string
+		header      map[string]string
+		body        string
+		status      int
+		contentType string
+		// contains is looked for in the body, or in its start for a stream.
+		contains string
+		location string
+		stream   bool
+	}{
+		{method: "GET", path: "/", status: 200},
+		{method: "GET", path: "/echo/abc", status: 200, contentType: "text/plain", contains: "abc"},
+		{method: "GET", path: "/user-agent", header: map[string]string{"User-Agent": "tester/1.0"}, status: 200, contains: "tester/1.0"},
+		{method: "GET", path: "/ip", status: 200, contains: "127.0.0.1"},
+		{method: "GET", path: "/json", status: 200, contentType: "application/json", contains: "Sample Slide Show"},
+		{method: "POST", path: "/anything/x?a=1", body: "hello", status: 200, contentType: "application/json", contains: `"body": "hello"`},
+		{method: "GET", path: "/uuid", status: 200, contentType: "text/plain"},
+		{method: "GET", path: "/metrics", status: 200, contains: "http_requests_total"},
+		{method: "GET", path: "/redirect-to?url=/echo/x", status: 302, location: "/echo/x"},
+		{method: "GET", path: "/redirect/2", status: 302, location: "/redirect/1"},
+		{method: "GET", path: "/redirect/0", status: 400},
+		{method: "GET", path: "/admin/cache", status: 401},
+		{method: "GET", path: "/admin/cache", header: map[string]string{"Authorization": "Bearer secret"}, status: 200, contains: `"files"`},
+		{method: "GET", path: "/auth/login", status: 404},
+		{method: "GET", path: "/ws", status: 426},
+		{method: "GET", path: "/poll?timeout=1", status: 204},
+		{method: "GET", path: "/publish", status: 405},
+		{method: "POST", path: "/publish", body: "hi", status: 200, contains: `"delivered"`},
+		{method: "GET", path: "/events", status: 200, contentType: "text/event-stream", contains: "retry:", stream: true},
+		{method: "GET", path: "/cookies", status: 200, contains: `"cookies"`},
+		{method: "GET", path: "/cookies/set?a=1", status: 302, location: "/cookies"},
+		{method: "GET", path: "/cookies/delete?a", status: 302, location: "/cookies"},
+		{method: "GET", path: "/session", status: 200, contains: `"session"`},
+		{method: "GET", path: "/session/set?k=v", status: 405},
+		{method: "POST", path: "/session/delete", status: 302, location: "/session"},
+		{method: "POST", path: "/session/set?k=v", status: 302, location: "/session"},
+		{method: "GET", path: "/stats/stream", status: 200, contentType: "application/x-ndjson", contains: "uptime_seconds", stream: true},
+		{method: "GET", path: "/snapshots", status: 200, contentType: "multipart/x-mixed-replace", stream: true},
+		{method: "GET", path: "/drip?numbytes=3&duration=0", status: 200, contains: "***"},
+		{method: "GET", path: "/ws/room", status: 426},
+		{method: "GET", path: "/stream/2", status: 200, contentType: "application/json", contains: `"id":1`},
+		{method: "GET", path: "/base64/aGk=", status: 200, contains: "hi"},
+		{method: "GET", path: "/files/missing", status: 404},
+		{method: "GET", path: "/blobs/" + strings.Repeat("0", 64), status: 404},
+		{method: "GET", path: "/nope", status: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "http://"+addr+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := resp.Header.Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+			var body []byte
+			if tt.stream {
+				body = make([]byte, 512)
+				n, _ := io.ReadAtLeast(resp.Body, body, len(tt.contains))
+				body = body[:n]
+			} else if body, err = io.ReadAll(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(body, []byte(tt.contains)) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.contains)
+			}
+		})
+	}
+}
+
+func TestFiles(t *testing.T) {
+	addr := startTestServer(t)
+	client := testClient()
+	url := "http://" + addr + "/files/notes.txt"
+
+	resp, err := client.Post(url, "application/octet-stream", strings.NewReader(strings.Repeat("hello ", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST status = %d, want 201", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+
+	resp, err = client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != strings.Repeat("hello ", 100) {
+		t.Fatalf("GET = %d %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("ETag"); got != etag {
+		t.Errorf("GET ETag = %q, POST gave %q", got, etag)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional GET status = %d, want 304", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != strings.Repeat("hello ", 100) {
+		t.Errorf("gzip body = %q", body)
+	}
+}
+
+// TestKeepAlive sends two requests down one raw connection and reads both
+// responses back in order.
+func TestKeepAlive(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /echo/one HTTP/1.1\r\nHost: test\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	for i, want := range []string{"one", "two"} {
+		if i == 1 {
+			fmt.Fprint(conn, "GET /echo/two HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("response %d body = %q, want %q", i+1, body, want)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after Connection: close (%v)", err)
+	}
+}
+
+func TestPollReceivesPublished(t *testing.T) {
+	addr := startTestServer(t)
+	client := testClient()
+
+	got := make(chan string, 1)
+	go func() {
+		resp, err := client.Get("http://" + addr + "/poll?timeout=5")
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		got <- string(body)
+	}()
+
+	// Publish until the poll has subscribed and received the message.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		resp, err := client.Post("http://"+addr+"/publish", "text/plain", strings.NewReader("news"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result map[string]int
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if result["delivered"] > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body := <-got; body != "news" {
+		t.Errorf("poll got %q, want %q", body, "news")
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	addr := startTestServer(t)
+	client := testClient()
+
+	resp, err := client.Post("http://"+addr+"/session/set?colour=blue", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get("http://" + addr + "/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Session map[string]string `json:"session"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Session["colour"] != "blue" {
+		t.Errorf("session = %v, want colour=blue", body.Session)
+	}
+}
+
+func TestLoginGrantsAdmin(t *testing.T) {
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal([]map[string]any{{"name": "ann", "password": hash, "roles": []string{"admin"}}})
+	if err := os.WriteFile(usersPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-users", usersPath)
+	client := testClient()
+
+	resp, err := client.Post("http://"+addr+"/auth/login", "application/json", strings.NewReader(`{"username":"ann","password":"wrong"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: status = %d, want 401", resp.StatusCode)
+	}
+
+	resp, err = client.Post("http://"+addr+"/auth/login", "application/json", strings.NewReader(`{"username":"ann","password":"hunter2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens tokenResponse
+	json.NewDecoder(resp.Body).Decode(&tokens)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || tokens.AccessToken == "" {
+		t.Fatalf("login: status = %d, token %q", resp.StatusCode, tokens.AccessToken)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/admin/users", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	resp, err = (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte(`"ann"`)) {
+		t.Errorf("GET /admin/users with token = %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	t.Cleanup(func() { routes = nil })
+	srv := &Server{}
+	srv.HandleFunc("GET", "/hello", func(w *ResponseWriter, req *http.Request) error {
+		_, err := io.WriteString(w, "hello")
+		return err
+	})
+	srv.HandleFunc("", "/greet/", func(w *ResponseWriter, req *http.Request) error {
+		_, err := io.WriteString(w, "any "+req.Method)
+		return err
+	})
+	srv.HandleFunc("POST", "/greet/loud/", func(w *ResponseWriter, req *http.Request) error {
+		_, err := io.WriteString(w, "LOUD")
+		return err
+	})
+	// Replaces the built-in /echo/ route.
+	srv.HandleFunc("GET", "/echo/", func(w *ResponseWriter, req *http.Request) error {
+		_, err := io.WriteString(w, "overridden")
+		return err
+	})
+	addr := startTestServer(t)
+	client := testClient()
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+		allow        string
+	}{
+		{method: "GET", path: "/hello", status: 200, body: "hello"},
+		{method: "HEAD", path: "/hello", status: 200},
+		{method: "POST", path: "/hello", status: 405, allow: "GET"},
+		{method: "GET", path: "/hello/there", status: 404},
+		{method: "DELETE", path: "/greet/you", status: 200, body: "any DELETE"},
+		{method: "POST", path: "/greet/loud/you", status: 200, body: "LOUD"},
+		{method: "GET", path: "/greet/loud/you", status: 200, body: "any GET"},
+		{method: "GET", path: "/echo/abc", status: 200, body: "overridden"},
+		{method: "POST", path: "/echo/abc", status: 200, body: "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://"+addr+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestAdminUserEmptyPassword(t *testing.T) {
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal([]map[string]any{{"name": "ann", "password": "pbkdf2-sha256$1$c2FsdA$aGFzaA"}})
+	if err := os.WriteFile(usersPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-users", usersPath, "-admin-token", "secret")
+	client := testClient()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/admin/users", `{"name":"bob","password":""}`, 400},
+		{http.MethodPatch, "/admin/users/ann", `{"password":""}`, 400},
+		{http.MethodPatch, "/admin/users/ann", `{"roles":["admin"]}`, 200},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "http://"+addr+tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s %s = %d %s, want %d", tt.method, tt.path, tt.body, resp.StatusCode, body, tt.status)
+		}
+	}
+	if u, _ := users.get("ann"); u.Password != "pbkdf2-sha256$1$c2FsdA$aGFzaA" {
+		t.Errorf("password changed to %q", u.Password)
+	}
+}
@@ -0,0 +1,320 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionIDBytes    = 32
+)
+
+// sessionKey signs session cookies. It comes from -session-secret, or is
+// random when that is unset, in which case sessions end with the process.
+var sessionKey []byte
+
+// sessions holds the data of every live session.
+var sessions sessionStore = newMemorySessionStore()
+
+// openSessions sets up the session key and store from the configuration
+// and starts removing expired sessions in the background.
+func openSessions() error {
+	if config.SessionSecret != "" {
+		sessionKey = []byte(config.SessionSecret)
+	} else {
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			return err
+		}
+	}
+
+	if config.SessionStore != "file" {
+		sessions = newMemorySessionStore()
+		return nil
+	}
+	store, err := newFileSessionStore(config.SessionDir)
+	if err != nil {
+		return err
+	}
+	sessions = store
+	return nil
+}
+
+// session is the state a client carries between requests, identified by a
+// signed cookie. Handlers get one from loadSession, read and change it with
+// Get, Set and Delete, and pass the cookie from save to sendResponse.
+type session struct {
+	id        string
+	data      *sessionData
+	isNew     bool
+	changed   bool
+	destroyed bool
+}
+
+// sessionData is what a sessionStore keeps for each session.
+type sessionData struct {
+	Values   map[string]string `json:"values"`
+	Created  time.Time         `json:"created"`
+	LastSeen time.Time         `json:"last_seen"`
+	// CSRFToken is issued by csrfToken the first time it is needed.
+	CSRFToken string `json:"csrf_token,omitempty"`
+	// User names the logged-in user, and AuthProvider the OpenID Connect
+	// provider they logged in through, if any. Unlike Values, they are
+	// only set by logging in.
+	User         string `json:"user,omitempty"`
+	AuthProvider string `json:"auth_provider,omitempty"`
+}
+
+// expired reports whether the session has been idle for longer than
+// -session-idle-timeout or has outlived -session-max-age.
+func (d *sessionData) expired(now time.Time) bool {
+	return now.Sub(d.LastSeen) > config.SessionIdleTimeout || now.Sub(d.Created) > config.SessionMaxAge
+}
+
+// loadSession returns the session named by req's session cookie, or a new
+// empty one if the cookie is missing, forged or names a session that has
+// expired.
+func loadSession(req *http.Request) *session {
+	now := time.Now()
+	if value, ok := requestCookie(req, sessionCookieName); ok {
+		if id, ok := verifySessionCookie(value); ok {
+			data, err := sessions.load(id)
+			switch {
+			case errors.Is(err, errNoSession):
+			case err != nil:
+				log.Printf("Error loading session: %v", err)
+			case data.expired(now):
+				sessions.delete(id)
+			default:
+				return &session{id: id, data: data}
+			}
+		}
+	}
+
+	return &session{
+		isNew: true,
+		data:  &sessionData{Values: make(map[string]string), Created: now, LastSeen: now},
+	}
+}
+
+func (s *session) Get(key string) (string, bool) {
+	value, ok := s.data.Values[key]
+	return value, ok
+}
+
+func (s *session) Set(key, value string) {
+	s.data.Values[key] = value
+	s.changed = true
+}
+
+func (s *session) Delete(key string) {
+	if _, ok := s.data.Values[key]; ok {
+		delete(s.data.Values, key)
+		s.changed = true
+	}
+}
+
+// Renew moves the session's values to a new id when save is called and
+// drops the old one, so that an id planted on the client before it logged
+// in is worth nothing afterwards.
+func (s *session) Renew() error {
+	if !s.isNew {
+		if err := sessions.delete(s.id); err != nil {
+			return err
+		}
+		s.id, s.isNew = "", true
+	}
+	s.changed = true
+	return nil
+}
+
+// sessionTouchInterval is how out of date touch lets LastSeen get before
+// writing it back, to spare the store a write for every request. It is a
+// variable so that tests can shorten it.
+var sessionTouchInterval = time.Minute
+
+// touch records that the session was used at now, which extends its idle
+// timeout. Unlike save, it doesn't store anything else the request
+// changed, and it doesn't need a new cookie.
+func (s *session) touch(now time.Time) {
+	if s.isNew || now.Sub(s.data.LastSeen) < sessionTouchInterval {
+		return
+	}
+	s.data.LastSeen = now
+	if err := sessions.save(s.id, s.data); err != nil {
+		log.Printf("Error saving session: %v", err)
+	}
+}
+
+// logIn records user as logged in to the session, through the OpenID
+// Connect provider named provider if it isn't empty.
+func (s *session) logIn(user, provider string) {
+	s.data.User = user
+	s.data.AuthProvider = provider
+	s.changed = true
+}
+
+// Destroy ends the session; save then tells the client to drop its cookie.
+func (s *session) Destroy() {
+	s.destroyed = true
+}
+
+// save writes the session back to the store and returns the cookie to send
+// with the response, which also extends the idle timeout. A new session
+// that nothing was stored in is not kept, and save returns a nil cookie.
+// The cookie lasts until -session-max-age; the idle timeout is kept by
+// the server, as requests that only read the session don't renew it.
+func (s *session) save(conn net.Conn, req *http.Request) (*http.Cookie, error) {
+	opts := defaultCookieOptions(conn, req)
+
+	if s.destroyed {
+		if s.isNew {
+			return nil, nil
+		}
+		if err := sessions.delete(s.id); err != nil {
+			return nil, err
+		}
+		opts.MaxAge = -1
+		return newCookie(sessionCookieName, "", opts)
+	}
+	if s.isNew && !s.changed {
+		return nil, nil
+	}
+
+	if s.isNew {
+		id, err := newSessionID()
+		if err != nil {
+			return nil, err
+		}
+		s.id, s.isNew = id, false
+	}
+	now := time.Now()
+	s.data.LastSeen = now
+	if err := sessions.save(s.id, s.data); err != nil {
+		return nil, err
+	}
+
+	opts.MaxAge = s.data.Created.Add(config.SessionMaxAge).Sub(now)
+	return newCookie(sessionCookieName, signSessionID(s.id), opts)
+}
+
+func newSessionID() (string, error) {
+	return randomToken()
+}
+
+// randomToken returns 32 random bytes in unpadded base64url, for ids and
+// secrets that end up in cookies, URLs or forms.
+func randomToken() (string, error) {
+	b := make([]byte, sessionIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// signSessionID returns the cookie value for id: the id and its HMAC, so
+// that clients can't go looking for other sessions in the store.
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionCookie returns the session id in a cookie value made by
+// signSessionID.
+func verifySessionCookie(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || !validSessionID(id) {
+		return "", false
+	}
+	return id, hmac.Equal([]byte(value), []byte(signSessionID(id)))
+}
+
+// validSessionID reports whether id looks like one made by newSessionID.
+// The file store relies on this to keep ids usable as file names.
+func validSessionID(id string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(b) == sessionIDBytes
+}
+
+// handleSession shows the values stored in the client's session.
+func handleSession(conn net.Conn, req *http.Request) {
+	sess := loadSession(req)
+	out := map[string]any{"session": sess.data.Values}
+	if !sess.isNew {
+		token, err := csrfToken(sess)
+		if err != nil {
+			sendError(conn, fmt.Errorf("creating CSRF token: %w", err))
+			return
+		}
+		out["csrf_token"] = token
+	}
+
+	cookie, err := sess.save(conn, req)
+	if err != nil {
+		sendError(conn, fmt.Errorf("saving session: %w", err))
+		return
+	}
+	sendJSON(conn, http.StatusOK, out, true, sessionCookies(cookie)...)
+}
+
+// handleSetSession stores every query parameter in the session and sends
+// the client back to /session. It only takes POST, so that the CSRF check
+// applies.
+func handleSetSession(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+	sess := loadSession(req)
+	for _, name := range sortedKeys(req.URL.Query()) {
+		sess.Set(name, req.URL.Query().Get(name))
+	}
+	redirectToSession(conn, req, sess)
+}
+
+// handleDeleteSession removes the keys named in the query string from the
+// session, or ends the session if none are named. Like handleSetSession,
+// it only takes POST.
+func handleDeleteSession(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+	sess := loadSession(req)
+	if len(req.URL.Query()) == 0 {
+		sess.Destroy()
+	}
+	for _, name := range sortedKeys(req.URL.Query()) {
+		sess.Delete(name)
+	}
+	redirectToSession(conn, req, sess)
+}
+
+func redirectToSession(conn net.Conn, req *http.Request, sess *session) {
+	cookie, err := sess.save(conn, req)
+	if err != nil {
+		sendError(conn, fmt.Errorf("saving session: %w", err))
+		return
+	}
+	sendResponse(conn, http.StatusFound, nil, map[string]string{"Location": "/session"}, sessionCookies(cookie)...)
+}
+
+// sessionCookies turns the result of session.save into the cookies
+// argument of sendResponse.
+func sessionCookies(cookie *http.Cookie) []*http.Cookie {
+	if cookie == nil {
+		return nil
+	}
+	return []*http.Cookie{cookie}
+}
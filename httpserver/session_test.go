@@ -0,0 +1,201 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionValuesDontLogIn(t *testing.T) {
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal([]map[string]any{{"name": "ann", "password": "pbkdf2-sha256$1$c2FsdA$aGFzaA", "roles": []string{"admin"}}})
+	if err := os.WriteFile(usersPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-users", usersPath, "-admin-token", "secret")
+	client := testClient()
+
+	resp, err := client.Post("http://"+addr+"/session/set?user=ann&auth_provider=x", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("setting session values = %d, want 302", resp.StatusCode)
+	}
+	resp, err = client.Get("http://" + addr + "/admin/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/admin/users with a forged session login = %d, want 401", resp.StatusCode)
+	}
+
+	// Once the session exists, changing it takes its CSRF token.
+	resp, err = client.Post("http://"+addr+"/session/delete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("/session/delete without a CSRF token = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestSessionIdleTimeoutRefresh(t *testing.T) {
+	defer func(d time.Duration) { sessionTouchInterval = d }(sessionTouchInterval)
+	sessionTouchInterval = 20 * time.Millisecond
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal([]map[string]any{{"name": "ann", "password": hash, "roles": []string{"admin"}}})
+	if err := os.WriteFile(usersPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, "-users", usersPath, "-admin-token", "secret", "-session-idle-timeout", "300ms")
+	client := testClient()
+
+	resp, err := client.Post("http://"+addr+"/auth/login", "application/json", strings.NewReader(`{"username":"ann","password":"hunter2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	status := func() int {
+		resp, err := client.Get("http://" + addr + "/admin/users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Using the session keeps it alive well past the idle timeout.
+	for i := 0; i < 8; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if got := status(); got != http.StatusOK {
+			t.Fatalf("after %v of activity, /admin/users = %d, want 200", time.Duration(i+1)*100*time.Millisecond, got)
+		}
+	}
+	time.Sleep(400 * time.Millisecond)
+	if got := status(); got != http.StatusUnauthorized {
+		t.Errorf("after idling past the timeout, /admin/users = %d, want 401", got)
+	}
+}
+
+// sessionValues returns the values of the client's session on the server
+// at addr.
+func sessionValues(t *testing.T, client *http.Client, addr string) map[string]string {
+	t.Helper()
+	resp, err := client.Get("http://" + addr + "/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Session map[string]string `json:"session"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Session
+}
+
+func TestFileSessionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	args := []string{"-session-store", "file", "-session-dir", dir, "-session-secret", "s3cret"}
+	addr := startTestServer(t, args...)
+	client := testClient()
+	resp, err := client.Post("http://"+addr+"/session/set?colour=blue", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Cookies don't depend on the port, so the client offers its cookie
+	// to the new server.
+	addr = startTestServer(t, args...)
+	if got := sessionValues(t, client, addr)["colour"]; got != "blue" {
+		t.Errorf("colour after restarting = %q, want blue", got)
+	}
+
+	// With another secret the cookie's signature no longer holds.
+	addr = startTestServer(t, "-session-store", "file", "-session-dir", dir, "-session-secret", "other")
+	if got := sessionValues(t, client, addr); len(got) != 0 {
+		t.Errorf("session under another secret = %v, want a new one", got)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	startTestServer(t, "-session-idle-timeout", "1h", "-session-max-age", "24h")
+	now := time.Now()
+	for _, tt := range []struct {
+		name              string
+		created, lastSeen time.Duration
+		expired           bool
+	}{
+		{"active", -time.Hour, -time.Minute, false},
+		{"idle", -2 * time.Hour, -61 * time.Minute, true},
+		{"too old", -25 * time.Hour, -time.Minute, true},
+	} {
+		data := &sessionData{Created: now.Add(tt.created), LastSeen: now.Add(tt.lastSeen)}
+		if got := data.expired(now); got != tt.expired {
+			t.Errorf("%s session: expired = %v, want %v", tt.name, got, tt.expired)
+		}
+		id, _ := newSessionID()
+		sessions.save(id, data)
+	}
+	if n := sessions.sweep(now); n != 2 {
+		t.Errorf("sweep removed %d sessions, want the 2 expired", n)
+	}
+}
+
+func TestLoginRenewsSession(t *testing.T) {
+	addr := startTestServer(t, "-users", writeTestUsers(t))
+	client := testClient()
+	resp, err := client.Post("http://"+addr+"/session/set?colour=blue", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get("http://" + addr + "/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	u, _ := url.Parse("http://" + addr)
+	planted := client.Jar.Cookies(u)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/auth/login", strings.NewReader(`{"username":"ann","password":"hunter2"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, body.CSRFToken)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login = %d", resp.StatusCode)
+	}
+	if got := sessionValues(t, client, addr)["colour"]; got != "blue" {
+		t.Errorf("colour after logging in = %q, want it carried over", got)
+	}
+
+	// A cookie planted before logging in is worth nothing afterwards.
+	old := testClient()
+	old.Jar.SetCookies(u, planted)
+	if got := sessionValues(t, old, addr); len(got) != 0 {
+		t.Errorf("session from before logging in still holds %v", got)
+	}
+}
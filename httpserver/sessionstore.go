@@ -0,0 +1,178 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoSession = errors.New("session not found")
+
+// sessionStore keeps session data by id. Implementations must be safe for
+// concurrent use.
+type sessionStore interface {
+	// load returns errNoSession for an id it doesn't have.
+	load(id string) (*sessionData, error)
+	save(id string, data *sessionData) error
+	delete(id string) error
+	// sweep removes sessions that have expired by now and returns how
+	// many it removed.
+	sweep(now time.Time) int
+}
+
+// memorySessionStore keeps sessions in memory; they are lost on restart.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]sessionData
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]sessionData)}
+}
+
+func (s *memorySessionStore) load(id string) (*sessionData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.sessions[id]
+	if !ok {
+		return nil, errNoSession
+	}
+	// Hand out a copy so that a handler's changes only take effect on save.
+	data.Values = copyValues(data.Values)
+	return &data, nil
+}
+
+func (s *memorySessionStore) save(id string, data *sessionData) error {
+	stored := *data
+	stored.Values = copyValues(data.Values)
+	s.mu.Lock()
+	s.sessions[id] = stored
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySessionStore) delete(id string) error {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySessionStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, data := range s.sessions {
+		if data.expired(now) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+func copyValues(values map[string]string) map[string]string {
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
+
+// fileSessionStore keeps each session as a JSON file in -session-dir, so
+// sessions survive a restart as long as -session-secret doesn't change.
+type fileSessionStore struct {
+	dir string
+}
+
+func newFileSessionStore(dir string) (*fileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+func (s *fileSessionStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *fileSessionStore) load(id string) (*sessionData, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session sessionData
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if session.Values == nil {
+		session.Values = make(map[string]string)
+	}
+	return &session, nil
+}
+
+// save writes the session to a temporary file and renames it into place,
+// so that a concurrent load sees either the old or the new session.
+func (s *fileSessionStore) save(id string, data *sessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(id)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *fileSessionStore) delete(id string) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileSessionStore) sweep(now time.Time) int {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Error reading session directory: %v", err)
+		return 0
+	}
+	n := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validSessionID(id) {
+			continue
+		}
+		data, err := s.load(id)
+		if err != nil {
+			continue
+		}
+		if data.expired(now) && s.delete(id) == nil {
+			n++
+		}
+	}
+	return n
+}
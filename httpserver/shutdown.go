@@ -0,0 +1,247 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// connTracker keeps account of the listeners and connections of a server,
+// so that it can stop without cutting off requests in flight.
+type connTracker struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	// conns maps each open connection to whether it is idle, waiting for
+	// its next request.
+	conns map[*serverConn]bool
+	// perIP counts the open connections from each client address held to
+	// -max-conns-per-ip.
+	perIP map[string]int
+	// bans holds the client addresses banned by -ban.
+	bans     *banList
+	stopping bool
+	// paused is set while Restart hands over to a new process; resumed
+	// is signalled when it is cleared or the server stops.
+	paused  bool
+	resumed *sync.Cond
+	// wg counts the open connections. It is only added to while mu is
+	// held and stopping is unset, so that shutdown can wait on it.
+	wg sync.WaitGroup
+}
+
+func newConnTracker() *connTracker {
+	t := &connTracker{
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*serverConn]bool),
+		perIP:     make(map[string]int),
+		bans:      newBanList(),
+	}
+	t.resumed = sync.NewCond(&t.mu)
+	return t
+}
+
+// serve accepts connections on listener until it is closed or the server
+// shuts down.
+func (t *connTracker) serve(listener net.Listener) {
+	t.mu.Lock()
+	if t.stopping {
+		t.mu.Unlock()
+		listener.Close()
+		return
+	}
+	t.listeners[listener] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.listeners, listener)
+		t.mu.Unlock()
+	}()
+
+	for {
+		netConn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.waitResumed()
+			continue
+		}
+		if err != nil {
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		conn := &serverConn{Conn: netConn, tracker: t}
+		if ip := hostOnly(netConn.RemoteAddr().String()); !isTrustedProxy(ip) {
+			if t.bans.banned(ip) {
+				serverStats.refusedConnections.Add(1)
+				netConn.Close()
+				continue
+			}
+			if config.MaxConnsPerIP > 0 {
+				conn.ip = ip
+			}
+		}
+		conn.ctx, conn.abort = context.WithCancel(context.Background())
+		if !t.add(conn) {
+			netConn.Close()
+			continue
+		}
+		go func() {
+			defer t.remove(conn)
+			defer conn.abort()
+			defer hooks.connClosed(conn)
+			conn.ctx = hooks.connOpened(conn.ctx, conn)
+			handleConnection(conn)
+		}()
+	}
+}
+
+// listenerFile returns a duplicate of the descriptor of the one listener
+// being served, for handing to another process.
+func (t *connTracker) listenerFile() (*os.File, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.listeners) != 1 {
+		return nil, fmt.Errorf("can only hand over one listener, not %d", len(t.listeners))
+	}
+	for listener := range t.listeners {
+		if l, ok := listener.(interface{ File() (*os.File, error) }); ok {
+			return l.File()
+		}
+	}
+	return nil, errors.New("listener has no file descriptor to hand over")
+}
+
+// pause stops accepting connections until resume, closes the idle ones,
+// and has the rest closed after the request they are serving. The
+// listeners stay open, so clients connecting meanwhile wait in their
+// backlog.
+func (t *connTracker) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = true
+	for listener := range t.listeners {
+		// An Accept past its deadline fails at once, leaving serve to
+		// wait in waitResumed.
+		if l, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+			l.SetDeadline(time.Unix(1, 0))
+		}
+	}
+	for conn, idle := range t.conns {
+		if idle {
+			conn.Conn.Close()
+		}
+	}
+}
+
+// resume undoes pause.
+func (t *connTracker) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = false
+	for listener := range t.listeners {
+		if l, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+			l.SetDeadline(time.Time{})
+		}
+	}
+	t.resumed.Broadcast()
+}
+
+// waitResumed waits while the tracker is paused and the server running.
+func (t *connTracker) waitResumed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.paused && !t.stopping {
+		t.resumed.Wait()
+	}
+}
+
+// add starts tracking conn, which counts as idle until it has sent a
+// request. It reports false once the server is shutting down, or if the
+// client already has -max-conns-per-ip connections open.
+func (t *connTracker) add(conn *serverConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopping {
+		return false
+	}
+	if conn.ip != "" {
+		if t.perIP[conn.ip] >= config.MaxConnsPerIP {
+			serverStats.refusedConnections.Add(1)
+			return false
+		}
+		t.perIP[conn.ip]++
+	}
+	t.conns[conn] = true
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) remove(conn *serverConn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	if conn.ip != "" {
+		if t.perIP[conn.ip]--; t.perIP[conn.ip] == 0 {
+			delete(t.perIP, conn.ip)
+		}
+	}
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// setIdle records whether conn is waiting for a request or serving one.
+// It reports false once the server is shutting down, or is paused and
+// conn done with its request, when the connection should be closed rather
+// than used for another request.
+func (t *connTracker) setIdle(conn *serverConn, idle bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopping || (t.paused && idle) {
+		return false
+	}
+	t.conns[conn] = idle
+	return true
+}
+
+// shutdown stops accepting connections, closes the idle ones, and waits
+// for the rest to finish the request they are serving. If ctx ends first,
+// the remaining requests are cancelled, their connections closed, and its
+// error returned.
+func (t *connTracker) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.stopping = true
+	t.resumed.Broadcast()
+	for listener := range t.listeners {
+		listener.Close()
+	}
+	for conn, idle := range t.conns {
+		if idle {
+			conn.Conn.Close()
+		}
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	for conn := range t.conns {
+		conn.abort()
+		conn.Conn.Close()
+	}
+	t.mu.Unlock()
+	return ctx.Err()
+}
@@ -0,0 +1,246 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// busyConns counts the connections of t that are serving a request.
+func (t *connTracker) busyConns() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	busy := 0
+	for _, idle := range t.conns {
+		if !idle {
+			busy++
+		}
+	}
+	return busy
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func shutdownWithin(tracker *connTracker, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return tracker.shutdown(ctx)
+}
+
+func TestShutdownFinishesActiveRequests(t *testing.T) {
+	addr := startTestServer(t)
+	tracker := connections
+	const clients = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body, err := roundTrip(addr, "GET /drip?numbytes=4&duration=0.4 HTTP/1.1\r\nHost: a\r\n\r\n")
+			if err != nil {
+				errs <- err
+			} else if status != http.StatusOK || body != "****" {
+				errs <- fmt.Errorf("got %d %q, want 200 \"****\"", status, body)
+			}
+		}()
+	}
+	waitFor(t, "every request to start", func() bool { return tracker.busyConns() == clients })
+
+	if err := shutdownWithin(tracker, 5*time.Second); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	addr := startTestServer(t)
+	tracker := connections
+
+	var conns []net.Conn
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET /echo/%d HTTP/1.1\r\nHost: a\r\n\r\n", i)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		conns = append(conns, conn)
+	}
+	waitFor(t, "the connections to go idle", func() bool { return tracker.busyConns() == 0 })
+
+	start := time.Now()
+	if err := shutdownWithin(tracker, 5*time.Second); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("shutdown took %v with only idle connections", took)
+	}
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection %d: read after shutdown = %v, want EOF", i, err)
+		}
+	}
+}
+
+// TestShutdownUnderLoad shuts the server down while clients keep opening
+// connections and sending requests on them. Every request must either get
+// its whole response or find the connection closed before any of it
+// arrives; none may be cut off part way.
+func TestShutdownUnderLoad(t *testing.T) {
+	addr := startTestServer(t)
+	tracker := connections
+	const clients = 50
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	completed := 0
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				n, err := sendEchoes(conn, i)
+				conn.Close()
+				mu.Lock()
+				completed += n
+				mu.Unlock()
+				if err != nil {
+					t.Errorf("client %d: %v", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	waitFor(t, "requests to be served", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return completed >= clients
+	})
+	if err := shutdownWithin(tracker, 5*time.Second); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	wg.Wait()
+
+	tracker.mu.Lock()
+	left := len(tracker.conns)
+	tracker.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d connections still tracked after shutdown", left)
+	}
+}
+
+// sendEchoes sends a few requests one after another on conn and checks
+// the responses, returning how many were complete. Finding the connection
+// closed or reset before a response starts is not an error.
+func sendEchoes(conn net.Conn, client int) (int, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 5; i++ {
+		want := fmt.Sprintf("%d-%d", client, i)
+		if _, err := fmt.Fprintf(conn, "GET /echo/%s HTTP/1.1\r\nHost: a\r\n\r\n", want); err != nil {
+			return i, nil
+		}
+		if _, err := reader.Peek(1); err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+			return i, nil
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return i, fmt.Errorf("response %d: %w", i+1, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return i, fmt.Errorf("response %d: %w", i+1, err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			return i, fmt.Errorf("response %d: %d %q, want 200 %q", i+1, resp.StatusCode, body, want)
+		}
+	}
+	return 5, nil
+}
+
+func TestShutdownDeadlineClosesLongRequests(t *testing.T) {
+	addr := startTestServer(t)
+	tracker := connections
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: a\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	waitFor(t, "the stream to start", func() bool { return tracker.busyConns() == 1 })
+
+	if err := shutdownWithin(tracker, 200*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reading the stream after shutdown: %v, want it closed", err)
+	}
+}
+
+// roundTrip sends raw on a new connection and reads back one response. Unlike
+// exchange it can be used outside the test goroutine.
+func roundTrip(addr, raw string) (status int, body string, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		return 0, "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), err
+}
@@ -0,0 +1,159 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureMaxSkew is how far the timestamp of a signed request may be
+// from our clock.
+const signatureMaxSkew = 5 * time.Minute
+
+// A request signed for a RouteAuth rule with scheme "hmac" carries
+//
+//	Authorization: HMAC-SHA256 keyId="<id>", timestamp="<unix seconds>", nonce="<nonce>", signature="<hex>"
+//	X-Content-SHA256: <hex SHA-256 of the body>
+//
+// where the signature is the HMAC-SHA256, keyed with the secret of keyId,
+// of the canonical request built by canonicalRequest. The nonce is any
+// string of up to maxNonceLength bytes that the signer never uses twice;
+// a request with a nonce already seen is refused as a replay. The body
+// hash may be left out of a request without a body.
+const (
+	signatureScheme     = "HMAC-SHA256"
+	contentSHA256Header = "X-Content-SHA256"
+)
+
+// maxNonceLength is the longest nonce a signed request may carry.
+const maxNonceLength = 128
+
+// maxSignatureNonces bounds the nonces remembered to catch replays. Once
+// that many signed requests have arrived within signatureMaxSkew, more are
+// refused until the oldest expire.
+const maxSignatureNonces = 100000
+
+// errBodyMismatch is returned by the body of a signed request whose
+// content doesn't match the hash that was signed.
+var errBodyMismatch = Errorf(http.StatusBadRequest, "request body doesn't match %s", contentSHA256Header)
+
+// canonicalRequest is what the signature of a request covers: the scheme,
+// timestamp, nonce, method, target, host and body hash, one to a line.
+func canonicalRequest(req *http.Request, timestamp, nonce, bodyHash string) string {
+	return strings.Join([]string{signatureScheme, timestamp, nonce, req.Method, req.RequestURI, req.Host, bodyHash}, "\n")
+}
+
+// requestSignature returns the hex signature of a canonical request.
+func requestSignature(secret, canonical string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkHMAC verifies a signed request, returning the id of the key it was
+// signed with. The body can't be checked until it has been read, so it is
+// replaced by one that fails at its end if it doesn't match the signed
+// hash; a handler storing it then throws it away.
+func (a *RouteAuth) checkHMAC(req *http.Request, credentials string, now time.Time) (string, bool) {
+	params := parseAuthParams(credentials)
+	keyID := params["keyid"]
+	secret, known := a.Keys[keyID]
+	if !known {
+		return "", false
+	}
+	seconds, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	signed := time.Unix(seconds, 0)
+	if skew := now.Sub(signed); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return "", false
+	}
+	nonce := params["nonce"]
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return "", false
+	}
+
+	bodyHash := strings.ToLower(req.Header.Get(contentSHA256Header))
+	if bodyHash == "" && req.ContentLength == 0 {
+		sum := sha256.Sum256(nil)
+		bodyHash = hex.EncodeToString(sum[:])
+	}
+	want, err := hex.DecodeString(bodyHash)
+	if err != nil || len(want) != sha256.Size {
+		return "", false
+	}
+	signature := requestSignature(secret, canonicalRequest(req, params["timestamp"], nonce, bodyHash))
+	if !hmac.Equal([]byte(signature), []byte(strings.ToLower(params["signature"]))) {
+		return "", false
+	}
+	// Nonces are only recorded once the signature is known to be good,
+	// so that nobody else can fill the cache. A replay is only possible
+	// while the timestamp is acceptable, so that is how long they are
+	// kept.
+	if !signatureNonces.use(keyID+" "+nonce, signed.Add(signatureMaxSkew), now) {
+		log.Printf("Refusing signed %s %s from %s: nonce already used or too many in use", req.Method, req.URL.Path, req.RemoteAddr)
+		return "", false
+	}
+	if req.Body != nil {
+		req.Body = &verifiedBody{ReadCloser: req.Body, hash: sha256.New(), want: want}
+	}
+	return keyID, true
+}
+
+// verifiedBody hashes a request body as it is read, and fails at its end
+// if the hash isn't the one expected.
+type verifiedBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(b.hash.Sum(nil), b.want) {
+		return n, errBodyMismatch
+	}
+	return n, err
+}
+
+// nonceCache remembers the nonces of signed requests until they expire.
+type nonceCache struct {
+	mu     sync.Mutex
+	max    int
+	nonces map[string]time.Time
+}
+
+var signatureNonces = &nonceCache{max: maxSignatureNonces, nonces: make(map[string]time.Time)}
+
+// use records nonce, which is of no use to a replay after expires. It
+// reports false if the nonce was already recorded, or if the cache is
+// full of nonces that haven't expired.
+func (c *nonceCache) use(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seen, ok := c.nonces[nonce]; ok && now.Before(seen) {
+		return false
+	}
+	if len(c.nonces) >= c.max {
+		for n, e := range c.nonces {
+			if !now.Before(e) {
+				delete(c.nonces, n)
+			}
+		}
+		if len(c.nonces) >= c.max {
+			return false
+		}
+	}
+	c.nonces[nonce] = expires
+	return true
+}
@@ -0,0 +1,113 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedRequests(t *testing.T) {
+	addr := startTestServer(t)
+	rule := &RouteAuth{Prefix: "/files/", Methods: []string{"post"}, Scheme: "hmac", Keys: map[string]string{"hook": "s3cret"}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	config.RouteAuth = []*RouteAuth{rule}
+	signatureNonces = &nonceCache{max: maxSignatureNonces, nonces: make(map[string]time.Time)}
+	client := testClient()
+
+	// send signs a POST of signed to path with secret and nonce at the
+	// given time, but sends body.
+	send := func(path, secret, nonce string, at time.Time, signed, body string) int {
+		t.Helper()
+		sum := sha256.Sum256([]byte(signed))
+		bodyHash := hex.EncodeToString(sum[:])
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+path, strings.NewReader(body))
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		req.RequestURI = path
+		signature := requestSignature(secret, canonicalRequest(req, timestamp, nonce, bodyHash))
+		req.RequestURI = ""
+		req.Header.Set("Authorization", fmt.Sprintf(`HMAC-SHA256 keyId="hook", timestamp="%s", nonce="%s", signature="%s"`, timestamp, nonce, signature))
+		req.Header.Set(contentSHA256Header, bodyHash)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	get := func(path string) int {
+		t.Helper()
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name, path, secret, nonce string
+		at                        time.Time
+		signed, body              string
+		status                    int
+	}{
+		{"signed", "/files/a", "s3cret", "n1", now, "hello", "hello", 201},
+		{"replayed", "/files/a", "s3cret", "n1", now, "hello", "hello", 401},
+		{"wrong secret", "/files/b", "guess", "n2", now, "hello", "hello", 401},
+		{"old timestamp", "/files/c", "s3cret", "n3", now.Add(-time.Hour), "hello", "hello", 401},
+		{"no nonce", "/files/c", "s3cret", "", now, "hello", "hello", 401},
+		{"tampered body", "/files/d", "s3cret", "n4", now, "hello", "evil!", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := send(tt.path, tt.secret, tt.nonce, tt.at, tt.signed, tt.body); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	if status := get("/files/a"); status != 200 {
+		t.Errorf("GET of the signed upload = %d, want 200", status)
+	}
+	if status := get("/files/d"); status != 404 {
+		t.Errorf("GET of the tampered upload = %d, want 404", status)
+	}
+	resp, err := client.Post("http://"+addr+"/files/e", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "HMAC-SHA256 ") {
+		t.Errorf("unsigned POST = %d with challenge %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := &nonceCache{max: 2, nonces: make(map[string]time.Time)}
+	now := time.Now()
+	if !c.use("a", now.Add(time.Minute), now) || !c.use("b", now.Add(2*time.Minute), now) {
+		t.Fatal("fresh nonces refused")
+	}
+	if c.use("a", now.Add(time.Minute), now) {
+		t.Error("repeated nonce accepted")
+	}
+	if c.use("c", now.Add(time.Minute), now) {
+		t.Error("nonce accepted with the cache full")
+	}
+	later := now.Add(90 * time.Second)
+	if !c.use("c", later.Add(time.Minute), later) {
+		t.Error("nonce refused after an expired one made room")
+	}
+	if !c.use("a", later.Add(time.Minute), later.Add(time.Minute)) {
+		t.Error("expired nonce refused")
+	}
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSignedURLLifetime caps the ttl of a URL from /admin/files/sign.
+const maxSignedURLLifetime = 7 * 24 * time.Hour
+
+// signFileURL returns the path and query of a URL that lets anyone holding
+// it GET /files/<name> until expires, and only from ip if ip isn't empty,
+// without any other credentials.
+func signFileURL(name string, expires time.Time, ip string) string {
+	path := "/files/" + name
+	query := url.Values{"expires": {strconv.FormatInt(expires.Unix(), 10)}}
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	query.Set("signature", fileURLSignature(path, query.Get("expires"), ip))
+	return (&url.URL{Path: path, RawQuery: query.Encode()}).String()
+}
+
+func fileURLSignature(path, expires, ip string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("file url\n" + path + "\n" + expires + "\n" + ip))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignedURL verifies a request for /files/ carrying a signature from
+// signFileURL. It reports whether the request is signed, in which case the
+// signature stands in for authentication, and returns false after sending
+// a 403 for a signature that is wrong, expired, bound to another address
+// or used for anything but a download.
+func checkSignedURL(conn net.Conn, req *http.Request) (signed, ok bool) {
+	query := req.URL.Query()
+	if !strings.HasPrefix(req.URL.Path, "/files/") || !query.Has("signature") {
+		return false, true
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	ip := query.Get("ip")
+	want := fileURLSignature(req.URL.Path, query.Get("expires"), ip)
+	var reason string
+	switch {
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		reason = "signed URLs are for downloads only"
+	case err != nil || !hmac.Equal([]byte(query.Get("signature")), []byte(want)):
+		reason = "invalid signature"
+	case time.Now().Unix() >= expires:
+		reason = "signed URL has expired"
+	case ip != "" && !sameIP(ip, req.RemoteAddr):
+		reason = "signed URL is for another address"
+	default:
+		return true, true
+	}
+	sendJSON(conn, http.StatusForbidden, map[string]string{"error": reason}, false)
+	return true, false
+}
+
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(hostOnly(b))
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+// handleSignFileURL issues a signed download URL for ?name=, valid for
+// ?ttl= (a Go duration, one hour by default) and optionally only from
+// ?ip=.
+func handleSignFileURL(conn net.Conn, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": http.MethodPost})
+		return
+	}
+
+	query := req.URL.Query()
+	name := query.Get("name")
+	ttl := time.Hour
+	var err error
+	if s := query.Get("ttl"); s != "" {
+		ttl, err = time.ParseDuration(s)
+	}
+	ip := query.Get("ip")
+	switch {
+	case name == "" || strings.HasPrefix(name, "/"):
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "name must be a path under /files/"}, false)
+		return
+	case err != nil || ttl <= 0 || ttl > maxSignedURLLifetime:
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "ttl must be a positive duration of at most " + maxSignedURLLifetime.String()}, false)
+		return
+	case ip != "" && net.ParseIP(ip) == nil:
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "ip is not an IP address"}, false)
+		return
+	}
+
+	expires := time.Now().Add(ttl)
+	path := signFileURL(name, expires, ip)
+	sendJSON(conn, http.StatusOK, map[string]string{
+		"url":     requestScheme(conn, req) + "://" + req.Host + path,
+		"expires": expires.UTC().Format(time.RFC3339),
+	}, false)
+}
@@ -0,0 +1,76 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedFileURL(t *testing.T) {
+	addr := startTestServer(t, "-admin-token", "secret")
+	client := testClient()
+	resp, err := client.Post("http://"+addr+"/files/report.pdf", "application/pdf", strings.NewReader("%PDF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	policy := &Policy{Prefix: "/files/", Methods: []string{"GET", "HEAD"}, Require: []string{"reader"}}
+	if err := policy.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	config.Policies = []*Policy{policy}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/admin/files/sign?name=report.pdf&ttl=1m", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed struct {
+		URL string `json:"url"`
+	}
+	json.NewDecoder(resp.Body).Decode(&signed)
+	resp.Body.Close()
+	issued, err := url.Parse(signed.URL)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("signing = %d %q", resp.StatusCode, signed.URL)
+	}
+
+	tamper := func(key, value string) string {
+		query := issued.Query()
+		query.Set(key, value)
+		return issued.Path + "?" + query.Encode()
+	}
+	other := issued.Query()
+	changed := []byte(issued.Query().Get("signature"))
+	changed[0] ^= 1
+	tests := []struct {
+		name, method, path string
+		status             int
+	}{
+		{"unsigned", "GET", "/files/report.pdf", 401},
+		{"issued", "GET", issued.RequestURI(), 200},
+		{"upload", "POST", issued.RequestURI(), 403},
+		{"another file", "GET", "/files/other.pdf?" + other.Encode(), 403},
+		{"later expiry", "GET", tamper("expires", "9999999999"), 403},
+		{"bound to an address", "GET", tamper("ip", "127.0.0.1"), 403},
+		{"changed signature", "GET", tamper("signature", string(changed)), 403},
+		{"expired", "GET", signFileURL("report.pdf", time.Now().Add(-time.Second), ""), 403},
+		{"for this address", "GET", signFileURL("report.pdf", time.Now().Add(time.Minute), "127.0.0.1"), 200},
+		{"for another address", "GET", signFileURL("report.pdf", time.Now().Add(time.Minute), "192.0.2.1"), 403},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "http://"+addr+tt.path, strings.NewReader(""))
+		resp, err := testClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const statsInterval = time.Second
+
+// serverStats holds process-wide counters reported by /stats/stream.
+var serverStats struct {
+	activeConnections  atomic.Int64
+	totalConnections   atomic.Int64
+	refusedConnections atomic.Int64
+	totalRequests      atomic.Int64
+}
+
+// statsRecord is one line of the /stats/stream NDJSON feed.
+type statsRecord struct {
+	Time               string  `json:"time"`
+	UptimeSeconds      float64 `json:"uptime_seconds"`
+	Goroutines         int     `json:"goroutines"`
+	HeapAllocBytes     uint64  `json:"heap_alloc_bytes"`
+	ActiveConnections  int64   `json:"active_connections"`
+	TotalConnections   int64   `json:"total_connections"`
+	RefusedConnections int64   `json:"refused_connections"`
+	TotalRequests      int64   `json:"total_requests"`
+}
+
+func currentStats() statsRecord {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return statsRecord{
+		Time:               time.Now().UTC().Format(time.RFC3339Nano),
+		UptimeSeconds:      time.Since(startTime).Seconds(),
+		Goroutines:         runtime.NumGoroutine(),
+		HeapAllocBytes:     mem.HeapAlloc,
+		ActiveConnections:  serverStats.activeConnections.Load(),
+		TotalConnections:   serverStats.totalConnections.Load(),
+		RefusedConnections: serverStats.refusedConnections.Load(),
+		TotalRequests:      serverStats.totalRequests.Load(),
+	}
+}
+
+// handleStatsStream streams a statsRecord per second as newline-delimited
+// JSON until the client disconnects.
+func handleStatsStream(conn net.Conn, req *http.Request) {
+	stream, err := startStream(conn, http.StatusOK, map[string]string{
+		"Content-Type":  "application/x-ndjson",
+		"Cache-Control": "no-cache",
+	})
+	if err != nil {
+		log.Printf("Error starting stats stream: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	encoder := json.NewEncoder(stream)
+	for {
+		if err := encoder.Encode(currentStats()); err != nil {
+			return
+		}
+		if err := stream.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileInfo describes a file held by a Storage.
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// Storage holds the files served under /files/. Names are single path
+// elements; a name a backend can't hold is reported as fs.ErrInvalid and
+// a missing file as fs.ErrNotExist. Implementations must be safe for
+// concurrent use.
+type Storage interface {
+	// Open returns the contents of name along with the details of the
+	// version opened, which a concurrent Write doesn't change.
+	Open(name string) (io.ReadSeekCloser, FileInfo, error)
+	Stat(name string) (FileInfo, error)
+	// Write replaces name with everything read from r. Readers see either
+	// the old contents or the new, never part of an upload.
+	Write(name string, r io.Reader) (FileInfo, error)
+	Delete(name string) error
+	// List returns every file, sorted by name.
+	List() ([]FileInfo, error)
+}
+
+// fileStorage holds the files of the default host.
+var fileStorage Storage
+
+// openStorage sets up the storage of the default host and of each virtual
+// host.
+func openStorage() error {
+	if config.Sandbox {
+		if err := checkSandbox(); err != nil {
+			return err
+		}
+	}
+	if err := loadEncryptionKeys(); err != nil {
+		return fmt.Errorf("loading encryption keys: %w", err)
+	}
+	if err := openReplication(); err != nil {
+		return fmt.Errorf("starting replication: %w", err)
+	}
+	if err := openStorageDB(); err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	var err error
+	if fileStorage, defaultFileExpiries, err = openHostStorage(config.DataDir, ""); err != nil {
+		return err
+	}
+	for _, vh := range config.VirtualHosts {
+		if vh.storage, vh.expiries, err = openHostStorage(vh.DataDir, vh.Hosts[0]); err != nil {
+			return fmt.Errorf("virtual host %s: %w", vh.Hosts[0], err)
+		}
+	}
+	return nil
+}
+
+// openHostStorage returns the storage for a host, with the
+// -content-addressed and -file-versions layers over it if asked for, and
+// the host's file expiry records. Earlier versions and the records go in
+// hidden folders, in storage of the same kind.
+func openHostStorage(dataDir, host string) (Storage, *fileExpiries, error) {
+	files, err := openContentLayer(dataDir, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.FileVersions > 0 {
+		versions, err := openContentLayer(filepath.Join(dataDir, ".versions"), path.Join(host, ".versions"))
+		if err != nil {
+			return nil, nil, err
+		}
+		files = newVersionedStorage(files, versions, config.FileVersions, config.FileVersionMaxAge)
+	}
+	expiries, err := openFileExpiries(files, newStorage(filepath.Join(dataDir, ".expiry"), path.Join(host, ".expiry")))
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, expiries, nil
+}
+
+// openContentLayer returns the -storage backend for dataDir, wrapped in
+// the -content-addressed layer if asked for. The layer's blobs go in a
+// hidden folder of their own, which on disk is also where uploads are
+// spooled; other backends spool in the same place on local disk.
+func openContentLayer(dataDir, host string) (Storage, error) {
+	if !config.ContentAddressed {
+		return newStorage(dataDir, host), nil
+	}
+	blobs := filepath.Join(dataDir, ".blobs")
+	return openContentStorage(newStorage(blobs, path.Join(host, ".blobs")), blobs)
+}
+
+// newStorage returns the -storage backend for a host serving dataDir,
+// encrypting what it holds if there are encryption keys. Backends other
+// than disk keep each host's files apart, in a folder named after host
+// where they need one.
+func newStorage(dataDir, host string) Storage {
+	var store Storage
+	switch config.Storage {
+	case "memory":
+		m := newMemoryStorage(config.StorageMaxSize)
+		memoryStorages = append(memoryStorages, m)
+		store = m
+	case "s3":
+		store = newS3Storage(config.S3, host)
+	case "db":
+		store = newDBStorage(storageDB, host)
+	default:
+		store = newDiskStorage(dataDir)
+		if replication != nil {
+			store = replication.wrap(store, dataDir)
+		}
+	}
+	if len(encryptionKeys) > 0 {
+		store = newEncryptedStorage(store)
+	}
+	return store
+}
+
+// errStorageFull is returned by Write when a file doesn't fit.
+var errStorageFull = errors.New("storage is full")
+
+// storageErrorStatus picks the response status for an error from writing
+// to a Storage, logging the ones that are the server's fault.
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errStorageFull):
+		return http.StatusInsufficientStorage
+	}
+	status := bodyErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Error saving upload: %v", err)
+	}
+	return status
+}
+
+// validFileName reports whether name can be stored: a single path element
+// that isn't hidden, since backends keep their own files under dot names.
+func validFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// diskStorage keeps files in a directory, one file per name. With
+// -sandbox, files are opened and looked up without following anything,
+// such as a symlink, out of the directory. Writing, renaming and removing
+// never follow the last element of a path, so they need no such care.
+type diskStorage struct {
+	dir     string
+	sandbox bool
+}
+
+func newDiskStorage(dir string) *diskStorage {
+	return &diskStorage{dir: dir, sandbox: config.Sandbox}
+}
+
+func (s *diskStorage) path(name string) (string, error) {
+	if !validFileName(name) {
+		return "", fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *diskStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	var f *os.File
+	if s.sandbox {
+		f, err = openBeneath(s.dir, name, os.O_RDONLY)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, FileInfo{}, err
+	}
+	return f, diskFileInfo(info), nil
+}
+
+func (s *diskStorage) Stat(name string) (FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	var info fs.FileInfo
+	if s.sandbox {
+		info, err = statBeneath(s.dir, name)
+	} else {
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return diskFileInfo(info), nil
+}
+
+// Write streams r into the directory without holding it in memory. The
+// data goes to a temporary file beside the target and is renamed into
+// place only once it has been received completely.
+func (s *diskStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return FileInfo{}, fmt.Errorf("creating directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "."+name+".upload-*")
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("creating temporary file: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return FileInfo{}, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return FileInfo{}, fmt.Errorf("setting permissions: %w", err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return FileInfo{}, fmt.Errorf("closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return FileInfo{}, fmt.Errorf("moving upload into place: %w", err)
+	}
+	committed = true
+
+	stored := diskFileInfo(info)
+	stored.Name = name
+	return stored, nil
+}
+
+func (s *diskStorage) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *diskStorage) List() ([]FileInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !validFileName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		files = append(files, diskFileInfo(info))
+	}
+	return files, nil
+}
+
+func diskFileInfo(info fs.FileInfo) FileInfo {
+	return FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// memoryStorage keeps files in memory, up to maxSize bytes in all; they
+// are lost on restart.
+type memoryStorage struct {
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]memoryFile
+	size  int64
+}
+
+// memoryFile is one version of a file. Its data is never changed once
+// stored, so readers can keep using it while it is replaced.
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryStorage(maxSize int64) *memoryStorage {
+	return &memoryStorage{maxSize: maxSize, files: make(map[string]memoryFile)}
+}
+
+func (s *memoryStorage) lookup(name string) (memoryFile, error) {
+	if !validFileName(name) {
+		return memoryFile{}, fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return memoryFile{}, fmt.Errorf("file %q: %w", name, fs.ErrNotExist)
+	}
+	return f, nil
+}
+
+func (s *memoryStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	f, err := s.lookup(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return nopSeekCloser{bytes.NewReader(f.data)}, f.info(name), nil
+}
+
+func (s *memoryStorage) Stat(name string) (FileInfo, error) {
+	f, err := s.lookup(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return f.info(name), nil
+}
+
+// Write reads r in full before storing it, and refuses it with
+// errStorageFull as soon as it can't fit even if it replaced everything.
+func (s *memoryStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	if !validFileName(name) {
+		return FileInfo{}, fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if n > s.maxSize {
+		return FileInfo{}, errStorageFull
+	}
+
+	f := memoryFile{data: buf.Bytes(), modTime: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := s.size - int64(len(s.files[name].data)) + n
+	if size > s.maxSize {
+		return FileInfo{}, errStorageFull
+	}
+	s.files[name] = f
+	s.size = size
+	return f.info(name), nil
+}
+
+func (s *memoryStorage) Delete(name string) error {
+	if !validFileName(name) {
+		return fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return fmt.Errorf("file %q: %w", name, fs.ErrNotExist)
+	}
+	s.size -= int64(len(f.data))
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memoryStorage) List() ([]FileInfo, error) {
+	s.mu.Lock()
+	files := make([]FileInfo, 0, len(s.files))
+	for name, f := range s.files {
+		files = append(files, f.info(name))
+	}
+	s.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (f memoryFile) info(name string) FileInfo {
+	return FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime}
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
@@ -0,0 +1,336 @@
+package httpserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxStreamLines     = 100
+	defaultStreamDelay = 100 * time.Millisecond
+	maxStreamDelay     = 10 * time.Second
+
+	maxDripBytes    = 10 * 1024 * 1024
+	maxDripDuration = time.Minute
+)
+
+// writeTimeout is how long Flush waits for a client to take what is sent.
+// It is a variable so that tests can shorten it.
+var writeTimeout = 10 * time.Second
+
+// streamWriter sends a response body incrementally. Unlike sendResponse,
+// the body does not need to be known up front: unless the caller supplies
+// a Content-Length, each Write becomes a chunk, and Flush pushes buffered
+// data onto the wire immediately.
+type streamWriter struct {
+	conn    net.Conn
+	bw      *bufio.Writer
+	body    io.Writer
+	chunked bool
+}
+
+// startStream writes the status line and headers for a streamed response
+// and returns a writer for the body. The caller must Close the writer to
+// terminate a chunked body.
+func startStream(conn net.Conn, status int, headers map[string]string) (*streamWriter, error) {
+	header := make(http.Header)
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	return startStreamHeader(conn, status, header)
+}
+
+// startStreamHeader is startStream for callers that need repeated header
+// fields, such as responses relayed from another server.
+func startStreamHeader(conn net.Conn, status int, header http.Header) (*streamWriter, error) {
+	if connClosing(conn) && header.Get("Connection") == "" {
+		header.Set("Connection", "close")
+	}
+
+	s := &streamWriter{conn: conn, bw: bufio.NewWriter(conn)}
+	s.body = s.bw
+	if header.Get("Content-Length") == "" && bodyAllowed(status) {
+		header.Set("Transfer-Encoding", "chunked")
+		s.chunked = true
+		s.body = httputil.NewChunkedWriter(s.bw)
+	}
+
+	recordStatus(conn, status)
+	if _, err := fmt.Fprintf(s.bw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status)); err != nil {
+		return nil, err
+	}
+	if err := header.Write(s.bw); err != nil {
+		return nil, err
+	}
+	if _, err := s.bw.WriteString("\r\n"); err != nil {
+		return nil, err
+	}
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// bodyAllowed reports whether a response with the given status may carry a
+// body (RFC 9110 section 6.4.1).
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	return s.body.Write(p)
+}
+
+// Flush sends any buffered data to the client. A client that stops reading
+// makes Flush fail after writeTimeout rather than blocking forever.
+func (s *streamWriter) Flush() error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return s.bw.Flush()
+}
+
+// Close ends a chunked body with the zero-length chunk and an empty
+// trailer, and flushes whatever remains.
+func (s *streamWriter) Close() error {
+	if s.chunked {
+		if err := s.body.(io.Closer).Close(); err != nil {
+			return err
+		}
+		if _, err := s.bw.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return s.Flush()
+}
+
+// multipartStream sends a multipart/x-mixed-replace response, where each
+// part replaces the previous one in the client (server push, MJPEG).
+type multipartStream struct {
+	stream *streamWriter
+	parts  *multipart.Writer
+}
+
+// startMultipartStream begins a multipart/x-mixed-replace response with a
+// freshly generated boundary.
+func startMultipartStream(conn net.Conn, status int, headers map[string]string) (*multipartStream, error) {
+	// The part writer needs the stream, which needs the boundary for its
+	// headers, so borrow a random boundary from a throwaway writer first.
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+
+	all := map[string]string{"Content-Type": "multipart/x-mixed-replace; boundary=" + boundary}
+	for k, v := range headers {
+		all[k] = v
+	}
+
+	stream, err := startStream(conn, status, all)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &multipartStream{stream: stream, parts: multipart.NewWriter(stream)}
+	if err := m.parts.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WritePart sends one complete part and flushes it to the client.
+func (m *multipartStream) WritePart(contentType string, body []byte) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	w, err := m.parts.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return m.stream.Flush()
+}
+
+// Close writes the closing boundary and terminates the response.
+func (m *multipartStream) Close() error {
+	if err := m.parts.Close(); err != nil {
+		return err
+	}
+	return m.stream.Close()
+}
+
+// handleSnapshots pushes a JSON snapshot of server state as a
+// multipart/x-mixed-replace stream, one part per ?interval milliseconds
+// (default 1000), for ?count parts or until the client disconnects.
+func handleSnapshots(conn net.Conn, req *http.Request) {
+	query := req.URL.Query()
+
+	interval, err := queryInt(query.Get("interval"), 1000)
+	if err != nil || interval < 1 {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	count, err := queryInt(query.Get("count"), 0)
+	if err != nil || count < 0 {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+
+	stream, err := startMultipartStream(conn, http.StatusOK, map[string]string{"Cache-Control": "no-cache"})
+	if err != nil {
+		log.Printf("Error starting snapshot stream: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for sent := 0; count == 0 || sent < count; sent++ {
+		if sent > 0 {
+			select {
+			case <-ticker.C:
+			case <-req.Context().Done():
+				return
+			}
+		}
+
+		snapshot, err := json.Marshal(map[string]any{
+			"time":       time.Now().UTC().Format(time.RFC3339Nano),
+			"uptime":     time.Since(startTime).Seconds(),
+			"goroutines": runtime.NumGoroutine(),
+			"sequence":   sent,
+		})
+		if err != nil {
+			log.Printf("Error encoding snapshot: %v", err)
+			return
+		}
+		if err := stream.WritePart("application/json", snapshot); err != nil {
+			return
+		}
+	}
+
+	if err := stream.Close(); err != nil {
+		log.Printf("Error closing snapshot stream: %v", err)
+	}
+}
+
+// handleStream sends n JSON lines, each in its own chunk, pausing between
+// them so clients can observe the response arriving incrementally. The
+// pause defaults to 100ms and can be changed with ?delay=<milliseconds>.
+func handleStream(w *ResponseWriter, req *http.Request) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/stream/"))
+	if err != nil || n < 1 || n > maxStreamLines {
+		return ErrBadRequest
+	}
+
+	delay := defaultStreamDelay
+	if v := req.URL.Query().Get("delay"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > maxStreamDelay {
+			return ErrBadRequest
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	for i := 0; i < n; i++ {
+		if i > 0 && !sleep(req.Context(), delay) {
+			return nil
+		}
+
+		line, err := json.Marshal(map[string]any{"id": i, "url": req.URL.Path, "origin": req.RemoteAddr})
+		if err != nil {
+			return fmt.Errorf("encoding stream line: %w", err)
+		}
+		w.Write(append(line, '\n'))
+		if err := w.Flush(); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleDrip trickles numbytes bytes to the client spread evenly over
+// duration seconds, after an optional initial delay. It exists to exercise
+// client read timeouts against a deliberately slow producer.
+func handleDrip(conn net.Conn, req *http.Request) {
+	query := req.URL.Query()
+
+	numBytes, err := queryInt(query.Get("numbytes"), 10)
+	if err != nil || numBytes < 1 || numBytes > maxDripBytes {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	duration, err := querySeconds(query.Get("duration"), 2*time.Second)
+	if err != nil || duration > maxDripDuration {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+	delay, err := querySeconds(query.Get("delay"), 0)
+	if err != nil || delay > maxDripDuration {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return
+	}
+
+	if !sleep(req.Context(), delay) {
+		return
+	}
+
+	stream, err := startStream(conn, http.StatusOK, map[string]string{
+		"Content-Type":   "application/octet-stream",
+		"Content-Length": strconv.Itoa(numBytes),
+	})
+	if err != nil {
+		log.Printf("Error starting drip: %v", err)
+		return
+	}
+
+	pause := duration / time.Duration(numBytes)
+	for i := 0; i < numBytes; i++ {
+		if i > 0 && !sleep(req.Context(), pause) {
+			return
+		}
+		if _, err := stream.Write([]byte{'*'}); err != nil {
+			return
+		}
+		if err := stream.Flush(); err != nil {
+			log.Printf("Error writing drip: %v", err)
+			return
+		}
+	}
+}
+
+// queryInt parses an integer query parameter, returning def when it is
+// absent.
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// querySeconds parses a non-negative, possibly fractional, number of
+// seconds, returning def when the parameter is absent.
+func querySeconds(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
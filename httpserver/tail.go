@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const tailPollInterval = 250 * time.Millisecond
+
+// followFile streams bytes appended to name in store, like tail -f, until
+// the client disconnects or the file is removed. Streaming starts at the
+// current end of the file; if the file shrinks it is assumed to have been
+// truncated and is followed again from the beginning.
+func followFile(ctx context.Context, conn net.Conn, store Storage, name string) {
+	f, _, err := store.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			handleNotFound(conn)
+		} else {
+			sendError(conn, fmt.Errorf("opening file: %w", err))
+		}
+		return
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		sendError(conn, fmt.Errorf("seeking file: %w", err))
+		return
+	}
+
+	stream, err := startStream(conn, http.StatusOK, map[string]string{
+		"Content-Type":  "application/octet-stream",
+		"Cache-Control": "no-cache",
+	})
+	if err != nil {
+		log.Printf("Error starting file tail: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	buf := make([]byte, 32*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := store.Stat(name)
+		if err != nil {
+			// The file was removed or renamed away; end the stream cleanly.
+			stream.Close()
+			return
+		}
+		if info.Size < offset {
+			if offset, err = f.Seek(0, io.SeekStart); err != nil {
+				return
+			}
+		}
+
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				offset += int64(n)
+				if _, werr := stream.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err := stream.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errBadAuthority = errors.New("invalid authority in absolute-form request target")
+
+// resolveAbsoluteForm turns an absolute-form request target such as
+// "GET http://localhost:4221/echo/hi HTTP/1.1" into the origin form the
+// router expects. RFC 9112 3.2.2 requires a server to accept this form and
+// to take the target's authority in place of the Host header.
+//
+// When the forward proxy is enabled, targets naming some other server are
+// left alone for handleForwardProxy; otherwise every absolute-form target
+// is served locally, as an origin server would.
+func resolveAbsoluteForm(conn net.Conn, req *http.Request) error {
+	if !req.URL.IsAbs() {
+		return nil
+	}
+	if err := checkAuthority(req.URL); err != nil {
+		return err
+	}
+	if len(config.ForwardProxyHosts) > 0 && !servesAuthority(conn, req.URL) {
+		return nil
+	}
+
+	req.Host = req.URL.Host
+	req.URL = &url.URL{
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	return nil
+}
+
+// checkAuthority validates the scheme and authority of an absolute URL:
+// http or https, a non-empty host, an optional numeric port and no
+// userinfo, which RFC 9110 4.2.4 forbids in http(s) URIs.
+func checkAuthority(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errBadAuthority
+	}
+	if u.User != nil || u.Hostname() == "" {
+		return errBadAuthority
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return errBadAuthority
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		return errBadAuthority
+	}
+	return nil
+}
+
+// servesAuthority reports whether the authority of u names this server: one
+// of its virtual hosts, or this machine on the port the client connected
+// to.
+func servesAuthority(conn net.Conn, u *url.URL) bool {
+	host := u.Hostname()
+	for _, vh := range config.VirtualHosts {
+		for _, name := range vh.Hosts {
+			if strings.EqualFold(name, host) {
+				return true
+			}
+		}
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	localHost, localPort, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil || port != localPort {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback() || ip.Equal(net.ParseIP(localHost))
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	hostname, err := os.Hostname()
+	return err == nil && strings.EqualFold(host, hostname)
+}
@@ -0,0 +1,199 @@
+package httpserver
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// builtinTemplates are the HTML pages used unless -templates names a
+// directory to take them from instead.
+//
+//go:embed templates
+var builtinTemplates embed.FS
+
+// A template directory holds layout.html, which defines "layout", any
+// number of partials under partials/, and one file for each page. A page
+// defines the "title" and "content" blocks that the layout fills in.
+// Inline styles and scripts are allowed by -csp if they carry the nonce of
+// the response, as in <style nonce="{{cspNonce}}">.
+const (
+	templateLayout   = "layout.html"
+	templatePartials = "partials/*.html"
+)
+
+// pageTemplates maps each page's file name to its parsed template, with
+// the layout and partials parsed into it. They are never executed
+// themselves, but cloned for each page rendered, so that every clone can
+// have the nonce of its response.
+var pageTemplates atomic.Pointer[map[string]*template.Template]
+
+var templateFuncs = template.FuncMap{
+	"formatSize": formatSize,
+	// cspNonce is replaced for each page by renderPage.
+	"cspNonce": func() string { return "" },
+}
+
+// templateDir returns where the templates are read from.
+func templateDir() fs.FS {
+	if config.TemplatesDir != "" {
+		return os.DirFS(config.TemplatesDir)
+	}
+	sub, _ := fs.Sub(builtinTemplates, "templates")
+	return sub
+}
+
+// loadTemplates parses the templates once, to be used until the server
+// stops unless -templates-reload is set.
+func loadTemplates() error {
+	pages, err := parseTemplates(templateDir())
+	if err != nil {
+		return err
+	}
+	pageTemplates.Store(&pages)
+	return nil
+}
+
+func parseTemplates(dir fs.FS) (map[string]*template.Template, error) {
+	base, err := template.New(templateLayout).Funcs(templateFuncs).ParseFS(dir, templateLayout)
+	if err != nil {
+		return nil, err
+	}
+	if partials, _ := fs.Glob(dir, templatePartials); len(partials) > 0 {
+		if _, err := base.ParseFS(dir, templatePartials); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := fs.Glob(dir, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*template.Template)
+	for _, name := range names {
+		if name == templateLayout {
+			continue
+		}
+		page, err := base.Clone()
+		if err == nil {
+			_, err = page.ParseFS(dir, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pages[name] = page
+	}
+	return pages, nil
+}
+
+// renderPage answers with the page of the given name, filled in from
+// data. With -templates-reload the templates are parsed afresh each time,
+// so that edits to them show up without a restart.
+func renderPage(w *ResponseWriter, status int, name string, data any) error {
+	var pages map[string]*template.Template
+	if config.TemplatesReload {
+		var err error
+		if pages, err = parseTemplates(templateDir()); err != nil {
+			return fmt.Errorf("parsing templates: %w", err)
+		}
+	} else if p := pageTemplates.Load(); p != nil {
+		pages = *p
+	}
+	parsed, ok := pages[name]
+	if !ok {
+		return fmt.Errorf("no template %s", name)
+	}
+	page, err := parsed.Clone()
+	if err != nil {
+		return fmt.Errorf("rendering %s: %w", name, err)
+	}
+	nonce := newCSPNonce()
+	page.Funcs(template.FuncMap{"cspNonce": func() string { return nonce }})
+
+	// A page that fails part way is not sent at all.
+	var buf bytes.Buffer
+	if err := page.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return fmt.Errorf("rendering %s: %w", name, err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setCSP(w.Header(), nonce)
+	w.WriteHeader(status)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// errorPage describes an error to error.html.
+type errorPage struct {
+	Status int
+	Text   string
+}
+
+// wantsErrorPage reports whether a response with no body of its own should
+// get an error page: one for an error, to a client that reads HTML.
+func (w *ResponseWriter) wantsErrorPage() bool {
+	return w.status >= http.StatusBadRequest && w.body.Len() == 0 &&
+		w.header.Get("Content-Type") == "" && w.req != nil && acceptsHTML(w.req)
+}
+
+// writeErrorPage fills in the body of an error response with error.html.
+// If that fails, the response goes out without a body as before.
+func (w *ResponseWriter) writeErrorPage() {
+	status := w.status
+	w.status = 0
+	if err := renderPage(w, status, "error.html", errorPage{Status: status, Text: http.StatusText(status)}); err != nil {
+		reportError(err)
+		w.header.Del("Content-Type")
+		w.body.Reset()
+		w.status = status
+	}
+}
+
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// handleFileList lists the files of the request's host, as a page for
+// browsers and as JSON otherwise.
+func handleFileList(w *ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil
+	}
+	files, err := virtualHost(req).storage.List()
+	if err != nil {
+		return fmt.Errorf("listing files: %w", err)
+	}
+	if files == nil {
+		files = []FileInfo{}
+	}
+
+	if acceptsHTML(req) {
+		return renderPage(w, http.StatusOK, "listing.html", map[string]any{"Files": files})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(map[string]any{"files": files})
+}
+
+// formatSize writes a byte count the way people read them.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
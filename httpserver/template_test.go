@@ -0,0 +1,126 @@
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getWithAccept(t *testing.T, url, accept string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", accept)
+	resp, err := testClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestTemplatePages(t *testing.T) {
+	addr := startTestServer(t)
+	resp, err := http.Post("http://"+addr+"/files/a<b>.txt", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	tests := []struct {
+		path, accept string
+		status       int
+		contentType  string
+		contains     []string
+	}{
+		{"/files/", "text/html", 200, "text/html; charset=utf-8", []string{"<title>Files</title>", `href="/files/a%3cb%3e.txt"`, "a&lt;b&gt;.txt", "5 B"}},
+		{"/files/", "*/*", 200, "application/json; charset=utf-8", []string{`"name":"a<b>.txt"`}},
+		{"/nowhere", "text/html", 404, "text/html; charset=utf-8", []string{"<h1>404 Not Found</h1>"}},
+		{"/nowhere", "*/*", 404, "", nil},
+		// A body of the handler's own is left alone.
+		{"/files/a<b>.txt", "text/html", 200, "", []string{"hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.accept, func(t *testing.T) {
+			resp, body := getWithAccept(t, "http://"+addr+tt.path, tt.accept)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if ct := resp.Header.Get("Content-Type"); tt.contentType != "" && ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(body, want) {
+					t.Errorf("body doesn't contain %q:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplatesReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("layout.html", `{{define "layout"}}[{{template "content" .}}]{{end}}`)
+	write("error.html", `{{define "content"}}first {{.Status}}{{end}}`)
+	addr := startTestServer(t, "-templates", dir, "-templates-reload")
+
+	if _, body := getWithAccept(t, "http://"+addr+"/nowhere", "text/html"); body != "[first 404]" {
+		t.Errorf("body = %q, want %q", body, "[first 404]")
+	}
+	write("error.html", `{{define "content"}}second {{.Status}}{{end}}`)
+	if _, body := getWithAccept(t, "http://"+addr+"/nowhere", "text/html"); body != "[second 404]" {
+		t.Errorf("after editing, body = %q, want %q", body, "[second 404]")
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"layout.html": `{{define "layout"}}<style nonce="{{cspNonce}}">p{}</style>{{template "content" .}}{{end}}`,
+		"error.html":  `{{define "content"}}{{.Status}}{{end}}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startTestServer(t, "-templates", dir, "-csp", "style-src 'nonce-{nonce}'")
+
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		resp, body := getWithAccept(t, "http://"+addr+"/nowhere", "text/html")
+		csp := resp.Header.Get("Content-Security-Policy")
+		nonce, ok := strings.CutPrefix(csp, "style-src 'nonce-")
+		nonce, ok2 := strings.CutSuffix(nonce, "'")
+		if !ok || !ok2 || nonce == "" {
+			t.Fatalf("Content-Security-Policy = %q", csp)
+		}
+		if want := `<style nonce="` + nonce + `">`; !strings.HasPrefix(body, want) {
+			t.Errorf("body = %q, want it to start with %q", body, want)
+		}
+		nonces = append(nonces, nonce)
+	}
+	if nonces[0] == nonces[1] {
+		t.Error("two responses had the same nonce")
+	}
+
+	if resp, _ := getWithAccept(t, "http://"+addr+"/files/", "application/json"); resp.Header.Get("Content-Security-Policy") != "" {
+		t.Error("JSON response has a Content-Security-Policy")
+	}
+
+	addr = startTestServer(t, "-templates", dir, "-csp", "")
+	if resp, _ := getWithAccept(t, "http://"+addr+"/nowhere", "text/html"); resp.Header.Get("Content-Security-Policy") != "" {
+		t.Errorf("Content-Security-Policy = %q with -csp empty", resp.Header.Get("Content-Security-Policy"))
+	}
+}
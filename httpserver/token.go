@@ -0,0 +1,150 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+var errBadToken = errors.New("invalid or expired token")
+
+// accessClaims is the payload of an access token: a JWT (RFC 7519) signed
+// with HS256 under a key derived from the session key.
+type accessClaims struct {
+	Subject  string   `json:"sub"`
+	Roles    []string `json:"roles,omitempty"`
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenKey derives the access token key from sessionKey, so that a session
+// cookie signature can never pass for a token signature or the reverse.
+func tokenKey() []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("access token"))
+	return mac.Sum(nil)
+}
+
+// issueAccessToken returns a signed access token for u and when it expires.
+func issueAccessToken(u *user, now time.Time) (string, time.Time, error) {
+	expires := now.Add(accessTokenLifetime)
+	payload, err := json.Marshal(accessClaims{
+		Subject:  u.Name,
+		Roles:    u.Roles,
+		IssuedAt: now.Unix(),
+		Expires:  expires.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signToken(signed), expires, nil
+}
+
+func signToken(signed string) string {
+	mac := hmac.New(sha256.New, tokenKey())
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// looksLikeJWT reports whether token has the three-part shape of a JWT, as
+// opposed to an opaque bearer token such as -admin-token.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verifyAccessToken checks the signature and expiry of an access token.
+// Only the header issueAccessToken writes is accepted, which rules out
+// "alg":"none" and algorithm confusion.
+func verifyAccessToken(token string, now time.Time) (*accessClaims, error) {
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, _ := strings.Cut(rest, ".")
+	if header != jwtHeader || !hmac.Equal([]byte(signature), []byte(signToken(header+"."+payload))) {
+		return nil, errBadToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errBadToken
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errBadToken
+	}
+	if claims.Subject == "" || now.Unix() >= claims.Expires {
+		return nil, errBadToken
+	}
+	return &claims, nil
+}
+
+// refreshTokenStore holds the outstanding refresh tokens. They are opaque
+// and single-use: redeeming one revokes it and issues a replacement. Only
+// a hash of each token is kept.
+type refreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]refreshToken
+}
+
+type refreshToken struct {
+	user    string
+	expires time.Time
+}
+
+var refreshTokens = &refreshTokenStore{tokens: make(map[string]refreshToken)}
+
+func (s *refreshTokenStore) issue(name string, now time.Time) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, t := range s.tokens {
+		if now.After(t.expires) {
+			delete(s.tokens, key)
+		}
+	}
+	s.tokens[hashToken(token)] = refreshToken{user: name, expires: now.Add(refreshTokenLifetime)}
+	return token, nil
+}
+
+// redeem revokes token and returns the user it was issued to.
+func (s *refreshTokenStore) redeem(token string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hashToken(token)
+	t, ok := s.tokens[key]
+	if !ok {
+		return "", errBadToken
+	}
+	delete(s.tokens, key)
+	if now.After(t.expires) {
+		return "", errBadToken
+	}
+	return t.user, nil
+}
+
+func (s *refreshTokenStore) revoke(token string) {
+	s.mu.Lock()
+	delete(s.tokens, hashToken(token))
+	s.mu.Unlock()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
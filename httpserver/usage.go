@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// credentialUsage is the traffic of one authenticated user, and the token
+// bucket behind -user-rate-limit.
+type credentialUsage struct {
+	mu        sync.Mutex
+	requests  int64
+	throttled int64
+	bytesIn   int64
+	bytesOut  int64
+	tokens    float64
+	refilled  time.Time
+}
+
+// usageReport is the admin API's view of a credentialUsage.
+type usageReport struct {
+	Requests  int64 `json:"requests"`
+	Throttled int64 `json:"throttled"`
+	BytesIn   int64 `json:"bytes_in"`
+	BytesOut  int64 `json:"bytes_out"`
+}
+
+// credentialUsages tracks usage per user, however they authenticated, so
+// that a user's tokens and sessions share one quota.
+var credentialUsages = struct {
+	sync.Mutex
+	users map[string]*credentialUsage
+}{users: make(map[string]*credentialUsage)}
+
+func usageFor(user string) *credentialUsage {
+	credentialUsages.Lock()
+	defer credentialUsages.Unlock()
+	u, ok := credentialUsages.users[user]
+	if !ok {
+		u = &credentialUsage{tokens: float64(config.UserRateBurst), refilled: time.Now()}
+		credentialUsages.users[user] = u
+	}
+	return u
+}
+
+// allowCredential counts a request by the authenticated caller p against
+// their quota. Once the caller is over -user-rate-limit it sends a 429
+// with Retry-After and returns false.
+func allowCredential(conn net.Conn, p *principal) bool {
+	u := usageFor(p.User)
+	u.mu.Lock()
+	u.requests++
+	if config.UserRateLimit <= 0 {
+		u.mu.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	rate := float64(config.UserRateLimit) / 60
+	u.tokens = min(float64(config.UserRateBurst), u.tokens+now.Sub(u.refilled).Seconds()*rate)
+	u.refilled = now
+	if u.tokens >= 1 {
+		u.tokens--
+		u.mu.Unlock()
+		return true
+	}
+	u.throttled++
+	wait := int(math.Ceil((1 - u.tokens) / rate))
+	u.mu.Unlock()
+
+	body := []byte(`{"error":"rate limit exceeded"}` + "\n")
+	sendResponse(conn, http.StatusTooManyRequests, body, map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+		"Retry-After":  strconv.Itoa(wait),
+	})
+	return false
+}
+
+// recordTransfer adds the bytes of the exchange just served on conn to the
+// usage of p.
+func recordTransfer(conn net.Conn, p *principal) {
+	sc, ok := conn.(*serverConn)
+	if !ok {
+		return
+	}
+	u := usageFor(p.User)
+	u.mu.Lock()
+	u.bytesIn += sc.body.read
+	u.bytesOut += sc.written.Load()
+	u.mu.Unlock()
+}
+
+// handleAdminUsage reports the usage of every user seen since startup.
+func handleAdminUsage(conn net.Conn, req *http.Request) {
+	credentialUsages.Lock()
+	report := make(map[string]usageReport, len(credentialUsages.users))
+	for name, u := range credentialUsages.users {
+		u.mu.Lock()
+		report[name] = usageReport{Requests: u.requests, Throttled: u.throttled, BytesIn: u.bytesIn, BytesOut: u.bytesOut}
+		u.mu.Unlock()
+	}
+	credentialUsages.Unlock()
+
+	sendJSON(conn, http.StatusOK, map[string]any{"users": report}, true)
+}
@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserRateLimitAndUsage(t *testing.T) {
+	credentialUsages.Lock()
+	credentialUsages.users = make(map[string]*credentialUsage)
+	credentialUsages.Unlock()
+	addr := startTestServer(t, "-users", writeTestUsers(t), "-admin-token", "secret", "-user-rate-limit", "2")
+	client := &http.Client{Timeout: 5 * time.Second}
+	status, tokens := postAuth(t, client, "http://"+addr+"/auth/login", `{"username":"ann","password":"hunter2"}`)
+	if status != http.StatusOK {
+		t.Fatalf("login = %d", status)
+	}
+
+	do := func(method, path, body, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := do("POST", "/files/a.txt", "hello", tokens.AccessToken); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload = %d", resp.StatusCode)
+	}
+	if resp := do("GET", "/files/a.txt", "", tokens.AccessToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf("download = %d", resp.StatusCode)
+	}
+	resp := do("GET", "/files/a.txt", "", tokens.AccessToken)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("request over the burst = %d, Retry-After %q, want 429 after 30s", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// Anonymous callers aren't held to a user's quota.
+	if resp := do("GET", "/files/a.txt", "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("anonymous download = %d, want 200", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/admin/usage", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Users map[string]usageReport `json:"users"`
+	}
+	json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	ann := report.Users["ann"]
+	if ann.Requests != 3 || ann.Throttled != 1 || ann.BytesIn != 5 || ann.BytesOut == 0 {
+		t.Errorf("usage of ann = %+v, want 3 requests, 1 throttled, 5 bytes in and some out", ann)
+	}
+	if len(report.Users) != 1 {
+		t.Errorf("usage reported for %v, want only ann", report.Users)
+	}
+}
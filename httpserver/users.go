@@ -0,0 +1,486 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// user is an account that can log in through /auth/login. Users are
+// never changed in place; an update replaces the whole value.
+type user struct {
+	Name string `json:"name"`
+	// Password is a hash made by hashPassword, never the password itself.
+	Password string   `json:"password"`
+	Roles    []string `json:"roles,omitempty"`
+	// Disabled users can't log in, and their sessions and tokens stop
+	// working.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+var (
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("no such user")
+	errBadUserName  = errors.New("invalid user name")
+)
+
+// userStore holds the accounts in the -users file and writes every change
+// back to it.
+type userStore struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]*user
+}
+
+// users is nil when -users is unset, which disables /auth/.
+var users *userStore
+
+// loadUsers reads a JSON array of users from path. A missing file is an
+// empty store, which the admin API can then add to.
+func loadUsers(path string) (*userStore, error) {
+	store := &userStore{path: path, users: make(map[string]*user)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*user
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&list); err != nil {
+		return nil, err
+	}
+
+	for _, u := range list {
+		if err := validUserName(u.Name); err != nil {
+			return nil, err
+		}
+		if _, dup := store.users[u.Name]; dup {
+			return nil, fmt.Errorf("user %q listed twice", u.Name)
+		}
+		if _, _, _, err := parsePasswordHash(u.Password); err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Name, err)
+		}
+		store.users[u.Name] = u
+	}
+	return store, nil
+}
+
+// validUserName rejects names that can't be used in Basic credentials or
+// the admin API's URLs.
+func validUserName(name string) error {
+	if name == "" || strings.ContainsAny(name, ":/") || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w %q", errBadUserName, name)
+	}
+	return nil
+}
+
+// lookup returns the named user if they exist and aren't disabled.
+func (s *userStore) lookup(name string) (*user, bool) {
+	u, ok := s.get(name)
+	if !ok || u.Disabled {
+		return nil, false
+	}
+	return u, true
+}
+
+// get returns the named user, disabled or not.
+func (s *userStore) get(name string) (*user, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	return u, ok
+}
+
+// list returns every user, sorted by name.
+func (s *userStore) list() []*user {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// create adds a new user.
+func (s *userStore) create(u *user) error {
+	if err := validUserName(u.Name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Name]; ok {
+		return errUserExists
+	}
+	s.users[u.Name] = u
+	if err := s.saveLocked(); err != nil {
+		delete(s.users, u.Name)
+		return err
+	}
+	return nil
+}
+
+// update replaces the named user with the result of change, which gets a
+// copy to modify.
+func (s *userStore) update(name string, change func(u *user)) (*user, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[name]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	u := *old
+	u.Roles = append([]string(nil), old.Roles...)
+	change(&u)
+	s.users[name] = &u
+	if err := s.saveLocked(); err != nil {
+		s.users[name] = old
+		return nil, err
+	}
+	return &u, nil
+}
+
+// remove deletes the named user.
+func (s *userStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[name]
+	if !ok {
+		return errUserNotFound
+	}
+	delete(s.users, name)
+	if err := s.saveLocked(); err != nil {
+		s.users[name] = old
+		return err
+	}
+	return nil
+}
+
+// saveLocked writes the users to a temporary file and renames it over the
+// -users file, so a crash leaves either the old or the new file.
+func (s *userStore) saveLocked() error {
+	list := make([]*user, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".users-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// authenticate returns the user with the given name and password. An
+// unknown name costs as much as a wrong password, so that response times
+// don't reveal which accounts exist.
+func (s *userStore) authenticate(name, password string) (*user, bool) {
+	u, ok := s.lookup(name)
+	if !ok {
+		verifyPassword(dummyPasswordHash(), password)
+		return nil, false
+	}
+	if !verifyPassword(u.Password, password) {
+		return nil, false
+	}
+	return u, true
+}
+
+// runHashPassword implements "server hash-password": it reads a password
+// from the first line of standard input and prints its hash for -users.
+func runHashPassword() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatalf("Error reading password: %v", err)
+	}
+	hash, err := hashPassword(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		log.Fatalf("Error hashing password: %v", err)
+	}
+	fmt.Println(hash)
+}
+
+// Passwords are hashed with PBKDF2-HMAC-SHA256 and stored as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" with unpadded base64 fields.
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordSaltBytes  = 16
+	passwordHashBytes  = 32
+)
+
+var errBadPasswordHash = errors.New("password is not a " + passwordScheme + " hash")
+
+// dummyPasswordHash is checked against when a login names no known user.
+// It is made on first use, since hashing is deliberately slow.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	return hashPasswordWithSalt("", make([]byte, passwordSaltBytes))
+})
+
+// hashPassword returns a hash of password with a fresh random salt.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashPasswordWithSalt(password, salt), nil
+}
+
+func hashPasswordWithSalt(password string, salt []byte) string {
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, passwordHashBytes)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPassword reports whether password matches a hash from hashPassword.
+func verifyPassword(hash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+func parsePasswordHash(hash string) (iterations int, salt, key []byte, err error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[0] != passwordScheme {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	iterations, err = strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errBadPasswordHash
+	}
+	return iterations, salt, key, nil
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018 5.2) with HMAC-SHA256 as the PRF.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	u := make([]byte, 0, sha256.Size)
+	t := make([]byte, sha256.Size)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// adminRole is the role that grants access to the admin endpoints.
+const adminRole = "admin"
+
+// userView is a user as the admin API shows it, without the password hash.
+type userView struct {
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles"`
+	Disabled bool     `json:"disabled"`
+}
+
+func viewUser(u *user) userView {
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return userView{Name: u.Name, Roles: roles, Disabled: u.Disabled}
+}
+
+// userChange is the body of a request to create or update a user. Fields
+// left out of an update keep their current values.
+type userChange struct {
+	Name     string    `json:"name"`
+	Password *string   `json:"password"`
+	Roles    *[]string `json:"roles"`
+	Disabled *bool     `json:"disabled"`
+}
+
+// handleAdminUsers lists users (GET) or creates one (POST).
+func handleAdminUsers(conn net.Conn, req *http.Request) {
+	if users == nil {
+		handleNotFound(conn)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		views := []userView{}
+		for _, u := range users.list() {
+			views = append(views, viewUser(u))
+		}
+		sendJSON(conn, http.StatusOK, map[string]any{"users": views}, true)
+	case http.MethodPost:
+		var change userChange
+		if !readAdminJSON(conn, req, &change) {
+			return
+		}
+		if change.Password == nil || *change.Password == "" {
+			sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "password is required"}, false)
+			return
+		}
+		hash, err := hashPassword(*change.Password)
+		if err != nil {
+			sendError(conn, fmt.Errorf("hashing password: %w", err))
+			return
+		}
+		u := &user{Name: change.Name, Password: hash}
+		if change.Roles != nil {
+			u.Roles = *change.Roles
+		}
+		if change.Disabled != nil {
+			u.Disabled = *change.Disabled
+		}
+		if err := users.create(u); err != nil {
+			sendUserError(conn, err)
+			return
+		}
+		sendJSON(conn, http.StatusCreated, viewUser(u), false)
+	default:
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": "GET, POST"})
+	}
+}
+
+// handleAdminUser shows (GET), changes (PATCH) or removes (DELETE) one
+// user. Disabling is a PATCH with {"disabled": true}.
+func handleAdminUser(conn net.Conn, req *http.Request, name string) {
+	if users == nil {
+		handleNotFound(conn)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		u, ok := users.get(name)
+		if !ok {
+			sendUserError(conn, errUserNotFound)
+			return
+		}
+		sendJSON(conn, http.StatusOK, viewUser(u), false)
+	case http.MethodPatch:
+		var change userChange
+		if !readAdminJSON(conn, req, &change) {
+			return
+		}
+		var hash string
+		if change.Password != nil {
+			if *change.Password == "" {
+				sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "password may not be empty"}, false)
+				return
+			}
+			var err error
+			if hash, err = hashPassword(*change.Password); err != nil {
+				sendError(conn, fmt.Errorf("hashing password: %w", err))
+				return
+			}
+		}
+		u, err := users.update(name, func(u *user) {
+			if hash != "" {
+				u.Password = hash
+			}
+			if change.Roles != nil {
+				u.Roles = *change.Roles
+			}
+			if change.Disabled != nil {
+				u.Disabled = *change.Disabled
+			}
+		})
+		if err != nil {
+			sendUserError(conn, err)
+			return
+		}
+		sendJSON(conn, http.StatusOK, viewUser(u), false)
+	case http.MethodDelete:
+		if err := users.remove(name); err != nil {
+			sendUserError(conn, err)
+			return
+		}
+		sendResponse(conn, http.StatusNoContent, nil, nil)
+	default:
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, map[string]string{"Allow": "GET, PATCH, DELETE"})
+	}
+}
+
+func readAdminJSON(conn net.Conn, req *http.Request, v any) bool {
+	if err := BindJSON(req, v); err != nil {
+		sendBindError(conn, err)
+		return false
+	}
+	return true
+}
+
+func sendUserError(conn net.Conn, err error) {
+	var status int
+	switch {
+	case errors.Is(err, errUserNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errUserExists):
+		status = http.StatusConflict
+	case errors.Is(err, errBadUserName):
+		status = http.StatusBadRequest
+	default:
+		sendError(conn, fmt.Errorf("saving users: %w", err))
+		return
+	}
+	sendJSON(conn, status, map[string]string{"error": err.Error()}, false)
+}
@@ -0,0 +1,280 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileVersion describes one version of a file in the version list.
+// Modified is set for the current version and Replaced, the time it
+// stopped being current, for earlier ones.
+type FileVersion struct {
+	Version  int        `json:"version"`
+	Size     int64      `json:"size"`
+	Current  bool       `json:"current"`
+	Modified *time.Time `json:"modified,omitempty"`
+	Replaced *time.Time `json:"replaced,omitempty"`
+}
+
+// versionedStorage is the -file-versions layer over another Storage. When
+// a file is overwritten, the old contents are first copied to a second
+// Storage as "<name>@<version>". Versions are numbered from 1 for each
+// file, the current one being the highest. At most keep earlier versions
+// are kept for each file, and none replaced more than maxAge ago when
+// maxAge is set. Removing a file removes its versions too.
+type versionedStorage struct {
+	current  Storage
+	versions Storage
+	keep     int
+	maxAge   time.Duration
+
+	mu sync.Mutex
+	// writing serialises changes to each name, so that versions are
+	// numbered in the order they were replaced. Entries are removed when
+	// no change is waiting.
+	writing map[string]*nameLock
+}
+
+type nameLock struct {
+	sync.Mutex
+	waiting int
+}
+
+func newVersionedStorage(current, versions Storage, keep int, maxAge time.Duration) *versionedStorage {
+	return &versionedStorage{
+		current:  current,
+		versions: versions,
+		keep:     keep,
+		maxAge:   maxAge,
+		writing:  make(map[string]*nameLock),
+	}
+}
+
+// lock takes the lock for changes to name and returns its release.
+func (s *versionedStorage) lock(name string) func() {
+	s.mu.Lock()
+	l, ok := s.writing[name]
+	if !ok {
+		l = &nameLock{}
+		s.writing[name] = l
+	}
+	l.waiting++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.waiting--; l.waiting == 0 {
+			delete(s.writing, name)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func versionName(name string, version int) string {
+	return name + "@" + strconv.Itoa(version)
+}
+
+func (s *versionedStorage) Open(name string) (io.ReadSeekCloser, FileInfo, error) {
+	return s.current.Open(name)
+}
+
+func (s *versionedStorage) Stat(name string) (FileInfo, error) {
+	return s.current.Stat(name)
+}
+
+func (s *versionedStorage) List() ([]FileInfo, error) {
+	return s.current.List()
+}
+
+func (s *versionedStorage) Write(name string, r io.Reader) (FileInfo, error) {
+	if !validFileName(name) {
+		return FileInfo{}, fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	defer s.lock(name)()
+	if err := s.archive(name); err != nil {
+		return FileInfo{}, err
+	}
+	return s.current.Write(name, r)
+}
+
+// Delete removes a file together with its earlier versions.
+func (s *versionedStorage) Delete(name string) error {
+	if !validFileName(name) {
+		return fmt.Errorf("file name %q: %w", name, fs.ErrInvalid)
+	}
+	defer s.lock(name)()
+	if err := s.current.Delete(name); err != nil {
+		return err
+	}
+	archived, err := s.archived(name)
+	if err != nil {
+		return err
+	}
+	for _, v := range archived {
+		if err := s.versions.Delete(versionName(name, v.Version)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// archive copies the current contents of name, if any, to the next
+// version and applies the retention limits. The caller holds the name's
+// lock.
+func (s *versionedStorage) archive(name string) error {
+	f, _, err := s.current.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	archived, err := s.archived(name)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(archived) > 0 {
+		next = archived[len(archived)-1].Version + 1
+	}
+	if _, err := s.versions.Write(versionName(name, next), f); err != nil {
+		return fmt.Errorf("keeping version %d of %s: %w", next, name, err)
+	}
+
+	now := time.Now()
+	for i, v := range archived {
+		// archived doesn't include the version just added.
+		tooMany := len(archived)-i >= s.keep
+		tooOld := s.maxAge > 0 && now.Sub(*v.Replaced) > s.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := s.versions.Delete(versionName(name, v.Version)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error removing version %d of %s: %v", v.Version, name, err)
+		}
+	}
+	return nil
+}
+
+// archived returns the earlier versions of name, oldest first.
+func (s *versionedStorage) archived(name string) ([]FileVersion, error) {
+	files, err := s.versions.List()
+	if err != nil {
+		return nil, err
+	}
+	var versions []FileVersion
+	for _, f := range files {
+		suffix, ok := strings.CutPrefix(f.Name, name+"@")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 1 || strconv.Itoa(n) != suffix {
+			// Another file's version, such as one of "name@1".
+			continue
+		}
+		replaced := f.ModTime
+		versions = append(versions, FileVersion{Version: n, Size: f.Size, Replaced: &replaced})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// history returns every version of name, oldest first, ending with the
+// current one if the file exists.
+func (s *versionedStorage) history(name string) ([]FileVersion, error) {
+	versions, err := s.archived(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.current.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := 1
+	if len(versions) > 0 {
+		current = versions[len(versions)-1].Version + 1
+	}
+	return append(versions, FileVersion{Version: current, Size: info.Size, Current: true, Modified: &info.ModTime}), nil
+}
+
+// versionLayer returns the versioning layer of store, if it has one.
+func versionLayer(store Storage) *versionedStorage {
+	vs, _ := store.(*versionedStorage)
+	return vs
+}
+
+// contentLayer returns the content-addressed layer of store, if it has one.
+func contentLayer(store Storage) *contentStorage {
+	if vs := versionLayer(store); vs != nil {
+		store = vs.current
+	}
+	cs, _ := store.(*contentStorage)
+	return cs
+}
+
+// resolveFileVersion finds where ?version=N of name is kept: in the
+// current storage if it is the current version and among the archived
+// versions otherwise. It sends a response and returns false if there is
+// no such version.
+func resolveFileVersion(conn net.Conn, store Storage, name, version string) (Storage, string, bool) {
+	vs := versionLayer(store)
+	n, err := strconv.Atoi(version)
+	if vs == nil || err != nil || n < 1 {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "version must be a version number from ?versions"}, false)
+		return nil, "", false
+	}
+	versions, err := vs.history(name)
+	if err != nil && !errors.Is(err, fs.ErrInvalid) {
+		sendError(conn, fmt.Errorf("listing versions: %w", err))
+		return nil, "", false
+	}
+	for _, v := range versions {
+		switch {
+		case v.Version != n:
+		case v.Current:
+			return vs.current, name, true
+		default:
+			return vs.versions, versionName(name, n), true
+		}
+	}
+	handleNotFound(conn)
+	return nil, "", false
+}
+
+// handleFileVersions serves GET /files/<name>?versions, the list of the
+// file's versions.
+func handleFileVersions(conn net.Conn, store Storage, name string) {
+	vs := versionLayer(store)
+	if vs == nil {
+		sendJSON(conn, http.StatusBadRequest, map[string]string{"error": "file versions are not kept"}, false)
+		return
+	}
+	versions, err := vs.history(name)
+	if err != nil && !errors.Is(err, fs.ErrInvalid) {
+		sendError(conn, fmt.Errorf("listing versions: %w", err))
+		return
+	}
+	if len(versions) == 0 {
+		handleNotFound(conn)
+		return
+	}
+	sendJSON(conn, http.StatusOK, map[string]any{"name": name, "versions": versions}, true)
+}
@@ -0,0 +1,73 @@
+package httpserver
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeVersions writes each of contents to name in turn.
+func writeVersions(t *testing.T, s Storage, name string, contents ...string) {
+	t.Helper()
+	for _, c := range contents {
+		if _, err := s.Write(name, strings.NewReader(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func versionNumbers(t *testing.T, s *versionedStorage, name string) []int {
+	t.Helper()
+	history, err := s.history(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for _, v := range history {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+func TestVersionRetention(t *testing.T) {
+	versions := newMemoryStorage(1 << 20)
+	s := newVersionedStorage(newMemoryStorage(1<<20), versions, 2, 0)
+	writeVersions(t, s, "a.txt", "v1", "v2", "v3", "v4")
+	// A file whose name looks like a version of a.txt has versions of its own.
+	writeVersions(t, s, "a.txt@1", "x1", "x2")
+
+	if got := versionNumbers(t, s, "a.txt"); len(got) != 3 || got[0] != 2 || got[2] != 4 {
+		t.Errorf("versions of a.txt = %v, want [2 3 4]", got)
+	}
+	f, _, err := versions.Open(versionName("a.txt", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(f); string(data) != "v3" {
+		t.Errorf("version 3 holds %q, want v3", data)
+	}
+	if got := versionNumbers(t, s, "a.txt@1"); len(got) != 2 {
+		t.Errorf("versions of a.txt@1 = %v, want [1 2]", got)
+	}
+
+	if err := s.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := versionNumbers(t, s, "a.txt"); len(got) != 0 {
+		t.Errorf("versions of a.txt after deleting it = %v, want none", got)
+	}
+	if got := versionNumbers(t, s, "a.txt@1"); len(got) != 2 {
+		t.Errorf("deleting a.txt took versions of a.txt@1: %v", got)
+	}
+}
+
+func TestVersionMaxAge(t *testing.T) {
+	s := newVersionedStorage(newMemoryStorage(1<<20), newMemoryStorage(1<<20), 10, 20*time.Millisecond)
+	writeVersions(t, s, "a.txt", "v1", "v2")
+	time.Sleep(50 * time.Millisecond)
+	writeVersions(t, s, "a.txt", "v3")
+	if got := versionNumbers(t, s, "a.txt"); len(got) != 2 || got[0] != 2 {
+		t.Errorf("versions of a.txt = %v, want version 1 gone as too old", got)
+	}
+}
@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// VirtualHost is the configuration used for requests whose Host header
+// matches one of Hosts. Routes restricts the built-in endpoints to those
+// whose path starts with one of the listed prefixes; when empty, every
+// built-in endpoint is available.
+type VirtualHost struct {
+	Hosts    []string      `json:"hosts"`
+	DataDir  string        `json:"data_dir"`
+	Routes   []string      `json:"routes"`
+	Proxy    []ProxyRoute  `json:"proxy"`
+	Rewrites []RewriteRule `json:"rewrites"`
+
+	// storage holds the files under /files/, in DataDir by default, and
+	// expiries records which of them were uploaded with a time-to-live.
+	storage  Storage
+	expiries *fileExpiries
+}
+
+type vhostContextKey struct{}
+
+// selectVirtualHost attaches the virtual host matching req's Host header to
+// the request, falling back to the top-level configuration.
+func selectVirtualHost(req *http.Request) *http.Request {
+	host := strings.ToLower(hostOnly(req.Host))
+	for _, vh := range config.VirtualHosts {
+		for _, name := range vh.Hosts {
+			if strings.EqualFold(name, host) {
+				return req.WithContext(context.WithValue(req.Context(), vhostContextKey{}, vh))
+			}
+		}
+	}
+	return req
+}
+
+// virtualHost returns the configuration that applies to req.
+func virtualHost(req *http.Request) *VirtualHost {
+	if vh, ok := req.Context().Value(vhostContextKey{}).(*VirtualHost); ok {
+		return vh
+	}
+	return &VirtualHost{
+		DataDir:  config.DataDir,
+		Proxy:    config.ProxyRoutes,
+		Rewrites: config.Rewrites,
+		storage:  fileStorage,
+		expiries: defaultFileExpiries,
+	}
+}
+
+// allowsRoute reports whether the built-in endpoint at path is enabled.
+func (vh *VirtualHost) allowsRoute(path string) bool {
+	if len(vh.Routes) == 0 {
+		return true
+	}
+	for _, prefix := range vh.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allProxyRoutes returns the proxy routes of the default host and of every
+// virtual host.
+func allProxyRoutes() []*ProxyRoute {
+	var routes []*ProxyRoute
+	for i := range config.ProxyRoutes {
+		routes = append(routes, &config.ProxyRoutes[i])
+	}
+	for _, vh := range config.VirtualHosts {
+		for i := range vh.Proxy {
+			routes = append(routes, &vh.Proxy[i])
+		}
+	}
+	return routes
+}
@@ -0,0 +1,595 @@
+package httpserver
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/http-server-starter-go/internal/uuid"
+)
+
+// With -webdav the files tree is served as a WebDAV class 2 resource
+// (RFC 4918), so that it can be mounted as a network drive: /files/ is a
+// collection holding each file, PUT and DELETE write and remove files,
+// PROPFIND lists them, COPY and MOVE copy and rename them, and LOCK and
+// UNLOCK take and release exclusive write locks. Storage holds no
+// directories, so MKCOL is always refused. GET, HEAD and POST are served
+// as usual.
+const davMethods = "OPTIONS, GET, HEAD, POST, PUT, DELETE, PROPFIND, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+
+const (
+	// davLockTimeout is how long a lock lasts when the client doesn't
+	// ask, and davMaxLockTimeout the longest it may ask for.
+	davLockTimeout    = 10 * time.Minute
+	davMaxLockTimeout = time.Hour
+
+	davContentType = "application/xml; charset=utf-8"
+)
+
+// isWebDAVMethod reports whether method is one that handleWebDAV serves.
+func isWebDAVMethod(method string) bool {
+	switch method {
+	case http.MethodOptions, http.MethodPut, http.MethodDelete, "PROPFIND", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK":
+		return true
+	}
+	return false
+}
+
+// handleWebDAV serves a WebDAV method on /files or a file under it.
+func handleWebDAV(w *ResponseWriter, req *http.Request) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/files"), "/")
+	if name != "" && !validFileName(name) {
+		if strings.Contains(name, "/") && (req.Method == http.MethodPut || req.Method == "MKCOL") {
+			// The parent collection doesn't exist.
+			return Errorf(http.StatusConflict, "no collection holds %s", req.URL.Path)
+		}
+		return ErrNotFound
+	}
+	vh := virtualHost(req)
+
+	switch req.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", davMethods)
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		return nil
+	case "PROPFIND":
+		return davPropfind(w, req, vh, name)
+	case "MKCOL":
+		if name == "" {
+			return davNotAllowed(w)
+		}
+		return Errorf(http.StatusForbidden, "the files tree holds no collections")
+	}
+
+	if name == "" {
+		return davNotAllowed(w)
+	}
+	switch req.Method {
+	case http.MethodPut:
+		return davPut(w, req, vh, name)
+	case http.MethodDelete:
+		return davDelete(w, req, vh, name)
+	case "COPY", "MOVE":
+		return davCopy(w, req, vh, name)
+	case "LOCK":
+		return davTakeLock(w, req, vh, name)
+	default:
+		return davReleaseLock(w, req, vh, name)
+	}
+}
+
+// davNotAllowed refuses a method /files/ itself doesn't support.
+func davNotAllowed(w *ResponseWriter) error {
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return nil
+}
+
+func davPut(w *ResponseWriter, req *http.Request, vh *VirtualHost, name string) error {
+	if !davLocks.allows(req, vh.storage, name) {
+		return errLocked
+	}
+	_, err := vh.storage.Stat(name)
+	existed := err == nil
+
+	defer vh.expiries.startUpload(name)()
+	if _, err := vh.storage.Write(name, req.Body); err != nil {
+		w.WriteHeader(storageErrorStatus(err))
+		return nil
+	}
+	if err := vh.expiries.set(name, time.Time{}); err != nil {
+		return fmt.Errorf("recording file expiry: %w", err)
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+func davDelete(w *ResponseWriter, req *http.Request, vh *VirtualHost, name string) error {
+	if !davLocks.allows(req, vh.storage, name) {
+		return errLocked
+	}
+	if err := vh.storage.Delete(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("deleting file: %w", err)
+	}
+	if err := vh.expiries.set(name, time.Time{}); err != nil {
+		return fmt.Errorf("recording file expiry: %w", err)
+	}
+	davLocks.remove(vh.storage, name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// davCopy copies name to the file named by the Destination header, and
+// with MOVE then removes it. Locks stay with the names they were taken on.
+func davCopy(w *ResponseWriter, req *http.Request, vh *VirtualHost, name string) error {
+	dest, err := davDestination(req)
+	if err != nil {
+		return err
+	}
+	if dest == name {
+		return Errorf(http.StatusForbidden, "source and destination are the same")
+	}
+	move := req.Method == "MOVE"
+	if !davLocks.allows(req, vh.storage, dest) || (move && !davLocks.allows(req, vh.storage, name)) {
+		return errLocked
+	}
+	if vh.expiries.gone(name, time.Now()) {
+		return ErrNotFound
+	}
+	_, err = vh.storage.Stat(dest)
+	existed := err == nil
+	if existed && req.Header.Get("Overwrite") == "F" {
+		return Errorf(http.StatusPreconditionFailed, "%s exists", dest)
+	}
+
+	f, _, err := vh.storage.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("reading file: %w", err)
+	}
+	defer vh.expiries.startUpload(dest)()
+	_, err = vh.storage.Write(dest, f)
+	f.Close()
+	if err != nil {
+		w.WriteHeader(storageErrorStatus(err))
+		return nil
+	}
+	if err := vh.expiries.set(dest, time.Time{}); err != nil {
+		return fmt.Errorf("recording file expiry: %w", err)
+	}
+	if move {
+		if err := vh.storage.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleting moved file: %w", err)
+		}
+		if err := vh.expiries.set(name, time.Time{}); err != nil {
+			return fmt.Errorf("recording file expiry: %w", err)
+		}
+		davLocks.remove(vh.storage, name)
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// davDestination returns the name of the file the Destination header of
+// a COPY or MOVE names. A destination on another server is answered with
+// 502 Bad Gateway, as RFC 4918 asks.
+func davDestination(req *http.Request) (string, error) {
+	header := req.Header.Get("Destination")
+	if header == "" {
+		return "", Errorf(http.StatusBadRequest, "no Destination")
+	}
+	u, err := url.Parse(header)
+	if err != nil {
+		return "", Errorf(http.StatusBadRequest, "invalid Destination: %w", err)
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, req.Host) {
+		return "", Errorf(http.StatusBadGateway, "Destination %s is on another server", header)
+	}
+	name, ok := strings.CutPrefix(u.Path, "/files/")
+	if !ok || !validFileName(name) {
+		return "", Errorf(http.StatusForbidden, "Destination %s is not a file name under /files/", header)
+	}
+	return name, nil
+}
+
+// errLocked refuses a change to a file locked by someone else.
+var errLocked = Errorf(http.StatusLocked, "locked")
+
+// davLock is an exclusive write lock on one file.
+type davLock struct {
+	token   string
+	owner   string
+	href    string
+	timeout time.Duration
+	expires time.Time
+}
+
+type davLockKey struct {
+	store Storage
+	name  string
+}
+
+// davLockTable holds the locks on the files of every host.
+type davLockTable struct {
+	mu    sync.Mutex
+	locks map[davLockKey]*davLock
+}
+
+var davLocks = &davLockTable{locks: make(map[davLockKey]*davLock)}
+
+// get returns the lock in force on name, if there is one; t.mu must be
+// held.
+func (t *davLockTable) get(store Storage, name string) *davLock {
+	key := davLockKey{store, name}
+	lock := t.locks[key]
+	if lock != nil && !time.Now().Before(lock.expires) {
+		delete(t.locks, key)
+		return nil
+	}
+	return lock
+}
+
+// allows reports whether req may change name: it isn't locked, or req
+// submits the token of its lock in an If header.
+func (t *davLockTable) allows(req *http.Request, store Storage, name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lock := t.get(store, name)
+	return lock == nil || submitsLockToken(req, lock.token)
+}
+
+// lock takes lock on name, reporting false if it is already locked.
+func (t *davLockTable) lock(store Storage, name string, lock *davLock) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.get(store, name) != nil {
+		return false
+	}
+	t.locks[davLockKey{store, name}] = lock
+	return true
+}
+
+// refresh restarts the timeout of the lock on name if req submits its
+// token, and returns a copy of it.
+func (t *davLockTable) refresh(req *http.Request, store Storage, name string, timeout time.Duration) (davLock, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lock := t.get(store, name)
+	if lock == nil || !submitsLockToken(req, lock.token) {
+		return davLock{}, false
+	}
+	lock.timeout, lock.expires = timeout, time.Now().Add(timeout)
+	return *lock, true
+}
+
+// unlock releases the lock on name with the given token, reporting
+// whether there was one.
+func (t *davLockTable) unlock(store Storage, name, token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lock := t.get(store, name)
+	if lock == nil || lock.token != token {
+		return false
+	}
+	delete(t.locks, davLockKey{store, name})
+	return true
+}
+
+// remove drops any lock on name, which is gone.
+func (t *davLockTable) remove(store Storage, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.locks, davLockKey{store, name})
+}
+
+// activeLock returns the lock on name for lockdiscovery.
+func (t *davLockTable) activeLock(store Storage, name string) (davLock, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lock := t.get(store, name); lock != nil {
+		return *lock, true
+	}
+	return davLock{}, false
+}
+
+// submitsLockToken reports whether the If header of req lists token. The
+// conditions aren't otherwise evaluated.
+func submitsLockToken(req *http.Request, token string) bool {
+	return strings.Contains(req.Header.Get("If"), "<"+token+">")
+}
+
+// davLockTimeoutFor returns the lock timeout asked for by req's Timeout
+// header, the first of whose choices is taken.
+func davLockTimeoutFor(req *http.Request) time.Duration {
+	choice, _, _ := strings.Cut(req.Header.Get("Timeout"), ",")
+	choice = strings.TrimSpace(choice)
+	if strings.EqualFold(choice, "Infinite") {
+		return davMaxLockTimeout
+	}
+	if s, ok := strings.CutPrefix(choice, "Second-"); ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+			return min(time.Duration(n)*time.Second, davMaxLockTimeout)
+		}
+	}
+	return davLockTimeout
+}
+
+// davLockInfo is the body of a LOCK request.
+type davLockInfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	LockScope struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	LockType struct {
+		Write *struct{} `xml:"DAV: write"`
+	} `xml:"DAV: locktype"`
+	Owner *struct {
+		Href string `xml:"DAV: href"`
+		Text string `xml:",chardata"`
+	} `xml:"DAV: owner"`
+}
+
+// davTakeLock takes an exclusive write lock on name, creating it empty if it
+// doesn't exist, or refreshes one when the request has no body.
+func davTakeLock(w *ResponseWriter, req *http.Request, vh *VirtualHost, name string) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	timeout := davLockTimeoutFor(req)
+	if len(body) == 0 {
+		lock, ok := davLocks.refresh(req, vh.storage, name, timeout)
+		if !ok {
+			return Errorf(http.StatusPreconditionFailed, "no lock on %s with the token given", name)
+		}
+		return writeLockDiscovery(w, http.StatusOK, lock)
+	}
+
+	var info davLockInfo
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return Errorf(http.StatusBadRequest, "invalid lockinfo: %w", err)
+	}
+	if info.LockScope.Exclusive == nil || info.LockType.Write == nil {
+		return Errorf(http.StatusUnprocessableEntity, "only exclusive write locks are supported")
+	}
+	token, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	lock := &davLock{
+		token:   "opaquelocktoken:" + token.String(),
+		href:    "/files/" + url.PathEscape(name),
+		timeout: timeout,
+		expires: time.Now().Add(timeout),
+	}
+	if info.Owner != nil {
+		lock.owner = strings.TrimSpace(info.Owner.Href + info.Owner.Text)
+	}
+	if !davLocks.lock(vh.storage, name, lock) {
+		return errLocked
+	}
+
+	// Locking a name that is not in use reserves it with an empty file.
+	status := http.StatusOK
+	if _, err := vh.storage.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		defer vh.expiries.startUpload(name)()
+		if _, err := vh.storage.Write(name, strings.NewReader("")); err != nil {
+			davLocks.remove(vh.storage, name)
+			w.WriteHeader(storageErrorStatus(err))
+			return nil
+		}
+		status = http.StatusCreated
+	}
+	w.Header().Set("Lock-Token", "<"+lock.token+">")
+	return writeLockDiscovery(w, status, *lock)
+}
+
+func davReleaseLock(w *ResponseWriter, req *http.Request, vh *VirtualHost, name string) error {
+	token := strings.Trim(req.Header.Get("Lock-Token"), "<>")
+	if !davLocks.unlock(vh.storage, name, token) {
+		return Errorf(http.StatusConflict, "no lock on %s with token %s", name, token)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// activeLockXML returns the activelock element describing lock.
+func activeLockXML(lock davLock) string {
+	var b strings.Builder
+	b.WriteString("<activelock><locktype><write/></locktype><lockscope><exclusive/></lockscope><depth>0</depth>")
+	if lock.owner != "" {
+		b.WriteString("<owner>")
+		xml.EscapeText(&b, []byte(lock.owner))
+		b.WriteString("</owner>")
+	}
+	fmt.Fprintf(&b, "<timeout>Second-%d</timeout>", int64(lock.timeout/time.Second))
+	b.WriteString("<locktoken><href>")
+	xml.EscapeText(&b, []byte(lock.token))
+	b.WriteString("</href></locktoken><lockroot><href>")
+	xml.EscapeText(&b, []byte(lock.href))
+	b.WriteString("</href></lockroot></activelock>")
+	return b.String()
+}
+
+func writeLockDiscovery(w *ResponseWriter, status int, lock davLock) error {
+	w.Header().Set("Content-Type", davContentType)
+	w.WriteHeader(status)
+	_, err := fmt.Fprintf(w, `%s<prop xmlns="DAV:"><lockdiscovery>%s</lockdiscovery></prop>`, xml.Header, activeLockXML(lock))
+	return err
+}
+
+// davPropfindRequest is the body of a PROPFIND request. An empty body asks
+// for every property, as allprop does.
+type davPropfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	Propname *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"href"`
+	Propstat []davPropstat `xml:"propstat"`
+}
+
+type davPropstat struct {
+	Prop struct {
+		Props []davProperty
+	} `xml:"prop"`
+	Status string `xml:"status"`
+}
+
+// davProperty is one property of a resource, its value given as XML in
+// the DAV: namespace.
+type davProperty struct {
+	XMLName xml.Name
+	Value   string `xml:",innerxml"`
+}
+
+// davPropfind describes /files/ or one file, and with Depth 1 or
+// infinity, which are the same for a tree one level deep, every file in
+// /files/.
+func davPropfind(w *ResponseWriter, req *http.Request, vh *VirtualHost, name string) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	var find davPropfindRequest
+	if len(body) > 0 {
+		if err := xml.Unmarshal(body, &find); err != nil {
+			return Errorf(http.StatusBadRequest, "invalid propfind: %w", err)
+		}
+	}
+
+	now := time.Now()
+	var ms davMultistatus
+	if name == "" {
+		ms.Responses = append(ms.Responses, davDescribe(&find, "/files/", davCollectionProps()))
+		if req.Header.Get("Depth") != "0" {
+			files, err := vh.storage.List()
+			if err != nil {
+				return fmt.Errorf("listing files: %w", err)
+			}
+			for _, f := range files {
+				if !vh.expiries.gone(f.Name, now) {
+					ms.Responses = append(ms.Responses, davDescribe(&find, "/files/"+url.PathEscape(f.Name), davFileProps(vh, f)))
+				}
+			}
+		}
+	} else {
+		info, err := vh.storage.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) || vh.expiries.gone(name, now) {
+			return ErrNotFound
+		} else if err != nil {
+			return fmt.Errorf("reading file: %w", err)
+		}
+		ms.Responses = append(ms.Responses, davDescribe(&find, "/files/"+url.PathEscape(name), davFileProps(vh, info)))
+	}
+
+	w.Header().Set("Content-Type", davContentType)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(ms)
+}
+
+func davProp(name, value string) davProperty {
+	return davProperty{XMLName: xml.Name{Space: "DAV:", Local: name}, Value: value}
+}
+
+func davText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func davCollectionProps() []davProperty {
+	return []davProperty{
+		davProp("displayname", "files"),
+		davProp("resourcetype", "<collection/>"),
+	}
+}
+
+func davFileProps(vh *VirtualHost, f FileInfo) []davProperty {
+	props := []davProperty{
+		davProp("displayname", davText(f.Name)),
+		davProp("resourcetype", ""),
+		davProp("getcontentlength", strconv.FormatInt(f.Size, 10)),
+		davProp("getcontenttype", "application/octet-stream"),
+		davProp("getlastmodified", f.ModTime.UTC().Format(http.TimeFormat)),
+		davProp("supportedlock", "<lockentry><lockscope><exclusive/></lockscope><locktype><write/></locktype></lockentry>"),
+	}
+	discovery := ""
+	if lock, ok := davLocks.activeLock(vh.storage, f.Name); ok {
+		discovery = activeLockXML(lock)
+	}
+	return append(props, davProp("lockdiscovery", discovery))
+}
+
+// davDescribe answers find for the resource at href with the given
+// properties: all of them, only their names, or those asked for, with the
+// ones it doesn't have reported as 404 Not Found.
+func davDescribe(find *davPropfindRequest, href string, props []davProperty) davResponse {
+	resp := davResponse{Href: href}
+	ok := davPropstat{Status: davStatus(http.StatusOK)}
+	switch {
+	case find.Propname != nil:
+		for _, p := range props {
+			ok.Prop.Props = append(ok.Prop.Props, davProperty{XMLName: p.XMLName})
+		}
+	case find.Prop != nil:
+		missing := davPropstat{Status: davStatus(http.StatusNotFound)}
+	names:
+		for _, n := range find.Prop.Names {
+			for _, p := range props {
+				if p.XMLName == n.XMLName {
+					ok.Prop.Props = append(ok.Prop.Props, p)
+					continue names
+				}
+			}
+			missing.Prop.Props = append(missing.Prop.Props, davProperty{XMLName: n.XMLName})
+		}
+		if len(missing.Prop.Props) > 0 {
+			resp.Propstat = append(resp.Propstat, missing)
+		}
+	default:
+		ok.Prop.Props = props
+	}
+	if len(ok.Prop.Props) > 0 || len(resp.Propstat) == 0 {
+		resp.Propstat = append([]davPropstat{ok}, resp.Propstat...)
+	}
+	return resp
+}
+
+func davStatus(status int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", status, http.StatusText(status))
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+	addr := startTestServer(t, "-webdav")
+	client := testClient()
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+path, strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+	expect := func(resp *http.Response, status int) {
+		t.Helper()
+		if resp.StatusCode != status {
+			t.Errorf("%s %s = %d, want %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status)
+		}
+	}
+
+	resp, _ := do("OPTIONS", "/files/", "", nil)
+	if resp.Header.Get("DAV") != "1, 2" {
+		t.Errorf("DAV = %q", resp.Header.Get("DAV"))
+	}
+	resp, _ = do("PUT", "/files/a.txt", "hello", nil)
+	expect(resp, 201)
+	resp, _ = do("PUT", "/files/a.txt", "hello, world", nil)
+	expect(resp, 204)
+	resp, _ = do("MKCOL", "/files/dir", "", nil)
+	expect(resp, 403)
+
+	resp, body := do("PROPFIND", "/files/", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:resourcetype/><x:color xmlns:x="urn:x"/></D:prop></D:propfind>`, map[string]string{"Depth": "1"})
+	expect(resp, 207)
+	var ms struct {
+		Responses []struct {
+			Href     string `xml:"href"`
+			Propstat []struct {
+				Length     string    `xml:"prop>getcontentlength"`
+				Collection *struct{} `xml:"prop>resourcetype>collection"`
+				Status     string    `xml:"status"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal([]byte(body), &ms); err != nil {
+		t.Fatalf("%v in %s", err, body)
+	}
+	if len(ms.Responses) != 2 || ms.Responses[0].Href != "/files/" || ms.Responses[0].Propstat[0].Collection == nil ||
+		ms.Responses[1].Href != "/files/a.txt" || ms.Responses[1].Propstat[0].Length != "12" ||
+		ms.Responses[1].Propstat[1].Status != "HTTP/1.1 404 Not Found" {
+		t.Errorf("PROPFIND = %s", body)
+	}
+
+	lockinfo := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner><D:href>alice</D:href></D:owner></D:lockinfo>`
+	resp, body = do("LOCK", "/files/a.txt", lockinfo, map[string]string{"Timeout": "Second-60"})
+	expect(resp, 200)
+	token := resp.Header.Get("Lock-Token")
+	if !strings.HasPrefix(token, "<opaquelocktoken:") || !strings.Contains(body, "<owner>alice</owner>") {
+		t.Fatalf("LOCK = %q, %s", token, body)
+	}
+	resp, _ = do("LOCK", "/files/a.txt", lockinfo, nil)
+	expect(resp, 423)
+	resp, _ = do("PUT", "/files/a.txt", "mine", nil)
+	expect(resp, 423)
+	resp, _ = do("POST", "/files/a.txt", "mine", nil)
+	expect(resp, 423)
+	resp, _ = do("PUT", "/files/a.txt", "locked", map[string]string{"If": "(" + token + ")"})
+	expect(resp, 204)
+	resp, _ = do("LOCK", "/files/a.txt", "", map[string]string{"If": "(" + token + ")"})
+	expect(resp, 200)
+	resp, _ = do("UNLOCK", "/files/a.txt", "", map[string]string{"Lock-Token": "<opaquelocktoken:other>"})
+	expect(resp, 409)
+	resp, _ = do("UNLOCK", "/files/a.txt", "", map[string]string{"Lock-Token": token})
+	expect(resp, 204)
+
+	resp, _ = do("COPY", "/files/a.txt", "", map[string]string{"Destination": "http://" + addr + "/files/b.txt"})
+	expect(resp, 201)
+	resp, _ = do("MOVE", "/files/b.txt", "", map[string]string{"Destination": "/files/a.txt", "Overwrite": "F"})
+	expect(resp, 412)
+	resp, _ = do("MOVE", "/files/b.txt", "", map[string]string{"Destination": "/files/c.txt"})
+	expect(resp, 201)
+	resp, _ = do("MOVE", "/files/c.txt", "", map[string]string{"Destination": "http://elsewhere/files/d.txt"})
+	expect(resp, 502)
+	resp, body = do("GET", "/files/c.txt", "", nil)
+	if resp.StatusCode != 200 || body != "locked" {
+		t.Errorf("GET of the moved file = %d %q", resp.StatusCode, body)
+	}
+	resp, _ = do("GET", "/files/b.txt", "", nil)
+	expect(resp, 404)
+
+	resp, _ = do("DELETE", "/files/c.txt", "", nil)
+	expect(resp, 204)
+	resp, _ = do("DELETE", "/files/c.txt", "", nil)
+	expect(resp, 404)
+}
@@ -0,0 +1,84 @@
+package httpserver
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/codecrafters-io/http-server-starter-go/internal/websocket"
+)
+
+// upgradeWebSocket performs the server side of the RFC 6455 opening
+// handshake. On failure it sends an error response itself and returns nil.
+func upgradeWebSocket(conn net.Conn, req *http.Request) *websocket.Conn {
+	if req.Method != http.MethodGet {
+		sendResponse(conn, http.StatusMethodNotAllowed, nil, nil)
+		return nil
+	}
+	if !headerContainsToken(req.Header, "Connection", "upgrade") ||
+		!headerContainsToken(req.Header, "Upgrade", "websocket") {
+		sendResponse(conn, http.StatusUpgradeRequired, nil, map[string]string{"Upgrade": "websocket"})
+		return nil
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		sendResponse(conn, http.StatusUpgradeRequired, nil, map[string]string{"Sec-WebSocket-Version": "13"})
+		return nil
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		sendResponse(conn, http.StatusBadRequest, nil, nil)
+		return nil
+	}
+
+	markClosing(conn)
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", websocket.AcceptKey(key))
+	if err != nil {
+		log.Printf("Error completing WebSocket handshake: %v", err)
+		return nil
+	}
+
+	// A conforming client waits for the 101 before sending frames, so
+	// nothing can be stranded in the reader used to parse the request.
+	return websocket.NewConn(conn, bufio.NewReader(conn), maxRequestSize)
+}
+
+// handleWebSocket echoes every text and binary message back to the sender
+// until the client closes the connection.
+func handleWebSocket(conn net.Conn, req *http.Request) {
+	ws := upgradeWebSocket(conn, req)
+	if ws == nil {
+		return
+	}
+
+	for {
+		op, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(op, message); err != nil {
+			log.Printf("Error writing WebSocket message: %v", err)
+			return
+		}
+	}
+}
+
+// headerContainsToken reports whether the comma-separated header name
+// contains token, compared case-insensitively.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+// Package uuid generates random (version 4) UUIDs as described in RFC 9562.
+package uuid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// UUID is a 128-bit universally unique identifier.
+type UUID [16]byte
+
+// NewV4 returns a new random UUID.
+func NewV4() (UUID, error) {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return UUID{}, err
+	}
+
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 9562 variant
+	return u, nil
+}
+
+// String returns the canonical xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form.
+func (u UUID) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:36], u[10:16])
+	return string(buf[:])
+}
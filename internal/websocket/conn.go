@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+// Close status codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormal           = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+)
+
+// ErrClosed is returned by ReadMessage once the closing handshake has
+// completed.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Conn is a server-side WebSocket connection. ReadMessage must only be
+// called from one goroutine at a time; WriteMessage and Close are safe for
+// concurrent use.
+type Conn struct {
+	conn       net.Conn
+	br         *bufio.Reader
+	maxMessage int64
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// NewConn wraps an upgraded connection. br must read from conn and may
+// hold bytes the client sent after the handshake.
+func NewConn(conn net.Conn, br *bufio.Reader, maxMessage int64) *Conn {
+	return &Conn{conn: conn, br: br, maxMessage: maxMessage}
+}
+
+// ReadMessage returns the next complete text or binary message,
+// reassembling fragments. Pings are answered automatically and a close
+// frame from the peer is echoed before ErrClosed is returned.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var (
+		op      Opcode
+		message []byte
+	)
+
+	for {
+		f, err := ReadFrame(c.br, c.maxMessage)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrFrameTooLarge):
+				c.Close(CloseMessageTooBig, "")
+			case errors.Is(err, ErrProtocol):
+				c.Close(CloseProtocolError, "")
+			}
+			return 0, nil, err
+		}
+		if !f.Masked {
+			c.Close(CloseProtocolError, "client frames must be masked")
+			return 0, nil, fmt.Errorf("%w: unmasked client frame", ErrProtocol)
+		}
+
+		switch f.Opcode {
+		case OpPing:
+			if err := c.writeFrame(Frame{Fin: true, Opcode: OpPong, Payload: f.Payload}); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			code := CloseNormal
+			if len(f.Payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(f.Payload))
+			}
+			c.Close(code, "")
+			return 0, nil, ErrClosed
+		case OpText, OpBinary:
+			if message != nil {
+				c.Close(CloseProtocolError, "")
+				return 0, nil, fmt.Errorf("%w: new message before previous finished", ErrProtocol)
+			}
+			op = f.Opcode
+			message = f.Payload
+		case OpContinuation:
+			if message == nil {
+				c.Close(CloseProtocolError, "")
+				return 0, nil, fmt.Errorf("%w: unexpected continuation frame", ErrProtocol)
+			}
+			if int64(len(message)+len(f.Payload)) > c.maxMessage {
+				c.Close(CloseMessageTooBig, "")
+				return 0, nil, ErrFrameTooLarge
+			}
+			message = append(message, f.Payload...)
+		default:
+			c.Close(CloseProtocolError, "")
+			return 0, nil, fmt.Errorf("%w: unknown opcode %d", ErrProtocol, f.Opcode)
+		}
+
+		if f.Fin {
+			if op == OpText && !utf8.Valid(message) {
+				c.Close(CloseInvalidPayload, "")
+				return 0, nil, fmt.Errorf("%w: invalid UTF-8 in text message", ErrProtocol)
+			}
+			return op, message, nil
+		}
+	}
+}
+
+// WriteMessage sends data as a single unfragmented message.
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	return c.writeFrame(Frame{Fin: true, Opcode: op, Payload: data})
+}
+
+// Close sends a close frame with the given status code and reason. It is
+// safe to call more than once; only the first call sends a frame.
+func (c *Conn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return WriteFrame(c.conn, Frame{Fin: true, Opcode: OpClose, Payload: payload})
+}
+
+func (c *Conn) writeFrame(f Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	return WriteFrame(c.conn, f)
+}
@@ -0,0 +1,153 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455): the opening handshake key computation, frame encoding and
+// decoding, and a message-oriented connection on top of them.
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Opcode identifies the type of a frame.
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// IsControl reports whether op is a control opcode (close, ping or pong).
+func (op Opcode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+// acceptGUID is the fixed value appended to the client key when computing
+// Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxControlPayload is the largest payload a control frame may carry.
+const maxControlPayload = 125
+
+var (
+	// ErrFrameTooLarge is returned when a frame exceeds the read limit.
+	ErrFrameTooLarge = errors.New("websocket: frame too large")
+	// ErrProtocol is returned for frames that violate RFC 6455.
+	ErrProtocol = errors.New("websocket: protocol error")
+)
+
+// AcceptKey returns the Sec-WebSocket-Accept value for a client's
+// Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Frame is a single WebSocket frame. Payload is always unmasked.
+type Frame struct {
+	Fin     bool
+	Opcode  Opcode
+	Masked  bool
+	Payload []byte
+}
+
+// ReadFrame reads one frame from r, unmasking the payload if necessary.
+// Frames whose payload is larger than maxPayload are rejected.
+func ReadFrame(r io.Reader, maxPayload int64) (Frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return Frame{}, err
+	}
+
+	f := Frame{
+		Fin:    head[0]&0x80 != 0,
+		Opcode: Opcode(head[0] & 0x0f),
+		Masked: head[1]&0x80 != 0,
+	}
+	if head[0]&0x70 != 0 {
+		return Frame{}, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return Frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length&(1<<63) != 0 {
+			return Frame{}, fmt.Errorf("%w: invalid payload length", ErrProtocol)
+		}
+	}
+
+	if f.Opcode.IsControl() && (!f.Fin || length > maxControlPayload) {
+		return Frame{}, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+	}
+	if length > uint64(maxPayload) {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	var mask [4]byte
+	if f.Masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return Frame{}, err
+		}
+	}
+
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return Frame{}, err
+	}
+	if f.Masked {
+		maskBytes(mask, f.Payload)
+	}
+
+	return f, nil
+}
+
+// WriteFrame encodes f onto w. Server-to-client frames are never masked,
+// so f.Masked is ignored.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, 0, 10+len(f.Payload))
+
+	b0 := byte(f.Opcode)
+	if f.Fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	switch n := len(f.Payload); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
@@ -14,7 +14,7 @@ set -e # Exit early if any commands fail
 # - Edit .codecrafters/compile.sh to change how your program compiles remotely
 (
   cd "$(dirname "$0")" # Ensure compile steps are run within the repository directory
-  go build -o /tmp/codecrafters-build-http-server-go app/*.go
+  go build -o /tmp/codecrafters-build-http-server-go ./cmd/server
 )
 
 # Copied from .codecrafters/run.sh